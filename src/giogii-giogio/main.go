@@ -6,11 +6,14 @@ import (
 	"fmt"
 	"giogii/src/check"
 	"giogii/src/flashback"
+	"giogii/src/heartbeat"
 	"giogii/src/lock"
+	"giogii/src/topology"
 	"io"
 	"log"
 	"os"
 	"strings"
+	"time"
 )
 
 func main() {
@@ -24,6 +27,15 @@ func main() {
 	var sshUser string
 	var sshPass string
 	var call string
+	var sqlFile string
+	var errant string
+	var apply string
+	var sshConf string
+	var executor string
+	var interval string
+	var heartbeatTable string
+	var tableFilter string
+	var thresholds string
 
 	flag.StringVar(&sourceUserInfo, "s", "", "")
 	flag.StringVar(&sourceSocket, "si", "", "")
@@ -35,31 +47,125 @@ func main() {
 	flag.StringVar(&sshUser, "u", "", "")
 	flag.StringVar(&sshPass, "p", "", "")
 	flag.StringVar(&call, "C", "", "")
+	flag.StringVar(&sqlFile, "o", "", "")
+	flag.StringVar(&errant, "e", "", "")
+	flag.StringVar(&apply, "a", "", "")
+	flag.StringVar(&sshConf, "k", "", "")
+	flag.StringVar(&executor, "x", "", "")
+	flag.StringVar(&interval, "i", "", "")
+	flag.StringVar(&heartbeatTable, "b", "", "")
+	flag.StringVar(&tableFilter, "d", "", "")
+	flag.StringVar(&thresholds, "T", "", "")
 
 	flag.Parse()
+	// 子命令, 子命令后的参数继续解析
+	command := flag.Arg(0)
+	if command != "" {
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
 
-	if strings.Trim(parameter, " ") == "c" {
-		check.InitCheckParameterConf(sourceUserInfo, sourceSocket, "greatrds", targetUserInfo, targetSocket, "information_schema")
-		check.DoCheckParameter(parameter)
+	if command == "topology" {
+		topology.DoShowTopology(targetUserInfo, targetSocket, strings.Trim(apply, " "))
+	} else if command == "watch" {
+		d, err := ParseInterval(interval, 5*time.Second)
+		if err != nil {
+			log.Fatal(err)
+		}
+		check.InitCheckConsistentConf(sourceUserInfo, sourceSocket, "information_schema", targetUserInfo, targetSocket, "information_schema")
+		check.DoWatchReplication(d, strings.Trim(heartbeatTable, " "), strings.Trim(apply, " "))
+	} else if command == "checksum" {
+		check.InitCheckConsistentConf(sourceUserInfo, sourceSocket, "information_schema", targetUserInfo, targetSocket, "information_schema")
+		check.DoChecksum(targetSocket, strings.Trim(tableFilter, " "), strings.Trim(heartbeatTable, " "), strings.Trim(apply, " "))
+	} else if command == "sync" {
+		check.InitCheckConsistentConf(sourceUserInfo, sourceSocket, "information_schema", targetUserInfo, targetSocket, "information_schema")
+		check.DoSyncData(targetUserInfo, targetSocket, strings.Trim(tableFilter, " "), strings.Trim(sqlFile, " "), strings.Trim(apply, " "))
+	} else if command == "schema" {
+		check.InitCheckConsistentConf(sourceUserInfo, sourceSocket, "information_schema", targetUserInfo, targetSocket, "information_schema")
+		check.DoSchemaDiff(strings.Trim(tableFilter, " "), strings.Trim(sqlFile, " "), strings.Trim(apply, " "))
+	} else if command == "heartbeat" {
+		d, err := ParseInterval(interval, time.Second)
+		if err != nil {
+			log.Fatal(err)
+		}
+		table := strings.Trim(heartbeatTable, " ")
+		if table == "" {
+			table = heartbeat.DefaultTable
+		}
+		if strings.Trim(apply, " ") == "monitor" {
+			heartbeat.DoMonitorHeartbeat(sourceUserInfo, sourceSocket, targetUserInfo, targetSocket, table, d)
+		} else {
+			heartbeat.DoHeartbeat(sourceUserInfo, sourceSocket, table, d)
+		}
+	} else if command == "params" {
+		// params history [参数名|节点], params diff [记录编号] [记录编号], params capture
+		action := flag.Arg(0)
+		if action != "" {
+			flag.CommandLine.Parse(flag.Args()[1:])
+		}
+		if action == "history" {
+			check.DoParamHistory(targetSocket, flag.Arg(0))
+		} else if action == "diff" {
+			check.DoParamDiff(targetSocket, flag.Arg(0), flag.Arg(1))
+		} else if action == "capture" {
+			check.DoCaptureBaseline(targetUserInfo, targetSocket, strings.Trim(sqlFile, " "), strings.Trim(apply, " "))
+		} else {
+			log.Fatal(fmt.Sprintf("未知的params命令 %s, 可选 history、diff、capture", action))
+		}
+	} else if template := strings.Trim(parameter, " "); template != "" {
+		template = check.InitCheckParameterConf(sourceUserInfo, sourceSocket, "greatrds", targetUserInfo, targetSocket, "information_schema", template)
+		check.DoCheckParameter(template, strings.Trim(sqlFile, " "), strings.Trim(apply, " "))
+	} else if strings.Trim(bigTrx, " ") == "tree" {
+		lock.InitConf(sourceUserInfo, sourceSocket, "performance_schema")
+		lock.DoShowBlockingTree(strings.Trim(apply, " "), strings.Trim(sqlFile, " "))
 	} else if strings.Trim(bigTrx, " ") == "m" {
+		if strings.Trim(apply, " ") != "" {
+			log.Fatal("锁监控的阈值使用 -T 指定, 例如 -T trx=60s,rows=1000")
+		}
+		t, err := lock.ParseThresholds(strings.Trim(thresholds, " "))
+		if err != nil {
+			log.Fatal(err)
+		}
+		d, err := ParseInterval(interval, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
 		lock.InitConf(sourceUserInfo, sourceSocket, "performance_schema")
-		lock.DoMonitorLock()
+		lock.DoMonitorLock(t, d)
 	} else if strings.Trim(fb, " ") == "start" {
-		flashback.InitMasterConnection(sourceUserInfo, sourceSocket)
-		flashback.InitSlaveConnection(targetUserInfo, targetSocket)
-		flashback.DoStartFlashback(targetUserInfo, targetSocket, sshUser, sshPass)
+		exec, err := flashback.NewExecutor(executor, sshConf, sshUser, sshPass)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := flashback.DoStartFlashback(sourceUserInfo, sourceSocket, targetUserInfo, targetSocket, exec, strings.Trim(heartbeatTable, " "), strings.Trim(apply, " ")); err != nil {
+			log.Fatal(err)
+		}
 	} else if strings.Trim(fb, " ") == "stop" {
-		flashback.InitMasterConnection(sourceUserInfo, sourceSocket)
-		flashback.InitSlaveConnection(targetUserInfo, targetSocket)
-		flashback.DoStopFlashback(sourceUserInfo, targetUserInfo, targetSocket, sshUser, sshPass)
+		exec, err := flashback.NewExecutor(executor, sshConf, sshUser, sshPass)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := flashback.DoStopFlashback(sourceUserInfo, sourceSocket, targetUserInfo, targetSocket, exec, strings.Trim(apply, " ")); err != nil {
+			log.Fatal(err)
+		}
 	} else if strings.Trim(fb, " ") == "begin" {
 		sInfo, tInfo, _ := ReadConfig()
-		flashback.DoBeginFlashback(sInfo, sourceSocket, tInfo, targetSocket)
+		if err := flashback.DoBeginFlashback(sInfo, sourceSocket, tInfo, targetSocket, strings.Trim(heartbeatTable, " "), strings.Trim(apply, " ")); err != nil {
+			log.Fatal(err)
+		}
 	} else if strings.Trim(fb, " ") == "end" {
 		sInfo, tInfo, sshInfo := ReadConfig()
 		sshUser = strings.Split(sshInfo, ":")[0]
 		sshPass = strings.Split(sshInfo, ":")[1]
-		flashback.DoEndFlashback(sInfo, sourceSocket, tInfo, targetSocket, sshUser, sshPass)
+		exec, err := flashback.NewExecutor(executor, sshConf, sshUser, sshPass)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := flashback.DoEndFlashback(sInfo, sourceSocket, tInfo, targetSocket, exec, sqlFile, strings.Trim(apply, " ")); err != nil {
+			log.Fatal(err)
+		}
+	} else if e := strings.Trim(errant, " "); e == "list" || e == check.RepairInject || e == check.RepairPurge {
+		check.InitCheckConsistentConf(sourceUserInfo, sourceSocket, "information_schema", targetUserInfo, targetSocket, "information_schema")
+		check.DoCheckErrant(e, strings.Trim(apply, " ") == "apply", sourceUserInfo, targetUserInfo)
 	} else if strings.Trim(call, " ") == "C" {
 		sInfo, tInfo, sshInfo := ReadConfig()
 		fmt.Println(sInfo, tInfo, sshInfo)
@@ -70,6 +176,15 @@ func main() {
 
 }
 
+// ParseInterval 解析 -i 指定的间隔, 未指定时使用各子命令的默认间隔
+func ParseInterval(interval string, def time.Duration) (time.Duration, error) {
+	interval = strings.Trim(interval, " ")
+	if interval == "" {
+		return def, nil
+	}
+	return time.ParseDuration(interval)
+}
+
 func ReadConfig() (sourceUserInfo string, targetUserInfo string, sshInfo string) {
 	path := "./gii.conf"
 	f, err := os.Open(path)
@@ -0,0 +1,328 @@
+package check
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"giogii/src/entity"
+	"giogii/src/mapper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/**
+参数基准可以来自管理平台的 greatrds.configuration_items, 也可以来自模板文件(.yaml/.yml/.json).
+模板文件通过 extends 继承同目录下的其他模板, 例如 8c32gb.yaml 继承 base.yaml, 子模板中的值覆盖父模板:
+
+extends: base
+resources:
+  ram: 32G
+  cpus: 8
+mysql:
+  innodb_buffer_pool_size: ${align(ram * 60%, 128M)}
+  sync_binlog: 1
+dbscale:
+  max-replication-delay: 10
+
+resources 没有配置时按模板名称推断, 例如 8c32gb 为 cpus=8、ram=32G. yaml只支持映射和标量, 不支持列表和多行值
+*/
+
+// BaselineProvider 参数基准来源
+type BaselineProvider interface {
+	Baseline(template string) ([]entity.Configuration, error)
+}
+
+// GreatrdsBaseline 从管理平台的 configuration_items 读取基准
+type GreatrdsBaseline struct {
+	Operator mapper.SqlScaleOperator
+}
+
+// Baseline 模板名称为 configuration.name
+func (g *GreatrdsBaseline) Baseline(template string) ([]entity.Configuration, error) {
+	var strSql = "select i.name,i.value,i.type from configuration_items as i inner join configuration as c on c.uuid = i.configuration_id where c.name = ?"
+	configuration := g.Operator.DoQueryParseParameter(strSql, template)
+	if len(configuration) == 0 {
+		return nil, fmt.Errorf("管理平台中没有模板 %s 的参数", template)
+	}
+	return configuration, nil
+}
+
+// BaselineTemplate 一个模板文件
+type BaselineTemplate struct {
+	Extends   string
+	Resources map[string]string
+	Mysql     map[string]string
+	Dbscale   map[string]string
+}
+
+// FileBaseline 从目录中的模板文件读取基准
+type FileBaseline struct {
+	Dir string
+}
+
+var templateExts = []string{".yaml", ".yml", ".json"}
+
+// IsFileTemplate -c 为模板文件路径时使用文件基准, 否则为管理平台中的模板名称
+func IsFileTemplate(template string) bool {
+	for _, ext := range templateExts {
+		if strings.HasSuffix(template, ext) {
+			return true
+		}
+	}
+	return strings.ContainsRune(template, os.PathSeparator)
+}
+
+// NewFileBaseline 模板文件路径拆分为目录和模板名称
+func NewFileBaseline(path string) (*FileBaseline, string) {
+	name := filepath.Base(path)
+	for _, ext := range templateExts {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return &FileBaseline{Dir: filepath.Dir(path)}, name
+}
+
+// Load 读取模板及其继承的全部模板, 父模板在前
+func (f *FileBaseline) Load(template string) ([]*BaselineTemplate, error) {
+	var chain []*BaselineTemplate
+	seen := make(map[string]bool)
+	for name := template; name != ""; {
+		if seen[name] {
+			return nil, fmt.Errorf("模板 %s 循环继承", name)
+		}
+		seen[name] = true
+		t, err := f.read(name)
+		if err != nil {
+			return nil, err
+		}
+		chain = append([]*BaselineTemplate{t}, chain...)
+		name = t.Extends
+	}
+	return chain, nil
+}
+
+func (f *FileBaseline) read(name string) (*BaselineTemplate, error) {
+	for _, ext := range templateExts {
+		path := filepath.Join(f.Dir, name+ext)
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var values map[string]interface{}
+		if ext == ".json" {
+			values, err = parseJsonTemplate(data)
+		} else {
+			values, err = parseYamlTemplate(data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		t, err := newBaselineTemplate(values)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("目录 %s 中没有模板 %s", f.Dir, name)
+}
+
+// Baseline 合并继承链上的参数并计算表达式, mysql参数在前, 同类参数按名称排序
+func (f *FileBaseline) Baseline(template string) ([]entity.Configuration, error) {
+	chain, err := f.Load(template)
+	if err != nil {
+		return nil, err
+	}
+	resources, mysql, dbscale := make(map[string]string), make(map[string]string), make(map[string]string)
+	for _, t := range chain {
+		for _, merge := range []struct{ to, from map[string]string }{{resources, t.Resources}, {mysql, t.Mysql}, {dbscale, t.Dbscale}} {
+			for k, v := range merge.from {
+				merge.to[k] = v
+			}
+		}
+	}
+	vars, err := templateResources(template, resources)
+	if err != nil {
+		return nil, err
+	}
+	var configuration []entity.Configuration
+	for _, section := range []struct {
+		tp     string
+		values map[string]string
+	}{{"mysql", mysql}, {"dbscale", dbscale}} {
+		names := make([]string, 0, len(section.values))
+		for name := range section.values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value, err := evalBaselineValue(section.values[name], vars)
+			if err != nil {
+				return nil, fmt.Errorf("参数 %s: %s", name, err)
+			}
+			configuration = append(configuration, entity.Configuration{Name: name, Value: value, Type: section.tp})
+		}
+	}
+	return configuration, nil
+}
+
+var templateSize = regexp.MustCompile(`(?i)(\d+)c(\d+)g`)
+
+// templateResources 表达式中可以使用的变量, 没有配置ram、cpus时按模板名称推断
+func templateResources(template string, resources map[string]string) (map[string]float64, error) {
+	vars := make(map[string]float64)
+	if m := templateSize.FindStringSubmatch(template); m != nil {
+		cpus, _ := parseSize(m[1])
+		ram, _ := parseSize(m[2] + "G")
+		vars["cpus"], vars["ram"] = cpus, ram
+	}
+	for k, v := range resources {
+		n, err := parseSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("resources %s=%s: %s", k, v, err)
+		}
+		vars[k] = n
+	}
+	return vars, nil
+}
+
+func newBaselineTemplate(values map[string]interface{}) (*BaselineTemplate, error) {
+	t := &BaselineTemplate{}
+	for key, value := range values {
+		var err error
+		switch key {
+		case "extends":
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("extends 必须是模板名称")
+			}
+			t.Extends = s
+		case "resources":
+			t.Resources, err = templateSection(key, value)
+		case "mysql":
+			t.Mysql, err = templateSection(key, value)
+		case "dbscale":
+			t.Dbscale, err = templateSection(key, value)
+		default:
+			err = fmt.Errorf("未知的配置 %s", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func templateSection(name string, value interface{}) (map[string]string, error) {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s 必须是映射", name)
+	}
+	section := make(map[string]string, len(m))
+	for k, v := range m {
+		switch v := v.(type) {
+		case string:
+			section[k] = v
+		case json.Number:
+			section[k] = v.String()
+		case bool:
+			section[k] = "OFF"
+			if v {
+				section[k] = "ON"
+			}
+		default:
+			return nil, fmt.Errorf("%s.%s 必须是标量", name, k)
+		}
+	}
+	return section, nil
+}
+
+func parseJsonTemplate(data []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// parseYamlTemplate 解析yaml的子集: 按缩进嵌套的映射, 值为标量, # 开头为注释
+func parseYamlTemplate(data []byte) (map[string]interface{}, error) {
+	type level struct {
+		indent int
+		values map[string]interface{}
+	}
+	root := make(map[string]interface{})
+	stack := []level{{indent: -1, values: root}}
+	// pending 值为空的键, 下一行缩进更深时为嵌套映射
+	var pending *level
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for no := 1; scanner.Scan(); no++ {
+		raw := scanner.Text()
+		text := strings.TrimRight(stripYamlComment(raw), " ")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		indent := len(text) - len(strings.TrimLeft(text, " "))
+		if strings.HasPrefix(text[indent:], "\t") {
+			return nil, fmt.Errorf("第%d行: 不支持tab缩进", no)
+		}
+		if pending != nil {
+			if indent > pending.indent {
+				stack = append(stack, level{indent: indent, values: pending.values})
+			}
+			pending = nil
+		}
+		for len(stack) > 1 && indent < stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		if indent != stack[len(stack)-1].indent && len(stack) > 1 {
+			return nil, fmt.Errorf("第%d行: 缩进不一致", no)
+		}
+		kv := strings.SplitN(strings.TrimSpace(text), ":", 2)
+		if len(kv) != 2 || strings.HasPrefix(kv[0], "-") {
+			return nil, fmt.Errorf("第%d行: 只支持 key: value, %s", no, raw)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		current := stack[len(stack)-1].values
+		if value == "" {
+			child := make(map[string]interface{})
+			current[key] = child
+			pending = &level{indent: indent, values: child}
+			continue
+		}
+		current[key] = unquoteYaml(value)
+	}
+	return root, scanner.Err()
+}
+
+// stripYamlComment 去掉引号以外 # 之后的注释
+func stripYamlComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' '):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquoteYaml(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
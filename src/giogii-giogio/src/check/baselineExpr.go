@@ -0,0 +1,210 @@
+package check
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/**
+基准值表达式, 写作 ${表达式}, 按主机资源计算参数值, 例如:
+innodb_buffer_pool_size: ${align(ram * 60%, 128M)}
+支持 + - * / 和括号, 数字可以带单位 K/M/G/T(1024进制) 或 %, 变量为模板resources中的值(ram、cpus等),
+函数 min(a, b)、max(a, b)、align(x, n) 向下取整为n的倍数. 结果取整数
+*/
+
+// evalBaselineValue 计算基准值, 不是 ${} 表达式时原样返回
+func evalBaselineValue(value string, vars map[string]float64) (string, error) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "${") || !strings.HasSuffix(value, "}") {
+		return value, nil
+	}
+	p := &exprParser{input: value[2 : len(value)-1], vars: vars}
+	result, err := p.parse()
+	if err != nil {
+		return "", fmt.Errorf("表达式 %s: %s", value, err)
+	}
+	return strconv.FormatInt(int64(math.Floor(result)), 10), nil
+}
+
+// parseSize 带单位的数值, K/M/G/T 为1024进制, %为百分比
+func parseSize(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	multiple := 1.0
+	upper := strings.ToUpper(s)
+	switch {
+	case strings.HasSuffix(upper, "%"):
+		multiple, s = 0.01, s[:len(s)-1]
+	case len(upper) > 0 && strings.ContainsAny(upper[len(upper)-1:], "KMGT"):
+		multiple, s = math.Pow(1024, float64(strings.Index("KMGT", upper[len(upper)-1:])+1)), s[:len(s)-1]
+	case strings.HasSuffix(upper, "B") && len(upper) > 1 && strings.ContainsAny(upper[len(upper)-2:len(upper)-1], "KMGT"):
+		multiple, s = math.Pow(1024, float64(strings.Index("KMGT", upper[len(upper)-2:len(upper)-1])+1)), s[:len(s)-2]
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiple, nil
+}
+
+type exprParser struct {
+	input string
+	pos   int
+	vars  map[string]float64
+}
+
+func (p *exprParser) parse() (float64, error) {
+	v, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("位置%d无法解析: %s", p.pos, p.input[p.pos:])
+	}
+	return v, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+// expr 加减
+func (p *exprParser) expr() (float64, error) {
+	v, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return v, nil
+		}
+		p.pos++
+		r, err := p.term()
+		if err != nil {
+			return 0, err
+		}
+		if op == '+' {
+			v += r
+		} else {
+			v -= r
+		}
+	}
+}
+
+// term 乘除
+func (p *exprParser) term() (float64, error) {
+	v, err := p.factor()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return v, nil
+		}
+		p.pos++
+		r, err := p.factor()
+		if err != nil {
+			return 0, err
+		}
+		if op == '*' {
+			v *= r
+		} else if r == 0 {
+			return 0, fmt.Errorf("除数为0")
+		} else {
+			v /= r
+		}
+	}
+}
+
+// factor 数字、变量、函数、括号和负号
+func (p *exprParser) factor() (float64, error) {
+	c := p.peek()
+	switch {
+	case c == '-':
+		p.pos++
+		v, err := p.factor()
+		return -v, err
+	case c == '(':
+		p.pos++
+		v, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if p.peek() != ')' {
+			return 0, fmt.Errorf("缺少 )")
+		}
+		p.pos++
+		return v, nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.input) && (unicode.IsDigit(rune(p.input[p.pos])) || strings.ContainsRune(".%KMGTBkmgtb", rune(p.input[p.pos]))) {
+			p.pos++
+		}
+		return parseSize(p.input[start:p.pos])
+	case unicode.IsLetter(rune(c)) || c == '_':
+		start := p.pos
+		for p.pos < len(p.input) && (unicode.IsLetter(rune(p.input[p.pos])) || unicode.IsDigit(rune(p.input[p.pos])) || p.input[p.pos] == '_') {
+			p.pos++
+		}
+		name := p.input[start:p.pos]
+		if p.peek() == '(' {
+			p.pos++
+			return p.call(name)
+		}
+		v, ok := p.vars[name]
+		if !ok {
+			return 0, fmt.Errorf("未知的变量 %s", name)
+		}
+		return v, nil
+	}
+	return 0, fmt.Errorf("位置%d无法解析", p.pos)
+}
+
+func (p *exprParser) call(name string) (float64, error) {
+	var args []float64
+	for {
+		v, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		args = append(args, v)
+		c := p.peek()
+		p.pos++
+		if c == ')' {
+			break
+		}
+		if c != ',' {
+			return 0, fmt.Errorf("函数 %s 缺少 )", name)
+		}
+	}
+	if len(args) != 2 {
+		return 0, fmt.Errorf("函数 %s 需要2个参数", name)
+	}
+	switch name {
+	case "min":
+		return math.Min(args[0], args[1]), nil
+	case "max":
+		return math.Max(args[0], args[1]), nil
+	case "align":
+		if args[1] <= 0 {
+			return 0, fmt.Errorf("align 的倍数必须大于0")
+		}
+		return math.Floor(args[0]/args[1]) * args[1], nil
+	}
+	return 0, fmt.Errorf("未知的函数 %s", name)
+}
@@ -0,0 +1,79 @@
+package check
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileBaseline(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"base.yaml": `# 所有规格共用
+mysql:
+  sync_binlog: 1
+  default-time-zone: '+08:00'   # 东八区
+  innodb_buffer_pool_size: ${align(ram * 60%, 128M)}
+dbscale:
+  max-replication-delay: 10
+`,
+		"8c32gb.json": `{"extends": "base", "mysql": {"max_connections": 4000, "sync_binlog": 0}}`,
+		"custom.yaml": "extends: base\nresources:\n  ram: 10G\n",
+		"loop.yaml":   "extends: loop\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !IsFileTemplate(filepath.Join(dir, "8c32gb.json")) || IsFileTemplate("8c32gb") {
+		t.Fatal("unexpected template kind")
+	}
+	provider, name := NewFileBaseline(filepath.Join(dir, "8c32gb.json"))
+	configuration, err := provider.Baseline(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]string)
+	for _, c := range configuration {
+		values[c.Type+":"+c.Name] = c.Value
+	}
+	// 子模板覆盖父模板, 规格从模板名称推断: 32G的60%向下取整为128M的倍数
+	expect := map[string]string{
+		"mysql:sync_binlog":             "0",
+		"mysql:max_connections":         "4000",
+		"mysql:default-time-zone":       "+08:00",
+		"mysql:innodb_buffer_pool_size": "20535312384",
+		"dbscale:max-replication-delay": "10",
+	}
+	if len(values) != len(expect) {
+		t.Fatalf("unexpected baseline %v", values)
+	}
+	for k, v := range expect {
+		if values[k] != v {
+			t.Fatalf("unexpected %s=%s in %v", k, values[k], values)
+		}
+	}
+	if configuration[0].Type != "mysql" || configuration[len(configuration)-1].Type != "dbscale" {
+		t.Fatalf("unexpected order %v", configuration)
+	}
+
+	custom, err := provider.Baseline("custom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range custom {
+		if c.Name == "innodb_buffer_pool_size" && c.Value != "6442450944" {
+			t.Fatalf("unexpected buffer pool %s", c.Value)
+		}
+	}
+	if _, err := provider.Baseline("loop"); err == nil {
+		t.Fatal("expect error for circular extends")
+	}
+	if _, err := provider.Baseline("base"); err == nil {
+		t.Fatal("expect error for expression without ram")
+	}
+	if v, err := evalBaselineValue("${max(2 * cpus, 16) + 1K / 2}", map[string]float64{"cpus": 4}); err != nil || v != "528" {
+		t.Fatalf("unexpected expression result %s %v", v, err)
+	}
+}
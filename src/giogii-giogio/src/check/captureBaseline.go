@@ -0,0 +1,251 @@
+package check
+
+import (
+	"encoding/json"
+	"fmt"
+	"giogii/src/mapper"
+	"giogii/src/topology"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+从参考集群生成参数模板, 与参数检查相反: 读取数据节点的 show global variables、performance_schema.setup_consumers
+和dbscale的 dbscale show options, 去掉与主机相关或随时变化的参数后写为模板文件(.yaml/.yml/.json), 可以直接作为 -c 使用
+*/
+
+// captureIgnore 默认忽略的参数, 按 show variables 名称(dbscale参数 - 替换为 _)匹配, 支持 * 通配
+var captureIgnore = []string{
+	"server_id", "server_uuid", "*_uuid", "hostname", "port", "*_port", "bind_address", "*_address", "*_ip", "*_host", "report_*",
+	"socket", "*_socket", "*dir", "*_file", "*_path", "*_basename", "log_bin_index", "relay_log_index", "log_error", "pid_file", "relay_log",
+	"secure_file_priv", "ssl_*", "gtid_executed*", "gtid_purged", "gtid_owned", "auto_increment_offset",
+	"version*", "innodb_version", "protocol_version", "license", "have_*", "system_time_zone", "timestamp", "rand_seed*", "warning_count", "error_count",
+	"last_insert_id", "identity", "insert_id", "pseudo_*", "large_page_size", "shared_memory_base_name", "named_pipe*",
+	"innodb_buffer_pool_dump_*", "innodb_buffer_pool_load_*",
+}
+
+// CaptureIgnore 默认忽略列表加上 -a 中逗号分隔的模式, !开头的模式从默认列表中移除
+func CaptureIgnore(extra string) []string {
+	ignore := append([]string{}, captureIgnore...)
+	for _, pattern := range strings.Split(extra, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "":
+		case strings.HasPrefix(pattern, "!"):
+			keep := VariableName(pattern[1:])
+			for i := 0; i < len(ignore); i++ {
+				if ignore[i] == keep {
+					ignore = append(ignore[:i], ignore[i+1:]...)
+					i--
+				}
+			}
+			// 被通配模式忽略的参数单独保留
+			ignore = append(ignore, "!"+keep)
+		default:
+			ignore = append(ignore, VariableName(pattern))
+		}
+	}
+	return ignore
+}
+
+// ignoredParam 参数是否在忽略列表中, !name 优先
+func ignoredParam(ignore []string, name string) bool {
+	variable := VariableName(name)
+	ignored := false
+	for _, pattern := range ignore {
+		if strings.HasPrefix(pattern, "!") {
+			if pattern[1:] == variable {
+				return false
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, variable); ok {
+			ignored = true
+		}
+	}
+	return ignored
+}
+
+// captureSection 读取两列(名称, 值)的结果, 去掉忽略的参数
+func captureSection(operator mapper.SqlScaleOperator, strSql string, ignore []string, name func(string) string, value func(string) string) (map[string]string, error) {
+	_, rows, err := operator.DoQueryParseRows(strSql)
+	if err != nil {
+		return nil, err
+	}
+	section := make(map[string]string)
+	for _, row := range rows {
+		if len(row) < 2 {
+			continue
+		}
+		n := name(row[0])
+		if ignoredParam(ignore, n) {
+			continue
+		}
+		section[n] = value(row[1])
+	}
+	return section, nil
+}
+
+func sameName(name string) string {
+	return name
+}
+
+// consumerValue setup_consumers 的 YES/NO 转为 ON/OFF
+func consumerValue(enabled string) string {
+	if enabled == "YES" {
+		return "ON"
+	}
+	return "OFF"
+}
+
+// CaptureBaseline 读取参考节点的mysql参数和consumer, proxy 不为nil时读取dbscale参数
+func CaptureBaseline(node mapper.SqlScaleOperator, proxy mapper.SqlScaleOperator, ignore []string) (*BaselineTemplate, error) {
+	mysql, err := captureSection(node, "show global variables", ignore, strings.ToLower, sameName)
+	if err != nil {
+		return nil, err
+	}
+	consumers, err := captureSection(node, "select name, enabled from performance_schema.setup_consumers", ignore,
+		func(name string) string { return "performance-schema-consumer-" + strings.ReplaceAll(name, "_", "-") }, consumerValue)
+	if err != nil {
+		log.Println(fmt.Sprintf("读取performance_schema consumer失败: %s", err))
+	}
+	for k, v := range consumers {
+		mysql[k] = v
+	}
+	t := &BaselineTemplate{Mysql: mysql}
+	if proxy != nil {
+		t.Dbscale, err = captureSection(proxy, "dbscale show options", ignore, sameName, sameName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// yamlValue 需要时加引号, 使 parseYamlTemplate 读回相同的值
+func yamlValue(value string) string {
+	if value == "" || value != strings.TrimSpace(value) || strings.Contains(value, " #") || strings.HasPrefix(value, "#") ||
+		strings.HasPrefix(value, "\"") || strings.HasPrefix(value, "'") {
+		if strings.Contains(value, "'") {
+			return "\"" + value + "\""
+		}
+		return "'" + value + "'"
+	}
+	return value
+}
+
+// WriteYaml 以 parseYamlTemplate 支持的格式输出模板
+func (t *BaselineTemplate) WriteYaml(w io.Writer) {
+	if t.Extends != "" {
+		fmt.Fprintf(w, "extends: %s\n", t.Extends)
+	}
+	for _, section := range []struct {
+		name   string
+		values map[string]string
+	}{{"resources", t.Resources}, {"mysql", t.Mysql}, {"dbscale", t.Dbscale}} {
+		if len(section.values) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s:\n", section.name)
+		for _, k := range sortedKeys(section.values) {
+			fmt.Fprintf(w, "  %s: %s\n", k, yamlValue(section.values[k]))
+		}
+	}
+}
+
+// WriteJson 以json输出模板, 键按名称排序
+func (t *BaselineTemplate) WriteJson(w io.Writer) error {
+	values := make(map[string]interface{})
+	if t.Extends != "" {
+		values["extends"] = t.Extends
+	}
+	for name, section := range map[string]map[string]string{"resources": t.Resources, "mysql": t.Mysql, "dbscale": t.Dbscale} {
+		if len(section) > 0 {
+			values[name] = section
+		}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(values)
+}
+
+// captureNode 参考集群为dbscale时直连第一个分片的主节点读取mysql参数, 否则直接读取 -ti
+func captureNode(userInfo string, proxy mapper.SqlScaleOperator, socket string) (mapper.SqlScaleOperator, bool, error) {
+	cluster, err := topology.Load(proxy)
+	if err != nil {
+		log.Println(fmt.Sprintf("读取集群拓扑失败, 从实例 %s 读取参数: %s", socket, err))
+		return proxy, false, nil
+	}
+	for _, ds := range cluster.Shards() {
+		if master := ds.Master(); master != nil {
+			conn, err := mapper.OpenSourceConn(userInfo, master.Socket(), "information_schema")
+			if err != nil {
+				return nil, true, fmt.Errorf("连接数据节点 %s 失败: %s", master.Socket(), err)
+			}
+			log.Println(fmt.Sprintf("从数据节点 %s 读取mysql参数", master.Socket()))
+			return &conn, true, nil
+		}
+	}
+	return nil, true, fmt.Errorf("集群中没有主节点")
+}
+
+// DoCaptureBaseline 从参考集群生成参数模板, outFile 为模板文件, 按扩展名输出yaml或json, 为空时以yaml输出到屏幕; ignore 为追加的忽略模式
+func DoCaptureBaseline(userInfo string, socket string, outFile string, ignore string) {
+	proxy, err := mapper.OpenSourceConn(userInfo, socket, "information_schema")
+	if err != nil {
+		log.Println(fmt.Sprintf("连接参考集群 %s 失败: %s", socket, err))
+		return
+	}
+	defer proxy.DoClose()
+	node, isDbscale, err := captureNode(userInfo, &proxy, socket)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var options mapper.SqlScaleOperator
+	if isDbscale {
+		defer node.DoClose()
+		options = &proxy
+	}
+	t, err := CaptureBaseline(node, options, CaptureIgnore(ignore))
+	if err != nil {
+		log.Println(fmt.Sprintf("读取参考集群参数失败: %s", err))
+		return
+	}
+
+	var out io.Writer = os.Stdout
+	if outFile != "" {
+		f, err := os.Create(outFile)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer f.Close()
+		out = f
+	}
+	if strings.HasSuffix(outFile, ".json") {
+		err = t.WriteJson(out)
+	} else {
+		fmt.Fprintf(out, "# 由 %s 的参数生成于 %s\n", socket, time.Now().Format("2006-01-02 15:04:05"))
+		t.WriteYaml(out)
+	}
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Println(fmt.Sprintf("mysql参数 %d 个, dbscale参数 %d 个", len(t.Mysql), len(t.Dbscale)))
+}
@@ -0,0 +1,61 @@
+package check
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCaptureIgnore(t *testing.T) {
+	ignore := CaptureIgnore("innodb_buffer_pool_size, !port, !log-error")
+	for name, ignored := range map[string]bool{
+		"server_id":                      true,
+		"server_uuid":                    true,
+		"datadir":                        true,
+		"slow_query_log_file":            true,
+		"innodb_buffer_pool_size":        true,
+		"port":                           false,
+		"log_error":                      false,
+		"mysqlx_port":                    true,
+		"backend-thread-dir":             true,
+		"innodb_adaptive_hash_index":     false,
+		"tls_version":                    false,
+		"innodb_flush_log_at_trx_commit": false,
+		"max-replication-delay":          false,
+	} {
+		if ignoredParam(ignore, name) != ignored {
+			t.Fatalf("ignoredParam(%s) != %v", name, ignored)
+		}
+	}
+}
+
+func TestWriteYamlRoundTrip(t *testing.T) {
+	captured := &BaselineTemplate{
+		Mysql: map[string]string{
+			"sql_mode":                        "STRICT_TRANS_TABLES,NO_ENGINE_SUBSTITUTION",
+			"init_connect":                    "",
+			"ft_boolean_syntax":               "+ -><()~*:\"\"&|",
+			"log_bin_trust_function_creators": "OFF",
+			"time_zone":                       "+08:00",
+			"general_log":                     "'x' #y",
+		},
+		Dbscale: map[string]string{"max-replication-delay": "10"},
+	}
+	var buf bytes.Buffer
+	captured.WriteYaml(&buf)
+	values, err := parseYamlTemplate(buf.Bytes())
+	if err != nil {
+		t.Fatalf("%s\n%s", err, buf.String())
+	}
+	parsed, err := newBaselineTemplate(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range captured.Mysql {
+		if parsed.Mysql[k] != v {
+			t.Fatalf("%s: %q != %q\n%s", k, parsed.Mysql[k], v, buf.String())
+		}
+	}
+	if parsed.Dbscale["max-replication-delay"] != "10" {
+		t.Fatalf("unexpected dbscale %v", parsed.Dbscale)
+	}
+}
@@ -2,10 +2,9 @@ package check
 
 import (
 	"fmt"
+	"giogii/src/gtid"
 	"giogii/src/mapper"
 	"log"
-	"strconv"
-	"strings"
 )
 
 var strSql string
@@ -19,13 +18,15 @@ func InitCheckConsistentConf(sourceUserInfo string, sourceSocket string, sourceD
 }
 
 func DoCheck() {
+	defer func() {
+		MasterSqlScaleOperator.DoClose()
+		SlaveSqlScaleOperator.DoClose()
+	}()
 
 	/**
 	是否需要判断是否是主集群？
 	是否需要判断是发是备集群？
 	*/
-	var rs = 2
-
 	strSql = fmt.Sprint("show master status")
 	masterStatus := MasterSqlScaleOperator.DoQueryParseMaster(strSql)
 
@@ -35,67 +36,52 @@ func DoCheck() {
 	strSql = fmt.Sprint("show slave status")
 	slaveStatus := SlaveSqlScaleOperator.DoQueryParseSlave(strSql)
 
-	var masterGtid string
-	var slaveGtid string
-
-	// 如果两个语句的返回值里任何一个不包含binlog文件，直接返回2
+	// 如果两个语句的返回值里任何一个不包含binlog文件，无法比较
 	if masterStatus.File == "" || slaveStatus.MasterLogFile == "" {
 		log.Printf("show master status / show slave status return null")
-		fmt.Println(rs)
+		fmt.Println("无法比较: show master status / show slave status 返回为空")
 		return
 	}
 
-	// 如果slave读取的binlog文件和主库当前binlog文件不相等，说明延迟很大，直接返回2，不需要进行下面比较
+	// 如果slave读取的binlog文件和主库当前binlog文件不相等，说明延迟很大
 	if masterStatus.File != slaveStatus.MasterLogFile {
 		log.Printf("备集群此刻读取主集群的binlog文件和主集群生产的binlog文件不相等，")
-		//fmt.Println(rs)
-		//return
 	}
 
-	// 获取主集群执行的gtid
-	masterExecutedGtids := strings.Split(masterStatus.ExecutedGtidSet, ",")
-	for i := 0; i < len(masterExecutedGtids); i++ {
-		if strings.Contains(masterExecutedGtids[i], masterUuid) {
-			masterGtid = strings.Trim(masterExecutedGtids[i], "\n")
-			break
-		}
-	}
-
-	// 获取备集群执行的gtid
-	slaveExecutedGtids := strings.Split(slaveStatus.ExecutedGtidSet, ",")
-	for i := 0; i < len(slaveExecutedGtids); i++ {
-		if strings.Contains(slaveExecutedGtids[i], masterUuid) {
-			slaveGtid = strings.Trim(slaveExecutedGtids[i], "\n")
-			break
-		}
+	masterSet, err := gtid.Parse(masterStatus.ExecutedGtidSet)
+	if err != nil {
+		log.Println("解析主集群GTID失败: ", err)
+		return
 	}
-
-	// 这里的逻辑是判断主集群GTID是否和备集群GTID相等
-	if strings.Contains(slaveGtid, masterGtid) {
-		rs -= 1
-	} else if strings.Contains(slaveGtid, "-") && strings.Contains(masterGtid, "-") {
-		slaveLastIndex := strings.LastIndex(slaveGtid, "-")
-		masterLastIndex := strings.LastIndex(masterGtid, "-")
-		if masterGtid[masterLastIndex+1:] == slaveGtid[slaveLastIndex+1:] {
-			rs -= 1
-		}
+	slaveSet, err := gtid.Parse(slaveStatus.ExecutedGtidSet)
+	if err != nil {
+		log.Println("解析备集群GTID失败: ", err)
+		return
 	}
 
-	// 这里的逻辑是判断主集群binlog点位是否和备集群点位相等
-	if strconv.Itoa(*masterStatus.Position) == strconv.Itoa(*slaveStatus.ReadMasterLogPos) {
-		rs -= 1
-	}
+	// 主集群已执行但备集群缺少的事务
+	missingOnSlave := masterSet.Subtract(slaveSet)
+	// 备集群多出的事务, 即主集群缺少的事务
+	missingOnMaster := slaveSet.Subtract(masterSet)
 
-	log.Printf("Source Cluster GTID：%s", masterGtid)
-	log.Printf("Target Cluster GTID：%s", slaveGtid)
+	log.Printf("Source Cluster UUID：%s", masterUuid)
+	log.Printf("Source Cluster GTID：%s", masterSet.UUIDString(masterUuid))
+	log.Printf("Target Cluster GTID：%s", slaveSet.UUIDString(masterUuid))
 	log.Print("Source Cluster POS: ", *masterStatus.Position)
 	log.Print("Target Cluster POS: ", *slaveStatus.ReadMasterLogPos)
 
-	fmt.Println(rs)
-
-	defer func() {
-		MasterSqlScaleOperator.DoClose()
-		SlaveSqlScaleOperator.DoClose()
-	}()
-
+	fmt.Printf("备集群缺少的事务 (%d): %s\n", missingOnSlave.Count(), missingOnSlave)
+	fmt.Printf("主集群缺少的事务 (%d): %s\n", missingOnMaster.Count(), missingOnMaster)
+	for _, uuid := range missingOnMaster.UUIDs() {
+		if !masterSet.Only(uuid).IsEmpty() {
+			continue
+		}
+		fmt.Printf("备集群存在主集群中没有的UUID: %s\n", uuid)
+	}
+	if missingOnSlave.IsEmpty() && missingOnMaster.IsEmpty() {
+		fmt.Println("主备集群GTID一致")
+	}
+	if *masterStatus.Position != *slaveStatus.ReadMasterLogPos {
+		fmt.Printf("主集群POS %d, 备集群读取POS %d\n", *masterStatus.Position, *slaveStatus.ReadMasterLogPos)
+	}
 }
@@ -0,0 +1,332 @@
+package check
+
+import (
+	"fmt"
+	"giogii/src/gtid"
+	"giogii/src/mapper"
+	"giogii/src/topology"
+	"log"
+	"strings"
+)
+
+const (
+	// RepairInject 在主集群注入空事务
+	RepairInject = "inject"
+	// RepairPurge 在灾备集群重写gtid_purged
+	RepairPurge = "purge"
+)
+
+// RepairPlan 修复计划, Statements 需要在 Hosts 中的每个实例上依次执行
+type RepairPlan struct {
+	Method     string
+	Hosts      []string
+	Statements []string
+}
+
+// FindErrantTransactions 灾备集群执行过但主集群没有的事务
+func FindErrantTransactions(masterSet *gtid.GtidSet, slaveSet *gtid.GtidSet) *gtid.GtidSet {
+	return slaveSet.Subtract(masterSet)
+}
+
+// PlanInjectEmptyTransactions 为每个errant事务在主集群生成一个空事务
+func PlanInjectEmptyTransactions(errant *gtid.GtidSet) []string {
+	var sqls []string
+	for _, uuid := range errant.UUIDs() {
+		for _, in := range errant.Intervals(uuid) {
+			for gno := in.Start; gno <= in.Stop; gno++ {
+				sqls = append(sqls, fmt.Sprintf("SET GTID_NEXT='%s:%d'", uuid, gno), "BEGIN", "COMMIT")
+			}
+		}
+	}
+	if len(sqls) > 0 {
+		sqls = append(sqls, "SET GTID_NEXT='AUTOMATIC'")
+	}
+	return sqls
+}
+
+// PlanRewriteGtidPurged 在灾备集群的一个节点上去掉errant事务后重写gtid_purged, nodeSet 为该节点自己的gtid_executed
+func PlanRewriteGtidPurged(nodeSet *gtid.GtidSet, errant *gtid.GtidSet) []string {
+	if errant.IsEmpty() {
+		return nil
+	}
+	return []string{
+		"STOP SLAVE",
+		"RESET MASTER",
+		fmt.Sprintf("SET GLOBAL gtid_purged='%s'", nodeSet.Subtract(errant)),
+		"START SLAVE",
+	}
+}
+
+// purgeNode 灾备集群的一个数据节点, Executed 为节点自己的gtid_executed
+type purgeNode struct {
+	Host     string
+	Shard    int
+	Master   bool
+	Operator mapper.SqlScaleOperator
+	Executed *gtid.GtidSet
+}
+
+// planPurge 按每个节点自己的gtid_executed计算errant事务并生成计划, 各分片主节点在前.
+// 从节点必须已经回放分片主节点上除errant以外的全部事务: 否则重写后没有回放的事务被记为已执行,
+// 主节点RESET MASTER后也没有binlog可以补齐, 有节点未追上时返回错误
+func planPurge(masterSet *gtid.GtidSet, nodes []*purgeNode) ([]RepairPlan, error) {
+	required := make(map[int]*gtid.GtidSet)
+	for _, n := range nodes {
+		if n.Master {
+			required[n.Shard] = n.Executed.Subtract(FindErrantTransactions(masterSet, n.Executed))
+		}
+	}
+	var masters, slaves []RepairPlan
+	for _, n := range nodes {
+		if !n.Master {
+			r, ok := required[n.Shard]
+			if !ok {
+				return nil, fmt.Errorf("实例 %s 所在的分片没有主节点", n.Host)
+			}
+			if missing := r.Subtract(n.Executed); !missing.IsEmpty() {
+				return nil, fmt.Errorf("实例 %s 未回放完分片主节点的 %d 个事务(%s), 等待追上后再执行", n.Host, missing.Count(), missing)
+			}
+		}
+		errant := FindErrantTransactions(masterSet, n.Executed)
+		if errant.IsEmpty() {
+			continue
+		}
+		plan := RepairPlan{Method: RepairPurge, Hosts: []string{n.Host}, Statements: PlanRewriteGtidPurged(n.Executed, errant)}
+		if n.Master {
+			masters = append(masters, plan)
+		} else {
+			slaves = append(slaves, plan)
+		}
+	}
+	return append(masters, slaves...), nil
+}
+
+// dataServerSockets 所有分片的数据节点, masterOnly为true时只返回各分片的主节点; 读取拓扑失败或没有节点时返回错误
+func dataServerSockets(operator mapper.SqlScaleOperator, masterOnly bool) ([]string, error) {
+	cluster, err := topology.Load(operator)
+	if err != nil {
+		return nil, fmt.Errorf("读取集群拓扑失败: %s", err)
+	}
+	var sockets []string
+	for _, ds := range cluster.Shards() {
+		for _, s := range ds.Servers {
+			if masterOnly && s.Role != topology.RoleMaster {
+				continue
+			}
+			sockets = append(sockets, s.Socket())
+		}
+	}
+	if len(sockets) == 0 {
+		return nil, fmt.Errorf("集群拓扑中没有可以执行修复计划的数据节点")
+	}
+	return sockets, nil
+}
+
+// openPurgeNodes 连接灾备集群全部分片的数据节点, 返回的函数关闭连接
+func openPurgeNodes(userInfo string) ([]*purgeNode, func(), error) {
+	cluster, err := topology.Load(SlaveSqlScaleOperator)
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取灾备集群拓扑失败: %s", err)
+	}
+	var nodes []*purgeNode
+	closeAll := func() {
+		for _, n := range nodes {
+			n.Operator.DoClose()
+		}
+	}
+	for i, ds := range cluster.Shards() {
+		for _, s := range ds.Servers {
+			conn, err := mapper.OpenSourceConn(userInfo, s.Socket(), "information_schema")
+			if err != nil {
+				closeAll()
+				return nil, nil, fmt.Errorf("连接实例 %s 失败: %s", s.Socket(), err)
+			}
+			nodes = append(nodes, &purgeNode{Host: s.Socket(), Shard: i, Master: s.Role == topology.RoleMaster, Operator: &conn})
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, nil, fmt.Errorf("灾备集群拓扑中没有数据节点")
+	}
+	return nodes, closeAll, nil
+}
+
+// readPurgeNodes 读取主集群和每个节点的gtid_executed
+func readPurgeNodes(nodes []*purgeNode) (*gtid.GtidSet, error) {
+	for _, n := range nodes {
+		set, err := gtid.Parse(executedGtid(n.Operator))
+		if err != nil {
+			return nil, fmt.Errorf("解析实例 %s 的GTID失败: %s", n.Host, err)
+		}
+		n.Executed = set
+	}
+	// 主集群的GTID只会增加, 在节点之后读取, 节点上新回放的事务不会被误判为errant
+	masterSet, err := gtid.Parse(MasterSqlScaleOperator.DoQueryParseMaster("show master status").ExecutedGtidSet)
+	if err != nil {
+		return nil, fmt.Errorf("解析主集群GTID失败: %s", err)
+	}
+	return masterSet, nil
+}
+
+// startSlaves 依次启动节点的复制, 各分片主节点在前
+func startSlaves(nodes []*purgeNode) {
+	for _, master := range []bool{true, false} {
+		for _, n := range nodes {
+			if n.Master != master {
+				continue
+			}
+			if err := n.Operator.DoExec("START SLAVE"); err != nil {
+				log.Println(fmt.Sprintf("实例 %s 启动复制失败, 需要手动执行 START SLAVE: %s", n.Host, err))
+			}
+		}
+	}
+}
+
+// doPurge 按每个节点自己的GTID生成计划, apply为true时先停止全部节点的复制再重新读取GTID生成计划并执行,
+// 有节点未追上时恢复复制并放弃执行
+func doPurge(userInfo string, apply bool) {
+	nodes, closeAll, err := openPurgeNodes(userInfo)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer closeAll()
+	if apply {
+		for _, n := range nodes {
+			if err := n.Operator.DoExec("STOP SLAVE"); err != nil {
+				log.Println(fmt.Sprintf("实例 %s 停止复制失败: %s", n.Host, err))
+				startSlaves(nodes)
+				return
+			}
+		}
+	}
+	masterSet, err := readPurgeNodes(nodes)
+	var plans []RepairPlan
+	if err == nil {
+		plans, err = planPurge(masterSet, nodes)
+	}
+	if err != nil {
+		log.Println(err)
+		if apply {
+			startSlaves(nodes)
+		}
+		return
+	}
+	printRepairPlans(plans)
+	if !apply {
+		fmt.Println("dry-run模式, 未执行修复计划")
+		return
+	}
+	operators := make(map[string]mapper.SqlScaleOperator)
+	for _, n := range nodes {
+		operators[n.Host] = n.Operator
+	}
+	for _, plan := range plans {
+		if err := applyRepairPlan(plan, func(host string) (mapper.SqlScaleOperator, func(), error) {
+			return operators[host], func() {}, nil
+		}); err != nil {
+			log.Println(err)
+			break
+		}
+	}
+	// 没有errant事务的节点和执行失败时的其余节点也需要恢复复制
+	startSlaves(nodes)
+}
+
+// printRepairPlans 输出修复计划
+func printRepairPlans(plans []RepairPlan) {
+	if len(plans) == 0 {
+		fmt.Println("各数据节点上没有errant事务, 不需要修复")
+	}
+	for _, plan := range plans {
+		fmt.Printf("修复计划(%s), 执行实例: %s\n", plan.Method, strings.Join(plan.Hosts, ", "))
+		for _, sqlStr := range plan.Statements {
+			fmt.Printf("  %s;\n", sqlStr)
+		}
+	}
+}
+
+// applyRepairPlan 在计划的每个实例上依次执行, connect 返回实例的连接和关闭连接的函数
+func applyRepairPlan(plan RepairPlan, connect func(host string) (mapper.SqlScaleOperator, func(), error)) error {
+	for _, host := range plan.Hosts {
+		log.Println(fmt.Sprintf("准备在实例 %s 上执行修复计划", host))
+		s, done, err := connect(host)
+		if err != nil {
+			return fmt.Errorf("连接实例 %s 失败: %s", host, err)
+		}
+		err = s.DoExecInSession(plan.Statements)
+		done()
+		if err != nil {
+			return fmt.Errorf("实例 %s 执行修复计划失败: %s", host, err)
+		}
+		log.Println(fmt.Sprintf("实例 %s 执行修复计划完成", host))
+	}
+	return nil
+}
+
+// DoCheckErrant 列出灾备集群上的errant事务并生成修复计划, apply为true时执行修复计划
+func DoCheckErrant(method string, apply bool, sourceUserInfo string, targetUserInfo string) {
+	defer func() {
+		MasterSqlScaleOperator.DoClose()
+		SlaveSqlScaleOperator.DoClose()
+	}()
+
+	strSql = fmt.Sprint("show master status")
+	masterStatus := MasterSqlScaleOperator.DoQueryParseMaster(strSql)
+	slaveGtid := slaveExecutedGtid()
+	strSql = fmt.Sprint("show variables like 'server_uuid'")
+	slaveUuid := strings.ToLower(SlaveSqlScaleOperator.DoQueryParseString(strSql))
+
+	masterSet, err := gtid.Parse(masterStatus.ExecutedGtidSet)
+	if err != nil {
+		log.Println("解析主集群GTID失败: ", err)
+		return
+	}
+	slaveSet, err := gtid.Parse(slaveGtid)
+	if err != nil {
+		log.Println("解析灾备集群GTID失败: ", err)
+		return
+	}
+
+	errant := FindErrantTransactions(masterSet, slaveSet)
+	if errant.IsEmpty() {
+		fmt.Println("灾备集群不存在errant事务")
+		return
+	}
+	fmt.Printf("灾备集群errant事务共 %d 个:\n", errant.Count())
+	for _, uuid := range errant.UUIDs() {
+		var reason string
+		if uuid == slaveUuid {
+			reason = "灾备集群自身UUID"
+		} else if masterSet.Only(uuid).IsEmpty() {
+			reason = "主集群中不存在该UUID"
+		} else {
+			reason = "主集群中缺少这些事务"
+		}
+		fmt.Printf("  %s (%d) [%s]\n", errant.UUIDString(uuid), errant.CountOf(uuid), reason)
+	}
+
+	switch method {
+	case RepairInject:
+		hosts, err := dataServerSockets(MasterSqlScaleOperator, true)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		plan := RepairPlan{Method: method, Hosts: hosts, Statements: PlanInjectEmptyTransactions(errant)}
+		printRepairPlans([]RepairPlan{plan})
+		if !apply {
+			fmt.Println("dry-run模式, 未执行修复计划")
+			return
+		}
+		err = applyRepairPlan(plan, func(host string) (mapper.SqlScaleOperator, func(), error) {
+			conn, err := mapper.OpenSourceConn(sourceUserInfo, host, "information_schema")
+			return &conn, conn.DoClose, err
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	case RepairPurge:
+		// 各节点的errant事务和已回放的事务不同, 按节点自己的gtid_executed生成计划
+		doPurge(targetUserInfo, apply)
+	}
+}
@@ -0,0 +1,99 @@
+package check
+
+import (
+	"giogii/src/entity"
+	"giogii/src/gtid"
+	"giogii/src/mapper"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	errantUuidA = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	errantUuidB = "8f2b1c3d-71ca-11e1-9e33-c80aa9429562"
+	errantUuidC = "c5d6e7f8-71ca-11e1-9e33-c80aa9429562"
+)
+
+func TestErrantTransactions(t *testing.T) {
+	masterSet := gtid.MustParse(errantUuidA + ":1-50:60-100," + errantUuidB + ":1-10")
+	slaveSet := gtid.MustParse(errantUuidA + ":1-50:60-102:105," + errantUuidB + ":1-10," + errantUuidC + ":1-2")
+
+	errant := FindErrantTransactions(masterSet, slaveSet)
+	if errant.String() != errantUuidA+":101-102:105,"+errantUuidC+":1-2" {
+		t.Fatalf("unexpected errant set %s", errant)
+	}
+
+	expect := []string{
+		"SET GTID_NEXT='" + errantUuidA + ":101'", "BEGIN", "COMMIT",
+		"SET GTID_NEXT='" + errantUuidA + ":102'", "BEGIN", "COMMIT",
+		"SET GTID_NEXT='" + errantUuidA + ":105'", "BEGIN", "COMMIT",
+		"SET GTID_NEXT='" + errantUuidC + ":1'", "BEGIN", "COMMIT",
+		"SET GTID_NEXT='" + errantUuidC + ":2'", "BEGIN", "COMMIT",
+		"SET GTID_NEXT='AUTOMATIC'",
+	}
+	if sqls := PlanInjectEmptyTransactions(errant); !reflect.DeepEqual(sqls, expect) {
+		t.Fatalf("unexpected inject plan %v", sqls)
+	}
+
+	expect = []string{
+		"STOP SLAVE",
+		"RESET MASTER",
+		"SET GLOBAL gtid_purged='" + errantUuidA + ":1-50:60-100," + errantUuidB + ":1-10'",
+		"START SLAVE",
+	}
+	if sqls := PlanRewriteGtidPurged(slaveSet, errant); !reflect.DeepEqual(sqls, expect) {
+		t.Fatalf("unexpected purge plan %v", sqls)
+	}
+
+	none := FindErrantTransactions(slaveSet, masterSet)
+	if !none.IsEmpty() || PlanInjectEmptyTransactions(none) != nil || PlanRewriteGtidPurged(masterSet, none) != nil {
+		t.Fatal("expect empty plans without errant transactions")
+	}
+}
+
+func TestPlanPurge(t *testing.T) {
+	masterSet := gtid.MustParse(errantUuidA + ":1-100")
+	node := func(host string, shard int, master bool, set string) *purgeNode {
+		return &purgeNode{Host: host, Shard: shard, Master: master, Executed: gtid.MustParse(set)}
+	}
+	// 每个节点按自己的GTID计算errant事务, 主节点在前, 没有errant事务的节点不执行
+	nodes := []*purgeNode{
+		node("10.0.0.2:3306", 0, false, errantUuidA+":1-90,"+errantUuidC+":1"),
+		node("10.0.0.1:3306", 0, true, errantUuidA+":1-90,"+errantUuidB+":1-3"),
+		node("10.0.0.3:3306", 1, true, errantUuidA+":1-80"),
+		node("10.0.0.4:3306", 1, false, errantUuidA+":1-80"),
+	}
+	plans, err := planPurge(masterSet, nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []RepairPlan{
+		{Method: RepairPurge, Hosts: []string{"10.0.0.1:3306"}, Statements: []string{"STOP SLAVE", "RESET MASTER", "SET GLOBAL gtid_purged='" + errantUuidA + ":1-90'", "START SLAVE"}},
+		{Method: RepairPurge, Hosts: []string{"10.0.0.2:3306"}, Statements: []string{"STOP SLAVE", "RESET MASTER", "SET GLOBAL gtid_purged='" + errantUuidA + ":1-90'", "START SLAVE"}},
+	}
+	if !reflect.DeepEqual(plans, expect) {
+		t.Fatalf("unexpected purge plans %+v", plans)
+	}
+
+	// 从节点落后于分片主节点时不生成计划
+	nodes[3] = node("10.0.0.4:3306", 1, false, errantUuidA+":1-79")
+	if _, err := planPurge(masterSet, nodes); err == nil || !strings.Contains(err.Error(), "10.0.0.4:3306") {
+		t.Fatalf("expect error for lagging slave, got %v", err)
+	}
+}
+
+// fakeNoTopology 不是dbscale集群, dbscale show dataservers 没有结果
+type fakeNoTopology struct {
+	mapper.SqlScaleOperator
+}
+
+func (f *fakeNoTopology) DoQueryParseToDataServers(string) []entity.DataServers {
+	return nil
+}
+
+func TestDataServerSocketsWithoutTopology(t *testing.T) {
+	if sockets, err := dataServerSockets(&fakeNoTopology{}, true); err == nil || len(sockets) != 0 {
+		t.Fatalf("expect error without topology, got %v %v", sockets, err)
+	}
+}
@@ -1,116 +1,395 @@
 package check
 
 import (
+	"bufio"
 	"fmt"
+	"giogii/src/entity"
 	"giogii/src/mapper"
+	"giogii/src/topology"
+	"io"
 	"log"
+	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 var BaseParameter mapper.SqlScaleOperator
 var ClusterParameter mapper.SqlScaleOperator
 var TargetSocket string
+var TargetUserInfo string
 
-func InitCheckParameterConf(sourceUserInfo string, sourceSocket string, sourceDatabase string, targetUserInfo string, targetSocket string, targetDatabase string) {
+// Baseline 参数基准来源, 由InitCheckParameterConf按 -c 选择
+var Baseline BaselineProvider
+
+// InitCheckParameterConf template 为模板文件路径时从文件读取基准, 只连接被检查的集群, 否则连接管理平台读取基准; 返回模板名称
+func InitCheckParameterConf(sourceUserInfo string, sourceSocket string, sourceDatabase string, targetUserInfo string, targetSocket string, targetDatabase string, template string) string {
+	TargetSocket, TargetUserInfo = targetSocket, targetUserInfo
+	if IsFileTemplate(template) {
+		t := mapper.InitSourceConn(targetUserInfo, targetSocket, targetDatabase)
+		ClusterParameter = &t
+		provider, name := NewFileBaseline(template)
+		Baseline = provider
+		return name
+	}
 	s, t := mapper.InitAllConn(sourceUserInfo, sourceSocket, sourceDatabase, targetUserInfo, targetSocket, targetDatabase)
 	BaseParameter = &s
 	ClusterParameter = &t
-	TargetSocket = targetSocket
-}
-
-func DoCheckParameter(template string) {
-	// select name,value,type from configuration_items where configuration_id = "d992bc11-fe27-4e03-a355-4ed325c7ca23";
-	// init base template
-	// select i.name,i.value,i.type from configuration_items as i inner join configuration as c on c.uuid = i.configuration_id where c.name = "base";
-	var strSql = "select i.name,i.value,i.type from configuration_items as i inner join configuration as c on c.uuid = i.configuration_id where c.name = ?"
-	configuration := BaseParameter.DoQueryParseParameter(strSql, template)
-	for i := 0; i < len(configuration); i++ {
-		switch tp := configuration[i].Type; tp {
-		case "dbscale":
-			strSql = fmt.Sprintf("dbscale show options like '%s'", configuration[i].Name)
-			value := strings.ToLower(ClusterParameter.DoQueryParseValue(strSql))
-			if value == "true" {
-				value = "1"
-			} else if value == "false" {
-				value = "0"
-			}
-			if value != strings.ToLower(configuration[i].Value) {
-				log.Println(fmt.Sprintf("[实例 %s]参数：%s 基准值为：%s,实际值为：%s", TargetSocket, configuration[i].Name, configuration[i].Value, value))
-			}
+	Baseline = &GreatrdsBaseline{Operator: BaseParameter}
+	return template
+}
 
-		case "mysql":
-			switch name := configuration[i].Name; name {
+// ParamResult 一个参数的检查结果
+type ParamResult struct {
+	Name     string
+	Type     string
+	Baseline string
+	Actual   string
+	Equal    bool
+}
 
-			case "performance-schema-instrument":
+// checkParams 按基准检查一个实例的参数
+func checkParams(operator mapper.SqlScaleOperator, configuration []entity.Configuration) []ParamResult {
+	results := make([]ParamResult, 0, len(configuration))
+	for _, c := range configuration {
+		r := ParamResult{Name: c.Name, Type: c.Type, Baseline: c.Value}
+		r.Actual, r.Equal = paramValue(operator, c)
+		results = append(results, r)
+	}
+	return results
+}
 
-			case "binlog_ignore_db":
-				strSql = fmt.Sprintf("show master status")
-				masterStatus := ClusterParameter.DoQueryParseMaster(strSql)
-				if configuration[i].Value != masterStatus.BinlogIgnoreDB {
-					log.Println(fmt.Sprintf("[实例 %s]参数：%s 基准值为：%s,实际值为：%s", TargetSocket, configuration[i].Name, configuration[i].Value, masterStatus.BinlogIgnoreDB))
-				}
-			case "plugin-load":
-
-			case "federated":
-
-			case "ssl":
-				strSql = fmt.Sprintf("show variables like '%s'", "have_openssl")
-				value := strings.ToLower(ClusterParameter.DoQueryParseValue(strSql))
-				baseValue := strings.ToLower(configuration[i].Value)
-				if value == "disabled" {
-					value = "off"
-				} else if value == "yes" {
-					value = "on"
-				}
+// paramValue 读取参数的实际值并与基准比较, 不在 show variables 中的参数单独读取
+func paramValue(operator mapper.SqlScaleOperator, c entity.Configuration) (string, bool) {
+	if c.Type == "dbscale" {
+		value := operator.DoQueryParseValue(fmt.Sprintf("dbscale show options like '%s'", c.Name))
+		return value, ParamEqual(c.Name, c.Value, value)
+	}
+	variable := VariableName(c.Name)
+	switch {
+	case variable == "binlog_ignore_db":
+		value := operator.DoQueryParseMaster("show master status").BinlogIgnoreDB
+		return value, ParamEqual(variable, c.Value, value)
+	case strings.HasPrefix(variable, "performance_schema_consumer_"):
+		var strSql = "select * from performance_schema.setup_consumers where name = ?"
+		consumer := operator.DoQueryParseConsumers(strSql, strings.TrimPrefix(variable, "performance_schema_consumer_"))
+		return consumer.Enabled, ParamEqual(variable, c.Value, consumer.Enabled)
+	case variable == "performance_schema_instrument":
+		return instrumentValue(operator, c.Value)
+	case variable == "plugin_load" || variable == "plugin_load_add":
+		return pluginValue(operator, c.Value)
+	case variable == "federated":
+		// 启用FEDERATED引擎的启动参数, 按 show engines 的Support判断
+		support := strings.ToUpper(operator.DoQueryParseSingleValue("select support from information_schema.engines where engine = 'FEDERATED'"))
+		value := "OFF"
+		if support == "YES" || support == "DEFAULT" {
+			value = "ON"
+		}
+		return value, ParamEqual(variable, c.Value, value)
+	}
+	value := operator.DoQueryParseValue(fmt.Sprintf("show variables like '%s'", variable))
+	return value, ParamEqual(variable, c.Value, value)
+}
 
-				if value != baseValue {
-					log.Println(fmt.Sprintf("[实例 %s]参数：%s 基准值为：%s,实际值为：%s", TargetSocket, configuration[i].Name, configuration[i].Value, value))
-				}
-			case "default-time-zone":
-				configuration[i].Name = "time_zone"
-				fallthrough
-			default:
-				if strings.Contains(configuration[i].Name, "performance-schema-consumer") {
-					strSql = fmt.Sprintf("select * from performance_schema.setup_consumers where name = ?")
-					index := strings.Index(configuration[i].Name, "consumer")
-					args := strings.ReplaceAll(configuration[i].Name[index+9:], "-", "_")
-					consumer := ClusterParameter.DoQueryParseConsumers(strSql, args)
-					if consumer.Enabled == "YES" {
-						consumer.Enabled = "on"
-					} else if consumer.Enabled == "NO" {
-						consumer.Enabled = "off"
-					}
-
-					if consumer.Enabled != configuration[i].Value {
-						log.Println(fmt.Sprintf("[实例 %s]参数：%s 基准值为：%s,实际值为：%s", TargetSocket, configuration[i].Name, configuration[i].Value, consumer.Enabled))
-					}
-				} else {
-					strSql = fmt.Sprintf("show variables like '%s'", configuration[i].Name)
-					value := strings.ToLower(ClusterParameter.DoQueryParseValue(strSql))
-					baseValue := strings.ToLower(configuration[i].Value)
-					if value == "on" {
-						value = "1"
-					} else if value == "off" {
-						value = "0"
-					} else if value == "" {
-						value = "''"
-					}
-
-					if baseValue == "on" {
-						baseValue = "1"
-					} else if baseValue == "off" {
-						baseValue = "0"
-					}
-					if value != baseValue {
-						log.Println(fmt.Sprintf("[实例 %s]参数：%s 基准值为：%s,实际值为：%s", TargetSocket, configuration[i].Name, configuration[i].Value, value))
-					}
-				}
+// instrumentValue performance-schema-instrument 的值为 名称模式=ON|OFF|COUNTED, 匹配的instrument全部符合时一致
+func instrumentValue(operator mapper.SqlScaleOperator, baseline string) (string, bool) {
+	kv := strings.SplitN(unquoteParam(baseline), "=", 2)
+	if len(kv) != 2 {
+		return "", false
+	}
+	pattern, expect := strings.ReplaceAll(strings.TrimSpace(kv[0]), "*", "%"), strings.ToUpper(strings.TrimSpace(kv[1]))
+	if b, ok := boolValues[strings.ToLower(expect)]; ok {
+		expect = map[string]string{"1": "ON", "0": "OFF"}[b]
+	}
+	_, rows, err := operator.DoQueryParseRows(fmt.Sprintf("select enabled, timed from performance_schema.setup_instruments where name like %s", quoteValue(pattern)))
+	if err != nil || len(rows) == 0 {
+		return "", false
+	}
+	counts := make(map[string]int)
+	for _, row := range rows {
+		state := "OFF"
+		if row[0] == "YES" && row[1] == "YES" {
+			state = "ON"
+		} else if row[0] == "YES" {
+			state = "COUNTED"
+		}
+		counts[state]++
+	}
+	var states []string
+	for _, state := range []string{"ON", "COUNTED", "OFF"} {
+		if counts[state] > 0 {
+			states = append(states, fmt.Sprintf("%s(%d)", state, counts[state]))
+		}
+	}
+	return fmt.Sprintf("%s=%s", pattern, strings.Join(states, ",")), len(counts) == 1 && counts[expect] > 0
+}
+
+// pluginValue plugin-load 的值为 分号分隔的 名称=库文件 或 库文件, 全部插件为ACTIVE时一致
+func pluginValue(operator mapper.SqlScaleOperator, baseline string) (string, bool) {
+	var loaded []string
+	equal := true
+	for _, plugin := range strings.Split(unquoteParam(baseline), ";") {
+		if plugin = strings.TrimSpace(plugin); plugin == "" {
+			continue
+		}
+		condition := fmt.Sprintf("plugin_library = %s", quoteValue(plugin))
+		if kv := strings.SplitN(plugin, "=", 2); len(kv) == 2 {
+			condition = fmt.Sprintf("plugin_name = %s", quoteValue(kv[0]))
+		}
+		if operator.DoQueryParseSingleValue(fmt.Sprintf("select plugin_status from information_schema.plugins where %s limit 1", condition)) == "ACTIVE" {
+			loaded = append(loaded, plugin)
+		} else {
+			equal = false
+		}
+	}
+	return strings.Join(loaded, ";"), equal
+}
+
+// ReportOptions -a 的选项: json/csv/html 为报告格式, apply 逐条确认后执行可以在线修改的语句
+type ReportOptions struct {
+	Format string
+	Apply  bool
+}
+
+// ParseReportOptions 解析 "html,apply" 形式的选项
+func ParseReportOptions(options string) (ReportOptions, error) {
+	var o ReportOptions
+	for _, option := range strings.Split(options, ",") {
+		switch option = strings.TrimSpace(option); option {
+		case "":
+		case "json", "csv", "html":
+			o.Format = option
+		case "apply":
+			o.Apply = true
+		default:
+			return o, fmt.Errorf("%s: 未知的选项", option)
+		}
+	}
+	return o, nil
+}
+
+// variableScope 在 session_variables 中存在的参数有会话级作用范围
+func variableScope(operator mapper.SqlScaleOperator) func(variable string) string {
+	return func(variable string) string {
+		var strSql = fmt.Sprintf("select count(*) from performance_schema.session_variables where variable_name = %s", quoteValue(variable))
+		if operator.DoQueryParseSingleValue(strSql) == "1" {
+			return ScopeSession
+		}
+		return ScopeGlobal
+	}
+}
+
+// writeDriftReport 按格式输出报告到 -o 指定的文件, 没有指定时输出到标准输出; 没有指定格式时输出修复语句
+func writeDriftReport(report DriftReport, format string, outFile string) error {
+	var out io.Writer = os.Stdout
+	if outFile != "" {
+		f, err := os.Create(outFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	switch format {
+	case "json":
+		return report.WriteJson(out)
+	case "csv":
+		return report.WriteCsv(out)
+	case "html":
+		return report.WriteHtml(out)
+	}
+	report.WriteRemediation(out)
+	return nil
+}
+
+// paramNode 被检查的一个实例
+type paramNode struct {
+	Name     string
+	Operator mapper.SqlScaleOperator
+	Err      error
+}
+
+// paramNodes 从dbscale拓扑读取全部dataserver并直连检查, 不是dbscale集群时只检查 -ti
+func paramNodes() ([]*paramNode, bool) {
+	cluster, err := topology.Load(ClusterParameter)
+	if err != nil {
+		log.Println(fmt.Sprintf("读取集群拓扑失败, 只检查实例 %s: %s", TargetSocket, err))
+		return []*paramNode{{Name: TargetSocket, Operator: ClusterParameter}}, false
+	}
+	var nodes []*paramNode
+	for _, s := range cluster.DataServers(topology.RoleMaster, topology.RoleSlave) {
+		node := &paramNode{Name: s.Socket()}
+		conn, err := mapper.OpenSourceConn(TargetUserInfo, s.Socket(), "information_schema")
+		if err != nil {
+			node.Err = err
+		} else {
+			node.Operator = &conn
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, true
+}
+
+// splitConfiguration 拆分为mysql参数和dbscale参数
+func splitConfiguration(configuration []entity.Configuration) (mysql []entity.Configuration, dbscale []entity.Configuration) {
+	for _, c := range configuration {
+		if c.Type == "dbscale" {
+			dbscale = append(dbscale, c)
+		} else {
+			mysql = append(mysql, c)
+		}
+	}
+	return
+}
+
+// checkNodes 并发检查各节点的参数, 返回各节点的结果、全部参数和合并后的报告
+func checkNodes(template string, nodes []*paramNode, configuration []entity.Configuration) (map[string][]ParamResult, map[string]map[string]string, DriftReport) {
+	results := make(map[string][]ParamResult)
+	variables := make(map[string]map[string]string)
+	reports := make([]DriftReport, len(nodes))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		if node.Err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, node *paramNode) {
+			defer wg.Done()
+			r := checkParams(node.Operator, configuration)
+			reports[i] = NewDriftReport(template, node.Name, r, variableScope(node.Operator))
+			all, err := captureVariables(node.Operator, "show global variables")
+			if err != nil {
+				log.Println(fmt.Sprintf("[实例 %s]读取全部参数失败, 历史中只记录模板中的参数: %s", node.Name, err))
 			}
+			mu.Lock()
+			results[node.Name] = r
+			if all != nil {
+				variables[node.Name] = all
+			}
+			mu.Unlock()
+		}(i, node)
+	}
+	wg.Wait()
+	report := DriftReport{Template: template, GeneratedAt: time.Now()}
+	for _, r := range reports {
+		report.Checked += r.Checked
+		report.Entries = append(report.Entries, r.Entries...)
+	}
+	return results, variables, report
+}
+
+// applyRemediation 逐条确认后在参数所在的节点上执行在线修改的语句, 静态参数只能修改my.cnf后重启
+func applyRemediation(operators map[string]mapper.SqlScaleOperator, report DriftReport) {
+	reader := bufio.NewReader(os.Stdin)
+	for _, e := range report.Entries {
+		if !e.Dynamic {
+			log.Println(fmt.Sprintf("[实例 %s]参数 %s 不能在线修改, 需要修改my.cnf后重启: %s", e.Node, e.Parameter, e.Remediation))
+			continue
+		}
+		if !confirm(reader, os.Stdout, fmt.Sprintf("[实例 %s]执行 %s", e.Node, e.Remediation)) {
+			log.Println(fmt.Sprintf("[实例 %s]跳过参数 %s", e.Node, e.Parameter))
+			continue
 		}
+		if err := operators[e.Node].DoExec(e.Remediation); err != nil {
+			log.Println(fmt.Sprintf("[实例 %s]修改参数 %s 失败: %s", e.Node, e.Parameter, err))
+			continue
+		}
+		log.Println(fmt.Sprintf("[实例 %s]参数 %s 已修改为 %s", e.Node, e.Parameter, e.Baseline))
 	}
+}
 
+// DoCheckParameter 检查参数并输出不一致的参数, dbscale集群检查全部dataserver并输出参数×节点矩阵,
+// options 为报告格式和apply, outFile 为报告文件
+func DoCheckParameter(template string, outFile string, options string) {
 	defer func() {
-		BaseParameter.DoClose()
+		if BaseParameter != nil {
+			BaseParameter.DoClose()
+		}
 		ClusterParameter.DoClose()
 	}()
+
+	o, err := ParseReportOptions(options)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	configuration, err := Baseline.Baseline(template)
+	if err != nil {
+		log.Println(fmt.Sprintf("读取参数基准失败: %s", err))
+		return
+	}
+	nodes, isDbscale := paramNodes()
+	var dbscale []entity.Configuration
+	if isDbscale {
+		// dbscale参数只在dbscale上检查, mysql参数在每个dataserver上检查
+		configuration, dbscale = splitConfiguration(configuration)
+		defer func() {
+			for _, node := range nodes {
+				if node.Operator != nil {
+					node.Operator.DoClose()
+				}
+			}
+		}()
+	}
+	results, variables, report := checkNodes(template, nodes, configuration)
+	operators := make(map[string]mapper.SqlScaleOperator)
+	names := make([]string, 0, len(nodes)+1)
+	failed := make(map[string]string)
+	if len(dbscale) > 0 {
+		proxy := checkParams(ClusterParameter, dbscale)
+		r := NewDriftReport(template, TargetSocket, proxy, variableScope(ClusterParameter))
+		report.Checked += r.Checked
+		report.Entries = append(r.Entries, report.Entries...)
+		results[TargetSocket] = proxy
+		if all, err := captureVariables(ClusterParameter, "dbscale show options"); err != nil {
+			log.Println(fmt.Sprintf("[实例 %s]读取全部dbscale参数失败, 历史中只记录模板中的参数: %s", TargetSocket, err))
+		} else {
+			variables[TargetSocket] = all
+		}
+		operators[TargetSocket] = ClusterParameter
+		names = append(names, TargetSocket)
+	}
+	for _, node := range nodes {
+		names = append(names, node.Name)
+		if node.Err != nil {
+			log.Println(fmt.Sprintf("[实例 %s]连接失败, 没有检查参数: %s", node.Name, node.Err))
+			failed[node.Name] = node.Err.Error()
+			continue
+		}
+		operators[node.Name] = node.Operator
+	}
+	for _, name := range names {
+		for _, r := range results[name] {
+			if r.Equal {
+				continue
+			}
+			actual := r.Actual
+			if actual == "" {
+				actual = "''"
+			}
+			log.Println(fmt.Sprintf("[实例 %s]参数：%s 基准值为：%s,实际值为：%s", name, r.Name, r.Baseline, actual))
+		}
+	}
+	if err := AppendParamHistory(ParamHistoryPath(TargetSocket), NewParamRun(template, names, results, variables)); err != nil {
+		log.Println(fmt.Sprintf("保存参数检查记录失败: %s", err))
+	}
+	if isDbscale {
+		m := NewParamMatrix(names, results)
+		m.Failed = failed
+		report.Matrix = m
+		if o.Format == "" {
+			m.WriteText(os.Stdout)
+		}
+	}
+	if len(report.Entries) == 0 && (report.Matrix == nil || len(report.Matrix.Differs()) == 0) {
+		log.Println(fmt.Sprintf("%d 个实例的参数与模板 %s 一致", len(names), template))
+		return
+	}
+	if err := writeDriftReport(report, o.Format, outFile); err != nil {
+		log.Println(fmt.Sprintf("输出参数报告失败: %s", err))
+	}
+	if o.Apply {
+		applyRemediation(operators, report)
+	}
 }
@@ -0,0 +1,580 @@
+package check
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"giogii/src/gtid"
+	"giogii/src/heartbeat"
+	"giogii/src/mapper"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+分块数据校验: 按主键把每张表切分为若干分块, 每个分块在同一个GTID点比较: 先暂停灾备集群的SQL线程, 在主集群短暂的全局读锁下
+开启一致性快照并读取GTID(见 snapshotSqls), 在快照中计算分块的行数和 BIT_XOR(CRC32(整行)), 再让灾备集群回放到该GTID后停止(SQL_AFTER_GTIDS),
+计算同一分块后恢复SQL线程. 两边不一致时在新的GTID点再比较确认, 仍不一致的分块记录为差异.
+每个分块完成后进度写入 checksum_<灾备集群ip_port>.json, 中断后再次执行从上次的位置继续.
+*/
+
+// defaultWaitTimeout 等待灾备集群回放到主集群GTID的默认超时时间
+const defaultWaitTimeout = 10 * time.Minute
+
+// 不参与校验和比较的系统库
+var checksumSkipSchemas = []string{"mysql", "information_schema", "performance_schema", "sys", "dbscale_tmp"}
+
+// ChecksumChunk 一个分块, Lower 为上一个分块的上界(不包含), Upper 为本分块的上界(包含), 为空表示不限
+type ChecksumChunk struct {
+	Index       int      `json:"index"`
+	Lower       []string `json:"lower,omitempty"`
+	Upper       []string `json:"upper,omitempty"`
+	SourceCount int64    `json:"source_count"`
+	SourceCrc   string   `json:"source_crc"`
+	TargetCount int64    `json:"target_count"`
+	TargetCrc   string   `json:"target_crc"`
+	// Repaired 已经通过sync修复
+	Repaired bool `json:"repaired,omitempty"`
+}
+
+// ChecksumTable 一张表的校验进度, Next 为下一个分块的下界
+type ChecksumTable struct {
+	Schema string          `json:"schema"`
+	Table  string          `json:"table"`
+	Keys   []string        `json:"keys"`
+	Chunks int             `json:"chunks"`
+	Rows   int64           `json:"rows"`
+	Next   []string        `json:"next,omitempty"`
+	Done   bool            `json:"done"`
+	Diffs  []ChecksumChunk `json:"diffs,omitempty"`
+}
+
+// Name 库名.表名
+func (t *ChecksumTable) Name() string {
+	return fmt.Sprintf("%s.%s", t.Schema, t.Table)
+}
+
+// ChecksumState 校验进度文件
+type ChecksumState struct {
+	Path      string           `json:"-"`
+	Target    string           `json:"target"`
+	StartedAt time.Time        `json:"started_at"`
+	Tables    []*ChecksumTable `json:"tables"`
+}
+
+// ChecksumOptions -a 逗号分隔: chunk=N 每个分块的行数, lag=时长 灾备集群延迟超过该值时暂停, restart 丢弃进度重新校验
+type ChecksumOptions struct {
+	ChunkSize int
+	MaxLag    time.Duration
+	Restart   bool
+	// Retries 分块不一致时的重试次数
+	Retries int
+	// WaitTimeout 等待灾备集群回放到主集群GTID的超时时间
+	WaitTimeout time.Duration
+}
+
+// ParseChecksumOptions 解析 -a 参数
+func ParseChecksumOptions(options string) (ChecksumOptions, error) {
+	o := ChecksumOptions{ChunkSize: 1000, MaxLag: 10 * time.Second, Retries: 3, WaitTimeout: defaultWaitTimeout}
+	for _, option := range strings.Split(options, ",") {
+		option = strings.TrimSpace(option)
+		kv := strings.SplitN(option, "=", 2)
+		var err error
+		switch kv[0] {
+		case "":
+		case "restart":
+			o.Restart = true
+		case "chunk":
+			if len(kv) == 2 {
+				o.ChunkSize, err = strconv.Atoi(kv[1])
+			}
+			if err == nil && o.ChunkSize <= 0 {
+				err = fmt.Errorf("分块行数必须大于0")
+			}
+		case "lag":
+			if len(kv) == 2 {
+				o.MaxLag, err = time.ParseDuration(kv[1])
+			}
+		default:
+			err = fmt.Errorf("未知的选项")
+		}
+		if err != nil {
+			return o, fmt.Errorf("%s: %s", option, err)
+		}
+	}
+	return o, nil
+}
+
+// ChecksumStatePath 每个灾备集群一个校验进度文件
+func ChecksumStatePath(targetSocket string) string {
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(targetSocket)
+	return fmt.Sprintf("./checksum_%s.json", name)
+}
+
+// LoadChecksumState 读取校验进度, 文件不存在时返回空进度
+func LoadChecksumState(path string, target string) (*ChecksumState, error) {
+	state := &ChecksumState{Path: path, Target: target, StartedAt: time.Now()}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("解析校验进度文件 %s 失败: %s", path, err)
+	}
+	if state.Target != target {
+		return nil, fmt.Errorf("校验进度文件 %s 属于集群 %s, 不是 %s", path, state.Target, target)
+	}
+	return state, nil
+}
+
+// Save 先写临时文件再rename, 避免进程中断时进度文件损坏
+func (s *ChecksumState) Save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+// table 进度中的表, 不存在时追加
+func (s *ChecksumState) table(schema string, name string) *ChecksumTable {
+	for _, t := range s.Tables {
+		if t.Schema == schema && t.Table == name {
+			return t
+		}
+	}
+	t := &ChecksumTable{Schema: schema, Table: name}
+	s.Tables = append(s.Tables, t)
+	return t
+}
+
+func quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func quoteValue(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+func quoteRow(values []string, quote func(string) string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = quote(v)
+	}
+	return "(" + strings.Join(quoted, ", ") + ")"
+}
+
+// chunkWhere 分块的条件, 多列主键使用行比较
+func chunkWhere(keys []string, lower []string, upper []string) string {
+	var conds []string
+	if len(lower) > 0 {
+		conds = append(conds, fmt.Sprintf("%s > %s", quoteRow(keys, quoteIdent), quoteRow(lower, quoteValue)))
+	}
+	if len(upper) > 0 {
+		conds = append(conds, fmt.Sprintf("%s <= %s", quoteRow(keys, quoteIdent), quoteRow(upper, quoteValue)))
+	}
+	if len(conds) == 0 {
+		return "1=1"
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// checksumSql 分块的行数和校验值, NULL单独记录避免与空字符串相同
+func checksumSql(schema string, table string, columns []string, where string) string {
+	quoted := make([]string, len(columns))
+	nulls := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = quoteIdent(c)
+		nulls[i] = fmt.Sprintf("ISNULL(%s)", quoteIdent(c))
+	}
+	row := fmt.Sprintf("CONCAT_WS('#', %s, CONCAT(%s))", strings.Join(quoted, ", "), strings.Join(nulls, ", "))
+	return fmt.Sprintf("SELECT COUNT(*), COALESCE(LOWER(CONV(BIT_XOR(CAST(CRC32(%s) AS UNSIGNED)), 10, 16)), 0) FROM %s.%s WHERE %s",
+		row, quoteIdent(schema), quoteIdent(table), where)
+}
+
+// boundarySql 从下界开始第size行的主键, 作为分块的上界
+func boundarySql(schema string, table string, keys []string, lower []string, size int) string {
+	quoted := make([]string, len(keys))
+	for i, k := range keys {
+		quoted[i] = quoteIdent(k)
+	}
+	return fmt.Sprintf("SELECT %s FROM %s.%s WHERE %s ORDER BY %s LIMIT %d, 1", strings.Join(quoted, ", "), quoteIdent(schema), quoteIdent(table),
+		chunkWhere(keys, lower, nil), strings.Join(quoted, ", "), size-1)
+}
+
+// matchTable filter 逗号分隔的库名或库名.表名, 支持*通配符, !开头的为排除项, 只有排除项或为空时包含其余全部表
+func matchTable(filter string, schema string, table string) bool {
+	included, hasInclude := false, false
+	for _, f := range strings.Split(filter, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		exclude := strings.HasPrefix(f, "!")
+		f = strings.TrimPrefix(f, "!")
+		matched := matchName(f, schema) || matchName(f, schema+"."+table)
+		if exclude {
+			if matched {
+				return false
+			}
+			continue
+		}
+		hasInclude = true
+		included = included || matched
+	}
+	return included || !hasInclude
+}
+
+func matchName(pattern string, name string) bool {
+	matched, err := path.Match(pattern, name)
+	return err == nil && matched
+}
+
+// skipSchemasSql 系统库, 用于 not in
+func skipSchemasSql() string {
+	skip := make([]string, len(checksumSkipSchemas))
+	for i, s := range checksumSkipSchemas {
+		skip[i] = quoteValue(s)
+	}
+	return strings.Join(skip, ", ")
+}
+
+// checksumTables 主集群上需要校验的表
+func checksumTables(operator mapper.SqlScaleOperator, filter string) ([][2]string, error) {
+	_, rows, err := operator.DoQueryParseRows(fmt.Sprintf("select table_schema, table_name from information_schema.tables where table_type = 'BASE TABLE' and table_schema not in (%s) order by table_schema, table_name",
+		skipSchemasSql()))
+	if err != nil {
+		return nil, err
+	}
+	var tables [][2]string
+	for _, row := range rows {
+		if matchTable(filter, row[0], row[1]) {
+			tables = append(tables, [2]string{row[0], row[1]})
+		}
+	}
+	return tables, nil
+}
+
+// tableKeys 主键列, 没有主键时返回空
+func tableKeys(operator mapper.SqlScaleOperator, schema string, table string) []string {
+	return operator.DoQueryParseStrings("select column_name from information_schema.key_column_usage where table_schema = ? and table_name = ? and constraint_name = 'PRIMARY' order by ordinal_position", schema, table)
+}
+
+// tableColumns 表的全部列
+func tableColumns(operator mapper.SqlScaleOperator, schema string, table string) []string {
+	return operator.DoQueryParseStrings("select column_name from information_schema.columns where table_schema = ? and table_name = ? order by ordinal_position", schema, table)
+}
+
+// chunkChecksum 计算一个分块的行数和校验值
+func chunkChecksum(operator mapper.SqlScaleOperator, sqlStr string) (int64, string, error) {
+	_, rows, err := operator.DoQueryParseNullRows(sqlStr)
+	if err != nil {
+		return 0, "", err
+	}
+	return checksumResult(sqlStr, rows)
+}
+
+func checksumResult(sqlStr string, rows [][]sql.NullString) (int64, string, error) {
+	if len(rows) != 1 || len(rows[0]) != 2 {
+		return 0, "", fmt.Errorf("校验结果为空: %s", sqlStr)
+	}
+	count, err := strconv.ParseInt(rows[0][0].String, 10, 64)
+	return count, rows[0][1].String, err
+}
+
+// executedGtid 实例已执行的GTID, 经dbscale时show master status可能没有GTID, 从show slave status读取
+func executedGtid(operator mapper.SqlScaleOperator) string {
+	executed := operator.DoQueryParseMaster("show master status").ExecutedGtidSet
+	if executed == "" {
+		executed = operator.DoQueryParseSlave("show slave status").ExecutedGtidSet
+	}
+	return executed
+}
+
+// slaveExecutedGtid 灾备集群已执行的GTID
+func slaveExecutedGtid() string {
+	return executedGtid(SlaveSqlScaleOperator)
+}
+
+// waitGtid 等待实例回放到主集群的GTID
+func waitGtid(operator mapper.SqlScaleOperator, masterGtid string, timeout time.Duration) error {
+	masterSet, err := gtid.Parse(masterGtid)
+	if err != nil {
+		return fmt.Errorf("解析主集群GTID失败: %s", err)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		slaveSet, err := gtid.Parse(executedGtid(operator))
+		if err != nil {
+			return fmt.Errorf("解析备集群GTID失败: %s", err)
+		}
+		missing := masterSet.Subtract(slaveSet)
+		if missing.IsEmpty() {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("等待回放超时, 缺少 %d 个事务", missing.Count())
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// pauseSlaveSqlThread 暂停灾备集群的SQL线程, 返回的函数清除UNTIL条件并恢复SQL线程
+func pauseSlaveSqlThread() (func(), error) {
+	if status := SlaveSqlScaleOperator.DoQueryParseSlave("show slave status"); status.SlaveSQLRunning != "Yes" {
+		return nil, fmt.Errorf("灾备集群SQL线程未运行(Slave_SQL_Running: %s), 无法固定比较的GTID点", status.SlaveSQLRunning)
+	}
+	if err := SlaveSqlScaleOperator.DoExec("stop slave sql_thread"); err != nil {
+		return nil, err
+	}
+	return func() {
+		// 未到达UNTIL位置时SQL线程仍在运行, 先停止以清除UNTIL条件
+		SlaveSqlScaleOperator.DoExec("stop slave sql_thread")
+		if err := SlaveSqlScaleOperator.DoExec("start slave sql_thread"); err != nil {
+			log.Println(fmt.Sprintf("恢复灾备集群SQL线程失败, 需要手动执行 start slave sql_thread: %s", err))
+		}
+	}, nil
+}
+
+// untilSlaveGtid 灾备集群回放到 masterGtid 后停止SQL线程
+func untilSlaveGtid(masterGtid string, timeout time.Duration) error {
+	masterSet, err := gtid.Parse(masterGtid)
+	if err != nil {
+		return fmt.Errorf("解析主集群GTID失败: %s", err)
+	}
+	if err := SlaveSqlScaleOperator.DoExec(fmt.Sprintf("start slave sql_thread until sql_after_gtids = '%s'", masterSet)); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		status := SlaveSqlScaleOperator.DoQueryParseSlave("show slave status")
+		if status.SlaveSQLRunning != "Yes" {
+			if status.LastSQLErrno != nil && *status.LastSQLErrno != 0 {
+				return fmt.Errorf("灾备集群SQL线程错误: %s", status.LastSQLError)
+			}
+			slaveSet, err := gtid.Parse(slaveExecutedGtid())
+			if err != nil {
+				return fmt.Errorf("解析备集群GTID失败: %s", err)
+			}
+			if missing := masterSet.Subtract(slaveSet); !missing.IsEmpty() {
+				return fmt.Errorf("灾备集群SQL线程已停止, 缺少 %d 个事务", missing.Count())
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("等待灾备集群回放到 %s 超时", masterSet)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// snapshotSqls 与 mysqldump --single-transaction --source-data 相同, 在全局读锁下开启一致性快照并读取GTID,
+// 快照和GTID之间没有提交的事务, 读取GTID后立即释放读锁
+var snapshotSqls = []string{
+	"flush tables with read lock",
+	"set session transaction isolation level repeatable read",
+	"start transaction with consistent snapshot",
+	"show master status",
+	"unlock tables",
+}
+
+// sourceSnapshot 在主集群的一致性快照事务中读取快照对应的GTID和 queries 的结果
+func sourceSnapshot(queries []string) (string, [][][]sql.NullString, error) {
+	sqls := append(append([]string{}, snapshotSqls...), queries...)
+	results, err := MasterSqlScaleOperator.DoQueryInSession(append(sqls, "commit"))
+	if err != nil {
+		return "", nil, err
+	}
+	status := results[3]
+	if len(status) == 0 || len(status[0]) < 5 || status[0][4].String == "" {
+		return "", nil, fmt.Errorf("主集群show master status没有GTID")
+	}
+	return strings.ReplaceAll(status[0][4].String, "\n", ""), results[len(snapshotSqls) : len(snapshotSqls)+len(queries)], nil
+}
+
+// pinnedRead 在同一个GTID点读取主备集群: 暂停灾备集群SQL线程后在主集群一致性快照中读取GTID和 queries 的结果,
+// 灾备集群回放到该GTID后停止, 以GTID和主集群的结果执行 target 后恢复SQL线程
+func pinnedRead(queries []string, timeout time.Duration, target func(executed string, source [][][]sql.NullString) error) error {
+	resume, err := pauseSlaveSqlThread()
+	if err != nil {
+		return err
+	}
+	defer resume()
+	executed, source, err := sourceSnapshot(queries)
+	if err != nil {
+		return err
+	}
+	if err := untilSlaveGtid(executed, timeout); err != nil {
+		return err
+	}
+	return target(executed, source)
+}
+
+// throttle 灾备集群延迟超过maxLag时暂停, 配置心跳表时按心跳延迟, 否则按Seconds_Behind_Master
+func throttle(maxLag time.Duration, monitor *heartbeat.Monitor) {
+	for {
+		var lag time.Duration
+		if monitor != nil {
+			l, err := monitor.Lag(time.Now())
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			lag = l
+		} else {
+			status := SlaveSqlScaleOperator.DoQueryParseSlave("show slave status")
+			if !status.SecondsBehindMaster.Valid {
+				return
+			}
+			lag = time.Duration(status.SecondsBehindMaster.Int64) * time.Second
+		}
+		if lag <= maxLag {
+			return
+		}
+		log.Println(fmt.Sprintf("灾备集群延迟 %s 超过 %s, 暂停校验", lag, maxLag))
+		time.Sleep(time.Second)
+	}
+}
+
+// checksumChunk 在同一个GTID点校验一个分块, 两边不一致时在新的GTID点重新比较确认, options.Retries 次后仍不一致为差异
+func checksumChunk(t *ChecksumTable, columns []string, chunk *ChecksumChunk, options ChecksumOptions) error {
+	sqlStr := checksumSql(t.Schema, t.Table, columns, chunkWhere(t.Keys, chunk.Lower, chunk.Upper))
+	for i := 0; ; i++ {
+		err := pinnedRead([]string{sqlStr}, options.WaitTimeout, func(_ string, source [][][]sql.NullString) (err error) {
+			if chunk.SourceCount, chunk.SourceCrc, err = checksumResult(sqlStr, source[0]); err != nil {
+				return err
+			}
+			chunk.TargetCount, chunk.TargetCrc, err = chunkChecksum(SlaveSqlScaleOperator, sqlStr)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if chunk.SourceCount == chunk.TargetCount && chunk.SourceCrc == chunk.TargetCrc || i >= options.Retries {
+			return nil
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// checksumTable 从上次的位置继续校验一张表
+func checksumTable(state *ChecksumState, t *ChecksumTable, options ChecksumOptions, monitor *heartbeat.Monitor) error {
+	columns := tableColumns(MasterSqlScaleOperator, t.Schema, t.Table)
+	if len(columns) == 0 {
+		return fmt.Errorf("读取表 %s 的列失败", t.Name())
+	}
+	if t.Chunks == 0 {
+		t.Keys = tableKeys(MasterSqlScaleOperator, t.Schema, t.Table)
+		if len(t.Keys) == 0 {
+			log.Println(fmt.Sprintf("表 %s 没有主键, 整表作为一个分块", t.Name()))
+		}
+	}
+	for !t.Done {
+		throttle(options.MaxLag, monitor)
+		chunk := ChecksumChunk{Index: t.Chunks, Lower: t.Next}
+		if len(t.Keys) > 0 {
+			_, rows, err := MasterSqlScaleOperator.DoQueryParseRows(boundarySql(t.Schema, t.Table, t.Keys, t.Next, options.ChunkSize))
+			if err != nil {
+				return err
+			}
+			if len(rows) > 0 {
+				chunk.Upper = rows[0]
+			}
+		}
+		if err := checksumChunk(t, columns, &chunk, options); err != nil {
+			return fmt.Errorf("校验表 %s 第%d个分块失败: %s", t.Name(), chunk.Index, err)
+		}
+		if chunk.SourceCount != chunk.TargetCount || chunk.SourceCrc != chunk.TargetCrc {
+			log.Println(fmt.Sprintf("表 %s 第%d个分块不一致, 主集群 %d行, 灾备集群 %d行, 条件: %s", t.Name(), chunk.Index,
+				chunk.SourceCount, chunk.TargetCount, chunkWhere(t.Keys, chunk.Lower, chunk.Upper)))
+			t.Diffs = append(t.Diffs, chunk)
+		}
+		t.Chunks++
+		t.Rows += chunk.SourceCount
+		t.Next = chunk.Upper
+		t.Done = chunk.Upper == nil
+		if err := state.Save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DoChecksum 按主键分块校验主备集群的数据, filter 逗号分隔的库名或库名.表名, heartbeatTable 不为空时按心跳延迟限速
+func DoChecksum(targetSocket string, filter string, heartbeatTable string, options string) {
+	defer func() {
+		MasterSqlScaleOperator.DoClose()
+		SlaveSqlScaleOperator.DoClose()
+	}()
+
+	o, err := ParseChecksumOptions(options)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	path := ChecksumStatePath(targetSocket)
+	if o.Restart {
+		os.Remove(path)
+	}
+	state, err := LoadChecksumState(path, targetSocket)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	tables, err := checksumTables(MasterSqlScaleOperator, filter)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var monitor *heartbeat.Monitor
+	if heartbeatTable != "" {
+		monitor = heartbeat.NewMonitor(MasterSqlScaleOperator, SlaveSqlScaleOperator, heartbeatTable)
+	}
+
+	var checked []*ChecksumTable
+	for _, name := range tables {
+		t := state.table(name[0], name[1])
+		checked = append(checked, t)
+		if t.Done {
+			continue
+		}
+		if t.Chunks > 0 {
+			log.Println(fmt.Sprintf("表 %s 从第%d个分块继续校验", t.Name(), t.Chunks))
+		}
+		if err := checksumTable(state, t, o, monitor); err != nil {
+			log.Println(err)
+			log.Println(fmt.Sprintf("校验中断, 进度已保存到 %s, 再次执行从中断的位置继续", path))
+			return
+		}
+		log.Println(fmt.Sprintf("表 %s 校验完成, %d个分块, %d行, 不一致分块 %d个", t.Name(), t.Chunks, t.Rows, len(t.Diffs)))
+	}
+
+	var diffs int
+	for _, t := range checked {
+		if len(t.Diffs) == 0 {
+			continue
+		}
+		fmt.Printf("%s 不一致分块 %d/%d:\n", t.Name(), len(t.Diffs), t.Chunks)
+		for _, c := range t.Diffs {
+			fmt.Printf("  #%d %s 主集群 %d行 %s, 灾备集群 %d行 %s\n", c.Index, chunkWhere(t.Keys, c.Lower, c.Upper),
+				c.SourceCount, c.SourceCrc, c.TargetCount, c.TargetCrc)
+		}
+		diffs++
+	}
+	if diffs == 0 {
+		fmt.Printf("%d张表主备集群数据一致\n", len(checked))
+	} else {
+		fmt.Printf("%d张表中 %d张表存在不一致的分块, 结果保存在 %s\n", len(checked), diffs, path)
+	}
+}
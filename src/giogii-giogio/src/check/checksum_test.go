@@ -0,0 +1,235 @@
+package check
+
+import (
+	"database/sql"
+	"fmt"
+	"giogii/src/entity"
+	"giogii/src/gtid"
+	"giogii/src/mapper"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChecksum(t *testing.T) {
+	keys := []string{"id", "k`2"}
+	if where := chunkWhere(keys, []string{"10", "a'b"}, []string{"20", "c"}); where != "(`id`, `k``2`) > ('10', 'a\\'b') AND (`id`, `k``2`) <= ('20', 'c')" {
+		t.Fatalf("unexpected where %s", where)
+	}
+	if where := chunkWhere(nil, nil, nil); where != "1=1" {
+		t.Fatalf("unexpected where %s", where)
+	}
+	if sqlStr := boundarySql("db", "t", []string{"id"}, nil, 1000); sqlStr != "SELECT `id` FROM `db`.`t` WHERE 1=1 ORDER BY `id` LIMIT 999, 1" {
+		t.Fatalf("unexpected boundary sql %s", sqlStr)
+	}
+	if sqlStr := checksumSql("db", "t", []string{"id", "v"}, "1=1"); sqlStr != "SELECT COUNT(*), COALESCE(LOWER(CONV(BIT_XOR(CAST(CRC32(CONCAT_WS('#', `id`, `v`, CONCAT(ISNULL(`id`), ISNULL(`v`)))) AS UNSIGNED)), 10, 16)), 0) FROM `db`.`t` WHERE 1=1" {
+		t.Fatalf("unexpected checksum sql %s", sqlStr)
+	}
+	if !matchTable("db1, db2.t1", "db2", "t1") || matchTable("db1,db2.t1", "db2", "t2") || !matchTable("", "db3", "t") {
+		t.Fatal("unexpected table filter result")
+	}
+	if matchTable("db1,!db1.tmp_*", "db1", "tmp_log") || !matchTable("db1,!db1.tmp_*", "db1", "orders") || !matchTable("!db1", "db2", "t") || matchTable("!db1", "db1", "t") {
+		t.Fatal("unexpected table exclude result")
+	}
+
+	o, err := ParseChecksumOptions("chunk=500,lag=5s,restart")
+	if err != nil || o.ChunkSize != 500 || o.MaxLag != 5*time.Second || !o.Restart {
+		t.Fatalf("unexpected options %+v %v", o, err)
+	}
+	if _, err := ParseChecksumOptions("chunk=0"); err == nil {
+		t.Fatal("expect error for chunk=0")
+	}
+
+	// 进度落盘后从下一个分块继续
+	path := filepath.Join(t.TempDir(), "checksum.json")
+	state, err := LoadChecksumState(path, "127.0.0.1:16310")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := state.table("db", "t")
+	table.Keys, table.Chunks, table.Next = []string{"id"}, 3, []string{"3000"}
+	table.Diffs = append(table.Diffs, ChecksumChunk{Index: 1, Lower: []string{"1000"}, Upper: []string{"2000"}})
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadChecksumState(path, "127.0.0.1:16310")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed := loaded.table("db", "t"); resumed.Chunks != 3 || resumed.Next[0] != "3000" || len(resumed.Diffs) != 1 || len(loaded.Tables) != 1 {
+		t.Fatalf("unexpected resumed table %+v", resumed)
+	}
+	if _, err := LoadChecksumState(path, "127.0.0.1:16320"); err == nil {
+		t.Fatal("expect error for state of another cluster")
+	}
+}
+
+const fakeUuid = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+
+// fakeReplication 主集群每次读取后都提交一个新事务, 灾备集群的数据为已回放的GTID对应的版本
+type fakeReplication struct {
+	executed int64
+	applied  int64
+	running  bool
+	source   func(version int64) [][]sql.NullString
+	target   func(version int64) [][]sql.NullString
+}
+
+func (r *fakeReplication) write() {
+	r.executed++
+	if r.running {
+		r.applied = r.executed
+	}
+}
+
+func fakeRows(values ...string) []sql.NullString {
+	row := make([]sql.NullString, len(values))
+	for i, v := range values {
+		row[i] = sql.NullString{String: v, Valid: true}
+	}
+	return row
+}
+
+// fakeQuery 校验语句返回行数和行内容拼接的校验值, 其余语句返回全部行
+func fakeQuery(sqlStr string, rows [][]sql.NullString) [][]sql.NullString {
+	if !strings.HasPrefix(sqlStr, "SELECT COUNT(*)") {
+		return rows
+	}
+	var crc []string
+	for _, row := range rows {
+		for _, v := range row {
+			crc = append(crc, v.String)
+		}
+	}
+	return [][]sql.NullString{fakeRows(fmt.Sprint(len(rows)), strings.Join(crc, "/"))}
+}
+
+type fakeMaster struct {
+	mapper.SqlScaleOperator
+	r *fakeReplication
+}
+
+// DoQueryInSession 没有全局读锁时, 开启快照和读取GTID之间会提交一个事务, GTID领先于快照
+func (m *fakeMaster) DoQueryInSession(sqls []string) (results [][][]sql.NullString, err error) {
+	defer m.r.write()
+	locked := false
+	var snapshot int64
+	for _, sqlStr := range sqls {
+		switch {
+		case sqlStr == "flush tables with read lock":
+			locked = true
+		case sqlStr == "unlock tables":
+			locked = false
+		case sqlStr == "start transaction with consistent snapshot":
+			snapshot = m.r.executed
+			if !locked {
+				m.r.write()
+			}
+		case sqlStr == "show master status":
+			results = append(results, [][]sql.NullString{fakeRows("bin.000001", "4", "", "", fmt.Sprintf("%s:1-%d", fakeUuid, m.r.executed))})
+			continue
+		case strings.HasPrefix(sqlStr, "SELECT"):
+			results = append(results, fakeQuery(sqlStr, m.r.source(snapshot)))
+			continue
+		}
+		results = append(results, nil)
+	}
+	if locked {
+		return nil, fmt.Errorf("global read lock not released")
+	}
+	return results, nil
+}
+
+func (m *fakeMaster) DoQueryParseNullRows(sqlStr string) ([]string, [][]sql.NullString, error) {
+	defer m.r.write()
+	return nil, fakeQuery(sqlStr, m.r.source(m.r.executed)), nil
+}
+
+type fakeSlave struct {
+	mapper.SqlScaleOperator
+	r *fakeReplication
+}
+
+func (s *fakeSlave) DoExec(sqlStr string) error {
+	switch {
+	case sqlStr == "stop slave sql_thread":
+		s.r.running = false
+	case sqlStr == "start slave sql_thread":
+		s.r.running = true
+		s.r.applied = s.r.executed
+	case strings.HasPrefix(sqlStr, "start slave sql_thread until sql_after_gtids = "):
+		set, err := gtid.Parse(strings.Trim(strings.TrimPrefix(sqlStr, "start slave sql_thread until sql_after_gtids = "), "'"))
+		if err != nil {
+			return err
+		}
+		intervals := set.Intervals(fakeUuid)
+		s.r.applied = intervals[len(intervals)-1].Stop
+	default:
+		return fmt.Errorf("unexpected sql %s", sqlStr)
+	}
+	return nil
+}
+
+func (s *fakeSlave) DoQueryParseMaster(string) entity.MasterStatus {
+	return entity.MasterStatus{ExecutedGtidSet: fmt.Sprintf("%s:1-%d", fakeUuid, s.r.applied)}
+}
+
+func (s *fakeSlave) DoQueryParseSlave(string) entity.SlaveStatus {
+	status := entity.SlaveStatus{SlaveSQLRunning: "No", ExecutedGtidSet: fmt.Sprintf("%s:1-%d", fakeUuid, s.r.applied)}
+	if s.r.running {
+		status.SlaveSQLRunning = "Yes"
+	}
+	return status
+}
+
+func (s *fakeSlave) DoQueryParseNullRows(sqlStr string) ([]string, [][]sql.NullString, error) {
+	return nil, fakeQuery(sqlStr, s.r.target(s.r.applied)), nil
+}
+
+// useFakeReplication 替换主备集群的连接, 测试结束后恢复
+func useFakeReplication(t *testing.T, r *fakeReplication) {
+	master, slave := MasterSqlScaleOperator, SlaveSqlScaleOperator
+	MasterSqlScaleOperator, SlaveSqlScaleOperator = &fakeMaster{r: r}, &fakeSlave{r: r}
+	t.Cleanup(func() {
+		MasterSqlScaleOperator, SlaveSqlScaleOperator = master, slave
+	})
+}
+
+func TestChecksumChunkPinned(t *testing.T) {
+	// 每个事务都修改 id=1, 开启快照和读取GTID之间也有提交, 灾备集群与主集群在同一GTID点的数据相同, 不重试也一致
+	version := func(v int64) []sql.NullString { return fakeRows("1", fmt.Sprintf("v%d", v)) }
+	r := &fakeReplication{executed: 10, applied: 10, running: true,
+		source: func(v int64) [][]sql.NullString { return [][]sql.NullString{version(v)} },
+		target: func(v int64) [][]sql.NullString { return [][]sql.NullString{version(v)} },
+	}
+	useFakeReplication(t, r)
+	options := ChecksumOptions{Retries: 0, WaitTimeout: time.Second}
+
+	table := &ChecksumTable{Schema: "db", Table: "t", Keys: []string{"id"}}
+	chunk := &ChecksumChunk{Upper: []string{"1"}}
+	if err := checksumChunk(table, []string{"id", "v"}, chunk, options); err != nil {
+		t.Fatal(err)
+	}
+	if chunk.SourceCrc != chunk.TargetCrc || chunk.SourceCount != 1 || chunk.TargetCount != 1 {
+		t.Fatalf("expect consistent chunk under write load, got %+v", chunk)
+	}
+	if !r.running || r.applied != r.executed {
+		t.Fatalf("expect slave sql thread resumed, running %v applied %d executed %d", r.running, r.applied, r.executed)
+	}
+
+	// 灾备集群缺少 id=2
+	r.source = func(v int64) [][]sql.NullString { return [][]sql.NullString{version(v), fakeRows("2", "x")} }
+	chunk = &ChecksumChunk{}
+	if err := checksumChunk(table, []string{"id", "v"}, chunk, options); err != nil {
+		t.Fatal(err)
+	}
+	if chunk.SourceCount != 2 || chunk.TargetCount != 1 {
+		t.Fatalf("expect different chunk, got %+v", chunk)
+	}
+
+	r.running = false
+	if err := checksumChunk(table, []string{"id", "v"}, chunk, options); err == nil {
+		t.Fatal("expect error when slave sql thread is not running")
+	}
+}
@@ -0,0 +1,373 @@
+package check
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"giogii/src/mapper"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/**
+每次参数检查的结果追加到当前目录的 params_history_<集群ip_port>.jsonl, 一行一次检查, 记录各节点全部参数的实际值.
+params history 按参数或节点列出值的变化, params diff 比较任意两次检查
+*/
+
+// ParamRun 一次参数检查, Values 为 节点 -> 参数 -> 实际值
+type ParamRun struct {
+	Id        int                          `json:"id"`
+	Time      time.Time                    `json:"time"`
+	Template  string                       `json:"template"`
+	Nodes     []string                     `json:"nodes"`
+	Baselines map[string]string            `json:"baselines"`
+	Values    map[string]map[string]string `json:"values"`
+}
+
+// ParamChange 参数在一个节点上的一次变化, 第一次记录时 Old 为空且 Initial 为true
+type ParamChange struct {
+	RunId     int
+	Time      time.Time
+	Node      string
+	Parameter string
+	Old       string
+	New       string
+	Initial   bool
+}
+
+// ParamHistoryPath 集群的参数历史文件
+func ParamHistoryPath(targetSocket string) string {
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(targetSocket)
+	return fmt.Sprintf("./params_history_%s.jsonl", name)
+}
+
+// historyIgnore 每次读取都会变化的参数, 不记录到历史中
+var historyIgnore = []string{
+	"gtid_executed*", "gtid_purged", "gtid_owned", "timestamp", "rand_seed*", "warning_count", "error_count",
+	"last_insert_id", "identity", "insert_id", "pseudo_*",
+}
+
+// captureVariables 读取节点的全部参数, 用于记录历史
+func captureVariables(operator mapper.SqlScaleOperator, strSql string) (map[string]string, error) {
+	return captureSection(operator, strSql, historyIgnore, strings.ToLower, sameName)
+}
+
+// NewParamRun 由各节点的全部参数和检查结果生成一次记录, variables 为节点 -> show global variables 的全部参数,
+// 模板中不在 variables 里的参数(如consumer)使用检查结果的实际值
+func NewParamRun(template string, nodes []string, results map[string][]ParamResult, variables map[string]map[string]string) *ParamRun {
+	run := &ParamRun{Time: time.Now(), Template: template, Nodes: nodes,
+		Baselines: make(map[string]string), Values: make(map[string]map[string]string)}
+	for _, node := range nodes {
+		r, ok := results[node]
+		all, captured := variables[node]
+		if !ok && !captured {
+			continue
+		}
+		values := make(map[string]string, len(all)+len(r))
+		for name, value := range all {
+			values[name] = value
+		}
+		for _, p := range r {
+			run.Baselines[p.Name] = p.Baseline
+			_, same := values[p.Name]
+			_, alias := values[VariableName(p.Name)]
+			if !same && !alias {
+				values[p.Name] = p.Actual
+			}
+		}
+		run.Values[node] = values
+	}
+	return run
+}
+
+// LoadParamHistory 读取全部记录, 文件不存在时返回空
+func LoadParamHistory(path string) ([]*ParamRun, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var runs []*ParamRun
+	reader := bufio.NewReader(f)
+	for no := 1; ; no++ {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			run := &ParamRun{}
+			if err := json.Unmarshal(line, run); err != nil {
+				return nil, fmt.Errorf("%s 第%d行: %s", path, no, err)
+			}
+			runs = append(runs, run)
+		}
+		if err == io.EOF {
+			return runs, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// historyTailBlock 从文件末尾向前读取最后一行时每次读取的字节数
+const historyTailBlock = 64 * 1024
+
+// lastParamRunId 只读取文件的最后一行得到最后一次记录的编号, 文件不存在或为空时返回0
+func lastParamRunId(path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var tail []byte
+	for end := info.Size(); end > 0; {
+		start := end - historyTailBlock
+		if start < 0 {
+			start = 0
+		}
+		block := make([]byte, end-start)
+		if _, err := f.ReadAt(block, start); err != nil {
+			return 0, err
+		}
+		tail = append(block, tail...)
+		end = start
+		// 去掉末尾的换行后, 前面出现换行时已经读到完整的最后一行
+		line := bytes.TrimRight(tail, "\r\n\t ")
+		if i := bytes.LastIndexByte(line, '\n'); i >= 0 {
+			tail = line[i+1:]
+			break
+		}
+	}
+	tail = bytes.TrimSpace(tail)
+	if len(tail) == 0 {
+		return 0, nil
+	}
+	var last struct {
+		Id int `json:"id"`
+	}
+	if err := json.Unmarshal(tail, &last); err != nil {
+		return 0, fmt.Errorf("%s 最后一行: %s", path, err)
+	}
+	return last.Id, nil
+}
+
+// AppendParamHistory 追加一次记录, 编号为最后一次记录的编号加1
+func AppendParamHistory(path string, run *ParamRun) error {
+	id, err := lastParamRunId(path)
+	if err != nil {
+		return err
+	}
+	run.Id = id + 1
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// hasNode 记录中是否出现过该节点
+func hasNode(runs []*ParamRun, node string) bool {
+	for _, run := range runs {
+		if _, ok := run.Values[node]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ParamChanges 按时间顺序列出值的变化, filter 为节点时列出该节点全部参数, 否则为参数名, 为空时列出全部
+func ParamChanges(runs []*ParamRun, filter string) []ParamChange {
+	byNode := filter != "" && hasNode(runs, filter)
+	var changes []ParamChange
+	last := make(map[string]string)
+	for _, run := range runs {
+		nodes := make([]string, 0, len(run.Values))
+		for node := range run.Values {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		for _, node := range nodes {
+			if byNode && node != filter {
+				continue
+			}
+			values := run.Values[node]
+			names := make([]string, 0, len(values))
+			for name := range values {
+				if byNode || filter == "" || VariableName(name) == VariableName(filter) {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				key := node + "\x00" + name
+				value := values[name]
+				old, seen := last[key]
+				last[key] = value
+				if seen && (old == value || ParamEqual(name, old, value)) {
+					continue
+				}
+				changes = append(changes, ParamChange{RunId: run.Id, Time: run.Time, Node: node, Parameter: name, Old: old, New: value, Initial: !seen})
+			}
+		}
+	}
+	return changes
+}
+
+// ParamRunDiff 两次记录中值不同的参数, 某次没有记录的值为 -
+type ParamRunDiff struct {
+	Node      string
+	Parameter string
+	From      string
+	To        string
+}
+
+// DiffParamRuns 比较两次记录, 按节点和参数排序
+func DiffParamRuns(from *ParamRun, to *ParamRun) []ParamRunDiff {
+	keys := make(map[[2]string]bool)
+	for _, run := range []*ParamRun{from, to} {
+		for node, values := range run.Values {
+			for name := range values {
+				keys[[2]string{node, name}] = true
+			}
+		}
+	}
+	var diffs []ParamRunDiff
+	for key := range keys {
+		a, ok1 := from.Values[key[0]][key[1]]
+		b, ok2 := to.Values[key[0]][key[1]]
+		if ok1 && ok2 && (a == b || ParamEqual(key[1], a, b)) {
+			continue
+		}
+		if !ok1 {
+			a = "-"
+		}
+		if !ok2 {
+			b = "-"
+		}
+		diffs = append(diffs, ParamRunDiff{Node: key[0], Parameter: key[1], From: a, To: b})
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Node != diffs[j].Node {
+			return diffs[i].Node < diffs[j].Node
+		}
+		return diffs[i].Parameter < diffs[j].Parameter
+	})
+	return diffs
+}
+
+// findRun 按编号查找记录, 负数为倒数第几次
+func findRun(runs []*ParamRun, id string) (*ParamRun, error) {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, fmt.Errorf("记录编号 %s 不是数字", id)
+	}
+	if n < 0 && -n <= len(runs) {
+		return runs[len(runs)+n], nil
+	}
+	for _, run := range runs {
+		if run.Id == n {
+			return run, nil
+		}
+	}
+	return nil, fmt.Errorf("没有编号为 %s 的记录", id)
+}
+
+func showValue(value string) string {
+	if value == "" {
+		return "''"
+	}
+	return value
+}
+
+// DoParamHistory 列出参数或节点的值变化, filter 为空时列出全部记录
+func DoParamHistory(targetSocket string, filter string) {
+	path := ParamHistoryPath(targetSocket)
+	runs, err := LoadParamHistory(path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(runs) == 0 {
+		log.Println(fmt.Sprintf("%s 中没有参数检查记录", path))
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	if filter == "" {
+		fmt.Fprintln(w, "ID\tTIME\tTEMPLATE\tNODES")
+		for _, run := range runs {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", run.Id, run.Time.Format("2006-01-02 15:04:05"), run.Template, strings.Join(run.Nodes, ","))
+		}
+		return
+	}
+	changes := ParamChanges(runs, filter)
+	if len(changes) == 0 {
+		fmt.Fprintf(w, "%d 次检查中没有 %s 的记录\n", len(runs), filter)
+		return
+	}
+	fmt.Fprintln(w, "ID\tTIME\tNODE\tPARAMETER\tOLD\tNEW")
+	for _, c := range changes {
+		old := showValue(c.Old)
+		if c.Initial {
+			old = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", c.RunId, c.Time.Format("2006-01-02 15:04:05"), c.Node, c.Parameter, old, showValue(c.New))
+	}
+}
+
+// DoParamDiff 比较两次记录, 没有指定时比较最近两次
+func DoParamDiff(targetSocket string, fromId string, toId string) {
+	path := ParamHistoryPath(targetSocket)
+	runs, err := LoadParamHistory(path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if fromId == "" {
+		fromId = "-2"
+	}
+	if toId == "" {
+		toId = "-1"
+	}
+	from, err := findRun(runs, fromId)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	to, err := findRun(runs, toId)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	diffs := DiffParamRuns(from, to)
+	fmt.Printf("记录 %d(%s, 模板 %s) 与 记录 %d(%s, 模板 %s)\n", from.Id, from.Time.Format("2006-01-02 15:04:05"), from.Template,
+		to.Id, to.Time.Format("2006-01-02 15:04:05"), to.Template)
+	if len(diffs) == 0 {
+		fmt.Println("参数没有变化")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "NODE\tPARAMETER\t#%d\t#%d\n", from.Id, to.Id)
+	for _, d := range diffs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", d.Node, d.Parameter, showValue(d.From), showValue(d.To))
+	}
+	w.Flush()
+}
@@ -0,0 +1,63 @@
+package check
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParamHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ParamHistoryPath("10.0.0.1:3306"))
+	nodes := []string{"10.0.0.1:3306", "10.0.0.2:3306"}
+	// 每行超过一次从末尾读取的长度, 编号仍然从最后一行得到
+	long := strings.Repeat("x", historyTailBlock+1)
+	for _, values := range [][2]string{{"1", "1"}, {"1", "2"}, {"ON", "2"}, {"1", "1"}} {
+		results := map[string][]ParamResult{
+			nodes[0]: {{Name: "innodb_flush_log_at_trx_commit", Baseline: "1", Actual: values[0]}, {Name: "sync_binlog", Baseline: "1", Actual: "1"}},
+			nodes[1]: {{Name: "innodb_flush_log_at_trx_commit", Baseline: "1", Actual: values[1]},
+				{Name: "performance-schema-consumer-events-statements-history", Baseline: "ON", Actual: "ON"}},
+		}
+		variables := map[string]map[string]string{
+			nodes[1]: {"innodb_flush_log_at_trx_commit": values[1], "init_connect": long, "max_connections": values[1] + "000"},
+		}
+		if err := AppendParamHistory(path, NewParamRun("8c32gb", nodes, results, variables)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runs, err := LoadParamHistory(path)
+	if err != nil || len(runs) != 4 || runs[3].Id != 4 {
+		t.Fatalf("unexpected runs %v %v", runs, err)
+	}
+	// 全部参数与模板中不在 show global variables 里的参数都记录
+	if values := runs[0].Values[nodes[1]]; len(values) != 4 || values["performance-schema-consumer-events-statements-history"] != "ON" {
+		t.Fatalf("unexpected values %v", values)
+	}
+	if changes := ParamChanges(runs, "max_connections"); len(changes) != 3 {
+		t.Fatalf("unexpected max_connections changes %+v", changes)
+	}
+
+	// ON 与 1 相同, 不是变化
+	changes := ParamChanges(runs, "innodb-flush-log-at-trx-commit")
+	if len(changes) != 4 {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+	if c := changes[2]; c.RunId != 2 || c.Node != nodes[1] || c.Old != "1" || c.New != "2" || c.Initial {
+		t.Fatalf("unexpected change %+v", c)
+	}
+	if c := changes[3]; c.RunId != 4 || c.Node != nodes[1] || c.Old != "2" || c.New != "1" {
+		t.Fatalf("unexpected change %+v", c)
+	}
+	if changes := ParamChanges(runs, nodes[0]); len(changes) != 2 || !changes[0].Initial || !changes[1].Initial {
+		t.Fatalf("unexpected node changes %+v", changes)
+	}
+
+	from, _ := findRun(runs, "1")
+	to, _ := findRun(runs, "-2")
+	diffs := DiffParamRuns(from, to)
+	if len(diffs) != 2 || diffs[0].Node != nodes[1] || diffs[0].From != "1" || diffs[0].To != "2" || diffs[1].Parameter != "max_connections" {
+		t.Fatalf("unexpected diffs %+v", diffs)
+	}
+	if _, err := findRun(runs, "9"); err == nil {
+		t.Fatal("expected error for missing run")
+	}
+}
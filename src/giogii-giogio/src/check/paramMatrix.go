@@ -0,0 +1,136 @@
+package check
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// MatrixRow 一个参数在各节点上的值, Drift 为与基准不一致的节点, Consistent 为各节点的值是否相同
+type MatrixRow struct {
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	Baseline   string            `json:"baseline"`
+	Values     map[string]string `json:"values"`
+	Drift      []string          `json:"drift,omitempty"`
+	Consistent bool              `json:"consistent"`
+}
+
+// Value 节点上的值, 没有检查该参数的节点为 -
+func (r MatrixRow) Value(node string) string {
+	value, ok := r.Values[node]
+	if !ok {
+		return "-"
+	}
+	if value == "" {
+		return "''"
+	}
+	return value
+}
+
+// Drifted 节点上的值是否与基准不一致
+func (r MatrixRow) Drifted(node string) bool {
+	for _, n := range r.Drift {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// ParamMatrix 参数×节点矩阵, Failed 为无法检查的节点及原因
+type ParamMatrix struct {
+	Nodes  []string          `json:"nodes"`
+	Rows   []MatrixRow       `json:"rows"`
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// NewParamMatrix 按节点顺序合并各节点的检查结果, 参数按第一次出现的顺序排列
+func NewParamMatrix(nodes []string, results map[string][]ParamResult) *ParamMatrix {
+	m := &ParamMatrix{Nodes: nodes}
+	index := make(map[string]int)
+	for _, node := range nodes {
+		for _, r := range results[node] {
+			key := r.Type + "/" + r.Name
+			i, ok := index[key]
+			if !ok {
+				i = len(m.Rows)
+				index[key] = i
+				m.Rows = append(m.Rows, MatrixRow{Name: r.Name, Type: r.Type, Baseline: r.Baseline, Values: make(map[string]string)})
+			}
+			row := &m.Rows[i]
+			row.Values[node] = r.Actual
+			if !r.Equal {
+				row.Drift = append(row.Drift, node)
+			}
+		}
+	}
+	for i := range m.Rows {
+		m.Rows[i].Consistent = consistentValues(m.Rows[i], nodes)
+	}
+	return m
+}
+
+// consistentValues 各节点的值按参数类型比较是否相同
+func consistentValues(row MatrixRow, nodes []string) bool {
+	var first string
+	seen := false
+	for _, node := range nodes {
+		value, ok := row.Values[node]
+		if !ok {
+			continue
+		}
+		if !seen {
+			first, seen = value, true
+			continue
+		}
+		if value != first && !ParamEqual(row.Name, first, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Differs 与基准不一致或节点间不一致的参数
+func (m *ParamMatrix) Differs() (rows []MatrixRow) {
+	for _, r := range m.Rows {
+		if len(r.Drift) > 0 || !r.Consistent {
+			rows = append(rows, r)
+		}
+	}
+	return
+}
+
+// WriteText 以表格输出有差异的参数, 与基准不一致的值后加 *, 节点间不一致的参数标记在最后一列
+func (m *ParamMatrix) WriteText(w io.Writer) {
+	for _, node := range m.Nodes {
+		if reason, ok := m.Failed[node]; ok {
+			fmt.Fprintf(w, "节点 %s 检查失败: %s\n", node, reason)
+		}
+	}
+	rows := m.Differs()
+	if len(rows) == 0 {
+		fmt.Fprintf(w, "%d 个参数在 %d 个节点上与基准一致\n", len(m.Rows), len(m.Nodes)-len(m.Failed))
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "PARAMETER\tBASELINE\t%s\tNODES\n", strings.Join(m.Nodes, "\t"))
+	for _, r := range rows {
+		cells := make([]string, 0, len(m.Nodes))
+		for _, node := range m.Nodes {
+			cell := r.Value(node)
+			if r.Drifted(node) {
+				cell += " *"
+			}
+			cells = append(cells, cell)
+		}
+		nodes := "一致"
+		if !r.Consistent {
+			nodes = "不一致"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Name, r.Baseline, strings.Join(cells, "\t"), nodes)
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "* 与基准不一致")
+}
@@ -0,0 +1,62 @@
+package check
+
+import (
+	"bytes"
+	"giogii/src/entity"
+	"giogii/src/mapper"
+	"strings"
+	"testing"
+)
+
+// fakeVariables 按 show variables like 返回节点上的参数值
+type fakeVariables struct {
+	mapper.SqlScaleOperator
+	values map[string]string
+}
+
+func (f *fakeVariables) DoQueryParseValue(sqlStr string) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(sqlStr, "show variables like '"), "'")
+	return f.values[name]
+}
+
+func TestParamMatrix(t *testing.T) {
+	nodes := []string{"10.0.0.1:3306", "10.0.0.2:3306", "10.0.0.3:3306"}
+	configuration := []entity.Configuration{
+		{Name: "optimizer_switch", Type: "mysql", Value: "index_merge=on"},
+		{Name: "innodb_flush_log_at_trx_commit", Type: "mysql", Value: "1"},
+		{Name: "wait_timeout", Type: "mysql", Value: "8h"},
+	}
+	variables := map[string]map[string]string{
+		nodes[0]: {"optimizer_switch": "index_merge=on,mrr=on,batched_key_access=off", "innodb_flush_log_at_trx_commit": "1", "wait_timeout": "28800"},
+		nodes[1]: {"optimizer_switch": "index_merge=on,mrr=on,batched_key_access=off", "innodb_flush_log_at_trx_commit": "2", "wait_timeout": "28800"},
+		nodes[2]: {"optimizer_switch": "index_merge=on,mrr=off,batched_key_access=off"},
+	}
+	results := make(map[string][]ParamResult)
+	for _, node := range nodes[:2] {
+		results[node] = checkParams(&fakeVariables{values: variables[node]}, configuration)
+	}
+	m := NewParamMatrix(nodes[:2], results)
+	if len(m.Rows) != 3 {
+		t.Fatalf("unexpected rows %+v", m.Rows)
+	}
+	flush := m.Rows[1]
+	if flush.Consistent || !flush.Drifted(nodes[1]) || flush.Drifted(nodes[0]) {
+		t.Fatalf("unexpected row %+v", flush)
+	}
+	if !m.Rows[2].Consistent || len(m.Differs()) != 1 {
+		t.Fatalf("unexpected differs %+v", m.Differs())
+	}
+
+	// 与基准一致但节点间不同的值也需要标记: optimizer_switch 只比较基准中列出的开关
+	results[nodes[2]] = checkParams(&fakeVariables{values: variables[nodes[2]]}, configuration[:1])
+	m = NewParamMatrix(nodes, results)
+	m.Failed = map[string]string{}
+	if m.Rows[0].Consistent || len(m.Rows[0].Drift) != 0 || m.Rows[1].Value(nodes[2]) != "-" {
+		t.Fatalf("unexpected rows %+v", m.Rows)
+	}
+	var buf bytes.Buffer
+	m.WriteText(&buf)
+	if !strings.Contains(buf.String(), "2 *") || strings.Count(buf.String(), "不一致") != 3 {
+		t.Fatalf("unexpected text:\n%s", buf.String())
+	}
+}
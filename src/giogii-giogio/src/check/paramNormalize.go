@@ -0,0 +1,221 @@
+package check
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+参数值按类型比较, 减少写法不同造成的误报:
+大小 1G 与 1073741824 相同, 布尔 ON/1/TRUE/YES/ENABLED 相同, 枚举不区分大小写,
+集合(sql_mode等)不区分顺序, optimizer_switch 只比较基准中列出的开关, 时长 8h 与 28800 相同, 路径按 path.Clean 比较.
+没有在 paramKinds 中的参数按值的形式推断类型
+*/
+
+// 参数值类型
+const (
+	KindSize     = "size"
+	KindEnum     = "enum"
+	KindSet      = "set"
+	KindSwitch   = "switch"
+	KindDuration = "duration"
+	KindPath     = "path"
+)
+
+// paramKinds 已知参数的类型, 键为 show variables 中的名称
+var paramKinds = map[string]string{
+	"sql_mode":                         KindSet,
+	"log_output":                       KindSet,
+	"tls_version":                      KindSet,
+	"binlog_ignore_db":                 KindSet,
+	"optimizer_switch":                 KindSwitch,
+	"transaction_isolation":            KindEnum,
+	"tx_isolation":                     KindEnum,
+	"binlog_format":                    KindEnum,
+	"binlog_row_image":                 KindEnum,
+	"innodb_flush_method":              KindEnum,
+	"long_query_time":                  KindDuration,
+	"binlog_expire_logs_seconds":       KindDuration,
+	"innodb_buffer_pool_size":          KindSize,
+	"innodb_log_file_size":             KindSize,
+	"innodb_redo_log_capacity":         KindSize,
+	"max_allowed_packet":               KindSize,
+	"max_binlog_size":                  KindSize,
+	"tmp_table_size":                   KindSize,
+	"max_heap_table_size":              KindSize,
+	"sort_buffer_size":                 KindSize,
+	"join_buffer_size":                 KindSize,
+	"read_buffer_size":                 KindSize,
+	"read_rnd_buffer_size":             KindSize,
+	"binlog_cache_size":                KindSize,
+	"innodb_log_buffer_size":           KindSize,
+	"innodb_buffer_pool_chunk_size":    KindSize,
+	"innodb_online_alter_log_max_size": KindSize,
+	"datadir":                          KindPath,
+	"basedir":                          KindPath,
+	"tmpdir":                           KindPath,
+	"socket":                           KindPath,
+	"log_error":                        KindPath,
+	"slow_query_log_file":              KindPath,
+	"general_log_file":                 KindPath,
+	"log_bin_basename":                 KindPath,
+	"relay_log":                        KindPath,
+	"relay_log_basename":               KindPath,
+	"innodb_data_home_dir":             KindPath,
+	"innodb_log_group_home_dir":        KindPath,
+	"innodb_undo_directory":            KindPath,
+	"pid_file":                         KindPath,
+	"secure_file_priv":                 KindPath,
+	"plugin_dir":                       KindPath,
+}
+
+// paramAliases my.cnf 中与 show variables 名称不同的参数, 只有 - 与 _ 不同的不需要登记
+var paramAliases = map[string]string{
+	"default_time_zone":   "time_zone",
+	"ssl":                 "have_openssl",
+	"tx_isolation":        "transaction_isolation",
+	"log_slow_queries":    "slow_query_log",
+	"key_buffer":          "key_buffer_size",
+	"table_cache":         "table_open_cache",
+	"sort_buffer":         "sort_buffer_size",
+	"skip_replica_start":  "skip_slave_start",
+	"log_replica_updates": "log_slave_updates",
+}
+
+// VariableName my.cnf中的参数名转为 show variables 中的名称: 去掉loose-前缀, - 替换为 _, 再按 paramAliases 转换
+func VariableName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "loose-"), "loose_")
+	name = strings.ReplaceAll(name, "-", "_")
+	if alias, ok := paramAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// ParamKind 参数的类型, 没有登记时按名称推断时长和路径
+func ParamKind(variable string) string {
+	if kind, ok := paramKinds[variable]; ok {
+		return kind
+	}
+	switch {
+	case strings.Contains(variable, "timeout") || strings.HasSuffix(variable, "_seconds"):
+		return KindDuration
+	case strings.HasSuffix(variable, "_dir") || strings.HasSuffix(variable, "_path"):
+		return KindPath
+	}
+	return ""
+}
+
+var boolValues = map[string]string{
+	"on": "1", "off": "0", "true": "1", "false": "0", "yes": "1", "no": "0",
+	"enabled": "1", "disabled": "0", "enable": "1", "disable": "0", "1": "1", "0": "0",
+}
+
+func unquoteParam(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// parseDuration 秒数或带单位的时长, 统一转为秒
+func parseDuration(value string) (float64, bool) {
+	if n, err := strconv.ParseFloat(value, 64); err == nil {
+		return n, true
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, false
+	}
+	return d.Seconds(), true
+}
+
+func parseNumber(value string) (float64, bool) {
+	n, err := parseSize(value)
+	return n, err == nil
+}
+
+func splitSet(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	sort.Strings(items)
+	return items
+}
+
+// switchValues optimizer_switch 形式的 key=value 列表
+func switchValues(value string) map[string]string {
+	values := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) == 2 {
+			values[kv[0]] = kv[1]
+		}
+	}
+	return values
+}
+
+func cleanPath(value string) string {
+	if value == "" {
+		return ""
+	}
+	return path.Clean(value)
+}
+
+// ParamEqual 按参数类型比较基准值和实际值, 名称为my.cnf或show variables中的名称
+func ParamEqual(name string, baseline string, actual string) bool {
+	b, a := strings.ToLower(unquoteParam(baseline)), strings.ToLower(unquoteParam(actual))
+	if b == a {
+		return true
+	}
+	switch ParamKind(VariableName(name)) {
+	case KindSize:
+		bn, ok1 := parseNumber(b)
+		an, ok2 := parseNumber(a)
+		return ok1 && ok2 && bn == an
+	case KindSet:
+		return strings.Join(splitSet(b), ",") == strings.Join(splitSet(a), ",")
+	case KindSwitch:
+		actualValues := switchValues(a)
+		for k, v := range switchValues(b) {
+			if actualValues[k] != v {
+				return false
+			}
+		}
+		return true
+	case KindEnum:
+		return strings.ReplaceAll(b, "_", "-") == strings.ReplaceAll(a, "_", "-")
+	case KindDuration:
+		bn, ok1 := parseDuration(b)
+		an, ok2 := parseDuration(a)
+		return ok1 && ok2 && bn == an
+	case KindPath:
+		// 路径区分大小写
+		b, a = cleanPath(unquoteParam(baseline)), cleanPath(unquoteParam(actual))
+		// 相对路径与绝对路径比较文件名部分
+		if path.IsAbs(b) != path.IsAbs(a) {
+			rel, abs := b, a
+			if path.IsAbs(b) {
+				rel, abs = a, b
+			}
+			return strings.HasSuffix(abs, "/"+strings.TrimPrefix(rel, "./"))
+		}
+		return b == a
+	}
+	bb, ok1 := boolValues[b]
+	ab, ok2 := boolValues[a]
+	if ok1 && ok2 {
+		return bb == ab
+	}
+	bn, ok1 := parseNumber(b)
+	an, ok2 := parseNumber(a)
+	return ok1 && ok2 && bn == an
+}
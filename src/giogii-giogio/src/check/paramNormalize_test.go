@@ -0,0 +1,42 @@
+package check
+
+import (
+	"testing"
+)
+
+func TestParamEqual(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		baseline string
+		actual   string
+		equal    bool
+	}{
+		{"innodb_buffer_pool_size", "1G", "1073741824", true},
+		{"innodb-buffer-pool-size", "1G", "2147483648", false},
+		{"max_allowed_packet", "64M", "67108864", true},
+		{"slow_query_log", "ON", "1", true},
+		{"ssl", "on", "YES", true},
+		{"performance-schema-consumer-events-statements-history", "on", "YES", true},
+		{"binlog_format", "row", "ROW", true},
+		{"transaction_isolation", "READ_COMMITTED", "READ-COMMITTED", true},
+		{"sql_mode", "STRICT_TRANS_TABLES,NO_ENGINE_SUBSTITUTION", "NO_ENGINE_SUBSTITUTION,STRICT_TRANS_TABLES", true},
+		{"sql_mode", "STRICT_TRANS_TABLES", "NO_ENGINE_SUBSTITUTION,STRICT_TRANS_TABLES", false},
+		{"optimizer_switch", "index_merge=on,mrr=off", "index_merge=on,index_merge_union=on,mrr=off", true},
+		{"optimizer_switch", "mrr=on", "index_merge=on,mrr=off", false},
+		{"wait_timeout", "8h", "28800", true},
+		{"long_query_time", "0.5", "0.500000", true},
+		{"loose-innodb-lock-wait-timeout", "50s", "50", true},
+		{"log-error", "./error.log", "/data/mysql/16310/error.log", true},
+		{"datadir", "/data/mysql/16310/dbdata/", "/data/mysql/16310/dbdata", true},
+		{"default-time-zone", "'+08:00'", "+08:00", true},
+		{"character_set_server", "utf8mb4", "utf8", false},
+		{"init_connect", "''", "", true},
+	} {
+		if got := ParamEqual(c.name, c.baseline, c.actual); got != c.equal {
+			t.Fatalf("ParamEqual(%s, %s, %s) = %v", c.name, c.baseline, c.actual, got)
+		}
+	}
+	if VariableName("loose-default-time-zone") != "time_zone" || VariableName("key-buffer") != "key_buffer_size" {
+		t.Fatal("unexpected variable name")
+	}
+}
@@ -0,0 +1,281 @@
+package check
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 参数的作用范围
+const (
+	ScopeGlobal  = "GLOBAL"
+	ScopeSession = "GLOBAL,SESSION"
+	ScopeDbscale = "DBSCALE"
+	ScopePfs     = "PERFORMANCE_SCHEMA"
+)
+
+// staticParams 只能在my.cnf中修改、重启后生效的参数, 键为 show variables 中的名称
+var staticParams = map[string]bool{
+	"innodb_buffer_pool_instances":  true,
+	"innodb_buffer_pool_chunk_size": true,
+	"innodb_log_file_size":          true,
+	"innodb_log_files_in_group":     true,
+	"innodb_page_size":              true,
+	"innodb_data_file_path":         true,
+	"innodb_temp_data_file_path":    true,
+	"innodb_data_home_dir":          true,
+	"innodb_log_group_home_dir":     true,
+	"innodb_undo_directory":         true,
+	"innodb_flush_method":           true,
+	"innodb_read_io_threads":        true,
+	"innodb_write_io_threads":       true,
+	"innodb_open_files":             true,
+	"innodb_doublewrite":            true,
+	"innodb_rollback_on_timeout":    true,
+	"innodb_autoinc_lock_mode":      true,
+	"innodb_sort_buffer_size":       true,
+	"innodb_use_native_aio":         true,
+	"innodb_numa_interleave":        true,
+	"innodb_dedicated_server":       true,
+	"lower_case_table_names":        true,
+	"log_bin":                       true,
+	"log_bin_basename":              true,
+	"log_bin_index":                 true,
+	"log_slave_updates":             true,
+	// binlog_ignore_db 来自 show master status, 不是系统变量, 只能写在my.cnf的 binlog-ignore-db 中
+	"binlog_ignore_db":              true,
+	"relay_log":                     true,
+	"relay_log_index":               true,
+	"relay_log_recovery":            true,
+	"skip_slave_start":              true,
+	"datadir":                       true,
+	"basedir":                       true,
+	"tmpdir":                        true,
+	"socket":                        true,
+	"port":                          true,
+	"bind_address":                  true,
+	"skip_name_resolve":             true,
+	"log_error":                     true,
+	"pid_file":                      true,
+	"secure_file_priv":              true,
+	"open_files_limit":              true,
+	"back_log":                      true,
+	"thread_handling":               true,
+	"thread_stack":                  true,
+	"table_open_cache_instances":    true,
+	"performance_schema":            true,
+	"performance_schema_instrument": true,
+	"federated":                     true,
+	"plugin_load":                   true,
+	"plugin_load_add":               true,
+	"have_openssl":                  true,
+	"default_authentication_plugin": true,
+	"report_host":                   true,
+	"report_port":                   true,
+	"disabled_storage_engines":      true,
+}
+
+// DriftEntry 报告中一个与基准不一致的参数, Dynamic 为true时可以在线修改
+type DriftEntry struct {
+	Node        string `json:"node"`
+	Parameter   string `json:"parameter"`
+	Type        string `json:"type"`
+	Baseline    string `json:"baseline"`
+	Actual      string `json:"actual"`
+	Dynamic     bool   `json:"dynamic"`
+	Scope       string `json:"scope"`
+	Remediation string `json:"remediation"`
+}
+
+// DriftReport 参数漂移报告
+type DriftReport struct {
+	Template    string       `json:"template"`
+	GeneratedAt time.Time    `json:"generated_at"`
+	Checked     int          `json:"checked"`
+	Entries     []DriftEntry `json:"entries"`
+	Matrix      *ParamMatrix `json:"matrix,omitempty"`
+}
+
+// isStaticParam 按名称判断是否只能重启生效, performance_schema 的容量参数都是静态参数
+func isStaticParam(variable string) bool {
+	if staticParams[variable] {
+		return true
+	}
+	return strings.HasPrefix(variable, "performance_schema_") && !strings.HasPrefix(variable, "performance_schema_consumer_")
+}
+
+// setValue SET语句中的值: 与 ParamEqual 相同, 大小(1G)和时长(8h)转为数字, 布尔值不加引号, 其余加引号
+func setValue(variable string, value string) string {
+	value = unquoteParam(value)
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return value
+	}
+	kind := ParamKind(variable)
+	if kind == KindSize || kind == "" {
+		if n, ok := parseNumber(value); ok {
+			return formatNumber(n)
+		}
+	}
+	if kind == KindDuration || kind == "" {
+		if n, ok := parseDuration(value); ok {
+			return formatNumber(n)
+		}
+	}
+	if _, ok := boolValues[strings.ToLower(value)]; ok {
+		return strings.ToUpper(value)
+	}
+	return quoteValue(value)
+}
+
+// formatNumber 整数不带小数点, long_query_time 等时长可以有小数
+func formatNumber(n float64) string {
+	if n == float64(int64(n)) {
+		return strconv.FormatInt(int64(n), 10)
+	}
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+// remediation 使参数与基准一致的操作: dbscale参数用 dbscale set global, 动态参数用 SET PERSIST, consumer 更新setup_consumers, 静态参数为my.cnf中的一行
+func remediation(r ParamResult) (string, bool) {
+	if r.Type == "dbscale" {
+		return fmt.Sprintf("dbscale set global \"%s\" = %s", r.Name, setValue(r.Name, r.Baseline)), true
+	}
+	variable := VariableName(r.Name)
+	if strings.HasPrefix(variable, "performance_schema_consumer_") {
+		enabled := "NO"
+		if boolValues[strings.ToLower(unquoteParam(r.Baseline))] == "1" {
+			enabled = "YES"
+		}
+		return fmt.Sprintf("UPDATE performance_schema.setup_consumers SET enabled = '%s' WHERE name = '%s'", enabled,
+			strings.TrimPrefix(variable, "performance_schema_consumer_")), true
+	}
+	if isStaticParam(variable) {
+		return fmt.Sprintf("%s = %s", r.Name, unquoteParam(r.Baseline)), false
+	}
+	return fmt.Sprintf("SET PERSIST %s = %s", variable, setValue(variable, r.Baseline)), true
+}
+
+// NewDriftReport 由检查结果生成报告, scope 读取动态参数的作用范围
+func NewDriftReport(template string, node string, results []ParamResult, scope func(variable string) string) DriftReport {
+	report := DriftReport{Template: template, GeneratedAt: time.Now(), Checked: len(results)}
+	for _, r := range results {
+		if r.Equal {
+			continue
+		}
+		e := DriftEntry{Node: node, Parameter: r.Name, Type: r.Type, Baseline: r.Baseline, Actual: r.Actual}
+		e.Remediation, e.Dynamic = remediation(r)
+		variable := VariableName(r.Name)
+		switch {
+		case r.Type == "dbscale":
+			e.Scope = ScopeDbscale
+		case strings.HasPrefix(variable, "performance_schema_consumer_"):
+			e.Scope = ScopePfs
+		case e.Dynamic:
+			e.Scope = scope(variable)
+		default:
+			e.Scope = ScopeGlobal
+		}
+		report.Entries = append(report.Entries, e)
+	}
+	return report
+}
+
+// WriteJson 以json输出报告
+func (r DriftReport) WriteJson(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteCsv 以csv输出报告, 每个参数一行
+func (r DriftReport) WriteCsv(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"node", "parameter", "type", "baseline", "actual", "dynamic", "scope", "remediation"})
+	for _, e := range r.Entries {
+		writer.Write([]string{e.Node, e.Parameter, e.Type, e.Baseline, e.Actual, strconv.FormatBool(e.Dynamic), e.Scope, e.Remediation})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+var driftHtml = template.Must(template.New("drift").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>参数漂移报告 {{.Template}}</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+th { background: #f0f0f0; }
+.static { background: #fff3cd; }
+.drift { background: #f8d7da; }
+.inconsistent td:first-child { font-weight: bold; color: #b02a37; }
+</style>
+</head>
+<body>
+<h2>参数漂移报告</h2>
+<p>模板: {{.Template}}, 生成时间: {{.GeneratedAt.Format "2006-01-02 15:04:05"}}, 检查参数 {{.Checked}} 个, 不一致 {{len .Entries}} 个</p>
+<table>
+<tr><th>节点</th><th>参数</th><th>类型</th><th>基准值</th><th>实际值</th><th>在线修改</th><th>范围</th><th>修复</th></tr>
+{{range .Entries}}<tr{{if not .Dynamic}} class="static"{{end}}><td>{{.Node}}</td><td>{{.Parameter}}</td><td>{{.Type}}</td><td>{{.Baseline}}</td><td>{{.Actual}}</td><td>{{if .Dynamic}}是{{else}}否, 需要重启{{end}}</td><td>{{.Scope}}</td><td><code>{{.Remediation}}</code></td></tr>
+{{end}}</table>
+{{with .Matrix}}
+<h3>节点参数矩阵</h3>
+<p>红色为与基准不一致的值, 参数名加粗为节点间不一致</p>
+{{range $node, $reason := .Failed}}<p>节点 {{$node}} 检查失败: {{$reason}}</p>
+{{end}}<table>
+<tr><th>参数</th><th>基准值</th>{{range .Nodes}}<th>{{.}}</th>{{end}}</tr>
+{{range $row := .Rows}}<tr{{if not $row.Consistent}} class="inconsistent"{{end}}><td>{{$row.Name}}</td><td>{{$row.Baseline}}</td>{{range $node := $.Matrix.Nodes}}<td{{if $row.Drifted $node}} class="drift"{{end}}>{{$row.Value $node}}</td>{{end}}</tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+// WriteHtml 以html表格输出报告, 需要重启的参数高亮
+func (r DriftReport) WriteHtml(w io.Writer) error {
+	return driftHtml.Execute(w, r)
+}
+
+// WriteRemediation 输出修复语句和my.cnf补丁
+func (r DriftReport) WriteRemediation(w io.Writer) {
+	var statements, cnf []string
+	for _, e := range r.Entries {
+		if e.Dynamic {
+			statements = append(statements, fmt.Sprintf("%s; -- %s", e.Remediation, e.Node))
+		} else {
+			cnf = append(cnf, fmt.Sprintf("%s  # %s 当前值 %s", e.Remediation, e.Node, e.Actual))
+		}
+	}
+	if len(statements) > 0 {
+		fmt.Fprintln(w, "-- 在线修改")
+		for _, s := range statements {
+			fmt.Fprintln(w, s)
+		}
+	}
+	if len(cnf) > 0 {
+		fmt.Fprintln(w, "# my.cnf 补丁, 修改后需要重启实例")
+		fmt.Fprintln(w, "[mysqld]")
+		for _, c := range cnf {
+			fmt.Fprintln(w, c)
+		}
+	}
+}
+
+// confirm 输出提示并读取一行, 输入y或yes时返回true
+func confirm(reader *bufio.Reader, out io.Writer, prompt string) bool {
+	fmt.Fprintf(out, "%s [y/N]: ", prompt)
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,89 @@
+package check
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDriftReport(t *testing.T) {
+	results := []ParamResult{
+		{Name: "sync_binlog", Type: "mysql", Baseline: "1", Actual: "1", Equal: true},
+		{Name: "innodb-buffer-pool-size", Type: "mysql", Baseline: "1G", Actual: "134217728"},
+		{Name: "sql_mode", Type: "mysql", Baseline: "STRICT_TRANS_TABLES", Actual: ""},
+		{Name: "innodb_log_file_size", Type: "mysql", Baseline: "1G", Actual: "50331648"},
+		{Name: "max-replication-delay", Type: "dbscale", Baseline: "10", Actual: "0"},
+		{Name: "performance-schema-consumer-events-statements-history", Type: "mysql", Baseline: "ON", Actual: "NO"},
+		{Name: "binlog_ignore_db", Type: "mysql", Baseline: "mysql", Actual: ""},
+	}
+	report := NewDriftReport("8c32gb", "127.0.0.1:3306", results, func(variable string) string {
+		if variable == "sql_mode" {
+			return ScopeSession
+		}
+		return ScopeGlobal
+	})
+	if report.Checked != 7 || len(report.Entries) != 6 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for i, c := range []struct {
+		remediation string
+		dynamic     bool
+		scope       string
+	}{
+		{"SET PERSIST innodb_buffer_pool_size = 1073741824", true, ScopeGlobal},
+		{"SET PERSIST sql_mode = 'STRICT_TRANS_TABLES'", true, ScopeSession},
+		{"innodb_log_file_size = 1G", false, ScopeGlobal},
+		{`dbscale set global "max-replication-delay" = 10`, true, ScopeDbscale},
+		{"UPDATE performance_schema.setup_consumers SET enabled = 'YES' WHERE name = 'events_statements_history'", true, ScopePfs},
+		{"binlog_ignore_db = mysql", false, ScopeGlobal},
+	} {
+		e := report.Entries[i]
+		if e.Remediation != c.remediation || e.Dynamic != c.dynamic || e.Scope != c.scope {
+			t.Fatalf("entry %d: %+v", i, e)
+		}
+	}
+
+	var buf bytes.Buffer
+	report.WriteRemediation(&buf)
+	if !strings.Contains(buf.String(), "[mysqld]\ninnodb_log_file_size = 1G") {
+		t.Fatalf("unexpected remediation:\n%s", buf.String())
+	}
+	buf.Reset()
+	if err := report.WriteCsv(&buf); err != nil || strings.Count(buf.String(), "\n") != 7 {
+		t.Fatalf("unexpected csv %v:\n%s", err, buf.String())
+	}
+	buf.Reset()
+	if err := report.WriteHtml(&buf); err != nil || !strings.Contains(buf.String(), `class="static"`) {
+		t.Fatalf("unexpected html %v", err)
+	}
+
+	if o, err := ParseReportOptions("html,apply"); err != nil || o.Format != "html" || !o.Apply {
+		t.Fatalf("unexpected options %+v %v", o, err)
+	}
+	if _, err := ParseReportOptions("xml"); err == nil {
+		t.Fatal("expected error for unknown option")
+	}
+}
+
+func TestSetValue(t *testing.T) {
+	// 带单位的大小和时长转为数字, 否则 SET PERSIST 会报错
+	for _, c := range []struct {
+		variable string
+		value    string
+		expect   string
+	}{
+		{"innodb_buffer_pool_size", "1G", "1073741824"},
+		{"key_buffer_size", "16M", "16777216"},
+		{"wait_timeout", "8h", "28800"},
+		{"long_query_time", "500ms", "0.5"},
+		{"binlog_expire_logs_seconds", "168h", "604800"},
+		{"max_connections", "'1000'", "1000"},
+		{"read_only", "on", "ON"},
+		{"sql_mode", "STRICT_TRANS_TABLES", "'STRICT_TRANS_TABLES'"},
+		{"transaction_isolation", "READ-COMMITTED", "'READ-COMMITTED'"},
+	} {
+		if v := setValue(c.variable, c.value); v != c.expect {
+			t.Fatalf("setValue(%s, %s) = %s, expect %s", c.variable, c.value, v, c.expect)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package check
+
+import (
+	"database/sql"
+	"fmt"
+	"giogii/src/mapper"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// 比较的对象类型, 按生成DDL的顺序排列
+const (
+	ObjectTable      = "TABLE"
+	ObjectColumn     = "COLUMN"
+	ObjectIndex      = "INDEX"
+	ObjectConstraint = "CONSTRAINT"
+	ObjectView       = "VIEW"
+	ObjectRoutine    = "ROUTINE"
+	ObjectTrigger    = "TRIGGER"
+)
+
+var objectOrder = map[string]int{ObjectTable: 0, ObjectColumn: 1, ObjectIndex: 2, ObjectConstraint: 3, ObjectView: 4, ObjectRoutine: 5, ObjectTrigger: 6}
+
+// SchemaObject 一个库对象, Table 为列、索引、约束、触发器所属的表, Type 为约束类型(FOREIGN KEY/CHECK)或存储过程类型(PROCEDURE/FUNCTION)
+// Definition 为从information_schema读取的定义, 两边相同即认为对象一致
+type SchemaObject struct {
+	Kind       string
+	Schema     string
+	Table      string
+	Name       string
+	Type       string
+	Definition string
+}
+
+// Key 同一类对象的唯一标识
+func (o SchemaObject) Key() string {
+	return strings.Join([]string{o.Kind, o.Schema, o.Table, o.Type, o.Name}, ".")
+}
+
+// String 输出用的对象名
+func (o SchemaObject) String() string {
+	switch o.Kind {
+	case ObjectTable, ObjectView, ObjectRoutine:
+		return fmt.Sprintf("%s %s.%s", strings.TrimSpace(o.Kind+" "+o.Type), o.Schema, o.Name)
+	}
+	return fmt.Sprintf("%s %s.%s.%s", strings.TrimSpace(o.Kind+" "+o.Type), o.Schema, o.Table, o.Name)
+}
+
+// SchemaDiff 一个对象的差异, Target 为nil时灾备集群缺少该对象, Source 为nil时灾备集群多出该对象, 都不为nil时定义不同
+type SchemaDiff struct {
+	Source *SchemaObject
+	Target *SchemaObject
+}
+
+// Object 差异对应的对象
+func (d SchemaDiff) Object() SchemaObject {
+	if d.Source != nil {
+		return *d.Source
+	}
+	return *d.Target
+}
+
+// Status 差异类型
+func (d SchemaDiff) Status() string {
+	switch {
+	case d.Target == nil:
+		return "灾备集群缺少"
+	case d.Source == nil:
+		return "灾备集群多出"
+	}
+	return "定义不同"
+}
+
+func nullValue(v sql.NullString) string {
+	if !v.Valid {
+		return "NULL"
+	}
+	return v.String
+}
+
+// schemaQueries 每类对象的查询, 结果前3列为库名、表名、对象名, 其余列拼接为定义
+var schemaQueries = []struct {
+	kind  string
+	query string
+}{
+	{ObjectTable, "select table_schema, table_name, table_name, '', concat('ENGINE=', engine, ' DEFAULT COLLATE=', table_collation) from information_schema.tables where table_type = 'BASE TABLE' and table_schema not in (%s)"},
+	{ObjectColumn, "select table_schema, table_name, column_name, '', column_type, is_nullable, column_default, extra, collation_name, column_comment from information_schema.columns where table_schema not in (%s) and (table_schema, table_name) in (select table_schema, table_name from information_schema.tables where table_type = 'BASE TABLE')"},
+	{ObjectIndex, "select table_schema, table_name, index_name, '', if(non_unique = 0, 'UNIQUE', ''), index_type, group_concat(concat(column_name, ifnull(concat('(', sub_part, ')'), '')) order by seq_in_index) from information_schema.statistics where table_schema not in (%s) group by table_schema, table_name, index_name, non_unique, index_type"},
+	{ObjectConstraint, "select k.constraint_schema, k.table_name, k.constraint_name, 'FOREIGN KEY', group_concat(k.column_name order by k.ordinal_position), 'REFERENCES', max(k.referenced_table_schema), max(k.referenced_table_name), group_concat(k.referenced_column_name order by k.ordinal_position), max(r.update_rule), max(r.delete_rule) from information_schema.key_column_usage k join information_schema.referential_constraints r on r.constraint_schema = k.constraint_schema and r.constraint_name = k.constraint_name and r.table_name = k.table_name where k.constraint_schema not in (%s) group by k.constraint_schema, k.table_name, k.constraint_name"},
+	{ObjectConstraint, "select t.constraint_schema, t.table_name, t.constraint_name, 'CHECK', c.check_clause from information_schema.table_constraints t join information_schema.check_constraints c on c.constraint_schema = t.constraint_schema and c.constraint_name = t.constraint_name where t.constraint_type = 'CHECK' and t.constraint_schema not in (%s)"},
+	{ObjectView, "select table_schema, table_name, table_name, '', view_definition, check_option, security_type from information_schema.views where table_schema not in (%s)"},
+	{ObjectRoutine, "select routine_schema, '', routine_name, routine_type, dtd_identifier, routine_definition, is_deterministic, sql_data_access, security_type from information_schema.routines where routine_schema not in (%s)"},
+	{ObjectTrigger, "select trigger_schema, event_object_table, trigger_name, '', action_timing, event_manipulation, action_statement from information_schema.triggers where trigger_schema not in (%s)"},
+}
+
+// loadSchemaObjects 读取库对象, filter 与checksum相同, 存储过程按 库名.名称 过滤
+func loadSchemaObjects(operator mapper.SqlScaleOperator, filter string) ([]SchemaObject, error) {
+	var objects []SchemaObject
+	for _, q := range schemaQueries {
+		_, rows, err := operator.DoQueryParseNullRows(fmt.Sprintf(q.query, skipSchemasSql()))
+		if err != nil {
+			// check_constraints 8.0.16 之后才有
+			if q.kind == ObjectConstraint && strings.Contains(q.query, "check_constraints") {
+				log.Println(fmt.Sprintf("读取CHECK约束失败, 不比较CHECK约束: %s", err))
+				continue
+			}
+			return nil, err
+		}
+		for _, row := range rows {
+			o := SchemaObject{Kind: q.kind, Schema: row[0].String, Table: row[1].String, Name: row[2].String, Type: row[3].String}
+			table := o.Table
+			if o.Kind == ObjectRoutine || o.Kind == ObjectView {
+				table = o.Name
+			}
+			if !matchTable(filter, o.Schema, table) {
+				continue
+			}
+			definition := make([]string, 0, len(row)-4)
+			for _, v := range row[4:] {
+				definition = append(definition, nullValue(v))
+			}
+			o.Definition = strings.Join(definition, " ")
+			objects = append(objects, o)
+		}
+	}
+	return objects, nil
+}
+
+// diffSchemaObjects 比较两边的对象, 整张表缺少或多出时不再列出表上的列、索引、约束和触发器
+func diffSchemaObjects(source []SchemaObject, target []SchemaObject) []SchemaDiff {
+	targets := make(map[string]*SchemaObject, len(target))
+	for i := range target {
+		targets[target[i].Key()] = &target[i]
+	}
+	sources := make(map[string]*SchemaObject, len(source))
+	for i := range source {
+		sources[source[i].Key()] = &source[i]
+	}
+	tableOnly := make(map[string]bool)
+	var diffs []SchemaDiff
+	for i := range source {
+		s := &source[i]
+		t, ok := targets[s.Key()]
+		if !ok {
+			diffs = append(diffs, SchemaDiff{Source: s})
+			if s.Kind == ObjectTable {
+				tableOnly[s.Schema+"."+s.Name] = true
+			}
+		} else if s.Definition != t.Definition {
+			diffs = append(diffs, SchemaDiff{Source: s, Target: t})
+		}
+	}
+	for i := range target {
+		t := &target[i]
+		if _, ok := sources[t.Key()]; !ok {
+			diffs = append(diffs, SchemaDiff{Target: t})
+			if t.Kind == ObjectTable {
+				tableOnly[t.Schema+"."+t.Name] = true
+			}
+		}
+	}
+	var result []SchemaDiff
+	for _, d := range diffs {
+		o := d.Object()
+		// 整张表只在一边时不再列出表上的列、索引和约束; SHOW CREATE TABLE 不包含触发器, 触发器仍单独列出
+		if (o.Kind == ObjectColumn || o.Kind == ObjectIndex || o.Kind == ObjectConstraint) && tableOnly[o.Schema+"."+o.Table] {
+			continue
+		}
+		result = append(result, d)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i].Object(), result[j].Object()
+		if objectOrder[a.Kind] != objectOrder[b.Kind] {
+			return objectOrder[a.Kind] < objectOrder[b.Kind]
+		}
+		return a.Key() < b.Key()
+	})
+	return result
+}
+
+// createTableLine SHOW CREATE TABLE 中以prefix开头的列、索引或约束定义
+func createTableLine(create string, prefix string) string {
+	for _, line := range strings.Split(create, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSuffix(line, ",")
+		}
+	}
+	return ""
+}
+
+// indexPrefix 索引在 SHOW CREATE TABLE 中的定义前缀, 普通索引为 KEY, 唯一索引为 UNIQUE KEY
+func indexPrefix(o SchemaObject) []string {
+	if o.Name == "PRIMARY" {
+		return []string{"PRIMARY KEY "}
+	}
+	name := quoteIdent(o.Name)
+	return []string{"KEY " + name, "UNIQUE KEY " + name, "FULLTEXT KEY " + name, "SPATIAL KEY " + name}
+}
+
+// createDatabase 灾备集群没有的库, 定义从主集群的 SHOW CREATE DATABASE 读取
+func createDatabase(operator mapper.SqlScaleOperator, schema string) string {
+	_, rows, err := operator.DoQueryParseRows("SHOW CREATE DATABASE " + quoteIdent(schema))
+	if err != nil || len(rows) == 0 || len(rows[0]) < 2 || !strings.HasPrefix(rows[0][1], "CREATE DATABASE ") {
+		log.Println(fmt.Sprintf("读取库 %s 的定义失败: %v", schema, err))
+		return fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s;", quoteIdent(schema))
+	}
+	create := rows[0][1]
+	if !strings.HasPrefix(create, "CREATE DATABASE IF NOT EXISTS ") {
+		create = "CREATE DATABASE IF NOT EXISTS " + strings.TrimPrefix(create, "CREATE DATABASE ")
+	}
+	return create + ";"
+}
+
+// schemaDdl 根据差异生成使灾备集群与主集群一致的DDL, 定义从主集群的 SHOW CREATE 读取, 删除表和列的语句注释输出, 需要确认后手工执行.
+// SHOW CREATE 中的对象名不带库名, 每个 CREATE 之前先 USE 所在的库; targetSchemas 为灾备集群已有的库, 缺少的库先创建
+func schemaDdl(operator mapper.SqlScaleOperator, diffs []SchemaDiff, targetSchemas map[string]bool) []string {
+	creates := make(map[string]string)
+	showCreate := func(kind string, schema string, name string, column int) string {
+		key := kind + " " + quoteIdent(schema) + "." + quoteIdent(name)
+		if create, ok := creates[key]; ok {
+			return create
+		}
+		_, rows, err := operator.DoQueryParseRows("SHOW CREATE " + key)
+		if err != nil || len(rows) == 0 || len(rows[0]) <= column {
+			log.Println(fmt.Sprintf("读取 %s 的定义失败: %v", key, err))
+			return ""
+		}
+		creates[key] = rows[0][column]
+		return rows[0][column]
+	}
+	line := func(o SchemaObject, prefixes ...string) string {
+		create := showCreate("TABLE", o.Schema, o.Table, 1)
+		for _, prefix := range prefixes {
+			if l := createTableLine(create, prefix); l != "" {
+				return l
+			}
+		}
+		return ""
+	}
+
+	use := func(schema string, create string) string {
+		return fmt.Sprintf("USE %s;\n%s", quoteIdent(schema), create)
+	}
+
+	var ddl []string
+	var schemas []string
+	missing := make(map[string]bool)
+	for _, d := range diffs {
+		if d.Target == nil && !targetSchemas[d.Source.Schema] && !missing[d.Source.Schema] {
+			missing[d.Source.Schema] = true
+			schemas = append(schemas, d.Source.Schema)
+		}
+	}
+	sort.Strings(schemas)
+	for _, schema := range schemas {
+		ddl = append(ddl, createDatabase(operator, schema))
+	}
+	for _, d := range diffs {
+		o := d.Object()
+		table := quoteIdent(o.Schema) + "." + quoteIdent(o.Table)
+		name := quoteIdent(o.Schema) + "." + quoteIdent(o.Name)
+		var drop, create string
+		switch o.Kind {
+		case ObjectTable:
+			if d.Source == nil {
+				ddl = append(ddl, fmt.Sprintf("-- DROP TABLE %s;", name))
+			} else if d.Target == nil {
+				if c := showCreate("TABLE", o.Schema, o.Name, 1); c != "" {
+					ddl = append(ddl, use(o.Schema, c+";"))
+				}
+			} else {
+				ddl = append(ddl, fmt.Sprintf("ALTER TABLE %s %s;", name, d.Source.Definition))
+			}
+			continue
+		case ObjectColumn:
+			if d.Source == nil {
+				ddl = append(ddl, fmt.Sprintf("-- ALTER TABLE %s DROP COLUMN %s;", table, quoteIdent(o.Name)))
+			} else if l := line(o, quoteIdent(o.Name)+" "); l == "" {
+				continue
+			} else if d.Target == nil {
+				ddl = append(ddl, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s;", table, l))
+			} else {
+				ddl = append(ddl, fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s;", table, l))
+			}
+			continue
+		case ObjectIndex:
+			drop = fmt.Sprintf("ALTER TABLE %s DROP INDEX %s;", table, quoteIdent(o.Name))
+			if o.Name == "PRIMARY" {
+				drop = fmt.Sprintf("ALTER TABLE %s DROP PRIMARY KEY;", table)
+			}
+			if d.Source != nil {
+				if l := line(o, indexPrefix(o)...); l != "" {
+					create = fmt.Sprintf("ALTER TABLE %s ADD %s;", table, l)
+				}
+			}
+		case ObjectConstraint:
+			drop = fmt.Sprintf("ALTER TABLE %s DROP %s %s;", table, o.Type, quoteIdent(o.Name))
+			if d.Source != nil {
+				if l := line(o, "CONSTRAINT "+quoteIdent(o.Name)+" "); l != "" {
+					create = fmt.Sprintf("ALTER TABLE %s ADD %s;", table, l)
+				}
+			}
+		case ObjectView:
+			drop = fmt.Sprintf("DROP VIEW IF EXISTS %s;", name)
+			if d.Source != nil {
+				if c := showCreate("VIEW", o.Schema, o.Name, 1); c != "" {
+					create = use(o.Schema, c+";")
+				}
+			}
+		case ObjectRoutine:
+			drop = fmt.Sprintf("DROP %s IF EXISTS %s;", o.Type, name)
+			if d.Source != nil {
+				if c := showCreate(o.Type, o.Schema, o.Name, 2); c != "" {
+					create = use(o.Schema, fmt.Sprintf("DELIMITER ;;\n%s;;\nDELIMITER ;", c))
+				}
+			}
+		case ObjectTrigger:
+			drop = fmt.Sprintf("DROP TRIGGER IF EXISTS %s;", name)
+			if d.Source != nil {
+				if c := showCreate("TRIGGER", o.Schema, o.Name, 2); c != "" {
+					create = use(o.Schema, fmt.Sprintf("DELIMITER ;;\n%s;;\nDELIMITER ;", c))
+				}
+			}
+		}
+		if d.Target != nil {
+			ddl = append(ddl, drop)
+		}
+		if create != "" {
+			ddl = append(ddl, create)
+		}
+	}
+	if len(ddl) == 0 {
+		return nil
+	}
+	// 表按名称顺序创建, 外键引用的表可能在之后才创建
+	ddl = append([]string{"SET FOREIGN_KEY_CHECKS=0;"}, ddl...)
+	return append(ddl, "SET FOREIGN_KEY_CHECKS=1;")
+}
+
+func writeSchemaDiffs(w io.Writer, diffs []SchemaDiff) {
+	for _, d := range diffs {
+		fmt.Fprintf(w, "%s: %s\n", d.Status(), d.Object())
+		if d.Source != nil && d.Target != nil {
+			fmt.Fprintf(w, "  主集群:   %s\n  灾备集群: %s\n", d.Source.Definition, d.Target.Definition)
+		}
+	}
+}
+
+// DoSchemaDiff 比较主备集群的表、列、索引、约束、视图、存储过程和触发器, filter 逗号分隔的库名或库名.表名, !开头为排除
+// options 为ddl时输出使灾备集群与主集群一致的DDL, outFile 不为空时DDL写入文件
+func DoSchemaDiff(filter string, outFile string, options string) {
+	defer func() {
+		MasterSqlScaleOperator.DoClose()
+		SlaveSqlScaleOperator.DoClose()
+	}()
+
+	source, err := loadSchemaObjects(MasterSqlScaleOperator, filter)
+	if err != nil {
+		log.Println(fmt.Sprintf("读取主集群库对象失败: %s", err))
+		return
+	}
+	target, err := loadSchemaObjects(SlaveSqlScaleOperator, filter)
+	if err != nil {
+		log.Println(fmt.Sprintf("读取灾备集群库对象失败: %s", err))
+		return
+	}
+	diffs := diffSchemaObjects(source, target)
+	if len(diffs) == 0 {
+		fmt.Printf("主备集群 %d 个库对象一致\n", len(source))
+		return
+	}
+	writeSchemaDiffs(os.Stdout, diffs)
+	fmt.Printf("主集群 %d 个库对象, 灾备集群 %d 个库对象, 差异 %d 个\n", len(source), len(target), len(diffs))
+
+	if options != "ddl" && outFile == "" {
+		return
+	}
+	var out io.Writer = os.Stdout
+	if outFile != "" {
+		f, err := os.Create(outFile)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer f.Close()
+		out = f
+	}
+	targetSchemas := make(map[string]bool)
+	for _, schema := range SlaveSqlScaleOperator.DoQueryParseStrings("select schema_name from information_schema.schemata") {
+		targetSchemas[schema] = true
+	}
+	fmt.Fprintln(out, "-- 在灾备集群执行, 删除表和列的语句已注释, 确认后手工执行")
+	for _, ddl := range schemaDdl(MasterSqlScaleOperator, diffs, targetSchemas) {
+		fmt.Fprintln(out, ddl)
+	}
+}
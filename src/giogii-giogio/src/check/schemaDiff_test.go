@@ -0,0 +1,107 @@
+package check
+
+import (
+	"fmt"
+	"giogii/src/mapper"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSchemaDiff(t *testing.T) {
+	source := []SchemaObject{
+		{Kind: ObjectTable, Schema: "db", Table: "t", Name: "t", Definition: "ENGINE=InnoDB"},
+		{Kind: ObjectColumn, Schema: "db", Table: "t", Name: "id", Definition: "int NO"},
+		{Kind: ObjectColumn, Schema: "db", Table: "t", Name: "name", Definition: "varchar(64) YES"},
+		{Kind: ObjectTable, Schema: "db", Table: "orders", Name: "orders", Definition: "ENGINE=InnoDB"},
+		{Kind: ObjectColumn, Schema: "db", Table: "orders", Name: "id", Definition: "int NO"},
+		{Kind: ObjectRoutine, Schema: "db", Name: "p", Type: "PROCEDURE", Definition: "BEGIN END"},
+		{Kind: ObjectTrigger, Schema: "db", Table: "orders", Name: "trg_orders", Definition: "BEFORE INSERT SET NEW.id = 1"},
+	}
+	target := []SchemaObject{
+		{Kind: ObjectTable, Schema: "db", Table: "t", Name: "t", Definition: "ENGINE=InnoDB"},
+		{Kind: ObjectColumn, Schema: "db", Table: "t", Name: "id", Definition: "int NO"},
+		{Kind: ObjectColumn, Schema: "db", Table: "t", Name: "name", Definition: "varchar(32) YES"},
+		{Kind: ObjectIndex, Schema: "db", Table: "t", Name: "idx_name", Definition: " BTREE name"},
+		{Kind: ObjectRoutine, Schema: "db", Name: "p", Type: "FUNCTION", Definition: "RETURN 1"},
+	}
+	diffs := diffSchemaObjects(source, target)
+	// 灾备集群缺少整张表时不再列出表上的列, 但仍列出表上的触发器; 同名的存储过程和函数是不同的对象
+	var got []string
+	for _, d := range diffs {
+		got = append(got, d.Status()+" "+d.Object().String())
+	}
+	expect := []string{
+		"灾备集群缺少 TABLE db.orders",
+		"定义不同 COLUMN db.t.name",
+		"灾备集群多出 INDEX db.t.idx_name",
+		"灾备集群多出 ROUTINE FUNCTION db.p",
+		"灾备集群缺少 ROUTINE PROCEDURE db.p",
+		"灾备集群缺少 TRIGGER db.orders.trg_orders",
+	}
+	if len(got) != len(expect) {
+		t.Fatalf("unexpected diffs %v", got)
+	}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Fatalf("unexpected diffs %v", got)
+		}
+	}
+
+	create := "CREATE TABLE `t` (\n  `id` int NOT NULL,\n  `name` varchar(64) DEFAULT NULL,\n  PRIMARY KEY (`id`),\n  KEY `idx_name2` (`name`),\n  KEY `idx_name` (`name`)\n) ENGINE=InnoDB"
+	if l := createTableLine(create, "`name` "); l != "`name` varchar(64) DEFAULT NULL" {
+		t.Fatalf("unexpected column line %s", l)
+	}
+	if l := createTableLine(create, "KEY `idx_name`"); l != "KEY `idx_name` (`name`)" {
+		t.Fatalf("unexpected index line %s", l)
+	}
+}
+
+// fakeShowCreate 按语句返回预设的 SHOW CREATE 结果
+type fakeShowCreate struct {
+	mapper.SqlScaleOperator
+	rows map[string][]string
+}
+
+func (f *fakeShowCreate) DoQueryParseRows(sqlStr string) ([]string, [][]string, error) {
+	row, ok := f.rows[sqlStr]
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected sql %s", sqlStr)
+	}
+	return nil, [][]string{row}, nil
+}
+
+func TestSchemaDdl(t *testing.T) {
+	operator := &fakeShowCreate{rows: map[string][]string{
+		"SHOW CREATE DATABASE `db2`":     {"db2", "CREATE DATABASE `db2` /*!40100 DEFAULT CHARACTER SET utf8mb4 */"},
+		"SHOW CREATE TABLE `db2`.`t`":    {"t", "CREATE TABLE `t` (\n  `id` int NOT NULL\n) ENGINE=InnoDB"},
+		"SHOW CREATE TABLE `db`.`t`":     {"t", "CREATE TABLE `t` (\n  `id` int NOT NULL,\n  `name` varchar(64) DEFAULT NULL\n) ENGINE=InnoDB"},
+		"SHOW CREATE VIEW `db`.`v`":      {"v", "CREATE VIEW `v` AS select 1 AS `1`", "utf8mb4", "utf8mb4_0900_ai_ci"},
+		"SHOW CREATE PROCEDURE `db`.`p`": {"p", "", "CREATE PROCEDURE `p`() BEGIN END"},
+		"SHOW CREATE TRIGGER `db`.`trg`": {"trg", "", "CREATE TRIGGER `trg` BEFORE INSERT ON `t` FOR EACH ROW SET NEW.id = 1"},
+	}}
+	missing := func(o SchemaObject) SchemaDiff { return SchemaDiff{Source: &o} }
+	diffs := []SchemaDiff{
+		missing(SchemaObject{Kind: ObjectTable, Schema: "db2", Table: "t", Name: "t"}),
+		missing(SchemaObject{Kind: ObjectColumn, Schema: "db", Table: "t", Name: "name"}),
+		missing(SchemaObject{Kind: ObjectView, Schema: "db", Name: "v"}),
+		{Source: &SchemaObject{Kind: ObjectRoutine, Schema: "db", Name: "p", Type: "PROCEDURE", Definition: "BEGIN END"},
+			Target: &SchemaObject{Kind: ObjectRoutine, Schema: "db", Name: "p", Type: "PROCEDURE", Definition: "BEGIN SELECT 1; END"}},
+		missing(SchemaObject{Kind: ObjectTrigger, Schema: "db", Table: "t", Name: "trg"}),
+	}
+	expect := []string{
+		"SET FOREIGN_KEY_CHECKS=0;",
+		"CREATE DATABASE IF NOT EXISTS `db2` /*!40100 DEFAULT CHARACTER SET utf8mb4 */;",
+		"USE `db2`;\nCREATE TABLE `t` (\n  `id` int NOT NULL\n) ENGINE=InnoDB;",
+		"ALTER TABLE `db`.`t` ADD COLUMN `name` varchar(64) DEFAULT NULL;",
+		"USE `db`;\nCREATE VIEW `v` AS select 1 AS `1`;",
+		"DROP PROCEDURE IF EXISTS `db`.`p`;",
+		"USE `db`;\nDELIMITER ;;\nCREATE PROCEDURE `p`() BEGIN END;;\nDELIMITER ;",
+		"USE `db`;\nDELIMITER ;;\nCREATE TRIGGER `trg` BEFORE INSERT ON `t` FOR EACH ROW SET NEW.id = 1;;\nDELIMITER ;",
+		"SET FOREIGN_KEY_CHECKS=1;",
+	}
+	ddl := schemaDdl(operator, diffs, map[string]bool{"db": true})
+	if !reflect.DeepEqual(ddl, expect) {
+		t.Fatalf("unexpected ddl\n%s", strings.Join(ddl, "\n"))
+	}
+}
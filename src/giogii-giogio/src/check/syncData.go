@@ -0,0 +1,350 @@
+package check
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"giogii/src/mapper"
+	"giogii/src/topology"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/**
+数据修复: 读取checksum记录的不一致分块, 与checksum相同在同一个GTID点按主键读取主备集群分块内的行, 生成使灾备集群与主集群一致的最少的
+DELETE/UPDATE/INSERT; 执行前在新的GTID点再读取一次, 只在灾备集群暂停在该GTID时执行两次都生成的语句.
+修复语句只在灾备集群执行, 会话中关闭sql_log_bin, 避免在灾备集群产生主集群没有的GTID(errant事务);
+因为不写binlog, 灾备集群是dbscale集群时语句直接在分片的每个数据节点上执行, 否则在 -ti 连接上执行.
+*/
+
+// SyncOptions -a 逗号分隔: apply 执行修复语句, 否则只输出; batch=N 每个事务的语句数
+type SyncOptions struct {
+	Apply bool
+	Batch int
+}
+
+// ParseSyncOptions 解析 -a 参数
+func ParseSyncOptions(options string) (SyncOptions, error) {
+	o := SyncOptions{Batch: 100}
+	for _, option := range strings.Split(options, ",") {
+		option = strings.TrimSpace(option)
+		kv := strings.SplitN(option, "=", 2)
+		var err error
+		switch kv[0] {
+		case "":
+		case "apply":
+			o.Apply = true
+		case "batch":
+			if len(kv) == 2 {
+				o.Batch, err = strconv.Atoi(kv[1])
+			}
+			if err == nil && o.Batch <= 0 {
+				err = fmt.Errorf("每个事务的语句数必须大于0")
+			}
+		default:
+			err = fmt.Errorf("未知的选项")
+		}
+		if err != nil {
+			return o, fmt.Errorf("%s: %s", option, err)
+		}
+	}
+	return o, nil
+}
+
+// sqlLiteral 行数据转为SQL字面量, 非utf8的二进制数据使用十六进制
+func sqlLiteral(v sql.NullString) string {
+	if !v.Valid {
+		return "NULL"
+	}
+	if !utf8.ValidString(v.String) {
+		return "0x" + hex.EncodeToString([]byte(v.String))
+	}
+	return quoteValue(v.String)
+}
+
+// keyWhere 按主键定位一行
+func keyWhere(columns []string, keys []int, row []sql.NullString) string {
+	conds := make([]string, len(keys))
+	for i, k := range keys {
+		conds[i] = fmt.Sprintf("%s = %s", quoteIdent(columns[k]), sqlLiteral(row[k]))
+	}
+	return strings.Join(conds, " AND ")
+}
+
+func rowKey(keys []int, row []sql.NullString) string {
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		values[i] = row[k].String
+	}
+	return strings.Join(values, "\x00")
+}
+
+// syncStatements 使target与source一致的语句: 只在target中的行删除, 值不同的行只更新不同的列, 只在source中的行插入
+func syncStatements(schema string, table string, columns []string, keyColumns []string, source [][]sql.NullString, target [][]sql.NullString) ([]string, error) {
+	var keys []int
+	for _, k := range keyColumns {
+		index := -1
+		for i, c := range columns {
+			if c == k {
+				index = i
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("表 %s.%s 的列中没有主键列 %s", schema, table, k)
+		}
+		keys = append(keys, index)
+	}
+	name := fmt.Sprintf("%s.%s", quoteIdent(schema), quoteIdent(table))
+	sourceRows := make(map[string][]sql.NullString, len(source))
+	for _, row := range source {
+		sourceRows[rowKey(keys, row)] = row
+	}
+	targetRows := make(map[string][]sql.NullString, len(target))
+	var deletes, updates, inserts []string
+	for _, row := range target {
+		key := rowKey(keys, row)
+		targetRows[key] = row
+		expect, ok := sourceRows[key]
+		if !ok {
+			deletes = append(deletes, fmt.Sprintf("DELETE FROM %s WHERE %s", name, keyWhere(columns, keys, row)))
+			continue
+		}
+		var sets []string
+		for i := range columns {
+			if expect[i] != row[i] {
+				sets = append(sets, fmt.Sprintf("%s = %s", quoteIdent(columns[i]), sqlLiteral(expect[i])))
+			}
+		}
+		if len(sets) > 0 {
+			updates = append(updates, fmt.Sprintf("UPDATE %s SET %s WHERE %s", name, strings.Join(sets, ", "), keyWhere(columns, keys, row)))
+		}
+	}
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = quoteIdent(c)
+	}
+	for _, row := range source {
+		if _, ok := targetRows[rowKey(keys, row)]; ok {
+			continue
+		}
+		values := make([]string, len(row))
+		for i, v := range row {
+			values[i] = sqlLiteral(v)
+		}
+		inserts = append(inserts, fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", name, strings.Join(quoted, ", "), strings.Join(values, ", ")))
+	}
+	// 先删除再更新和插入, 避免唯一索引冲突
+	return append(append(deletes, updates...), inserts...), nil
+}
+
+// chunkRowsSql 按主键顺序读取分块内的行
+func chunkRowsSql(t *ChecksumTable, columns []string, chunk ChecksumChunk) string {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = quoteIdent(c)
+	}
+	keys := make([]string, len(t.Keys))
+	for i, k := range t.Keys {
+		keys[i] = quoteIdent(k)
+	}
+	return fmt.Sprintf("SELECT %s FROM %s.%s WHERE %s ORDER BY %s", strings.Join(quoted, ", "),
+		quoteIdent(t.Schema), quoteIdent(t.Table), chunkWhere(t.Keys, chunk.Lower, chunk.Upper), strings.Join(keys, ", "))
+}
+
+// commonStatements 两次读取都生成的语句, 按第二次的顺序
+func commonStatements(first []string, second []string) []string {
+	seen := make(map[string]bool, len(first))
+	for _, s := range first {
+		seen[s] = true
+	}
+	var common []string
+	for _, s := range second {
+		if seen[s] {
+			common = append(common, s)
+		}
+	}
+	return common
+}
+
+// chunkSyncStatements 在同一个GTID点读取主备集群的分块并生成修复语句(见 pinnedRead), 执行前在新的GTID点再读取一次校验,
+// 灾备集群停在第二次的GTID时以两次都生成的语句和GTID调用 apply, 修复语句不会覆盖之后回放的修改.
+// 分块已经一致时语句为空; 两次读取之间分块有修改时只执行两次相同的语句, stable 为false
+func chunkSyncStatements(t *ChecksumTable, columns []string, chunk ChecksumChunk, apply func(statements []string, executed string) error) (statements []string, stable bool, err error) {
+	sqlStr := chunkRowsSql(t, columns, chunk)
+	read := func(source [][][]sql.NullString) ([]string, error) {
+		_, target, err := SlaveSqlScaleOperator.DoQueryParseNullRows(sqlStr)
+		if err != nil {
+			return nil, err
+		}
+		return syncStatements(t.Schema, t.Table, columns, t.Keys, source[0], target)
+	}
+	var first []string
+	err = pinnedRead([]string{sqlStr}, defaultWaitTimeout, func(_ string, source [][][]sql.NullString) (err error) {
+		first, err = read(source)
+		return err
+	})
+	if err != nil || len(first) == 0 {
+		return nil, err == nil, err
+	}
+	err = pinnedRead([]string{sqlStr}, defaultWaitTimeout, func(executed string, source [][][]sql.NullString) error {
+		second, err := read(source)
+		if err != nil {
+			return err
+		}
+		statements = commonStatements(first, second)
+		stable = len(statements) == len(first) && len(statements) == len(second)
+		if len(statements) == 0 {
+			return nil
+		}
+		return apply(statements, executed)
+	})
+	return statements, stable, err
+}
+
+// syncTargets 执行修复语句的实例: dbscale集群为分片的全部数据节点, 多分片时行所在的分片无法确定, 返回错误
+func syncTargets(targetSocket string) ([]string, error) {
+	cluster, err := topology.Load(SlaveSqlScaleOperator)
+	if err != nil {
+		log.Println(fmt.Sprintf("读取灾备集群拓扑失败, 修复语句在 %s 上执行: %s", targetSocket, err))
+		return []string{targetSocket}, nil
+	}
+	shard, err := cluster.Shard()
+	if err != nil {
+		return nil, err
+	}
+	var sockets []string
+	for _, s := range shard.Servers {
+		sockets = append(sockets, s.Socket())
+	}
+	return sockets, nil
+}
+
+// applySyncStatements 关闭sql_log_bin后按batch条语句一个事务执行
+func applySyncStatements(operator mapper.SqlScaleOperator, statements []string, batch int) error {
+	for start := 0; start < len(statements); start += batch {
+		end := start + batch
+		if end > len(statements) {
+			end = len(statements)
+		}
+		sqls := append([]string{"SET SESSION sql_log_bin = 0", "BEGIN"}, statements[start:end]...)
+		if err := operator.DoExecInSession(append(sqls, "COMMIT")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DoSyncData 按checksum的结果修复灾备集群, filter 逗号分隔的库名或库名.表名, outFile 不为空时修复语句写入文件
+func DoSyncData(targetUserInfo string, targetSocket string, filter string, outFile string, options string) {
+	defer func() {
+		MasterSqlScaleOperator.DoClose()
+		SlaveSqlScaleOperator.DoClose()
+	}()
+
+	o, err := ParseSyncOptions(options)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	path := ChecksumStatePath(targetSocket)
+	state, err := LoadChecksumState(path, targetSocket)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var out io.Writer = os.Stdout
+	if outFile != "" {
+		f, err := os.Create(outFile)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer f.Close()
+		out = f
+	}
+	var nodes []mapper.SqlScaleOperator
+	if o.Apply {
+		sockets, err := syncTargets(targetSocket)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		for _, socket := range sockets {
+			conn, err := mapper.OpenSourceConn(targetUserInfo, socket, "information_schema")
+			if err != nil {
+				log.Println(fmt.Sprintf("连接实例 %s 失败: %s", socket, err))
+				return
+			}
+			defer conn.DoClose()
+			nodes = append(nodes, &conn)
+		}
+		log.Println(fmt.Sprintf("修复语句将在实例 %s 上执行", strings.Join(sockets, ", ")))
+	}
+
+	var total, chunks int
+	for _, t := range state.Tables {
+		if !matchTable(filter, t.Schema, t.Table) || len(t.Diffs) == 0 {
+			continue
+		}
+		if len(t.Keys) == 0 {
+			log.Println(fmt.Sprintf("表 %s 没有主键, 无法按行修复", t.Name()))
+			continue
+		}
+		columns := tableColumns(MasterSqlScaleOperator, t.Schema, t.Table)
+		for i := range t.Diffs {
+			chunk := &t.Diffs[i]
+			if chunk.Repaired {
+				continue
+			}
+			statements, stable, err := chunkSyncStatements(t, columns, *chunk, func(statements []string, executed string) error {
+				if !o.Apply {
+					return nil
+				}
+				// 数据节点都回放到该GTID后再执行, 分片内的从节点不会在修复之后再回放更早的修改
+				for _, node := range nodes {
+					if err := waitGtid(node, executed, defaultWaitTimeout); err != nil {
+						return err
+					}
+					if err := applySyncStatements(node, statements, o.Batch); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				log.Println(fmt.Sprintf("表 %s 第%d个分块修复失败: %s", t.Name(), chunk.Index, err))
+				return
+			}
+			if !stable {
+				log.Println(fmt.Sprintf("表 %s 第%d个分块在两次读取之间有修改, 只处理两次相同的 %d 条语句, 需要再次执行checksum和修复", t.Name(), chunk.Index, len(statements)))
+			}
+			if len(statements) == 0 && stable {
+				log.Println(fmt.Sprintf("表 %s 第%d个分块已经一致, 不需要修复", t.Name(), chunk.Index))
+			} else if len(statements) > 0 {
+				fmt.Fprintf(out, "-- %s #%d %s\n", t.Name(), chunk.Index, chunkWhere(t.Keys, chunk.Lower, chunk.Upper))
+				for _, s := range statements {
+					fmt.Fprintf(out, "%s;\n", s)
+				}
+				total += len(statements)
+				chunks++
+			}
+			if !o.Apply || !stable {
+				continue
+			}
+			chunk.Repaired = true
+			if err := state.Save(); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+	}
+	if o.Apply {
+		log.Println(fmt.Sprintf("修复完成, %d个分块, %d条语句, 建议再次执行checksum确认", chunks, total))
+	} else {
+		log.Println(fmt.Sprintf("%d个分块共 %d条修复语句, 未执行, 确认后使用 -a apply 执行", chunks, total))
+	}
+}
@@ -0,0 +1,92 @@
+package check
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSyncStatements(t *testing.T) {
+	v := func(values ...string) []sql.NullString {
+		row := make([]sql.NullString, len(values))
+		for i, value := range values {
+			row[i] = sql.NullString{String: value, Valid: value != "NULL"}
+		}
+		return row
+	}
+	source := [][]sql.NullString{v("1", "a", "x"), v("2", "b", "NULL"), v("4", "d", "\xff")}
+	target := [][]sql.NullString{v("1", "a", "x"), v("2", "b", ""), v("3", "c", "z")}
+	statements, err := syncStatements("db", "t", []string{"id", "name", "memo"}, []string{"id"}, source, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 相同的行不生成语句, 只更新值不同的列, NULL与空字符串不同
+	expect := []string{
+		"DELETE FROM `db`.`t` WHERE `id` = '3'",
+		"UPDATE `db`.`t` SET `memo` = NULL WHERE `id` = '2'",
+		"INSERT INTO `db`.`t` (`id`, `name`, `memo`) VALUES ('4', 'd', 0xff)",
+	}
+	if strings.Join(statements, "\n") != strings.Join(expect, "\n") {
+		t.Fatalf("unexpected statements\n%s", strings.Join(statements, "\n"))
+	}
+	if _, err := syncStatements("db", "t", []string{"name"}, []string{"id"}, source, target); err == nil {
+		t.Fatal("expect error for missing key column")
+	}
+
+	o, err := ParseSyncOptions("apply,batch=10")
+	if err != nil || !o.Apply || o.Batch != 10 {
+		t.Fatalf("unexpected options %+v %v", o, err)
+	}
+}
+
+func TestChunkSyncStatementsPinned(t *testing.T) {
+	// 主集群在每次读取时和读取之间都修改 id=1, 灾备集群在同一GTID点与主集群相同, 只缺少 id=2
+	version := func(v int64) []sql.NullString { return fakeRows("1", fmt.Sprintf("v%d", v)) }
+	r := &fakeReplication{executed: 10, applied: 10, running: true,
+		source: func(v int64) [][]sql.NullString { return [][]sql.NullString{version(v), fakeRows("2", "x")} },
+		target: func(v int64) [][]sql.NullString { return [][]sql.NullString{version(v)} },
+	}
+	useFakeReplication(t, r)
+
+	table := &ChecksumTable{Schema: "db", Table: "t", Keys: []string{"id"}}
+	var applied []string
+	statements, stable, err := chunkSyncStatements(table, []string{"id", "v"}, ChecksumChunk{}, func(statements []string, executed string) error {
+		// 执行时灾备集群停在读取的GTID点
+		if r.running || executed != fmt.Sprintf("%s:1-%d", fakeUuid, r.applied) {
+			return fmt.Errorf("slave not pinned at %s, running %v applied %d", executed, r.running, r.applied)
+		}
+		applied = statements
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"INSERT INTO `db`.`t` (`id`, `v`) VALUES ('2', 'x')"}
+	if !stable || !reflect.DeepEqual(statements, expect) || !reflect.DeepEqual(applied, expect) {
+		t.Fatalf("unexpected statements %v, applied %v", statements, applied)
+	}
+	if !r.running || r.applied != r.executed {
+		t.Fatalf("expect slave sql thread resumed, running %v applied %d executed %d", r.running, r.applied, r.executed)
+	}
+
+	// 两次读取之间 id=3 有修改, 只执行两次相同的语句
+	r.source = func(v int64) [][]sql.NullString {
+		return [][]sql.NullString{version(v), fakeRows("2", "x"), fakeRows("3", fmt.Sprintf("v%d", v))}
+	}
+	applied = nil
+	statements, stable, err = chunkSyncStatements(table, []string{"id", "v"}, ChecksumChunk{}, func(statements []string, executed string) error {
+		applied = statements
+		return nil
+	})
+	if err != nil || stable || !reflect.DeepEqual(statements, expect) || !reflect.DeepEqual(applied, expect) {
+		t.Fatalf("unexpected unstable statements %v, applied %v, stable %v, %v", statements, applied, stable, err)
+	}
+
+	// 已经一致的分块不生成语句
+	r.source = r.target
+	if statements, stable, err := chunkSyncStatements(table, []string{"id", "v"}, ChecksumChunk{}, func([]string, string) error { return nil }); err != nil || !stable || len(statements) != 0 {
+		t.Fatalf("expect no statements for converged chunk, got %v %v", statements, err)
+	}
+}
@@ -0,0 +1,253 @@
+package check
+
+import (
+	"encoding/json"
+	"fmt"
+	"giogii/src/entity"
+	"giogii/src/gtid"
+	"giogii/src/heartbeat"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReplicationSample 主备集群复制状态的一次采样
+// ByteGap 为灾备集群已回放位置到主集群当前位置之间的binlog字节数, 无法计算时为-1
+// ApplyRate/SourceRate 为灾备集群回放和主集群产生事务的速率(事务/秒), CatchUp 为预计追平的秒数, 无法追平时为-1
+// HeartbeatLag 为心跳表的延迟秒数, 没有配置心跳表时为nil
+type ReplicationSample struct {
+	Time                time.Time `json:"time"`
+	SourceFile          string    `json:"source_file"`
+	SourcePos           int64     `json:"source_pos"`
+	ReadFile            string    `json:"read_file"`
+	ReadPos             int64     `json:"read_pos"`
+	ExecFile            string    `json:"exec_file"`
+	ExecPos             int64     `json:"exec_pos"`
+	IORunning           string    `json:"io_running"`
+	SQLRunning          string    `json:"sql_running"`
+	SecondsBehindMaster *int64    `json:"seconds_behind_master"`
+	GtidGap             int64     `json:"gtid_gap"`
+	ByteGap             int64     `json:"byte_gap"`
+	ApplyRate           float64   `json:"apply_rate"`
+	SourceRate          float64   `json:"source_rate"`
+	CatchUp             int64     `json:"catch_up"`
+	HeartbeatLag        *float64  `json:"heartbeat_lag,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+
+	sourceCount int64
+	slaveCount  int64
+}
+
+// CaughtUp 复制线程正常且没有未回放的事务
+func (s ReplicationSample) CaughtUp() bool {
+	return s.IORunning == "Yes" && s.SQLRunning == "Yes" && s.GtidGap == 0
+}
+
+// ReplicationWatcher 按间隔采样复制状态, 速率取相邻采样的指数平均
+type ReplicationWatcher struct {
+	prev       *ReplicationSample
+	rated      bool
+	applyRate  float64
+	sourceRate float64
+}
+
+// newSample 由主集群和灾备集群的状态生成采样, binaryLogs为主集群 show binary logs 的文件大小, 为nil时只计算同一文件内的字节差
+func newSample(now time.Time, master entity.MasterStatus, slave entity.SlaveStatus, binaryLogs map[string]int64) (ReplicationSample, error) {
+	sample := ReplicationSample{
+		Time:       now,
+		SourceFile: master.File,
+		SourcePos:  intValue(master.Position),
+		ReadFile:   slave.MasterLogFile,
+		ReadPos:    intValue(slave.ReadMasterLogPos),
+		ExecFile:   slave.RelayMasterLogFile,
+		ExecPos:    intValue(slave.ExecMasterLogPos),
+		IORunning:  slave.SlaveIORunning,
+		SQLRunning: slave.SlaveSQLRunning,
+		ByteGap:    -1,
+	}
+	if slave.SecondsBehindMaster.Valid {
+		seconds := slave.SecondsBehindMaster.Int64
+		sample.SecondsBehindMaster = &seconds
+	}
+	if slave.LastIOError != "" {
+		sample.LastError = slave.LastIOError
+	} else if slave.LastSQLError != "" {
+		sample.LastError = slave.LastSQLError
+	}
+	masterSet, err := gtid.Parse(master.ExecutedGtidSet)
+	if err != nil {
+		return sample, fmt.Errorf("解析主集群GTID失败: %s", err)
+	}
+	slaveSet, err := gtid.Parse(slave.ExecutedGtidSet)
+	if err != nil {
+		return sample, fmt.Errorf("解析备集群GTID失败: %s", err)
+	}
+	sample.GtidGap = masterSet.Subtract(slaveSet).Count()
+	sample.sourceCount = masterSet.Count()
+	sample.slaveCount = slaveSet.Count()
+	sample.ByteGap = byteGap(sample.ExecFile, sample.ExecPos, sample.SourceFile, sample.SourcePos, binaryLogs)
+	return sample, nil
+}
+
+func intValue(v *int) int64 {
+	if v == nil {
+		return 0
+	}
+	return int64(*v)
+}
+
+// byteGap 从灾备集群已回放的位置到主集群当前位置的字节数, 跨文件时累加中间文件的大小
+func byteGap(execFile string, execPos int64, sourceFile string, sourcePos int64, binaryLogs map[string]int64) int64 {
+	if execFile == "" || sourceFile == "" {
+		return -1
+	}
+	if execFile == sourceFile {
+		return sourcePos - execPos
+	}
+	if binaryLogs == nil || execFile > sourceFile {
+		return -1
+	}
+	size, ok := binaryLogs[execFile]
+	if !ok {
+		return -1
+	}
+	gap := size - execPos + sourcePos
+	for file, size := range binaryLogs {
+		if file > execFile && file < sourceFile {
+			gap += size
+		}
+	}
+	return gap
+}
+
+// Observe 根据上一次采样计算速率和预计追平时间
+func (w *ReplicationWatcher) Observe(sample *ReplicationSample) {
+	if w.prev != nil {
+		if elapsed := sample.Time.Sub(w.prev.Time).Seconds(); elapsed > 0 {
+			apply := math.Max(0, float64(sample.slaveCount-w.prev.slaveCount)/elapsed)
+			source := math.Max(0, float64(sample.sourceCount-w.prev.sourceCount)/elapsed)
+			if w.rated {
+				w.applyRate = 0.7*w.applyRate + 0.3*apply
+				w.sourceRate = 0.7*w.sourceRate + 0.3*source
+			} else {
+				w.applyRate, w.sourceRate, w.rated = apply, source, true
+			}
+		}
+	}
+	sample.ApplyRate, sample.SourceRate = w.applyRate, w.sourceRate
+	switch {
+	case sample.GtidGap == 0:
+		sample.CatchUp = 0
+	case w.rated && w.applyRate > w.sourceRate:
+		sample.CatchUp = int64(float64(sample.GtidGap) / (w.applyRate - w.sourceRate))
+	default:
+		sample.CatchUp = -1
+	}
+	prev := *sample
+	w.prev = &prev
+}
+
+// binaryLogSizes 主集群 show binary logs 的文件大小, 不支持时返回nil
+func binaryLogSizes() map[string]int64 {
+	_, rows, err := MasterSqlScaleOperator.DoQueryParseRows("show binary logs")
+	if err != nil {
+		return nil
+	}
+	sizes := make(map[string]int64)
+	for _, row := range rows {
+		if len(row) < 2 {
+			continue
+		}
+		size, err := strconv.ParseInt(row[1], 10, 64)
+		if err != nil {
+			return nil
+		}
+		sizes[row[0]] = size
+	}
+	return sizes
+}
+
+func writeSampleHeader(w io.Writer) {
+	fmt.Fprintf(w, "%-19s %-4s %-4s %10s %14s %8s %10s %10s %10s %10s\n", "TIME", "IO", "SQL", "GTID_GAP", "BYTE_GAP", "SBM", "HEARTBEAT", "APPLY/s", "SOURCE/s", "CATCH_UP")
+}
+
+func writeSampleRow(w io.Writer, s ReplicationSample) {
+	sbm, byteGap, catchUp, lag := "NULL", "-", "-", "-"
+	if s.SecondsBehindMaster != nil {
+		sbm = strconv.FormatInt(*s.SecondsBehindMaster, 10)
+	}
+	if s.HeartbeatLag != nil {
+		lag = strconv.FormatFloat(*s.HeartbeatLag, 'f', 3, 64)
+	}
+	if s.ByteGap >= 0 {
+		byteGap = strconv.FormatInt(s.ByteGap, 10)
+	}
+	if s.CatchUp >= 0 {
+		catchUp = (time.Duration(s.CatchUp) * time.Second).String()
+	}
+	fmt.Fprintf(w, "%-19s %-4s %-4s %10d %14s %8s %10s %10.1f %10.1f %10s\n", s.Time.Format("2006-01-02 15:04:05"), s.IORunning, s.SQLRunning,
+		s.GtidGap, byteGap, sbm, lag, s.ApplyRate, s.SourceRate, catchUp)
+	if s.LastError != "" {
+		fmt.Fprintf(w, "  复制错误: %s\n", s.LastError)
+	}
+}
+
+// DoWatchReplication 按间隔轮询主集群 show master status 和灾备集群 show slave status, 输出GTID差距、字节差距、复制线程状态、回放速率及预计追平时间
+// table 不为空时同时输出心跳表的延迟, options 逗号分隔: json 每次采样输出一行json, until 追平后退出
+func DoWatchReplication(interval time.Duration, table string, options string) {
+	defer func() {
+		MasterSqlScaleOperator.DoClose()
+		SlaveSqlScaleOperator.DoClose()
+	}()
+	var jsonLines, until bool
+	for _, o := range strings.Split(options, ",") {
+		switch strings.TrimSpace(o) {
+		case "json":
+			jsonLines = true
+		case "until":
+			until = true
+		}
+	}
+
+	watcher := &ReplicationWatcher{}
+	var monitor *heartbeat.Monitor
+	if table != "" {
+		monitor = heartbeat.NewMonitor(MasterSqlScaleOperator, SlaveSqlScaleOperator, table)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for rows := 0; ; rows++ {
+		masterStatus := MasterSqlScaleOperator.DoQueryParseMaster("show master status")
+		slaveStatus := SlaveSqlScaleOperator.DoQueryParseSlave("show slave status")
+		sample, err := newSample(time.Now(), masterStatus, slaveStatus, binaryLogSizes())
+		if err != nil {
+			log.Println(err)
+		} else {
+			watcher.Observe(&sample)
+			if monitor != nil {
+				if lag, err := monitor.Lag(time.Now()); err != nil {
+					log.Println(err)
+				} else {
+					seconds := lag.Seconds()
+					sample.HeartbeatLag = &seconds
+				}
+			}
+			if jsonLines {
+				encoder.Encode(sample)
+			} else {
+				// 每20行重复输出表头
+				if rows%20 == 0 {
+					writeSampleHeader(os.Stdout)
+				}
+				writeSampleRow(os.Stdout, sample)
+			}
+			if until && sample.CaughtUp() {
+				return
+			}
+		}
+		time.Sleep(interval)
+	}
+}
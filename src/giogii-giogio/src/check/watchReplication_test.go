@@ -0,0 +1,48 @@
+package check
+
+import (
+	"database/sql"
+	"giogii/src/entity"
+	"testing"
+	"time"
+)
+
+func TestWatchReplication(t *testing.T) {
+	if gap := byteGap("mysql-bin.000009", 100, "mysql-bin.000011", 50, map[string]int64{
+		"mysql-bin.000009": 1000, "mysql-bin.000010": 500, "mysql-bin.000011": 50,
+	}); gap != 1450 {
+		t.Fatalf("unexpected byte gap %d", gap)
+	}
+	if gap := byteGap("mysql-bin.000009", 100, "mysql-bin.000011", 50, nil); gap != -1 {
+		t.Fatalf("unexpected byte gap %d", gap)
+	}
+
+	pos := 120
+	sample := func(at time.Duration, source string, slave string) ReplicationSample {
+		master := entity.MasterStatus{File: "mysql-bin.000001", Position: &pos, ExecutedGtidSet: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-" + source}
+		status := entity.SlaveStatus{RelayMasterLogFile: "mysql-bin.000001", ExecMasterLogPos: &pos, SlaveIORunning: "Yes", SlaveSQLRunning: "Yes",
+			ExecutedGtidSet: "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-" + slave, SecondsBehindMaster: sql.NullInt64{Valid: true}}
+		s, err := newSample(time.Unix(0, 0).Add(at), master, status, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	w := &ReplicationWatcher{}
+	first := sample(0, "1000", "100")
+	w.Observe(&first)
+	if first.GtidGap != 900 || first.CatchUp != -1 || first.CaughtUp() {
+		t.Fatalf("unexpected first sample %+v", first)
+	}
+	// 10秒内主集群产生100个事务, 灾备集群回放300个, 剩余700个按每秒20个追平
+	second := sample(10*time.Second, "1100", "400")
+	w.Observe(&second)
+	if second.ApplyRate != 30 || second.SourceRate != 10 || second.CatchUp != 35 {
+		t.Fatalf("unexpected second sample %+v", second)
+	}
+	done := sample(20*time.Second, "1100", "1100")
+	w.Observe(&done)
+	if !done.CaughtUp() || done.CatchUp != 0 {
+		t.Fatalf("unexpected caught up sample %+v", done)
+	}
+}
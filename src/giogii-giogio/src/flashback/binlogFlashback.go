@@ -0,0 +1,559 @@
+package flashback
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"giogii/src/gtid"
+	"giogii/src/mapper"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/google/uuid"
+	"io"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// BinlogFlashback 闪回引擎, 读取 GtidSet 之后到 EndFile:EndPos 之间的事务并生成反向事务
+type BinlogFlashback struct {
+	GtidSet string
+	EndFile string
+	EndPos  uint32
+	// ColumnResolver binlog_row_metadata不为FULL时用来查询表的列名, 按ordinal_position排序
+	ColumnResolver func(schema string, table string) []string
+
+	// Transactions 读取到的事务, 按原始提交顺序
+	Transactions []*FlashbackTrx
+
+	savedSet    *gtid.GtidSet
+	format      []byte
+	tableIDSize map[replication.EventType]int
+	checksum    bool
+	currentFile string
+	current     *FlashbackTrx
+	statement   *FlashbackStatement
+	columns     map[string][]string
+	// xid 当前XA事务的xid, prepared 已PREPARE未提交的XA事务, 按xid索引
+	xid      string
+	prepared map[string]*FlashbackTrx
+}
+
+// FlashbackTrx 一个需要闪回的事务
+type FlashbackTrx struct {
+	Gtid       string
+	Statements []*FlashbackStatement
+}
+
+// FlashbackStatement 事务中的一条语句, DML为若干TableMap加rows事件, DDL为反转后的语句
+type FlashbackStatement struct {
+	Schema    string
+	Query     string
+	TableMaps [][]byte
+	Rows      []*RowsChange
+}
+
+// RowsChange 一个rows事件, Reversed为反转后的原始事件
+type RowsChange struct {
+	EventType replication.EventType
+	Event     *replication.RowsEvent
+	Raw       []byte
+	Reversed  []byte
+}
+
+func NewBinlogFlashback(gtidSet string, endFile string, endPos uint32) *BinlogFlashback {
+	return &BinlogFlashback{
+		GtidSet: gtidSet,
+		EndFile: endFile,
+		EndPos:  endPos,
+	}
+}
+
+// Run 从reader读取binlog直到结束位点
+func (b *BinlogFlashback) Run(reader BinlogReader) error {
+	set, err := gtid.Parse(b.GtidSet)
+	if err != nil {
+		return err
+	}
+	b.savedSet = set
+	b.Transactions = nil
+	b.tableIDSize = make(map[replication.EventType]int)
+	b.columns = make(map[string][]string)
+	b.prepared = make(map[string]*FlashbackTrx)
+	b.xid = ""
+
+	reached := false
+	err = reader.ReadEvents(b.GtidSet, func(ev *replication.BinlogEvent) (bool, error) {
+		if err := b.handleEvent(ev); err != nil {
+			return false, err
+		}
+		if ev.Header.LogPos > 0 && filepath.Base(b.currentFile) == b.EndFile && ev.Header.LogPos >= b.EndPos {
+			reached = true
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if !reached {
+		return fmt.Errorf("未读取到结束位点 %s:%d", b.EndFile, b.EndPos)
+	}
+	if b.current != nil {
+		log.Println(fmt.Sprintf("结束位点处事务 %s 未提交, 忽略该事务", b.current.Gtid))
+		b.current = nil
+	}
+	for xid, trx := range b.prepared {
+		log.Println(fmt.Sprintf("结束位点处XA事务 %s(%s) 已PREPARE未提交, 忽略该事务", trx.Gtid, xid))
+	}
+	return nil
+}
+
+func (b *BinlogFlashback) handleEvent(ev *replication.BinlogEvent) error {
+	switch e := ev.Event.(type) {
+	case *replication.FormatDescriptionEvent:
+		b.format = ev.RawData
+		b.checksum = e.ChecksumAlgorithm == replication.BINLOG_CHECKSUM_ALG_CRC32
+		for _, t := range []replication.EventType{replication.TABLE_MAP_EVENT,
+			replication.WRITE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv1,
+			replication.WRITE_ROWS_EVENTv2, replication.UPDATE_ROWS_EVENTv2, replication.DELETE_ROWS_EVENTv2} {
+			b.tableIDSize[t] = 6
+			if int(t) <= len(e.EventTypeHeaderLengths) && e.EventTypeHeaderLengths[t-1] == 6 {
+				b.tableIDSize[t] = 4
+			}
+		}
+	case *replication.RotateEvent:
+		b.currentFile = string(e.NextLogName)
+	case *replication.GTIDEvent:
+		if ev.Header.EventType == replication.ANONYMOUS_GTID_EVENT {
+			return fmt.Errorf("%s 中存在匿名事务, 闪回需要开启GTID", b.currentFile)
+		}
+		u, err := uuid.FromBytes(e.SID)
+		if err != nil {
+			return err
+		}
+		if b.current != nil {
+			log.Println(fmt.Sprintf("事务 %s 未读取到提交事件, 忽略该事务", b.current.Gtid))
+		}
+		b.current = nil
+		b.statement = nil
+		b.xid = ""
+		if !b.savedSet.ContainsGtid(u.String(), e.GNO) {
+			b.current = &FlashbackTrx{Gtid: fmt.Sprintf("%s:%d", u.String(), e.GNO)}
+		}
+	case *replication.QueryEvent:
+		if b.current == nil {
+			return nil
+		}
+		query := strings.TrimSpace(string(e.Query))
+		upper := strings.ToUpper(query)
+		switch {
+		case upper == "BEGIN":
+			return nil
+		case upper == "COMMIT":
+			b.commit()
+			return nil
+		case upper == "ROLLBACK":
+			log.Println(fmt.Sprintf("事务 %s 已回滚, 忽略该事务", b.current.Gtid))
+			b.current = nil
+			b.statement = nil
+			return nil
+		case strings.HasPrefix(upper, "XA "):
+			return b.handleXA(query)
+		}
+		reversed, err := reverseDDL(string(e.Schema), query)
+		if err != nil {
+			return fmt.Errorf("事务 %s: %s", b.current.Gtid, err)
+		}
+		if reversed != "" {
+			b.current.Statements = append(b.current.Statements, &FlashbackStatement{Schema: string(e.Schema), Query: reversed})
+		}
+		// DDL自身就是一个事务
+		b.commit()
+	case *replication.XIDEvent:
+		if b.current != nil {
+			b.commit()
+		}
+	case *replication.GenericEvent:
+		// go-mysql 不解析 XA_PREPARE_LOG_EVENT, 以事件类型判断
+		if ev.Header.EventType == replication.XA_PREPARE_LOG_EVENT && b.current != nil {
+			return b.prepare()
+		}
+	case *replication.TableMapEvent:
+		if b.current == nil {
+			return nil
+		}
+		if b.statement == nil {
+			b.statement = &FlashbackStatement{}
+		}
+		b.statement.TableMaps = append(b.statement.TableMaps, ev.RawData)
+	case *replication.RowsEvent:
+		if b.current == nil {
+			return nil
+		}
+		if b.statement == nil {
+			return fmt.Errorf("事务 %s: rows事件之前没有TableMap事件", b.current.Gtid)
+		}
+		b.statement.Rows = append(b.statement.Rows, &RowsChange{EventType: ev.Header.EventType, Event: e, Raw: ev.RawData})
+		if e.Flags&replication.RowsEventStmtEndFlag > 0 {
+			if err := b.closeStatement(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// closeStatement 语句结束时倒序生成反向rows事件, STMT_END标记落在最后一个反向事件上
+func (b *BinlogFlashback) closeStatement() error {
+	s := b.statement
+	b.statement = nil
+	last := len(s.Rows) - 1
+	for i := last; i >= 0; i-- {
+		rc := s.Rows[i]
+		reversed, err := reverseRowsEvent(rc.Raw, rc.Event, b.tableIDSize[rc.EventType], b.checksum, i == 0)
+		if err != nil {
+			return fmt.Errorf("事务 %s: %s", b.current.Gtid, err)
+		}
+		rc.Reversed = reversed
+	}
+	b.current.Statements = append(b.current.Statements, s)
+	return nil
+}
+
+func (b *BinlogFlashback) commit() {
+	if b.statement != nil {
+		log.Println(fmt.Sprintf("事务 %s 存在未结束的语句, 忽略该语句", b.current.Gtid))
+		b.statement = nil
+	}
+	if len(b.current.Statements) > 0 {
+		b.Transactions = append(b.Transactions, b.current)
+	}
+	b.current = nil
+}
+
+var xaRegexp = regexp.MustCompile("(?is)^XA\\s+(START|BEGIN|END|COMMIT|ROLLBACK)\\s+(.+?)(\\s+ONE\\s+PHASE)?$")
+
+// handleXA XA事务在binlog中分为两个GTID: XA START..XA END 加 XA_PREPARE_LOG_EVENT, 以及单独的 XA COMMIT/XA ROLLBACK.
+// PREPARE的事务按xid暂存, 在 XA COMMIT 处按提交顺序加入闪回, XA ROLLBACK 丢弃; ONE PHASE 提交与普通事务相同
+func (b *BinlogFlashback) handleXA(query string) error {
+	m := xaRegexp.FindStringSubmatch(query)
+	if m == nil {
+		return fmt.Errorf("事务 %s: 无法解析的XA语句: %s", b.current.Gtid, query)
+	}
+	xid := m[2]
+	switch strings.ToUpper(m[1]) {
+	case "START", "BEGIN":
+		b.xid = xid
+	case "END":
+	case "COMMIT":
+		if m[3] != "" {
+			b.xid = ""
+			b.commit()
+			return nil
+		}
+		trx, ok := b.prepared[xid]
+		if !ok {
+			return fmt.Errorf("事务 %s: XA事务 %s 在闪回起点之前已PREPARE, 提交在闪回范围内, 无法闪回该事务的修改", b.current.Gtid, xid)
+		}
+		delete(b.prepared, xid)
+		if len(trx.Statements) > 0 {
+			b.Transactions = append(b.Transactions, trx)
+		}
+		b.current = nil
+	case "ROLLBACK":
+		delete(b.prepared, xid)
+		b.current = nil
+	}
+	return nil
+}
+
+// prepare XA事务PREPARE时暂存, 等待 XA COMMIT
+func (b *BinlogFlashback) prepare() error {
+	if b.xid == "" {
+		return fmt.Errorf("事务 %s: XA PREPARE之前没有XA START", b.current.Gtid)
+	}
+	if b.statement != nil {
+		log.Println(fmt.Sprintf("事务 %s 存在未结束的语句, 忽略该语句", b.current.Gtid))
+		b.statement = nil
+	}
+	b.prepared[b.xid] = b.current
+	b.current = nil
+	b.xid = ""
+	return nil
+}
+
+var (
+	createDatabaseRegexp = regexp.MustCompile("(?is)^CREATE\\s+(?:DATABASE|SCHEMA)\\s+(IF\\s+NOT\\s+EXISTS\\s+)?(`[^`]+`|\\w+)")
+	createTableRegexp    = regexp.MustCompile("(?is)^CREATE\\s+TABLE\\s+(IF\\s+NOT\\s+EXISTS\\s+)?((?:`[^`]+`|\\w+)(?:\\.(?:`[^`]+`|\\w+))?)")
+	renameTableRegexp    = regexp.MustCompile("(?is)^RENAME\\s+TABLE\\s+(.+)$")
+	renamePairRegexp     = regexp.MustCompile("(?is)^\\s*(\\S+)\\s+TO\\s+(\\S+)\\s*$")
+)
+
+// reverseDDL 按README支持的DDL生成反向语句, 返回空字符串表示不需要反转
+func reverseDDL(schema string, query string) (string, error) {
+	if m := createDatabaseRegexp.FindStringSubmatch(query); m != nil {
+		if m[1] != "" {
+			return "", fmt.Errorf("不支持带IF NOT EXISTS的语句: %s", query)
+		}
+		name := strings.Trim(m[2], "`")
+		if name == "dbscale" || name == "dbscale_tmp" {
+			return "", nil
+		}
+		return fmt.Sprintf("DROP DATABASE %s", quoteName(name)), nil
+	}
+	if m := createTableRegexp.FindStringSubmatch(query); m != nil {
+		if m[1] != "" {
+			return "", fmt.Errorf("不支持带IF NOT EXISTS的语句: %s", query)
+		}
+		return fmt.Sprintf("DROP TABLE %s", qualifyName(schema, m[2])), nil
+	}
+	if m := renameTableRegexp.FindStringSubmatch(query); m != nil {
+		pairs := strings.Split(m[1], ",")
+		reversed := make([]string, 0, len(pairs))
+		for i := len(pairs) - 1; i >= 0; i-- {
+			p := renamePairRegexp.FindStringSubmatch(pairs[i])
+			if p == nil {
+				return "", fmt.Errorf("无法解析的RENAME语句: %s", query)
+			}
+			reversed = append(reversed, fmt.Sprintf("%s TO %s", qualifyName(schema, p[2]), qualifyName(schema, p[1])))
+		}
+		return "RENAME TABLE " + strings.Join(reversed, ", "), nil
+	}
+	return "", fmt.Errorf("不支持闪回的语句: %s", query)
+}
+
+func qualifyName(schema string, name string) string {
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) == 2 {
+		return quoteName(strings.Trim(parts[0], "`")) + "." + quoteName(strings.Trim(parts[1], "`"))
+	}
+	return quoteName(schema) + "." + quoteName(strings.Trim(name, "`"))
+}
+
+func quoteName(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// BinlogStatements 生成应用反向binlog所需的语句, 需要在同一个会话中按顺序执行
+func (b *BinlogFlashback) BinlogStatements() []string {
+	var sqls []string
+	if b.format != nil {
+		sqls = append(sqls, binlogStatement([][]byte{b.format}))
+	}
+	for i := len(b.Transactions) - 1; i >= 0; i-- {
+		trx := b.Transactions[i]
+		isDDL := trx.Statements[0].Query != ""
+		if !isDDL {
+			sqls = append(sqls, "BEGIN")
+		}
+		for j := len(trx.Statements) - 1; j >= 0; j-- {
+			s := trx.Statements[j]
+			if s.Query != "" {
+				if s.Schema != "" {
+					sqls = append(sqls, "USE "+quoteName(s.Schema))
+				}
+				sqls = append(sqls, s.Query)
+				continue
+			}
+			events := append([][]byte{}, s.TableMaps...)
+			for k := len(s.Rows) - 1; k >= 0; k-- {
+				events = append(events, s.Rows[k].Reversed)
+			}
+			sqls = append(sqls, binlogStatement(events))
+		}
+		if !isDDL {
+			sqls = append(sqls, "COMMIT")
+		}
+	}
+	return sqls
+}
+
+// binlogStatement 与mysqlbinlog的输出一致, 每个事件单独base64编码
+func binlogStatement(events [][]byte) string {
+	var buf strings.Builder
+	buf.WriteString("BINLOG '\n")
+	for _, e := range events {
+		buf.WriteString(base64.StdEncoding.EncodeToString(e))
+		buf.WriteString("\n")
+	}
+	buf.WriteString("'")
+	return buf.String()
+}
+
+// Apply 在目标实例上回放反向binlog
+func (b *BinlogFlashback) Apply(operator mapper.SqlScaleOperator) error {
+	if len(b.Transactions) == 0 {
+		log.Println("没有需要闪回的事务")
+		return nil
+	}
+	log.Println(fmt.Sprintf("准备闪回 %d 个事务", len(b.Transactions)))
+	return operator.DoExecInSession(b.BinlogStatements())
+}
+
+// WriteSql 生成可审核的反向SQL, 事务按提交顺序倒序输出
+func (b *BinlogFlashback) WriteSql(w io.Writer) error {
+	var buf bytes.Buffer
+	for i := len(b.Transactions) - 1; i >= 0; i-- {
+		trx := b.Transactions[i]
+		buf.WriteString(fmt.Sprintf("-- flashback of %s\n", trx.Gtid))
+		isDDL := trx.Statements[0].Query != ""
+		if !isDDL {
+			buf.WriteString("BEGIN;\n")
+		}
+		for j := len(trx.Statements) - 1; j >= 0; j-- {
+			s := trx.Statements[j]
+			if s.Query != "" {
+				buf.WriteString(s.Query + ";\n")
+				continue
+			}
+			for k := len(s.Rows) - 1; k >= 0; k-- {
+				b.writeRowsSql(&buf, s.Rows[k])
+			}
+		}
+		if !isDDL {
+			buf.WriteString("COMMIT;\n")
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (b *BinlogFlashback) writeRowsSql(buf *bytes.Buffer, rc *RowsChange) {
+	e := rc.Event
+	table := qualifyName(string(e.Table.Schema), string(e.Table.Table))
+	names := b.columnNames(e.Table)
+	unsigned := e.Table.UnsignedMap()
+
+	switch rc.EventType {
+	case replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		for i := len(e.Rows) - 1; i >= 0; i-- {
+			buf.WriteString(fmt.Sprintf("DELETE FROM %s WHERE %s LIMIT 1;\n", table,
+				strings.Join(columnConditions(e.Table, names, e.Rows[i], e.SkippedColumns[i], unsigned), " AND ")))
+		}
+	case replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+		for i := len(e.Rows) - 1; i >= 0; i-- {
+			var cols []string
+			var values []string
+			for c, v := range e.Rows[i] {
+				if isSkipped(e.SkippedColumns[i], c) {
+					continue
+				}
+				cols = append(cols, quoteName(names[c]))
+				values = append(values, sqlValue(v, e.Table.ColumnType[c], unsigned[c]))
+			}
+			buf.WriteString(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s);\n", table, strings.Join(cols, ", "), strings.Join(values, ", ")))
+		}
+	case replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+		for i := len(e.Rows) - 2; i >= 0; i -= 2 {
+			var sets []string
+			for c, v := range e.Rows[i] {
+				if isSkipped(e.SkippedColumns[i], c) {
+					continue
+				}
+				sets = append(sets, fmt.Sprintf("%s=%s", quoteName(names[c]), sqlValue(v, e.Table.ColumnType[c], unsigned[c])))
+			}
+			buf.WriteString(fmt.Sprintf("UPDATE %s SET %s WHERE %s LIMIT 1;\n", table, strings.Join(sets, ", "),
+				strings.Join(columnConditions(e.Table, names, e.Rows[i+1], e.SkippedColumns[i+1], unsigned), " AND ")))
+		}
+	}
+}
+
+func (b *BinlogFlashback) columnNames(table *replication.TableMapEvent) []string {
+	if names := table.ColumnNameString(); len(names) == int(table.ColumnCount) {
+		return names
+	}
+	key := string(table.Schema) + "." + string(table.Table)
+	if names, ok := b.columns[key]; ok {
+		return names
+	}
+	var names []string
+	if b.ColumnResolver != nil {
+		names = b.ColumnResolver(string(table.Schema), string(table.Table))
+	}
+	if len(names) != int(table.ColumnCount) {
+		// 列名不可用时用@n占位, 该SQL只能用于审核
+		names = make([]string, table.ColumnCount)
+		for i := range names {
+			names[i] = "@" + strconv.Itoa(i+1)
+		}
+	}
+	b.columns[key] = names
+	return names
+}
+
+func columnConditions(table *replication.TableMapEvent, names []string, row []interface{}, skipped []int, unsigned map[int]bool) []string {
+	var conds []string
+	for c, v := range row {
+		if isSkipped(skipped, c) {
+			continue
+		}
+		if v == nil {
+			conds = append(conds, fmt.Sprintf("%s IS NULL", quoteName(names[c])))
+		} else {
+			conds = append(conds, fmt.Sprintf("%s=%s", quoteName(names[c]), sqlValue(v, table.ColumnType[c], unsigned[c])))
+		}
+	}
+	return conds
+}
+
+func isSkipped(skipped []int, c int) bool {
+	for _, s := range skipped {
+		if s == c {
+			return true
+		}
+	}
+	return false
+}
+
+func sqlValue(v interface{}, tp byte, unsigned bool) string {
+	switch x := v.(type) {
+	case nil:
+		return "NULL"
+	case int8:
+		if unsigned {
+			return strconv.FormatUint(uint64(uint8(x)), 10)
+		}
+		return strconv.FormatInt(int64(x), 10)
+	case int16:
+		if unsigned {
+			return strconv.FormatUint(uint64(uint16(x)), 10)
+		}
+		return strconv.FormatInt(int64(x), 10)
+	case int32:
+		if unsigned && tp == mysql.MYSQL_TYPE_INT24 {
+			return strconv.FormatUint(uint64(uint32(x)&0xFFFFFF), 10)
+		} else if unsigned {
+			return strconv.FormatUint(uint64(uint32(x)), 10)
+		}
+		return strconv.FormatInt(int64(x), 10)
+	case int64:
+		if unsigned {
+			return strconv.FormatUint(uint64(x), 10)
+		}
+		return strconv.FormatInt(x, 10)
+	case int:
+		return strconv.Itoa(x)
+	case float32:
+		return strconv.FormatFloat(float64(x), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	case []byte:
+		if len(x) == 0 {
+			return "''"
+		}
+		return "0x" + hex.EncodeToString(x)
+	case string:
+		return quoteString(x)
+	default:
+		return quoteString(fmt.Sprint(x))
+	}
+}
+
+func quoteString(s string) string {
+	r := strings.NewReplacer("\\", "\\\\", "'", "\\'", "\x00", "\\0", "\n", "\\n", "\r", "\\r", "\x1a", "\\Z")
+	return "'" + r.Replace(s) + "'"
+}
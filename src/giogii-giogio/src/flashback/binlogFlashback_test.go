@@ -0,0 +1,379 @@
+package flashback
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/google/uuid"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testUUID = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+
+type binlogWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *binlogWriter) event(tp replication.EventType, body []byte) uint32 {
+	if w.buf.Len() == 0 {
+		w.buf.Write(replication.BinLogFileHeader)
+	}
+	size := replication.EventHeaderSize + len(body) + 4
+	logPos := uint32(w.buf.Len() + size)
+	header := make([]byte, replication.EventHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], 1660000000)
+	header[4] = byte(tp)
+	binary.LittleEndian.PutUint32(header[5:], 1)
+	binary.LittleEndian.PutUint32(header[9:], uint32(size))
+	binary.LittleEndian.PutUint32(header[13:], logPos)
+	data := append(header, body...)
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(data))
+	w.buf.Write(data)
+	w.buf.Write(crc)
+	return logPos
+}
+
+func (w *binlogWriter) formatDescription() {
+	body := make([]byte, 2+50+4+1)
+	binary.LittleEndian.PutUint16(body, 4)
+	copy(body[2:], "8.0.26")
+	body[56] = replication.EventHeaderSize
+	lengths := make([]byte, 40)
+	lengths[replication.TABLE_MAP_EVENT-1] = 8
+	lengths[replication.WRITE_ROWS_EVENTv2-1] = 10
+	lengths[replication.UPDATE_ROWS_EVENTv2-1] = 10
+	lengths[replication.DELETE_ROWS_EVENTv2-1] = 10
+	body = append(body, lengths...)
+	body = append(body, replication.BINLOG_CHECKSUM_ALG_CRC32)
+	w.event(replication.FORMAT_DESCRIPTION_EVENT, body)
+}
+
+func (w *binlogWriter) gtid(gno int64) {
+	body := []byte{1}
+	sid := uuid.MustParse(testUUID)
+	body = append(body, sid[:]...)
+	gnoBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(gnoBytes, uint64(gno))
+	body = append(body, gnoBytes...)
+	w.event(replication.GTID_EVENT, body)
+}
+
+func (w *binlogWriter) query(schema string, query string) uint32 {
+	body := make([]byte, 13)
+	body[8] = byte(len(schema))
+	body = append(body, schema...)
+	body = append(body, 0)
+	body = append(body, query...)
+	return w.event(replication.QUERY_EVENT, body)
+}
+
+// tableMap 表 test.t1 (id int, name varchar(32), data blob)
+func (w *binlogWriter) tableMap() {
+	body := []byte{1, 0, 0, 0, 0, 0, 0, 0}
+	body = append(body, 4)
+	body = append(body, "test"...)
+	body = append(body, 0, 2)
+	body = append(body, "t1"...)
+	body = append(body, 0, 3)
+	body = append(body, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_BLOB)
+	body = append(body, 3, 128, 0, 2)
+	body = append(body, 0x06)
+	names := []byte{2, 'i', 'd', 4, 'n', 'a', 'm', 'e', 4, 'd', 'a', 't', 'a'}
+	body = append(body, replication.TABLE_MAP_OPT_META_COLUMN_NAME, byte(len(names)))
+	body = append(body, names...)
+	w.event(replication.TABLE_MAP_EVENT, body)
+}
+
+type testRow struct {
+	id   int32
+	name string
+	data []byte
+}
+
+func (r testRow) image() []byte {
+	var img []byte
+	if r.data == nil {
+		img = append(img, 0x04)
+	} else {
+		img = append(img, 0x00)
+	}
+	id := make([]byte, 4)
+	binary.LittleEndian.PutUint32(id, uint32(r.id))
+	img = append(img, id...)
+	img = append(img, byte(len(r.name)))
+	img = append(img, r.name...)
+	if r.data != nil {
+		img = append(img, byte(len(r.data)), 0)
+		img = append(img, r.data...)
+	}
+	return img
+}
+
+func (w *binlogWriter) rows(tp replication.EventType, rows ...testRow) {
+	body := []byte{1, 0, 0, 0, 0, 0, replication.RowsEventStmtEndFlag, 0, 2, 0, 3, 0x07}
+	if tp == replication.UPDATE_ROWS_EVENTv2 {
+		body = append(body, 0x07)
+	}
+	for _, r := range rows {
+		body = append(body, r.image()...)
+	}
+	w.event(tp, body)
+}
+
+func (w *binlogWriter) xid() uint32 {
+	return w.event(replication.XID_EVENT, make([]byte, 8))
+}
+
+func writeTestBinlog(t *testing.T) (string, uint32) {
+	w := &binlogWriter{}
+	w.formatDescription()
+
+	// 1 在begin阶段记录的GTID集合内, 不需要闪回
+	w.gtid(1)
+	w.query("", "BEGIN")
+	w.tableMap()
+	w.rows(replication.WRITE_ROWS_EVENTv2, testRow{1, "a", []byte("x")})
+	w.xid()
+
+	w.gtid(2)
+	w.query("", "BEGIN")
+	w.tableMap()
+	w.rows(replication.WRITE_ROWS_EVENTv2, testRow{2, "b", []byte("x")}, testRow{3, "c", nil})
+	w.xid()
+
+	w.gtid(3)
+	w.query("", "BEGIN")
+	w.tableMap()
+	w.rows(replication.UPDATE_ROWS_EVENTv2, testRow{2, "b", []byte("x")}, testRow{2, "bb", []byte("yy")})
+	w.tableMap()
+	w.rows(replication.DELETE_ROWS_EVENTv2, testRow{3, "c", nil})
+	endPos := w.xid()
+
+	w.gtid(4)
+	w.query("test", "CREATE TABLE t2 (id int primary key)")
+
+	file := filepath.Join(t.TempDir(), "greatdb-bin.000001")
+	if err := os.WriteFile(file, w.buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file, endPos
+}
+
+func TestBinlogFlashbackWriteSql(t *testing.T) {
+	file, endPos := writeTestBinlog(t)
+
+	fb := NewBinlogFlashback(testUUID+":1", "greatdb-bin.000001", endPos)
+	if err := fb.Run(&LocalBinlogReader{Files: []string{file}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fb.Transactions) != 2 {
+		t.Fatalf("expect 2 transactions, got %d", len(fb.Transactions))
+	}
+
+	var buf bytes.Buffer
+	if err := fb.WriteSql(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expect := strings.Join([]string{
+		"-- flashback of " + testUUID + ":3",
+		"BEGIN;",
+		"INSERT INTO `test`.`t1` (`id`, `name`, `data`) VALUES (3, 'c', NULL);",
+		"UPDATE `test`.`t1` SET `id`=2, `name`='b', `data`=0x78 WHERE `id`=2 AND `name`='bb' AND `data`=0x7979 LIMIT 1;",
+		"COMMIT;",
+		"-- flashback of " + testUUID + ":2",
+		"BEGIN;",
+		"DELETE FROM `test`.`t1` WHERE `id`=3 AND `name`='c' AND `data` IS NULL LIMIT 1;",
+		"DELETE FROM `test`.`t1` WHERE `id`=2 AND `name`='b' AND `data`=0x78 LIMIT 1;",
+		"COMMIT;",
+		"",
+	}, "\n")
+	if buf.String() != expect {
+		t.Fatalf("unexpected sql:\n%s", buf.String())
+	}
+}
+
+func TestBinlogFlashbackReversedEvents(t *testing.T) {
+	file, endPos := writeTestBinlog(t)
+
+	fb := NewBinlogFlashback(testUUID+":1", "greatdb-bin.000001", endPos)
+	if err := fb.Run(&LocalBinlogReader{Files: []string{file}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 反转后的事件需要能被重新解析, 且校验和正确
+	parser := replication.NewBinlogParser()
+	parser.SetVerifyChecksum(true)
+	if _, err := parser.Parse(fb.format); err != nil {
+		t.Fatal(err)
+	}
+	var types []replication.EventType
+	var rows [][][]interface{}
+	for i := len(fb.Transactions) - 1; i >= 0; i-- {
+		trx := fb.Transactions[i]
+		for j := len(trx.Statements) - 1; j >= 0; j-- {
+			s := trx.Statements[j]
+			for _, tm := range s.TableMaps {
+				if _, err := parser.Parse(tm); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for k := len(s.Rows) - 1; k >= 0; k-- {
+				ev, err := parser.Parse(s.Rows[k].Reversed)
+				if err != nil {
+					t.Fatal(err)
+				}
+				types = append(types, ev.Header.EventType)
+				rows = append(rows, ev.Event.(*replication.RowsEvent).Rows)
+			}
+		}
+	}
+
+	expectTypes := []replication.EventType{replication.WRITE_ROWS_EVENTv2, replication.UPDATE_ROWS_EVENTv2, replication.DELETE_ROWS_EVENTv2}
+	if !reflect.DeepEqual(types, expectTypes) {
+		t.Fatalf("unexpected event types %v", types)
+	}
+	expectRows := [][][]interface{}{
+		{{int32(3), "c", nil}},
+		{{int32(2), "bb", []byte("yy")}, {int32(2), "b", []byte("x")}},
+		{{int32(3), "c", nil}, {int32(2), "b", []byte("x")}},
+	}
+	if !reflect.DeepEqual(rows, expectRows) {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+
+	sqls := fb.BinlogStatements()
+	if len(sqls) != 8 || sqls[1] != "BEGIN" || sqls[4] != "COMMIT" || !strings.HasPrefix(sqls[2], "BINLOG '") {
+		t.Fatalf("unexpected statements %v", sqls)
+	}
+}
+
+func TestReverseDDL(t *testing.T) {
+	cases := map[string]string{
+		"CREATE DATABASE a":               "DROP DATABASE `a`",
+		"create table t2 (id int)":        "DROP TABLE `test`.`t2`",
+		"CREATE TABLE `db`.`t3` (id int)": "DROP TABLE `db`.`t3`",
+		"RENAME TABLE a TO b, c TO d":     "RENAME TABLE `test`.`d` TO `test`.`c`, `test`.`b` TO `test`.`a`",
+		"CREATE DATABASE dbscale_tmp":     "",
+	}
+	for query, expect := range cases {
+		reversed, err := reverseDDL("test", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reversed != expect {
+			t.Fatalf("%s: expect %s, got %s", query, expect, reversed)
+		}
+	}
+	for _, query := range []string{"CREATE TABLE IF NOT EXISTS t (id int)", "ALTER TABLE t ADD c int", "DROP TABLE t"} {
+		if _, err := reverseDDL("test", query); err == nil {
+			t.Fatalf("%s: expect error", query)
+		}
+	}
+}
+
+// xaPrepare XA_PREPARE_LOG_EVENT: one_phase, formatID, gtrid_length, bqual_length, data
+func (w *binlogWriter) xaPrepare(gtrid string) uint32 {
+	body := make([]byte, 13)
+	binary.LittleEndian.PutUint32(body[1:], 1)
+	binary.LittleEndian.PutUint32(body[5:], uint32(len(gtrid)))
+	body = append(body, gtrid...)
+	return w.event(replication.XA_PREPARE_LOG_EVENT, body)
+}
+
+func writeXaBinlog(t *testing.T) (string, uint32) {
+	w := &binlogWriter{}
+	w.formatDescription()
+
+	// 1 PREPARE 后在 2 中提交
+	w.gtid(1)
+	w.query("", "XA START X'31',X'',1")
+	w.tableMap()
+	w.rows(replication.WRITE_ROWS_EVENTv2, testRow{1, "a", nil})
+	w.query("", "XA END X'31',X'',1")
+	w.xaPrepare("1")
+
+	// 3 在 1 提交前开始的普通事务
+	w.gtid(3)
+	w.query("", "BEGIN")
+	w.tableMap()
+	w.rows(replication.WRITE_ROWS_EVENTv2, testRow{2, "b", nil})
+	w.xid()
+
+	w.gtid(2)
+	w.query("", "XA COMMIT X'31',X'',1")
+
+	// 4 PREPARE 后在 5 中回滚
+	w.gtid(4)
+	w.query("", "XA START X'32',X'',1")
+	w.tableMap()
+	w.rows(replication.WRITE_ROWS_EVENTv2, testRow{3, "c", nil})
+	w.query("", "XA END X'32',X'',1")
+	w.xaPrepare("2")
+	w.gtid(5)
+	w.query("", "XA ROLLBACK X'32',X'',1")
+
+	// 6 一阶段提交
+	w.gtid(6)
+	w.query("", "XA START X'33',X'',1")
+	w.tableMap()
+	w.rows(replication.DELETE_ROWS_EVENTv2, testRow{4, "d", nil})
+	w.query("", "XA END X'33',X'',1")
+	w.query("", "XA COMMIT X'33',X'',1 ONE PHASE")
+
+	// 7 被回滚的普通事务
+	w.gtid(7)
+	w.query("", "BEGIN")
+	w.tableMap()
+	w.rows(replication.WRITE_ROWS_EVENTv2, testRow{5, "e", nil})
+	endPos := w.query("", "ROLLBACK")
+
+	file := filepath.Join(t.TempDir(), "greatdb-bin.000001")
+	if err := os.WriteFile(file, w.buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file, endPos
+}
+
+func TestBinlogFlashbackXa(t *testing.T) {
+	file, endPos := writeXaBinlog(t)
+
+	fb := NewBinlogFlashback(testUUID+":5", "greatdb-bin.000001", endPos)
+	if err := fb.Run(&LocalBinlogReader{Files: []string{file}}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := fb.WriteSql(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expect := strings.Join([]string{
+		"-- flashback of " + testUUID + ":6",
+		"BEGIN;",
+		"INSERT INTO `test`.`t1` (`id`, `name`, `data`) VALUES (4, 'd', NULL);",
+		"COMMIT;",
+		"-- flashback of " + testUUID + ":1",
+		"BEGIN;",
+		"DELETE FROM `test`.`t1` WHERE `id`=1 AND `name`='a' AND `data` IS NULL LIMIT 1;",
+		"COMMIT;",
+		"-- flashback of " + testUUID + ":3",
+		"BEGIN;",
+		"DELETE FROM `test`.`t1` WHERE `id`=2 AND `name`='b' AND `data` IS NULL LIMIT 1;",
+		"COMMIT;",
+		"",
+	}, "\n")
+	if buf.String() != expect {
+		t.Fatalf("unexpected sql:\n%s", buf.String())
+	}
+
+	// 1 已在起点的GTID集合中(PREPARE在起点之前), 提交 2 在闪回范围内, 无法闪回
+	fb = NewBinlogFlashback(testUUID+":1", "greatdb-bin.000001", endPos)
+	if err := fb.Run(&LocalBinlogReader{Files: []string{file}}); err == nil || !strings.Contains(err.Error(), "X'31',X'',1") {
+		t.Fatalf("expect error for XA prepared before start, got %v", err)
+	}
+}
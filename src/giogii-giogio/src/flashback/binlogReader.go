@@ -0,0 +1,126 @@
+package flashback
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"os"
+	"time"
+)
+
+// OnBinlogEvent 处理一个binlog事件, 返回false表示已经读到结束位点, 不再需要后续事件
+type OnBinlogEvent func(ev *replication.BinlogEvent) (bool, error)
+
+// BinlogReader binlog事件来源, 闪回引擎对副本和本地binlog文件使用同一套处理逻辑
+type BinlogReader interface {
+	ReadEvents(gtidSet string, onEvent OnBinlogEvent) error
+}
+
+// RemoteBinlogReader 伪装成从库, 从实例上按GTID拉取binlog
+type RemoteBinlogReader struct {
+	Host     string
+	Port     uint16
+	User     string
+	Password string
+	ServerID uint32
+	// Timeout 超过该时间没有收到新事件则认为结束位点不可达
+	Timeout time.Duration
+}
+
+func (r *RemoteBinlogReader) ReadEvents(gtidSet string, onEvent OnBinlogEvent) error {
+	serverID := r.ServerID
+	if serverID == 0 {
+		serverID = uint32(os.Getpid()%10000) + 190000
+	}
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	cfg := replication.BinlogSyncerConfig{
+		ServerID: serverID,
+		Flavor:   "mysql",
+		Host:     r.Host,
+		Port:     r.Port,
+		User:     r.User,
+		Password: r.Password,
+	}
+	syncer := replication.NewBinlogSyncer(cfg)
+	defer syncer.Close()
+
+	set, err := mysql.ParseMysqlGTIDSet(gtidSet)
+	if err != nil {
+		return fmt.Errorf("解析GTID集合失败: %s", err)
+	}
+	// 只会收到不在gtidSet中的事务, 即begin之后写入的事务
+	streamer, err := syncer.StartSyncGTID(set)
+	if err != nil {
+		return err
+	}
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		ev, err := streamer.GetEvent(ctx)
+		cancel()
+		if err == context.DeadlineExceeded {
+			return fmt.Errorf("%s:%d 超过%s未收到binlog事件, 未读取到结束位点", r.Host, r.Port, timeout)
+		}
+		if err != nil {
+			return err
+		}
+		next, err := onEvent(ev)
+		if err != nil {
+			return err
+		}
+		if !next {
+			return nil
+		}
+	}
+}
+
+// LocalBinlogReader 按顺序解析本地binlog文件
+type LocalBinlogReader struct {
+	Files []string
+}
+
+func (r *LocalBinlogReader) ReadEvents(gtidSet string, onEvent OnBinlogEvent) error {
+	parser := replication.NewBinlogParser()
+	parser.SetVerifyChecksum(true)
+
+	done := false
+	for _, file := range r.Files {
+		// 与RemoteBinlogReader保持一致, 每个文件开始时先给出当前文件名
+		rotate := &replication.BinlogEvent{
+			Header: &replication.EventHeader{EventType: replication.ROTATE_EVENT},
+			Event:  &replication.RotateEvent{Position: 4, NextLogName: []byte(file)},
+		}
+		next, err := onEvent(rotate)
+		if err != nil {
+			return err
+		}
+		if !next {
+			return nil
+		}
+
+		parser.Reset()
+		err = parser.ParseFile(file, 4, func(ev *replication.BinlogEvent) error {
+			next, err := onEvent(ev)
+			if err != nil {
+				return err
+			}
+			if !next {
+				done = true
+				parser.Stop()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	return nil
+}
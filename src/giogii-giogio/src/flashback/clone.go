@@ -0,0 +1,810 @@
+package flashback
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"giogii/src/mapper"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+clone重建节点: start流程在每个节点上以在线实例的配置为模板启动一个临时实例, 临时实例依次从孤岛节点clone数据;
+stop流程停止临时实例和在线实例, 用临时实例的数据目录替换在线实例的数据目录后重新启动在线实例.
+每个节点的路径、端口等信息在discover_clone_nodes步骤中确定并记录到journal, stop流程从journal读取
+*/
+
+// 值为目录的参数
+var cloneDirKeys = map[string]bool{
+	"datadir":                   true,
+	"tmpdir":                    true,
+	"innodb_data_home_dir":      true,
+	"innodb_log_group_home_dir": true,
+	"innodb_undo_directory":     true,
+}
+
+// 值为文件的参数, 启动前创建文件所在的目录
+var cloneFileKeys = map[string]bool{
+	"socket":              true,
+	"pid_file":            true,
+	"log_error":           true,
+	"log_bin":             true,
+	"log_bin_index":       true,
+	"relay_log":           true,
+	"relay_log_index":     true,
+	"slow_query_log_file": true,
+	"general_log_file":    true,
+}
+
+// clone写入数据的目录, stop流程中与在线实例的目录交换
+var cloneSwapKeys = []string{"datadir", "innodb_data_home_dir", "innodb_log_group_home_dir", "innodb_undo_directory"}
+
+// 临时实例不沿用在线实例的参数, 由templateConfig重新设置
+var cloneOverrideKeys = map[string]bool{
+	"port":                    true,
+	"innodb_buffer_pool_size": true,
+	"mysqlx":                  true,
+	"mysqlx_port":             true,
+	"mysqlx_socket":           true,
+	"read_only":               true,
+	"super_read_only":         true,
+	"skip_slave_start":        true,
+}
+
+const clonePluginSql = "select plugin_status from information_schema.plugins where plugin_name = 'clone'"
+
+// DirSwap 用clone的目录替换在线实例的目录, 在线实例原来的目录保留为 <目录>_bak
+type DirSwap struct {
+	Live  string `json:"live"`
+	Clone string `json:"clone"`
+}
+
+// CloneInstance 一个节点的在线实例和clone临时实例
+type CloneInstance struct {
+	Node         string    `json:"node"`
+	BaseDir      string    `json:"basedir"`
+	DefaultsFile string    `json:"defaults_file"`
+	PidFile      string    `json:"pid_file"`
+	CloneDir     string    `json:"clone_dir"`
+	ClonePort    string    `json:"clone_port"`
+	CloneConfig  string    `json:"clone_config"`
+	CloneSocket  string    `json:"clone_socket"`
+	ClonePidFile string    `json:"clone_pid_file"`
+	Dirs         []string  `json:"dirs"`
+	Swaps        []DirSwap `json:"swaps"`
+	// Config 临时实例的配置内容
+	Config string `json:"config"`
+}
+
+func cloneOutput(node string) string {
+	return "clone:" + node
+}
+
+// cloneSocket 临时实例的ip:port
+func (c *CloneInstance) cloneSocket() string {
+	host, _ := splitSocket(c.Node)
+	return fmt.Sprintf("%s:%s", host, c.ClonePort)
+}
+
+func (c *CloneInstance) bin(name string) string {
+	return path.Join(c.BaseDir, "bin", name)
+}
+
+// cloneInstanceOf 读取discover_clone_nodes步骤记录的节点信息, plan模式下不存在时以占位符代替
+func cloneInstanceOf(j *Journal, node string) (*CloneInstance, error) {
+	v, err := j.MustGet(cloneOutput(node))
+	if err != nil {
+		return nil, err
+	}
+	if j.Planning && j.Get(cloneOutput(node)) == "" {
+		return &CloneInstance{
+			Node:         node,
+			BaseDir:      "<basedir>",
+			DefaultsFile: "<defaults_file>",
+			PidFile:      "<pid_file>",
+			CloneDir:     "<clone_dir>",
+			ClonePort:    "<clone_port>",
+			CloneConfig:  "<clone_dir>/my.cnf",
+			CloneSocket:  "<clone_socket>",
+			ClonePidFile: "<clone_pid_file>",
+			Dirs:         []string{"<clone_dir>"},
+			Swaps:        []DirSwap{{Live: "<datadir>", Clone: "<clone_datadir>"}},
+		}, nil
+	}
+	inst := &CloneInstance{}
+	if err := json.Unmarshal([]byte(v), inst); err != nil {
+		return nil, fmt.Errorf("解析journal中的 %s 失败: %s", cloneOutput(node), err)
+	}
+	return inst, nil
+}
+
+// cloneSettings 没有读取clone配置文件时使用默认配置
+func (s *Session) cloneSettings() *CloneSettings {
+	if s.Clone == nil {
+		return NewCloneSettings()
+	}
+	return s.Clone
+}
+
+// configOption 配置行的参数名和值, 参数名统一为小写下划线并去掉loose_前缀
+func configOption(text string) (key string, value string) {
+	kv := strings.SplitN(text, "=", 2)
+	key = strings.ToLower(strings.TrimSpace(kv[0]))
+	key = strings.TrimPrefix(strings.ReplaceAll(key, "-", "_"), "loose_")
+	if len(kv) == 2 {
+		value = strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+	}
+	return
+}
+
+func underDir(p string, dir string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// templateConfig 以在线实例的配置为模板生成临时实例配置: 实例目录替换为clone目录, 端口、buffer pool使用clone配置,
+// 关闭只读、X协议和复制线程自动启动. 返回配置内容和[mysqld]中的路径参数, 路径不在clone目录下时返回错误
+func templateConfig(live string, instanceDir string, cloneDir string, port string, bufferPool string) (string, map[string]string, error) {
+	var lines []string
+	paths := make(map[string]string)
+	section, header := "", -1
+	for _, line := range strings.Split(strings.TrimRight(live, "\n"), "\n") {
+		line = strings.ReplaceAll(line, instanceDir, cloneDir)
+		text := strings.TrimSpace(line)
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			section = strings.ToLower(strings.TrimSpace(text[1 : len(text)-1]))
+			lines = append(lines, line)
+			if section == "mysqld" && header < 0 {
+				header = len(lines)
+			}
+			continue
+		}
+		if section == "mysqld" && text != "" && !strings.HasPrefix(text, "#") && !strings.HasPrefix(text, ";") {
+			key, value := configOption(text)
+			if cloneOverrideKeys[key] {
+				continue
+			}
+			if cloneDirKeys[key] || cloneFileKeys[key] {
+				paths[key] = value
+			}
+		}
+		lines = append(lines, line)
+	}
+	if header < 0 {
+		return "", nil, fmt.Errorf("配置中没有[mysqld]")
+	}
+	if paths["datadir"] == "" || paths["socket"] == "" {
+		return "", nil, fmt.Errorf("配置中缺少datadir或socket")
+	}
+	for key, value := range paths {
+		if strings.HasPrefix(value, "/") && !underDir(value, cloneDir) {
+			return "", nil, fmt.Errorf("参数 %s = %s 不在实例目录 %s 下, 临时实例会与在线实例冲突", key, value, instanceDir)
+		}
+	}
+	overrides := []string{
+		"# clone临时实例",
+		"port = " + port,
+		"innodb_buffer_pool_size = " + bufferPool,
+		"loose_mysqlx = OFF",
+		"read_only = OFF",
+		"super_read_only = OFF",
+		"skip_slave_start = ON",
+	}
+	if paths["pid_file"] == "" {
+		paths["pid_file"] = path.Join(cloneDir, "mysqld.pid")
+		overrides = append(overrides, "pid_file = "+paths["pid_file"])
+	}
+	lines = append(lines[:header], append(overrides, lines[header:]...)...)
+	return strings.Join(lines, "\n") + "\n", paths, nil
+}
+
+// cloneDirs 临时实例启动前需要创建的目录
+func cloneDirs(cloneDir string, paths map[string]string) []string {
+	dirs := map[string]bool{cloneDir: true}
+	for key, value := range paths {
+		if !strings.HasPrefix(value, "/") {
+			continue
+		}
+		if cloneDirKeys[key] {
+			dirs[value] = true
+		} else {
+			dirs[path.Dir(value)] = true
+		}
+	}
+	var all []string
+	for d := range dirs {
+		all = append(all, d)
+	}
+	sort.Strings(all)
+	return all
+}
+
+// cloneSwaps clone写入数据的目录, 已经包含在其他目录中的不再单独交换
+func cloneSwaps(instanceDir string, cloneDir string, paths map[string]string) []DirSwap {
+	var dirs []string
+	for _, key := range cloneSwapKeys {
+		if value := paths[key]; strings.HasPrefix(value, "/") {
+			dirs = append(dirs, path.Clean(value))
+		}
+	}
+	sort.Strings(dirs)
+	var swaps []DirSwap
+	for _, d := range dirs {
+		if len(swaps) > 0 && underDir(d, swaps[len(swaps)-1].Clone) {
+			continue
+		}
+		swaps = append(swaps, DirSwap{Live: instanceDir + strings.TrimPrefix(d, cloneDir), Clone: d})
+	}
+	return swaps
+}
+
+// freePort 选择范围内没有监听且本次流程没有分配过的端口, listening为ss或netstat的输出
+func freePort(listening string, min int, max int, reserved map[int]bool) (int, error) {
+	used := make(map[int]bool)
+	for _, field := range strings.Fields(listening) {
+		i := strings.LastIndex(field, ":")
+		if i < 0 {
+			continue
+		}
+		if p, err := strconv.Atoi(field[i+1:]); err == nil {
+			used[p] = true
+		}
+	}
+	for p := min; p <= max; p++ {
+		if !used[p] && !reserved[p] {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("端口 %d-%d 全部被占用", min, max)
+}
+
+// reservePort 为主机上的临时实例分配端口, 同一主机上的多个节点不会分配到相同端口
+func (s *Session) reservePort(host string, listening string) (int, error) {
+	settings := s.cloneSettings()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ports == nil {
+		s.ports = make(map[string]map[int]bool)
+	}
+	if s.ports[host] == nil {
+		s.ports[host] = make(map[int]bool)
+	}
+	port, err := freePort(listening, settings.PortMin, settings.PortMax, s.ports[host])
+	if err != nil {
+		return 0, err
+	}
+	s.ports[host][port] = true
+	return port, nil
+}
+
+// discoverInstance 读取在线实例的目录和配置文件, 生成临时实例的配置
+func (s *Session) discoverInstance(ctx context.Context, node string) (*CloneInstance, error) {
+	settings := s.cloneSettings()
+	conn, err := mapper.OpenSourceConn(s.TargetUserInfo, node, "")
+	if err != nil {
+		return nil, fmt.Errorf("连接 %s 失败: %s", node, err)
+	}
+	defer conn.DoClose()
+	_, rows, err := conn.DoQueryParseRows("select @@basedir, @@datadir, @@pid_file")
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) != 1 {
+		return nil, fmt.Errorf("%s 读取实例目录失败", node)
+	}
+	host, port := splitSocket(node)
+	inst := &CloneInstance{
+		Node:         node,
+		BaseDir:      settings.path(settings.BaseDir, port),
+		DefaultsFile: settings.path(settings.DefaultsFile, port),
+		PidFile:      rows[0][2],
+		CloneDir:     settings.path(settings.CloneDir, port),
+	}
+	if inst.BaseDir == "" {
+		inst.BaseDir = path.Clean(rows[0][0])
+	}
+	instanceDir := settings.path(settings.InstanceDir, port)
+	if instanceDir == "" {
+		instanceDir = path.Dir(path.Clean(rows[0][1]))
+	}
+	if inst.CloneDir == "" {
+		inst.CloneDir = path.Join(path.Dir(instanceDir), "clonebackup")
+	}
+	if !path.IsAbs(inst.CloneDir) || strings.Count(path.Clean(inst.CloneDir), "/") < 2 ||
+		underDir(inst.CloneDir, instanceDir) || underDir(instanceDir, inst.CloneDir) {
+		return nil, fmt.Errorf("clone目录 %s 与实例目录 %s 冲突", inst.CloneDir, instanceDir)
+	}
+	if inst.DefaultsFile == "" {
+		out, err := s.run(ctx, node, fmt.Sprintf("tr '\\0' '\\n' < /proc/$(cat %s)/cmdline | sed -n 's/^--defaults-file=//p'", inst.PidFile), "")
+		inst.DefaultsFile = strings.TrimSpace(out)
+		if err != nil || inst.DefaultsFile == "" {
+			return nil, fmt.Errorf("无法从mysqld进程读取 %s 的配置文件, 请在clone配置中设置defaults_file", node)
+		}
+	}
+	live, err := s.run(ctx, node, "cat "+inst.DefaultsFile, "")
+	if err != nil {
+		return nil, fmt.Errorf("读取 %s 的配置文件 %s 失败: %s", node, inst.DefaultsFile, err)
+	}
+	listening, err := s.run(ctx, node, "ss -Htln 2>/dev/null || netstat -tln", "")
+	if err != nil {
+		return nil, fmt.Errorf("读取 %s 的监听端口失败: %s", node, err)
+	}
+	clonePort, err := s.reservePort(host, listening)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", node, err)
+	}
+	inst.ClonePort = strconv.Itoa(clonePort)
+	config, paths, err := templateConfig(live, instanceDir, inst.CloneDir, inst.ClonePort, settings.BufferPool)
+	if err != nil {
+		return nil, fmt.Errorf("%s 的配置文件 %s: %s", node, inst.DefaultsFile, err)
+	}
+	inst.Config = config
+	inst.CloneConfig = path.Join(inst.CloneDir, "my.cnf")
+	inst.CloneSocket = paths["socket"]
+	inst.ClonePidFile = paths["pid_file"]
+	inst.Dirs = cloneDirs(inst.CloneDir, paths)
+	inst.Swaps = cloneSwaps(instanceDir, inst.CloneDir, paths)
+	return inst, nil
+}
+
+// installClonePlugin clone插件未安装时安装, 实例开启super_read_only时临时关闭
+func installClonePlugin(conn mapper.SqlScaleOperator) error {
+	if conn.DoQueryParseSingleValue(clonePluginSql) == "ACTIVE" {
+		return nil
+	}
+	if conn.DoQueryParseSingleValue("select @@super_read_only") == "1" {
+		if err := conn.DoExec("SET GLOBAL super_read_only = OFF"); err != nil {
+			return err
+		}
+		defer func() {
+			if err := conn.DoExec("SET GLOBAL super_read_only = ON"); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+	return conn.DoExec("INSTALL PLUGIN clone SONAME 'mysql_clone.so'")
+}
+
+// sqlQuote SQL字符串中的引号和反斜杠转义
+func sqlQuote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+// nodeSql 直接连接数据节点, 在同一个会话中执行
+func (s *Session) nodeSql(node string, sqls []string, secret string) Action {
+	return Action{
+		Kind:    ActionSql,
+		Target:  node,
+		Command: maskSecret(strings.Join(sqls, "; "), secret),
+		run: func(ctx context.Context) error {
+			conn, err := mapper.OpenSourceConn(s.TargetUserInfo, node, "")
+			if err != nil {
+				return fmt.Errorf("连接 %s 失败: %s", node, err)
+			}
+			defer conn.DoClose()
+			if err := conn.DoExecInSession(sqls); err != nil {
+				return fmt.Errorf("%s: %s", node, maskSecret(err.Error(), secret))
+			}
+			return nil
+		},
+	}
+}
+
+// shutdown 通过SQL停止实例, 无法连接时认为实例已经停止, 由之后的等待确认进程退出
+func (s *Session) shutdown(target string) Action {
+	return Action{
+		Kind:    ActionSql,
+		Target:  target,
+		Command: "SHUTDOWN",
+		run: func(ctx context.Context) error {
+			conn, err := mapper.OpenSourceConn(s.TargetUserInfo, target, "")
+			if err != nil {
+				log.Println(fmt.Sprintf("%s 无法连接, 跳过SHUTDOWN: %s", target, err))
+				return nil
+			}
+			defer conn.DoClose()
+			return conn.DoExec("SHUTDOWN")
+		},
+	}
+}
+
+// waitStopped 等待pid文件中的进程退出
+func (s *Session) waitStopped(node string, desc string, pidFile string) Action {
+	shell := fmt.Sprintf("pid=$(cat %s 2>/dev/null); test -z \"$pid\" || ! kill -0 $pid 2>/dev/null", pidFile)
+	return s.waitShell(node, desc, s.cloneSettings().StartTimeout, shell, "")
+}
+
+// waitSql 轮询直到可以连接节点上的实例
+func (s *Session) waitSql(target string, desc string) Action {
+	return Action{
+		Kind:    ActionWait,
+		Target:  target,
+		Command: fmt.Sprintf("%s, 轮询连接 %s", desc, target),
+		run: func(ctx context.Context) error {
+			return waitFor(ctx, desc, s.cloneSettings().StartTimeout, 5*time.Second, func() (bool, error) {
+				conn, err := mapper.OpenSourceConn(s.TargetUserInfo, target, "")
+				if err != nil {
+					return false, err
+				}
+				conn.DoClose()
+				return true, nil
+			})
+		},
+	}
+}
+
+// uploadContent 把内容写入临时文件后上传到节点
+func (s *Session) uploadContent(node string, desc string, content string, remoteFile string) Action {
+	return Action{
+		Kind:    ActionUpload,
+		Target:  node,
+		Command: fmt.Sprintf("<%s> -> %s", desc, remoteFile),
+		run: func(ctx context.Context) error {
+			if s.Exec == nil {
+				return fmt.Errorf("没有配置 %s 的执行器", node)
+			}
+			f, err := os.CreateTemp("", "giogii-*")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(f.Name())
+			if _, err := f.WriteString(content); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			return s.Exec.Upload(ctx, node, f.Name(), remoteFile)
+		},
+	}
+}
+
+// startMysqld 在节点上通过mysqld_safe启动实例
+func (s *Session) startMysqld(inst *CloneInstance, defaultsFile string, logFile string) Action {
+	return s.shell(inst.Node, fmt.Sprintf("nohup %s --defaults-file=%s --user=%s > %s 2>&1 < /dev/null &",
+		inst.bin("mysqld_safe"), defaultsFile, s.cloneSettings().OsUser, logFile), "")
+}
+
+// prepareCloneActions 停止并清理上一次的临时实例, 按模板配置初始化、启动临时实例并创建灾备集群用户
+func (s *Session) prepareCloneActions(inst *CloneInstance) []Action {
+	settings := s.cloneSettings()
+	user, password := s.targetUser()
+	node := inst.Node
+	mysql := fmt.Sprintf("%s -uroot -S %s", inst.bin("mysql"), inst.CloneSocket)
+	grant := fmt.Sprintf("CREATE USER IF NOT EXISTS '%s'@'%%' IDENTIFIED BY '%s'; GRANT ALL ON *.* TO '%s'@'%%' WITH GRANT OPTION;", user, sqlQuote(password), user)
+	all := []Action{
+		// 只停止通过clone配置启动的进程, 避免pid文件残留时误杀其他进程
+		s.shell(node, fmt.Sprintf("pid=$(cat %s 2>/dev/null); if [ -n \"$pid\" ] && grep -qs %s /proc/$pid/cmdline; then kill $pid; fi", inst.ClonePidFile, inst.CloneConfig), ""),
+		s.waitStopped(node, "上一次的clone实例停止", inst.ClonePidFile),
+		s.shell(node, fmt.Sprintf("rm -rf %s && mkdir -p %s && { [ $(id -u) -ne 0 ] || chown -R %s %s; }",
+			inst.CloneDir, strings.Join(inst.Dirs, " "), settings.OsUser, inst.CloneDir), ""),
+		s.uploadContent(node, "clone实例配置", inst.Config, inst.CloneConfig),
+		s.shell(node, fmt.Sprintf("%s --defaults-file=%s --initialize-insecure --user=%s", inst.bin("mysqld"), inst.CloneConfig, settings.OsUser), ""),
+		s.startMysqld(inst, inst.CloneConfig, path.Join(inst.CloneDir, "mysqld_safe.log")),
+		s.waitShell(node, "clone实例启动", settings.StartTimeout, mysql+" -e 'select 1'", ""),
+		s.shell(node, fmt.Sprintf("%s -e %s", mysql, shellQuote(grant)), password),
+	}
+	for i := range all {
+		all[i].Batch = "init"
+	}
+	return all
+}
+
+// cloneAction 临时实例从孤岛节点clone数据
+func (s *Session) cloneAction(inst *CloneInstance, donor string) Action {
+	user, password := s.targetUser()
+	host, port := splitSocket(donor)
+	cloneSql := fmt.Sprintf("CLONE INSTANCE FROM '%s'@'%s':%s IDENTIFIED BY '%s'", user, host, port, sqlQuote(password))
+	return Action{
+		Kind:    ActionSql,
+		Target:  inst.cloneSocket(),
+		Command: maskSecret(cloneSql, sqlQuote(password)),
+		run: func(ctx context.Context) error {
+			return s.cloneInstance(ctx, inst, donor, cloneSql)
+		},
+	}
+}
+
+// cloneInstance 执行CLONE INSTANCE并由CloneMonitor跟踪进度, 阶段失败、停滞或超时时KILL clone语句并使流程失败;
+// clone完成后临时实例由mysqld_safe重启, 语句的连接会断开,
+// 因此以重启后performance_schema.clone_status的状态作为结果
+func (s *Session) cloneInstance(ctx context.Context, inst *CloneInstance, donor string, cloneSql string) error {
+	_, password := s.targetUser()
+	settings := s.cloneSettings()
+	target := inst.cloneSocket()
+	conn, err := mapper.OpenSourceConn(s.TargetUserInfo, target, "")
+	if err != nil {
+		return fmt.Errorf("连接clone实例 %s 失败: %s", target, err)
+	}
+	defer conn.DoClose()
+	if err := installClonePlugin(&conn); err != nil {
+		return err
+	}
+	if err := conn.DoExec(fmt.Sprintf("SET GLOBAL clone_autotune_concurrency = OFF, clone_max_concurrency = 32, clone_buffer_size = 33554432, clone_valid_donor_list = '%s'", donor)); err != nil {
+		return err
+	}
+
+	log.Println(fmt.Sprintf("%s 开始clone %s", target, donor))
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.DoExec(cloneSql)
+	}()
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	timeout := time.NewTimer(settings.CloneTimeout)
+	defer timeout.Stop()
+	monitor := NewCloneMonitor(target, settings.StallTimeout, time.Now())
+	var cloneErr error
+	for running := true; running; {
+		select {
+		case cloneErr = <-done:
+			running = false
+		case <-ticker.C:
+			if err := observeClone(monitor, &conn); err != nil {
+				alertClone(err)
+				killClone(&conn)
+				return err
+			}
+		case <-ctx.Done():
+			killClone(&conn)
+			return ctx.Err()
+		case <-timeout.C:
+			err := fmt.Errorf("%s clone超时", target)
+			alertClone(err)
+			killClone(&conn)
+			return err
+		}
+	}
+
+	var state, errNo, message string
+	err = waitFor(ctx, "clone实例重启", settings.StartTimeout, 5*time.Second, func() (bool, error) {
+		_, rows, err := conn.DoQueryParseRows("select state, error_no, error_message from performance_schema.clone_status")
+		if err != nil {
+			return false, err
+		}
+		if len(rows) == 0 {
+			return false, fmt.Errorf("clone_status为空")
+		}
+		state, errNo, message = rows[0][0], rows[0][1], rows[0][2]
+		return state != "In Progress" && state != "Not Started", nil
+	})
+	if err != nil {
+		if cloneErr != nil {
+			return fmt.Errorf("%s clone失败: %s", target, maskSecret(cloneErr.Error(), sqlQuote(password)))
+		}
+		return err
+	}
+	if state != "Completed" {
+		err := fmt.Errorf("%s clone失败: %s, error_no: %s, %s", target, state, errNo, message)
+		alertClone(err)
+		return err
+	}
+	log.Println(fmt.Sprintf("%s clone完成", target))
+	return nil
+}
+
+// observeClone 读取clone_progress并输出进度, 查询失败时(例如RESTART阶段)只检查是否停滞
+func observeClone(monitor *CloneMonitor, conn mapper.SqlScaleOperator) error {
+	_, rows, err := conn.DoQueryParseRows(cloneProgressSql)
+	if err != nil {
+		log.Println(fmt.Sprintf("%s 读取clone进度失败: %s", monitor.Target, err))
+		return monitor.Stalled(time.Now())
+	}
+	progress, err := monitor.Observe(time.Now(), parseCloneStages(rows))
+	log.Println(fmt.Sprintf("%s clone %s", monitor.Target, progress))
+	return err
+}
+
+// killClone 终止正在执行的clone语句
+func killClone(conn mapper.SqlScaleOperator) {
+	pid := conn.DoQueryParseSingleValue("select pid from performance_schema.clone_status where state = 'In Progress'")
+	if pid == "" {
+		return
+	}
+	if err := conn.DoExec("KILL QUERY " + pid); err != nil {
+		log.Println(err)
+	}
+}
+
+// swapShell 交换数据目录, clone目录不存在时说明已经交换过, 可以重复执行
+func swapShell(swaps []DirSwap) string {
+	var cmds []string
+	for _, d := range swaps {
+		cmds = append(cmds, fmt.Sprintf("if [ -d %[2]s ]; then rm -rf %[1]s_bak && mv %[1]s %[1]s_bak && mv %[2]s %[1]s; fi", d.Live, d.Clone))
+	}
+	return strings.Join(cmds, " && ")
+}
+
+// unswapShell 还原在线实例原来的数据目录, clone的数据移回clone目录
+func unswapShell(swaps []DirSwap) string {
+	var cmds []string
+	for _, d := range swaps {
+		cmds = append(cmds, fmt.Sprintf("if [ -d %[1]s_bak ]; then mkdir -p %[3]s && rm -rf %[2]s && mv %[1]s %[2]s && mv %[1]s_bak %[1]s; fi", d.Live, d.Clone, path.Dir(d.Clone)))
+	}
+	return strings.Join(cmds, " && ")
+}
+
+// cloneStep 对每个clone节点生成动作, 同一批次中各节点并发执行
+func (s *Session) cloneStep(j *Journal, batch string, build func(inst *CloneInstance) []Action) ([]Action, error) {
+	var all []Action
+	for _, node := range cloneNodes(j) {
+		inst, err := cloneInstanceOf(j, node)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range build(inst) {
+			a.Batch = batch
+			all = append(all, a)
+		}
+	}
+	return all, nil
+}
+
+/**
+start流程的clone步骤
+*/
+
+func (s *Session) installClonePluginStep() Step {
+	return Step{
+		Name: "install_clone_plugin",
+		Desc: "孤岛节点安装clone插件",
+		Actions: func(j *Journal) ([]Action, error) {
+			island := islandNode(j)
+			return []Action{{
+				Kind:    ActionSql,
+				Target:  island,
+				Command: "INSTALL PLUGIN clone SONAME 'mysql_clone.so'",
+				run: func(ctx context.Context) error {
+					conn, err := mapper.OpenSourceConn(s.TargetUserInfo, island, "")
+					if err != nil {
+						return fmt.Errorf("连接 %s 失败: %s", island, err)
+					}
+					defer conn.DoClose()
+					return installClonePlugin(&conn)
+				},
+			}}, nil
+		},
+	}
+}
+
+func (s *Session) discoverCloneNodesStep() Step {
+	return Step{
+		Name: "discover_clone_nodes",
+		Desc: "读取clone节点的实例目录和配置, 生成临时实例配置",
+		Actions: func(j *Journal) ([]Action, error) {
+			var all []Action
+			for _, node := range cloneNodes(j) {
+				node := node
+				all = append(all, Action{
+					Kind:    ActionQuery,
+					Target:  node,
+					Command: "select @@basedir, @@datadir, @@pid_file; 读取实例配置文件, 选择临时实例端口",
+					Batch:   "discover",
+					run: func(ctx context.Context) error {
+						inst, err := s.discoverInstance(ctx, node)
+						if err != nil {
+							return err
+						}
+						data, err := json.Marshal(inst)
+						if err != nil {
+							return err
+						}
+						log.Println(fmt.Sprintf("%s clone实例: %s, 目录 %s", node, inst.cloneSocket(), inst.CloneDir))
+						j.Set(cloneOutput(node), string(data))
+						return nil
+					},
+				})
+			}
+			return all, nil
+		},
+	}
+}
+
+func (s *Session) prepareCloneInstancesStep() Step {
+	return Step{
+		Name: "prepare_clone_instances",
+		Desc: "初始化并启动clone临时实例",
+		Actions: func(j *Journal) ([]Action, error) {
+			return s.cloneStep(j, "init", s.prepareCloneActions)
+		},
+	}
+}
+
+// cloneNodesStep 孤岛节点同一时间只能作为一个clone的数据源, 各节点依次clone
+func (s *Session) cloneNodesStep() Step {
+	return Step{
+		Name: "clone_nodes",
+		Desc: "其余节点clone孤岛节点",
+		Actions: func(j *Journal) ([]Action, error) {
+			island := islandNode(j)
+			return s.cloneStep(j, "", func(inst *CloneInstance) []Action {
+				return []Action{s.cloneAction(inst, island)}
+			})
+		},
+	}
+}
+
+/**
+stop流程用clone的数据替换在线实例, 每个步骤都可以回滚到上一个状态
+*/
+
+func (s *Session) stopInstancesStep() Step {
+	return Step{
+		Name: "stop_instances",
+		Desc: "停止clone实例和在线实例",
+		Actions: func(j *Journal) ([]Action, error) {
+			return s.cloneStep(j, "stop", func(inst *CloneInstance) []Action {
+				return []Action{
+					s.shutdown(inst.cloneSocket()),
+					s.waitStopped(inst.Node, "clone实例停止", inst.ClonePidFile),
+					s.shutdown(inst.Node),
+					s.waitStopped(inst.Node, "在线实例停止", inst.PidFile),
+				}
+			})
+		},
+		Rollback: func(j *Journal) ([]Action, error) {
+			return s.cloneStep(j, "start", s.startInstanceActions)
+		},
+	}
+}
+
+func (s *Session) swapDataDirStep() Step {
+	return Step{
+		Name: "swap_datadir",
+		Desc: "用clone的数据目录替换在线实例的数据目录, 原目录保留为 <目录>_bak",
+		Actions: func(j *Journal) ([]Action, error) {
+			return s.cloneStep(j, "swap", func(inst *CloneInstance) []Action {
+				return []Action{s.shell(inst.Node, swapShell(inst.Swaps), "")}
+			})
+		},
+		Rollback: func(j *Journal) ([]Action, error) {
+			return s.cloneStep(j, "swap", func(inst *CloneInstance) []Action {
+				return []Action{s.shell(inst.Node, unswapShell(inst.Swaps), "")}
+			})
+		},
+	}
+}
+
+func (s *Session) startInstanceActions(inst *CloneInstance) []Action {
+	return []Action{
+		s.startMysqld(inst, inst.DefaultsFile, "/dev/null"),
+		s.waitSql(inst.Node, "实例启动"),
+	}
+}
+
+func (s *Session) startInstancesStep() Step {
+	return Step{
+		Name: "start_instances",
+		Desc: "启动替换数据后的实例",
+		Actions: func(j *Journal) ([]Action, error) {
+			start, err := s.cloneStep(j, "start", s.startInstanceActions)
+			if err != nil {
+				return nil, err
+			}
+			return actions(start, s.EnableReadOnly()), nil
+		},
+		Rollback: func(j *Journal) ([]Action, error) {
+			return s.cloneStep(j, "stop", func(inst *CloneInstance) []Action {
+				return []Action{s.shutdown(inst.Node), s.waitStopped(inst.Node, "在线实例停止", inst.PidFile)}
+			})
+		},
+	}
+}
+
+func (s *Session) removeCloneDirsStep() Step {
+	return Step{
+		Name: "remove_clone_dirs",
+		Desc: "删除clone临时实例目录",
+		Actions: func(j *Journal) ([]Action, error) {
+			return s.cloneStep(j, "cleanup", func(inst *CloneInstance) []Action {
+				return []Action{s.shell(inst.Node, "rm -rf "+inst.CloneDir, "")}
+			})
+		},
+	}
+}
@@ -0,0 +1,125 @@
+package flashback
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CloneStage performance_schema.clone_progress的一行, 阶段依次为 DROP DATA、FILE COPY、PAGE COPY、REDO COPY、FILE SYNC、RESTART、RECOVERY
+type CloneStage struct {
+	Stage    string
+	State    string
+	Estimate int64
+	Data     int64
+}
+
+const cloneProgressSql = "select stage, state, estimate, data from performance_schema.clone_progress"
+
+// parseCloneStages 解析clone_progress的查询结果
+func parseCloneStages(rows [][]string) []CloneStage {
+	var stages []CloneStage
+	for _, row := range rows {
+		estimate, _ := strconv.ParseInt(row[2], 10, 64)
+		data, _ := strconv.ParseInt(row[3], 10, 64)
+		stages = append(stages, CloneStage{Stage: row[0], State: row[1], Estimate: estimate, Data: data})
+	}
+	return stages
+}
+
+// CloneProgress 一次采样的汇总: 各阶段合计的已复制和预计数据量, 最近一段时间的速率及预计完成时间
+type CloneProgress struct {
+	Stage    string
+	Data     int64
+	Estimate int64
+	// Rate 每秒复制的字节数
+	Rate float64
+	// Finish 预计完成时间, 速率未知时为零值
+	Finish time.Time
+}
+
+func (p CloneProgress) String() string {
+	s := fmt.Sprintf("阶段 %s, 已复制 %dMB/%dMB", p.Stage, p.Data>>20, p.Estimate>>20)
+	if p.Estimate > 0 {
+		s += fmt.Sprintf(" (%.1f%%)", float64(p.Data)*100/float64(p.Estimate))
+	}
+	if p.Rate > 0 {
+		s += fmt.Sprintf(", %.1fMB/s", p.Rate/(1<<20))
+	}
+	if !p.Finish.IsZero() {
+		s += fmt.Sprintf(", 预计 %s 完成", p.Finish.Format("2006-01-02 15:04:05"))
+	}
+	return s
+}
+
+// CloneMonitor 跟踪一个接收端实例的clone进度, 阶段失败或数据量长时间没有变化时返回错误
+type CloneMonitor struct {
+	Target string
+	// StallTimeout 超过该时间没有进展认为clone停滞
+	StallTimeout time.Duration
+
+	stage      string
+	data       int64
+	sampled    time.Time
+	progressed time.Time
+	rate       float64
+}
+
+// NewCloneMonitor 从now开始计算停滞时间
+func NewCloneMonitor(target string, stallTimeout time.Duration, now time.Time) *CloneMonitor {
+	return &CloneMonitor{Target: target, StallTimeout: stallTimeout, sampled: now, progressed: now}
+}
+
+// Observe 记录一次clone_progress采样. 阶段切换或数据量增加都算作进展, 速率取最近采样间隔的指数平均
+func (m *CloneMonitor) Observe(now time.Time, stages []CloneStage) (CloneProgress, error) {
+	var p CloneProgress
+	running := false
+	for _, s := range stages {
+		if s.State == "Failed" {
+			return p, fmt.Errorf("%s clone阶段 %s 失败", m.Target, s.Stage)
+		}
+		p.Data += s.Data
+		p.Estimate += s.Estimate
+		// 没有进行中的阶段时取最后一个完成的阶段
+		if s.State == "In Progress" {
+			p.Stage, running = s.Stage, true
+		} else if s.State == "Completed" && !running {
+			p.Stage = s.Stage
+		}
+	}
+	if p.Stage != m.stage || p.Data > m.data {
+		if elapsed := now.Sub(m.sampled).Seconds(); elapsed > 0 && p.Data > m.data {
+			rate := float64(p.Data-m.data) / elapsed
+			if m.rate == 0 {
+				m.rate = rate
+			} else {
+				m.rate = 0.7*m.rate + 0.3*rate
+			}
+		}
+		m.stage, m.data, m.progressed = p.Stage, p.Data, now
+	}
+	m.sampled = now
+	p.Rate = m.rate
+	if p.Rate > 0 && p.Estimate > p.Data {
+		p.Finish = now.Add(time.Duration(float64(p.Estimate-p.Data) / p.Rate * float64(time.Second)))
+	}
+	return p, m.Stalled(now)
+}
+
+// Stalled 超过StallTimeout没有进展时返回错误, 查询进度失败时也需要检查
+func (m *CloneMonitor) Stalled(now time.Time) error {
+	if m.StallTimeout > 0 && now.Sub(m.progressed) > m.StallTimeout {
+		return fmt.Errorf("%s clone已经 %s 没有进展, 停留在阶段 %s", m.Target, now.Sub(m.progressed).Round(time.Second), m.stage)
+	}
+	return nil
+}
+
+// alertClone 醒目输出clone异常
+func alertClone(err error) {
+	banner := strings.Repeat("*", 92)
+	log.Println(banner)
+	log.Println(fmt.Sprintf("clone异常: %s", err))
+	log.Println(banner)
+}
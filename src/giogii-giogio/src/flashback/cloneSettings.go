@@ -0,0 +1,142 @@
+package flashback
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+clone配置文件, 每个灾备集群一个, 位于当前目录 flashback_<灾备集群ip_port>.conf, 不存在时全部使用默认值
+每行 key = value, # 开头为注释, 路径中的 {port} 替换为节点端口, 为空的路径执行时从在线实例读取
+支持的配置:
+basedir        mysql安装目录, 默认为实例的@@basedir
+instance_dir   在线实例目录, 默认为@@datadir的上级目录
+defaults_file  在线实例的配置文件, 默认从mysqld进程的--defaults-file读取
+clone_dir      临时实例目录, 默认为实例目录同级的clonebackup
+clone_ports    临时实例端口范围, 默认18000-18999
+buffer_pool    临时实例的innodb_buffer_pool_size, 默认512M
+os_user        mysqld运行的系统用户, 默认mysql
+start_timeout  等待实例启动、停止的超时时间, 默认5m
+clone_timeout  clone超时时间, 默认6h
+stall_timeout  clone进度没有变化超过该时间认为停滞, 默认10m
+例如:
+basedir = /data/app/mysql-8.0.26
+instance_dir = /data/mysqldata/{port}
+clone_dir = /data/mysqldata/clonebackup_{port}
+*/
+
+// CloneSettings 灾备集群通过clone重建节点使用的路径和参数
+type CloneSettings struct {
+	BaseDir      string
+	InstanceDir  string
+	DefaultsFile string
+	CloneDir     string
+	PortMin      int
+	PortMax      int
+	BufferPool   string
+	OsUser       string
+	StartTimeout time.Duration
+	CloneTimeout time.Duration
+	StallTimeout time.Duration
+}
+
+// NewCloneSettings 默认配置, 路径全部从在线实例读取
+func NewCloneSettings() *CloneSettings {
+	return &CloneSettings{
+		PortMin:      18000,
+		PortMax:      18999,
+		BufferPool:   "512M",
+		OsUser:       "mysql",
+		StartTimeout: 5 * time.Minute,
+		CloneTimeout: 6 * time.Hour,
+		StallTimeout: 10 * time.Minute,
+	}
+}
+
+// CloneSettingsPath 每个灾备集群一个clone配置文件, 与journal文件放在一起
+func CloneSettingsPath(targetSocket string) string {
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(targetSocket)
+	return fmt.Sprintf("./flashback_%s.conf", name)
+}
+
+// LoadCloneSettings 读取clone配置文件, 文件不存在时使用默认配置
+func LoadCloneSettings(path string) (*CloneSettings, error) {
+	settings := NewCloneSettings()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return settings, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("打开clone配置文件失败: %s", err)
+	}
+	defer f.Close()
+	if err := settings.Parse(f); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return settings, nil
+}
+
+// Parse 读取配置文件内容
+func (c *CloneSettings) Parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for no := 1; scanner.Scan(); no++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		kv := strings.SplitN(text, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("第%d行: 无法解析 %s, 需要key = value", no, text)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		var err error
+		switch key {
+		case "basedir":
+			c.BaseDir = value
+		case "instance_dir":
+			c.InstanceDir = value
+		case "defaults_file":
+			c.DefaultsFile = value
+		case "clone_dir":
+			c.CloneDir = value
+		case "clone_ports":
+			ports := strings.SplitN(value, "-", 2)
+			if len(ports) != 2 {
+				err = fmt.Errorf("端口范围格式为 最小端口-最大端口")
+				break
+			}
+			c.PortMin, err = strconv.Atoi(strings.TrimSpace(ports[0]))
+			if err == nil {
+				c.PortMax, err = strconv.Atoi(strings.TrimSpace(ports[1]))
+			}
+			if err == nil && (c.PortMin <= 0 || c.PortMax > 65535 || c.PortMin > c.PortMax) {
+				err = fmt.Errorf("端口范围无效")
+			}
+		case "buffer_pool":
+			c.BufferPool = value
+		case "os_user":
+			c.OsUser = value
+		case "start_timeout":
+			c.StartTimeout, err = time.ParseDuration(value)
+		case "clone_timeout":
+			c.CloneTimeout, err = time.ParseDuration(value)
+		case "stall_timeout":
+			c.StallTimeout, err = time.ParseDuration(value)
+		default:
+			return fmt.Errorf("第%d行: 未知的配置 %s", no, key)
+		}
+		if err != nil {
+			return fmt.Errorf("第%d行: %s=%s: %s", no, key, value, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// path 替换路径中的 {port}
+func (c *CloneSettings) path(p string, port string) string {
+	return strings.ReplaceAll(p, "{port}", port)
+}
@@ -0,0 +1,123 @@
+package flashback
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTemplateConfig(t *testing.T) {
+	live := `[client]
+socket = /data/mysqldata/16310/socket/mysql.sock
+[mysqld]
+port = 16310
+datadir = /data/mysqldata/16310/dbdata
+innodb_log_group_home_dir = /data/mysqldata/16310/logfile
+socket = /data/mysqldata/16310/socket/mysql.sock
+log-error = /data/mysqldata/16310/log/error.log
+innodb_buffer_pool_size = 64G
+super_read_only = ON
+loose-mysqlx-port = 33060
+server_id = 16310
+`
+	config, paths, err := templateConfig(live, "/data/mysqldata/16310", "/data/mysqldata/clonebackup", "18000", "512M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"port = 18000", "innodb_buffer_pool_size = 512M", "super_read_only = OFF", "server_id = 16310",
+		"datadir = /data/mysqldata/clonebackup/dbdata", "pid_file = /data/mysqldata/clonebackup/mysqld.pid"} {
+		if !strings.Contains(config, expect+"\n") {
+			t.Fatalf("missing %q in\n%s", expect, config)
+		}
+	}
+	for _, unexpected := range []string{"16310/", "64G", "33060", "port = 16310"} {
+		if strings.Contains(config, unexpected) {
+			t.Fatalf("unexpected %q in\n%s", unexpected, config)
+		}
+	}
+	dirs := cloneDirs("/data/mysqldata/clonebackup", paths)
+	if strings.Join(dirs, " ") != "/data/mysqldata/clonebackup /data/mysqldata/clonebackup/dbdata /data/mysqldata/clonebackup/log /data/mysqldata/clonebackup/logfile /data/mysqldata/clonebackup/socket" {
+		t.Fatalf("unexpected dirs %v", dirs)
+	}
+
+	// 路径不在实例目录下时临时实例会与在线实例冲突
+	if _, _, err := templateConfig(live+"tmpdir = /tmp\ninnodb_undo_directory = /data/undo\n", "/data/mysqldata/16310", "/data/mysqldata/clonebackup", "18000", "512M"); err == nil {
+		t.Fatal("expect error for undo directory outside instance dir")
+	}
+
+	if port, err := freePort("LISTEN 0 128 *:18000 *:*\nLISTEN 0 128 [::]:18001 [::]:*\n", 18000, 18010, map[int]bool{18002: true}); err != nil || port != 18003 {
+		t.Fatalf("unexpected port %d %v", port, err)
+	}
+}
+
+func TestSwapDataDir(t *testing.T) {
+	root := t.TempDir()
+	live, clone := filepath.Join(root, "16310", "dbdata"), filepath.Join(root, "clonebackup", "dbdata")
+	for dir, content := range map[string]string{live: "live", clone: "clone"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "data"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Session{Exec: &LocalExecutor{Root: root}, Clone: &CloneSettings{StartTimeout: time.Second}}
+	swaps := []DirSwap{{Live: live, Clone: clone}}
+	read := func(dir string) string {
+		data, _ := os.ReadFile(filepath.Join(dir, "data"))
+		return string(data)
+	}
+	// 交换可以重复执行, 回滚后还原在线实例原来的目录
+	for i := 0; i < 2; i++ {
+		if err := runActions(context.Background(), []Action{s.shell("127.0.0.1:16310", swapShell(swaps), "")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if read(live) != "clone" || read(live+"_bak") != "live" {
+		t.Fatalf("unexpected swap result %q %q", read(live), read(live+"_bak"))
+	}
+	if err := runActions(context.Background(), []Action{s.shell("127.0.0.1:16310", unswapShell(swaps), "")}); err != nil {
+		t.Fatal(err)
+	}
+	if read(live) != "live" || read(clone) != "clone" {
+		t.Fatalf("unexpected rollback result %q %q", read(live), read(clone))
+	}
+}
+
+func TestCloneMonitor(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	m := NewCloneMonitor("127.0.0.1:18000", time.Minute, start)
+	stages := func(data int64, state string) []CloneStage {
+		return []CloneStage{
+			{Stage: "DROP DATA", State: "Completed"},
+			{Stage: "FILE COPY", State: state, Estimate: 1000 << 20, Data: data << 20},
+			{Stage: "PAGE COPY", State: "Not Started"},
+		}
+	}
+	if _, err := m.Observe(start.Add(10*time.Second), stages(100, "In Progress")); err != nil {
+		t.Fatal(err)
+	}
+	p, err := m.Observe(start.Add(20*time.Second), stages(200, "In Progress"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 按采样间隔的平均速率和剩余数据量推算完成时间
+	if p.Stage != "FILE COPY" || p.Data != 200<<20 || p.Rate < 10<<20 || p.Finish.IsZero() || !p.Finish.After(start.Add(20*time.Second)) {
+		t.Fatalf("unexpected progress %+v", p)
+	}
+	if !strings.Contains(p.String(), "200MB/1000MB (20.0%)") {
+		t.Fatalf("unexpected progress text %s", p)
+	}
+	if _, err := m.Observe(start.Add(50*time.Second), stages(200, "In Progress")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Observe(start.Add(90*time.Second), stages(200, "In Progress")); err == nil {
+		t.Fatal("expect error for stalled clone")
+	}
+	if _, err := NewCloneMonitor("127.0.0.1:18000", time.Minute, start).Observe(start, stages(200, "Failed")); err == nil {
+		t.Fatal("expect error for failed stage")
+	}
+}
@@ -1,84 +1,322 @@
 package flashback
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/pkg/sftp"
 	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
+// 主机公钥的校验方式
+const (
+	// HostKeyStrict 主机公钥必须已经记录在known_hosts中
+	HostKeyStrict = "strict"
+	// HostKeyTofu 第一次连接时把主机公钥记录到known_hosts, 之后按known_hosts校验
+	HostKeyTofu = "tofu"
+)
+
+// known_hosts的写入在所有连接间串行
+var knownHostsLock sync.Mutex
+
 type Client struct {
-	Username   string
-	Password   string
-	Socket     string
+	Username string
+	Password string
+	Socket   string
+	Timeout  time.Duration
+	// KeyFile 私钥文件, KeyPassphrase 为私钥的密码
+	KeyFile       string
+	KeyPassphrase string
+	// Agent 使用SSH_AUTH_SOCK指向的ssh-agent认证
+	Agent bool
+	// KnownHosts known_hosts文件, 为空时使用~/.ssh/known_hosts
+	KnownHosts string
+	HostKey    string
+	// Keepalive 发送keepalive的间隔, 为0时不发送
+	Keepalive time.Duration
+	// SudoUser 不为空时命令通过sudo以该用户执行, sudo需要密码时使用SudoPassword, 为空时使用Password
+	SudoUser     string
+	SudoPassword string
+
 	client     *gossh.Client
+	agentConn  net.Conn
 	session    *gossh.Session
 	LastResult string
 }
 
 func (c *Client) Connect() (*Client, error) {
+	auth, err := c.authMethods()
+	if err != nil {
+		return c, err
+	}
+	hostKeyCallback, err := c.hostKeyCallback()
+	if err != nil {
+		return c, err
+	}
 	config := &gossh.ClientConfig{}
 	config.SetDefaults()
 	config.User = c.Username
-	config.Auth = []gossh.AuthMethod{gossh.Password(c.Password)}
-	config.HostKeyCallback = func(hostname string, remote net.Addr, key gossh.PublicKey) error { return nil }
-	client, err := gossh.Dial("tcp", c.Socket, config)
-	if nil != err {
+	config.Auth = auth
+	config.HostKeyCallback = hostKeyCallback
+	config.Timeout = c.Timeout
+
+	// 连接和握手都受Timeout限制
+	conn, err := net.DialTimeout("tcp", c.Socket, c.Timeout)
+	if err != nil {
+		return c, err
+	}
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+	sshConn, chans, reqs, err := gossh.NewClientConn(conn, c.Socket, config)
+	if err != nil {
+		conn.Close()
 		return c, err
 	}
-	c.client = client
+	conn.SetDeadline(time.Time{})
+	c.client = gossh.NewClient(sshConn, chans, reqs)
+	if c.Keepalive > 0 {
+		go c.keepalive(c.client)
+	}
 	return c, nil
 }
 
-func (c *Client) UploadFile(localFile string, remoteFile string, client *gossh.Client) {
-	sftpClient, err := sftp.NewClient(client)
+// Close 关闭ssh连接和ssh-agent连接
+func (c *Client) Close() {
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+	if c.agentConn != nil {
+		c.agentConn.Close()
+		c.agentConn = nil
+	}
+}
+
+// authMethods 按私钥、ssh-agent、密码的顺序尝试认证
+func (c *Client) authMethods() ([]gossh.AuthMethod, error) {
+	var methods []gossh.AuthMethod
+	if c.KeyFile != "" {
+		pem, err := ioutil.ReadFile(expandHome(c.KeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("读取私钥 %s 失败: %s", c.KeyFile, err)
+		}
+		var signer gossh.Signer
+		if c.KeyPassphrase != "" {
+			signer, err = gossh.ParsePrivateKeyWithPassphrase(pem, []byte(c.KeyPassphrase))
+		} else {
+			signer, err = gossh.ParsePrivateKey(pem)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("解析私钥 %s 失败: %s", c.KeyFile, err)
+		}
+		methods = append(methods, gossh.PublicKeys(signer))
+	}
+	if c.Agent {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, fmt.Errorf("使用ssh-agent认证需要设置SSH_AUTH_SOCK")
+		}
+		// 重连时关闭上一次连接使用的ssh-agent连接
+		if c.agentConn != nil {
+			c.agentConn.Close()
+			c.agentConn = nil
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, fmt.Errorf("连接ssh-agent失败: %s", err)
+		}
+		c.agentConn = conn
+		methods = append(methods, gossh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+	if c.Password != "" {
+		methods = append(methods, gossh.Password(c.Password))
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("%s 没有配置ssh认证方式(私钥、ssh-agent或密码)", c.Socket)
+	}
+	return methods, nil
+}
+
+// hostKeyCallback 按known_hosts校验主机公钥, 公钥与记录不一致时总是拒绝连接
+func (c *Client) hostKeyCallback() (gossh.HostKeyCallback, error) {
+	path := c.KnownHosts
+	if path == "" {
+		path = "~/.ssh/known_hosts"
+	}
+	path = expandHome(path)
+	if c.HostKey == HostKeyTofu {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取known_hosts %s 失败: %s", path, err)
+	}
+	if c.HostKey != HostKeyTofu {
+		return callback, nil
+	}
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return err
+		}
+		knownHostsLock.Lock()
+		defer knownHostsLock.Unlock()
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)); err != nil {
+			return err
+		}
+		log.Println(fmt.Sprintf("首次连接 %s, 记录主机公钥 %s 到 %s", hostname, gossh.FingerprintSHA256(key), path))
+		return nil
+	}, nil
+}
+
+func (c *Client) keepalive(client *gossh.Client) {
+	ticker := time.NewTicker(c.Keepalive)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			return
+		}
+	}
+}
+
+// UploadFile 先上传到临时文件, 校验sha256一致后再重命名为目标文件
+func (c *Client) UploadFile(localFile string, remoteFile string) error {
+	if c.client == nil {
+		if _, err := c.Connect(); err != nil {
+			return err
+		}
+	}
+	sftpClient, err := sftp.NewClient(c.client)
 	if err != nil {
-		log.Fatal(err)
-		return
+		return fmt.Errorf("%s 建立sftp连接失败: %s", c.Socket, err)
 	}
-	// 用来测试的本地文件路径 和 远程机器上的文件夹
+	defer sftpClient.Close()
+
 	srcFile, err := os.Open(localFile)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer srcFile.Close()
 
-	dstFile, err := sftpClient.Create(remoteFile)
+	tmpFile := remoteFile + ".uploading"
+	dstFile, err := sftpClient.Create(tmpFile)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("%s 创建 %s 失败: %s", c.Socket, tmpFile, err)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(dstFile, hash), srcFile); err != nil {
+		dstFile.Close()
+		sftpClient.Remove(tmpFile)
+		return fmt.Errorf("%s 写入 %s 失败: %s", c.Socket, tmpFile, err)
+	}
+	if err := dstFile.Close(); err != nil {
+		sftpClient.Remove(tmpFile)
+		return fmt.Errorf("%s 写入 %s 失败: %s", c.Socket, tmpFile, err)
 	}
-	defer dstFile.Close()
 
-	all, err := ioutil.ReadAll(srcFile)
+	expect := hex.EncodeToString(hash.Sum(nil))
+	out, err := c.runAsLogin(fmt.Sprintf("sha256sum %s", shellQuote(tmpFile)))
 	if err != nil {
-		log.Fatal(err)
+		sftpClient.Remove(tmpFile)
+		return fmt.Errorf("%s 计算 %s 的sha256失败: %s %s", c.Socket, tmpFile, err, out)
+	}
+	if fields := strings.Fields(out); len(fields) == 0 || fields[0] != expect {
+		sftpClient.Remove(tmpFile)
+		return fmt.Errorf("%s 上传 %s 校验失败, 本地sha256 %s, 远程 %s", c.Socket, remoteFile, expect, strings.TrimSpace(out))
 	}
-	dstFile.Write(all)
-	fmt.Println("upload: copy file to remote server finished!")
+	if err := sftpClient.PosixRename(tmpFile, remoteFile); err != nil {
+		sftpClient.Remove(tmpFile)
+		return fmt.Errorf("%s 重命名 %s 失败: %s", c.Socket, remoteFile, err)
+	}
+	log.Println(fmt.Sprintf("upload: %s -> %s:%s sha256 %s", localFile, c.Socket, remoteFile, expect))
+	return nil
 }
 
-func (c Client) Run(shell string) (string, error) {
-	if c.client == nil {
-		if _, err := c.Connect(); err != nil {
-			return "", err
-		}
+// command 配置了SudoUser时通过sudo执行, 返回实际执行的命令和需要写入stdin的内容
+func (c *Client) command(shell string) (string, string) {
+	if c.SudoUser == "" {
+		return shell, ""
 	}
-	session, err := c.client.NewSession()
+	password := c.SudoPassword
+	if password == "" {
+		password = c.Password
+	}
+	if password == "" {
+		return fmt.Sprintf("sudo -n -u %s -- bash -c %s", c.SudoUser, shellQuote(shell)), ""
+	}
+	return fmt.Sprintf("sudo -S -p '' -u %s -- bash -c %s", c.SudoUser, shellQuote(shell)), password + "\n"
+}
+
+func (c *Client) Run(shell string) (string, error) {
+	return c.RunContext(context.Background(), shell)
+}
+
+// RunContext 执行远程命令, ctx取消时关闭会话结束命令
+func (c *Client) RunContext(ctx context.Context, shell string) (string, error) {
+	cmd, stdin := c.command(shell)
+	return c.run(ctx, cmd, stdin)
+}
+
+// runAsLogin 以登录用户执行, 不经过sudo
+func (c *Client) runAsLogin(shell string) (string, error) {
+	return c.run(context.Background(), shell, "")
+}
+
+func (c *Client) run(ctx context.Context, cmd string, stdin string) (string, error) {
+	session, err := c.CreateSession()
 	if err != nil {
 		return "", err
 	}
 	defer session.Close()
+	if stdin != "" {
+		session.Stdin = strings.NewReader(stdin)
+	}
 
-	buf, err := session.CombinedOutput(shell)
-
-	c.LastResult = string(buf)
-	return c.LastResult, err
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Signal(gossh.SIGKILL)
+			session.Close()
+		case <-done:
+		}
+	}()
+	buf, err := session.CombinedOutput(cmd)
+	if ctx.Err() != nil {
+		return string(buf), ctx.Err()
+	}
+	return string(buf), err
 }
 
-func (c Client) CreateSession() (*gossh.Session, error) {
+func (c *Client) CreateSession() (*gossh.Session, error) {
 	if c.client == nil {
 		if _, err := c.Connect(); err != nil {
 			return nil, err
@@ -91,13 +329,85 @@ func (c Client) CreateSession() (*gossh.Session, error) {
 	return session, err
 }
 
-func (c Client) CloseSession(session *gossh.Session) (string, error) {
+func (c *Client) CloseSession(session *gossh.Session) (string, error) {
 	err := session.Close()
 	return "", err
 }
 
-func (c Client) RunSession(session *gossh.Session, shell string) (string, error) {
+func (c *Client) RunSession(session *gossh.Session, shell string) (string, error) {
 	buf, err := session.CombinedOutput(shell)
 	c.LastResult = string(buf)
 	return c.LastResult, err
 }
+
+// shellQuote 单引号转义, 作为一个参数传给远程shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
+
+// SshExecutor 通过ssh在节点上执行, 连接按主机复用, 第一次使用时建立
+type SshExecutor struct {
+	Config  *SshConfig
+	clients map[string]*Client
+	lock    sync.Mutex
+}
+
+func (e *SshExecutor) client(node string) (*Client, error) {
+	host, _ := splitSocket(node)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if c, ok := e.clients[host]; ok {
+		return c, nil
+	}
+	if e.Config == nil {
+		return nil, fmt.Errorf("没有配置 %s 的ssh连接", host)
+	}
+	c := e.Config.Client(host)
+	if _, err := c.Connect(); err != nil {
+		return nil, fmt.Errorf("ssh连接 %s 失败: %s", c.Socket, err)
+	}
+	if e.clients == nil {
+		e.clients = make(map[string]*Client)
+	}
+	e.clients[host] = c
+	return c, nil
+}
+
+func (e *SshExecutor) Run(ctx context.Context, node string, shell string) (string, error) {
+	c, err := e.client(node)
+	if err != nil {
+		return "", err
+	}
+	return c.RunContext(ctx, shell)
+}
+
+func (e *SshExecutor) Upload(ctx context.Context, node string, localFile string, remoteFile string) error {
+	c, err := e.client(node)
+	if err != nil {
+		return err
+	}
+	return c.UploadFile(localFile, remoteFile)
+}
+
+// Dir 脚本上传到mysql用户的home目录
+func (e *SshExecutor) Dir(node string) string {
+	return "/home/mysql"
+}
+
+func (e *SshExecutor) Close() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for host, c := range e.clients {
+		c.Close()
+		delete(e.clients, host)
+	}
+}
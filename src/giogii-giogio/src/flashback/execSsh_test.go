@@ -0,0 +1,109 @@
+package flashback
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSshConfig(t *testing.T) {
+	config := NewSshConfig("mysql", "mysql")
+	err := config.Parse(strings.NewReader(`
+# 默认配置写在主机配置之后也先生效
+10.0.0.2 user=root password=root sudo=mysql port=2222
+* key=~/.ssh/id_rsa host_key=tofu keepalive=15s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := config.Client("10.0.0.1")
+	if c.Socket != "10.0.0.1:22" || c.Username != "mysql" || c.KeyFile != "~/.ssh/id_rsa" || c.HostKey != HostKeyTofu || c.Keepalive != 15*time.Second {
+		t.Fatalf("unexpected default client %+v", c)
+	}
+	// 主机配置在默认配置的基础上覆盖
+	c = config.Client("10.0.0.2")
+	if c.Socket != "10.0.0.2:2222" || c.Username != "root" || c.KeyFile != "~/.ssh/id_rsa" || c.SudoUser != "mysql" {
+		t.Fatalf("unexpected host client %+v", c)
+	}
+	if cmd, stdin := c.command("echo 'a'"); cmd != `sudo -S -p '' -u mysql -- bash -c 'echo '\''a'\'''` || stdin != "root\n" {
+		t.Fatalf("unexpected sudo command %q %q", cmd, stdin)
+	}
+	if err := config.Parse(strings.NewReader("* host_key=any")); err == nil {
+		t.Fatal("expect error for unknown host_key")
+	}
+}
+
+func TestHostKeyTofu(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := gossh.NewPublicKey(pub)
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := gossh.NewPublicKey(other)
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	path := filepath.Join(t.TempDir(), "known_hosts")
+
+	strict := &Client{KnownHosts: path, HostKey: HostKeyStrict}
+	if _, err := strict.hostKeyCallback(); err == nil {
+		t.Fatal("expect error for missing known_hosts")
+	}
+
+	tofu := &Client{KnownHosts: path, HostKey: HostKeyTofu}
+	callback, err := tofu.hostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callback("10.0.0.1:22", addr, key); err != nil {
+		t.Fatal(err)
+	}
+	// 记录后严格模式可以校验通过, 公钥变化时拒绝连接
+	callback, err = strict.hostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callback("10.0.0.1:22", addr, key); err != nil {
+		t.Fatal(err)
+	}
+	callback, _ = tofu.hostKeyCallback()
+	if err := callback("10.0.0.1:22", addr, otherKey); err == nil {
+		t.Fatal("expect error for changed host key")
+	}
+}
+
+func TestAgentConnReconnect(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	// 每次重连都重新连接ssh-agent, 上一次的连接被关闭
+	c := &Client{Socket: "10.0.0.1:22", Agent: true}
+	for i := 0; i < 2; i++ {
+		if _, err := c.authMethods(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := <-accepted
+	<-accepted
+	first.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := first.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expect first agent connection closed, got %v", err)
+	}
+	c.Close()
+}
@@ -0,0 +1,188 @@
+package flashback
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Executor 在数据节点上执行命令和上传文件, node为节点的ip:port
+type Executor interface {
+	Run(ctx context.Context, node string, shell string) (string, error)
+	Upload(ctx context.Context, node string, localFile string, remoteFile string) error
+	// Dir 节点上存放脚本的目录
+	Dir(node string) string
+	Close()
+}
+
+// NewExecutor 按 -x 参数创建执行器, 逗号分隔的选项:
+// local=<目录> 在本机执行, 每个节点使用 <目录>/<ip_port> 作为工作目录; 不配置时通过ssh执行, ssh配置见LoadSshConfig
+// audit=<文件> 把执行的命令追加记录到文件
+func NewExecutor(spec string, sshConf string, sshUser string, sshPass string) (Executor, error) {
+	ssh, err := LoadSshConfig(sshConf, sshUser, sshPass)
+	if err != nil {
+		return nil, err
+	}
+	var executor Executor = &SshExecutor{Config: ssh}
+	var audit string
+	for _, option := range strings.Split(spec, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("无法解析执行器参数 %s", option)
+		}
+		switch kv[0] {
+		case "local":
+			executor = &LocalExecutor{Root: kv[1]}
+		case "audit":
+			audit = kv[1]
+		default:
+			return nil, fmt.Errorf("未知的执行器参数 %s", kv[0])
+		}
+	}
+	if audit == "" {
+		return executor, nil
+	}
+	f, err := os.OpenFile(audit, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("打开审计文件失败: %s", err)
+	}
+	return &RecordingExecutor{Next: executor, Out: f, closer: f}, nil
+}
+
+type secretKey struct{}
+
+// withSecret 命令中需要脱敏的密码, 记录执行的命令时替换
+func withSecret(ctx context.Context, secret string) context.Context {
+	if secret == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, secretKey{}, secret)
+}
+
+func secretFrom(ctx context.Context) string {
+	secret, _ := ctx.Value(secretKey{}).(string)
+	return secret
+}
+
+// LocalExecutor 在本机执行, 每个节点一个工作目录, 用于在一台机器上对本地的多个mysqld实例执行流程
+// 命令在节点目录下通过bash执行, 环境变量 NODE_HOST、NODE_PORT、NODE_DIR 为节点信息
+type LocalExecutor struct {
+	Root string
+}
+
+// Dir 节点的工作目录
+func (e *LocalExecutor) Dir(node string) string {
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(node)
+	return filepath.Join(e.Root, name)
+}
+
+func (e *LocalExecutor) Run(ctx context.Context, node string, shell string) (string, error) {
+	dir := e.Dir(node)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	host, port := splitSocket(node)
+	cmd := exec.CommandContext(ctx, "bash", "-c", shell)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "NODE_HOST="+host, "NODE_PORT="+port, "NODE_DIR="+dir)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return string(out), ctx.Err()
+	}
+	return string(out), err
+}
+
+func (e *LocalExecutor) Upload(ctx context.Context, node string, localFile string, remoteFile string) error {
+	if !filepath.IsAbs(remoteFile) {
+		remoteFile = filepath.Join(e.Dir(node), remoteFile)
+	}
+	if err := os.MkdirAll(filepath.Dir(remoteFile), 0755); err != nil {
+		return err
+	}
+	src, err := os.Open(localFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(remoteFile)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+func (e *LocalExecutor) Close() {}
+
+// ExecRecord 审计记录, 命令中的密码已经脱敏
+type ExecRecord struct {
+	Time     time.Time `json:"time"`
+	Node     string    `json:"node"`
+	Kind     string    `json:"kind"`
+	Command  string    `json:"command"`
+	Duration string    `json:"duration"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// RecordingExecutor 记录每次执行后交给Next执行, 每条记录一行json
+type RecordingExecutor struct {
+	Next   Executor
+	Out    io.Writer
+	lock   sync.Mutex
+	closer io.Closer
+}
+
+func (e *RecordingExecutor) record(ctx context.Context, node string, kind string, command string, start time.Time, err error) {
+	r := ExecRecord{
+		Time:     start,
+		Node:     node,
+		Kind:     kind,
+		Command:  maskSecret(command, secretFrom(ctx)),
+		Duration: time.Since(start).Round(time.Millisecond).String(),
+	}
+	if err != nil {
+		r.Error = maskSecret(err.Error(), secretFrom(ctx))
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	json.NewEncoder(e.Out).Encode(r)
+}
+
+func (e *RecordingExecutor) Run(ctx context.Context, node string, shell string) (string, error) {
+	start := time.Now()
+	out, err := e.Next.Run(ctx, node, shell)
+	e.record(ctx, node, ActionShell, shell, start, err)
+	return out, err
+}
+
+func (e *RecordingExecutor) Upload(ctx context.Context, node string, localFile string, remoteFile string) error {
+	start := time.Now()
+	err := e.Next.Upload(ctx, node, localFile, remoteFile)
+	e.record(ctx, node, ActionUpload, fmt.Sprintf("%s -> %s", localFile, remoteFile), start, err)
+	return err
+}
+
+func (e *RecordingExecutor) Dir(node string) string {
+	return e.Next.Dir(node)
+}
+
+func (e *RecordingExecutor) Close() {
+	e.Next.Close()
+	if e.closer != nil {
+		e.closer.Close()
+	}
+}
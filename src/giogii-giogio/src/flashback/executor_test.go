@@ -0,0 +1,52 @@
+package flashback
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalRecordingExecutor(t *testing.T) {
+	root := t.TempDir()
+	var audit bytes.Buffer
+	rec := &RecordingExecutor{Next: &LocalExecutor{Root: root}, Out: &audit}
+	s := &Session{Exec: rec}
+
+	script := filepath.Join(t.TempDir(), "check.sh")
+	if err := os.WriteFile(script, []byte("echo $NODE_PORT $1 > out.txt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	node := "127.0.0.1:3307"
+	steps := []Action{
+		s.upload(node, script, "check.sh"),
+		s.shell(node, "bash "+s.scriptPath(node, "check.sh")+" secret", "secret"),
+	}
+	if err := runActions(context.Background(), steps); err != nil {
+		t.Fatal(err)
+	}
+	// 每个节点在自己的工作目录下执行
+	out, err := os.ReadFile(filepath.Join(root, "127.0.0.1_3307", "out.txt"))
+	if err != nil || string(out) != "3307 secret\n" {
+		t.Fatalf("unexpected output %q %v", out, err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected audit %s", audit.String())
+	}
+	var r ExecRecord
+	if err := json.Unmarshal([]byte(lines[1]), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Node != node || r.Kind != ActionShell || strings.Contains(r.Command, "secret") || !strings.Contains(r.Command, "******") {
+		t.Fatalf("unexpected record %+v", r)
+	}
+
+	if _, err := NewExecutor("remote=1", "", "", ""); err == nil {
+		t.Fatal("expect error for unknown executor option")
+	}
+}
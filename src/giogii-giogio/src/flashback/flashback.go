@@ -1,53 +1,50 @@
 package flashback
 
 import (
+	"context"
 	"fmt"
 	"giogii/src/entity"
+	"giogii/src/gtid"
 	"giogii/src/mapper"
-	"golang.org/x/crypto/ssh"
+	"giogii/src/topology"
 	"log"
 	"os"
-	"path"
-	"path/filepath"
-	"runtime"
 	"strings"
-	"sync"
 	"time"
 )
 
-var secondaryClient Client
-var primaryClient Client
-var joinerClient Client
-var MasterSqlMapper mapper.SqlScaleOperator
-var SlaveSqlMapper mapper.SqlScaleOperator
-var SlaveStatus entity.SlaveStatus
-var ServerName string
-var Host string
-var Port string
-var MasterHost string
-var MasterPort string
-
-func initSshConnection(primary string, secondary string, joiner string, sshUser string, sshPass string) {
-	primaryClient = Client{
-		Username: sshUser,
-		Password: sshPass,
-		Socket:   fmt.Sprintf("%s:22", primary),
-	}
-	secondaryClient = Client{
-		Username: sshUser,
-		Password: sshPass,
-		Socket:   fmt.Sprintf("%s:22", secondary),
+const (
+	targetMaster = "主集群"
+	targetSlave  = "灾备集群"
+)
+
+// heartbeatMaxLag 断开复制前允许的心跳延迟
+const heartbeatMaxLag = time.Second
+
+func maskSecret(s string, secret string) string {
+	if secret == "" {
+		return s
 	}
-	joinerClient = Client{
-		Username: sshUser,
-		Password: sshPass,
-		Socket:   fmt.Sprintf("%s:22", joiner),
+	return strings.ReplaceAll(s, secret, "******")
+}
+
+func sqlAction(target string, operator mapper.SqlScaleOperator, sqlStr string, secret string) Action {
+	return Action{
+		Kind:    ActionSql,
+		Target:  target,
+		Command: maskSecret(sqlStr, secret),
+		run: func(ctx context.Context) error {
+			return operator.DoExec(sqlStr)
+		},
 	}
 }
 
-func InitMasterConnection(sourceUserInfo string, sourceSocket string) {
-	s := mapper.InitSourceConn(sourceUserInfo, sourceSocket, "information_schema")
-	MasterSqlMapper = &s
+// splitSocket ip:port
+func splitSocket(socket string) (host string, port string) {
+	if i := strings.LastIndex(socket, ":"); i >= 0 {
+		return socket[:i], socket[i+1:]
+	}
+	return socket, ""
 }
 
 func InitTmpConnection(sourceUserInfo string, sourceSocket string) (s mapper.SqlStruct) {
@@ -55,390 +52,507 @@ func InitTmpConnection(sourceUserInfo string, sourceSocket string) (s mapper.Sql
 	return
 }
 
-func InitSlaveConnection(targetUserInfo string, targetSocket string) {
-	s := mapper.InitSourceConn(targetUserInfo, targetSocket, "information_schema")
-	SlaveSqlMapper = &s
-}
-
-func GetSshIp() (p string, s string, j string) {
-	strSql := fmt.Sprint("dbscale show dataservers")
-	m := SlaveSqlMapper.DoQueryParseToDataServers(strSql)
-	if len(m) > 0 {
-		for i := 0; i < len(m); i++ {
-			switch ms := m[i].MasterOnlineStatus.String; ms {
-			case "Master_Online":
-				p = m[i].Host.String
-				MasterHost = m[i].Host.String
-				MasterPort = m[i].Port.String
-			default:
-				if s == "" {
-					s = m[i].Host.String
-					ServerName = m[i].Servername.String
-					Host = m[i].Host.String
-					Port = m[i].Port.String
-				} else {
-					j = m[i].Host.String
-				}
-			}
-		}
+// RecordDataServers 从灾备集群拓扑中记录节点: 主节点、孤岛节点(第一个从节点)及其余从节点
+// flashback流程只支持单分片的灾备集群, 至少需要一主两从
+func (s *Session) RecordDataServers(j *Journal) error {
+	cluster, err := s.Topology()
+	if err != nil {
+		return err
+	}
+	shard, err := cluster.Shard()
+	if err != nil {
+		return err
+	}
+	master := shard.Master()
+	slaves := shard.Slaves()
+	if master == nil || len(slaves) < 2 {
+		return fmt.Errorf("分片 %s 需要一主两从以上的节点, 实际获取到 %d 个", shard.Name, len(shard.Servers))
+	}
+	j.Set(OutputMasterHost, master.Host)
+	j.Set(OutputMasterPort, master.Port)
+	j.Set(OutputSecondaryServer, slaves[0].Name)
+	j.Set(OutputSecondaryHost, slaves[0].Host)
+	j.Set(OutputSecondaryPort, slaves[0].Port)
+	var others []string
+	for _, n := range slaves[1:] {
+		others = append(others, n.Socket())
 	}
-	return p, s, j
+	j.Set(OutputSlaveNodes, strings.Join(others, ","))
+	log.Println(fmt.Sprintf("主节点: %s, 孤岛节点: %s, 其余从节点: [%s]", master.Socket(), slaves[0].Socket(), j.Get(OutputSlaveNodes)))
+	return nil
 }
 
-func RemoveSlaveCluster() {
-	var strSql string
-	strSql = fmt.Sprint("dbscale dynamic remove datasource slave_dbscale_source")
-	MasterSqlMapper.DoQueryWithoutRes(strSql)
-	strSql = fmt.Sprint("dbscale dynamic remove dataserver slave_dbscale_server")
-	MasterSqlMapper.DoQueryWithoutRes(strSql)
+// islandNode 孤岛节点的ip:port
+func islandNode(j *Journal) string {
+	return fmt.Sprintf("%s:%s", j.Value(OutputSecondaryHost), j.Value(OutputSecondaryPort))
 }
 
-func AddBackupCluster(sourceUserInfo string, host string, port string, user string, password string) {
-	var strSql string
-	var id string
-	strSql = fmt.Sprintf("dbscale request cluster info")
-	info := MasterSqlMapper.DoQueryParseToClusterInfo(strSql)
-	if len(info) > 0 {
-		for i := 0; i < len(info); i++ {
-			if info[i].MasterDbscale == "master" {
-				tmpConnection := InitTmpConnection(sourceUserInfo, info[i].Host)
-				strSql = fmt.Sprintf("dbscale request next group id")
-				id = tmpConnection.DoQueryParseSingleValue(strSql)
-				tmpConnection.DoClose()
+// masterNode 主节点的ip:port
+func masterNode(j *Journal) string {
+	return fmt.Sprintf("%s:%s", j.Value(OutputMasterHost), j.Value(OutputMasterPort))
+}
+
+// cloneNodes start流程中clone孤岛节点数据的节点: 其余从节点和主节点
+func cloneNodes(j *Journal) []string {
+	return append(j.SlaveNodes(), masterNode(j))
+}
+
+func (s *Session) recordDataServersAction(j *Journal) Action {
+	return Action{
+		Kind:    ActionQuery,
+		Target:  targetSlave,
+		Command: "dbscale show dataservers",
+		run: func(ctx context.Context) error {
+			return s.RecordDataServers(j)
+		},
+	}
+}
+
+// RemoveSlaveCluster 主集群移除灾备集群, 可以幂等操作, 移除失败只记录日志
+func (s *Session) RemoveSlaveCluster() (actions []Action) {
+	for _, strSql := range []string{
+		"dbscale dynamic remove datasource slave_dbscale_source",
+		"dbscale dynamic remove dataserver slave_dbscale_server",
+	} {
+		a := sqlAction(targetMaster, s.Master, strSql, "")
+		run := a.run
+		a.run = func(ctx context.Context) error {
+			if err := run(ctx); err != nil {
+				log.Println(err)
 			}
+			return nil
 		}
+		actions = append(actions, a)
 	}
+	return
+}
 
-	strSql = fmt.Sprintf("dbscale dynamic ADD DATASERVER server_name=slave_dbscale_server,server_host=\"%s\",server_port=%s,server_user=\"%s\",server_password=\"%s\",dbscale_server", host, port, user, password)
-	MasterSqlMapper.DoQueryWithoutRes(strSql)
+// AddBackupCluster 主集群把灾备集群添加为slave_dbscale_server, group id 在执行时向主集群的master dbscale申请
+func (s *Session) AddBackupCluster() []Action {
+	host, port := splitSocket(s.TargetSocket)
+	user, password := s.targetUser()
+	var id string
+	nextGroupId := Action{
+		Kind:    ActionQuery,
+		Target:  targetMaster,
+		Command: "dbscale request next group id",
+		run: func(ctx context.Context) error {
+			cluster, err := topology.Load(s.Master)
+			if err != nil {
+				return err
+			}
+			master := cluster.MasterDbscale()
+			if master == nil {
+				return fmt.Errorf("主集群中没有master dbscale")
+			}
+			tmpConnection := InitTmpConnection(s.SourceUserInfo, master.Host)
+			strSql := fmt.Sprintf("dbscale request next group id")
+			id = tmpConnection.DoQueryParseSingleValue(strSql)
+			tmpConnection.DoClose()
+			if id == "" {
+				return fmt.Errorf("获取主集群group id失败")
+			}
+			return nil
+		},
+	}
+	addDatasource := Action{
+		Kind:    ActionSql,
+		Target:  targetMaster,
+		Command: "dbscale dynamic add server datasource slave_dbscale_source slave_dbscale_server-1-1000-400-800 group_id = <next group id>",
+		run: func(ctx context.Context) error {
+			strSql := fmt.Sprintf("dbscale dynamic add server datasource slave_dbscale_source slave_dbscale_server-1-1000-400-800 group_id = %s", id)
+			return s.Master.DoExec(strSql)
+		},
+	}
+	return []Action{
+		nextGroupId,
+		sqlAction(targetMaster, s.Master, fmt.Sprintf("dbscale dynamic ADD DATASERVER server_name=slave_dbscale_server,server_host=\"%s\",server_port=%s,server_user=\"%s\",server_password=\"%s\",dbscale_server", host, port, user, password), password),
+		addDatasource,
+		sqlAction(targetMaster, s.Master, fmt.Sprint("dbscale dynamic add slave slave_dbscale_source to normal_0"), ""),
+	}
+}
 
-	strSql = fmt.Sprintf("dbscale dynamic add server datasource slave_dbscale_source slave_dbscale_server-1-1000-400-800 group_id = %s", id)
-	MasterSqlMapper.DoQueryWithoutRes(strSql)
+func (s *Session) StartSlave() []Action {
+	return []Action{
+		sqlAction(targetSlave, s.Slave, fmt.Sprint("dbscale set global 'enable-slave-dbscale-server'=1"), ""),
+		sqlAction(targetSlave, s.Slave, fmt.Sprint("dbscale set global 'slave-dbscale-mode'=1"), ""),
+		sqlAction(targetSlave, s.Slave, fmt.Sprint("start slave"), ""),
+	}
+}
 
-	strSql = fmt.Sprintf("dbscale dynamic add slave slave_dbscale_source to normal_0")
-	MasterSqlMapper.DoQueryWithoutRes(strSql)
+func (s *Session) AddData() []Action {
+	return []Action{
+		sqlAction(targetMaster, s.Master, fmt.Sprintf("create database a"), ""),
+		sqlAction(targetMaster, s.Master, fmt.Sprintf("drop database a"), ""),
+	}
 }
 
-func StartSlave() {
-	var strSql string
-	strSql = fmt.Sprint("dbscale set global 'enable-slave-dbscale-server'=1")
-	SlaveSqlMapper.DoQueryWithoutRes(strSql)
-	strSql = fmt.Sprint("dbscale set global 'slave-dbscale-mode'=1")
-	SlaveSqlMapper.DoQueryWithoutRes(strSql)
-	strSql = fmt.Sprint("start slave")
-	SlaveSqlMapper.DoQueryWithoutRes(strSql)
+func (s *Session) CloseReplication() []Action {
+	return []Action{
+		sqlAction(targetSlave, s.Slave, fmt.Sprint("stop slave"), ""),
+		sqlAction(targetSlave, s.Slave, fmt.Sprint("dbscale set global 'slave-dbscale-mode'=0"), ""),
+		sqlAction(targetSlave, s.Slave, fmt.Sprint("dbscale set global 'enable-slave-dbscale-server'=0"), ""),
+	}
 }
 
-func AddData() {
-	var strSql string
-	strSql = fmt.Sprintf("create database a")
-	MasterSqlMapper.DoQueryWithoutRes(strSql)
-	strSql = fmt.Sprintf("drop database a")
-	MasterSqlMapper.DoQueryWithoutRes(strSql)
+func (s *Session) DisableDataServer(serverName string) []Action {
+	return []Action{sqlAction(targetSlave, s.Slave, fmt.Sprintf("dbscale disable dataserver %s", serverName), "")}
 }
 
-func CloseReplication() {
-	var strSql string
-	strSql = fmt.Sprint("stop slave")
-	SlaveSqlMapper.DoQueryWithoutRes(strSql)
-	strSql = fmt.Sprint("dbscale set global 'slave-dbscale-mode'=0")
-	SlaveSqlMapper.DoQueryWithoutRes(strSql)
-	strSql = fmt.Sprint("dbscale set global 'enable-slave-dbscale-server'=0")
-	SlaveSqlMapper.DoQueryWithoutRes(strSql)
+func (s *Session) EnableDataServer(serverName string) []Action {
+	return []Action{sqlAction(targetSlave, s.Slave, fmt.Sprintf("dbscale enable dataserver %s", serverName), "")}
 }
 
-func GetSlaveGTIDSet() {
-	var strSql string
-	strSql = fmt.Sprint("show slave status")
-	SlaveStatus = SlaveSqlMapper.DoQueryParseSlave(strSql)
+func (s *Session) CloseReadOnly() []Action {
+	return []Action{sqlAction(targetSlave, s.Slave, fmt.Sprint("dbscale set global \"enable-read-only\" = 0"), "")}
 }
 
-func DisableDataServer() {
-	var strSql string
-	strSql = fmt.Sprintf("dbscale disable dataserver %s", ServerName)
-	SlaveSqlMapper.DoQueryWithoutRes(strSql)
-	log.Println("剔除孤岛节点: ", ServerName)
+func (s *Session) EnableReadOnly() []Action {
+	return []Action{sqlAction(targetSlave, s.Slave, fmt.Sprint("dbscale set global \"enable-read-only\" = 1"), "")}
 }
-func EnableDataServer() {
-	var strSql string
-	strSql = fmt.Sprintf("dbscale enable dataserver %s", ServerName)
-	SlaveSqlMapper.DoQueryWithoutRes(strSql)
+
+func (s *Session) ForceOnline(serverName string) []Action {
+	return []Action{sqlAction(targetSlave, s.Slave, fmt.Sprintf("DBSCALE FLASHBACK DATASERVER %s FORCE ONLINE", serverName), "")}
 }
 
-func CloseReadOnly() {
-	var strSql string
-	strSql = fmt.Sprint("dbscale set global \"enable-read-only\" = 0")
-	SlaveSqlMapper.DoQueryWithoutRes(strSql)
+func actions(groups ...[]Action) []Action {
+	var all []Action
+	for _, g := range groups {
+		all = append(all, g...)
+	}
+	return all
 }
 
-func EnableReadOnly() {
-	var strSql string
-	strSql = fmt.Sprint("dbscale set global \"enable-read-only\" = 1")
-	SlaveSqlMapper.DoQueryWithoutRes(strSql)
+/**
+以下步骤由start/stop/begin/end流程共用
+*/
+
+// detachReplicationStep 主集群移除灾备集群、备集群关闭复制, 回滚时重新建立复制关系
+func (s *Session) detachReplicationStep() Step {
+	return Step{
+		Name: "detach_replication",
+		Desc: "断开主备集群复制",
+		Actions: func(j *Journal) ([]Action, error) {
+			return actions(s.RemoveSlaveCluster(), s.CloseReplication()), nil
+		},
+		Rollback: func(j *Journal) ([]Action, error) {
+			return s.attachReplication(), nil
+		},
+	}
 }
 
-func ForceOnline() {
-	var strSql string
-	strSql = fmt.Sprintf("DBSCALE FLASHBACK DATASERVER %s FORCE ONLINE", ServerName)
-	SlaveSqlMapper.DoQueryWithoutRes(strSql)
+// attachReplicationStep 重新建立主备集群复制关系
+func (s *Session) attachReplicationStep() Step {
+	return Step{
+		Name: "attach_replication",
+		Desc: "重新建立主备集群复制",
+		Actions: func(j *Journal) ([]Action, error) {
+			return s.attachReplication(), nil
+		},
+	}
 }
 
-var (
-	wg sync.WaitGroup
-)
+func (s *Session) attachReplication() []Action {
+	waitSlave := Action{
+		Kind:    ActionWait,
+		Target:  targetSlave,
+		Command: "show slave status, 等待Slave_IO_Running/Slave_SQL_Running为Yes",
+		run: func(ctx context.Context) error {
+			return waitFor(ctx, "灾备集群复制启动", 2*time.Minute, 3*time.Second, func() (bool, error) {
+				status := s.SlaveStatus()
+				return status.SlaveIORunning == "Yes" && status.SlaveSQLRunning == "Yes", nil
+			})
+		},
+	}
+	return actions(
+		s.RemoveSlaveCluster(),
+		s.AddBackupCluster(),
+		s.StartSlave(),
+		[]Action{waitSlave},
+	)
+}
+
+// waitHeartbeatStep 配置心跳表时, 断开复制前等待灾备集群的心跳延迟降到heartbeatMaxLag以内, 减少断开时没有传输到灾备集群的事务
+func (s *Session) waitHeartbeatStep() Step {
+	return Step{
+		Name: "wait_heartbeat",
+		Desc: "等待灾备集群心跳延迟",
+		Actions: func(j *Journal) ([]Action, error) {
+			if s.Heartbeat == nil {
+				return nil, nil
+			}
+			return []Action{{
+				Kind:    ActionWait,
+				Target:  targetSlave,
+				Command: fmt.Sprintf("比较主备集群 %s 的心跳时间, 等待延迟小于 %s", s.Heartbeat.Table, heartbeatMaxLag),
+				run: func(ctx context.Context) error {
+					return waitFor(ctx, "灾备集群心跳延迟", 6*time.Hour, time.Second, func() (bool, error) {
+						lag, err := s.Heartbeat.Lag(time.Now())
+						if err != nil {
+							return false, err
+						}
+						if lag > heartbeatMaxLag {
+							log.Println(fmt.Sprintf("等待灾备集群心跳延迟, 当前 %s", lag))
+							return false, nil
+						}
+						return true, nil
+					})
+				},
+			}}, nil
+		},
+	}
+}
+
+// waitReplayStep 确保灾备集群已接收的事务全部回放完成, 记录灾备集群的GTID
+func (s *Session) waitReplayStep() Step {
+	return Step{
+		Name: "wait_replay",
+		Desc: "等待灾备集群回放binlog",
+		Actions: func(j *Journal) ([]Action, error) {
+			return []Action{{
+				Kind:    ActionWait,
+				Target:  targetSlave,
+				Command: "show slave status, 等待Retrieved_Gtid_Set全部回放且Seconds_Behind_Master为0, 记录Executed_Gtid_Set",
+				run: func(ctx context.Context) error {
+					var status entity.SlaveStatus
+					err := waitFor(ctx, "灾备集群回放binlog", 6*time.Hour, 3*time.Second, func() (bool, error) {
+						status = s.SlaveStatus()
+						retrieved, err := gtid.Parse(status.RetrievedGtidSet)
+						if err != nil {
+							return false, err
+						}
+						executed, err := gtid.Parse(status.ExecutedGtidSet)
+						if err != nil {
+							return false, err
+						}
+						if !executed.Contains(retrieved) {
+							log.Println(fmt.Sprintf("等待灾备集群回放binlog, 剩余 %d 个事务", retrieved.Subtract(executed).Count()))
+							return false, nil
+						}
+						// 断开复制后Seconds_Behind_Master为NULL, 配置心跳时已经在断开前按心跳延迟等待
+						return s.Heartbeat != nil || status.SecondsBehindMaster.Int64 == 0, nil
+					})
+					if err != nil {
+						return err
+					}
+					log.Println(fmt.Sprintf("记录gtid [ %s ]", status.ExecutedGtidSet))
+					j.Set(OutputGtidSet, strings.ReplaceAll(status.ExecutedGtidSet, "\n", ""))
+					return nil
+				},
+			}}, nil
+		},
+	}
+}
+
+// closeReadOnlyStep 备集群关闭只读, 回滚时重新打开只读
+func (s *Session) closeReadOnlyStep() Step {
+	return Step{
+		Name: "close_read_only",
+		Desc: "备集群关闭只读功能",
+		Actions: func(j *Journal) ([]Action, error) {
+			a := s.CloseReadOnly()
+			run := a[0].run
+			a[0].run = func(ctx context.Context) error {
+				if err := run(ctx); err != nil {
+					return err
+				}
+				log.Println("********************************************************************************************")
+				log.Println("*********************************备集群可以进行业务写入操作*********************************")
+				log.Println("********************************************************************************************")
+				return nil
+			}
+			return a, nil
+		},
+		Rollback: func(j *Journal) ([]Action, error) {
+			return s.EnableReadOnly(), nil
+		},
+	}
+}
+
+func (s *Session) enableReadOnlyStep(name string) Step {
+	return Step{
+		Name: name,
+		Desc: "备集群打开只读功能",
+		Actions: func(j *Journal) ([]Action, error) {
+			return s.EnableReadOnly(), nil
+		},
+		Rollback: func(j *Journal) ([]Action, error) {
+			return s.CloseReadOnly(), nil
+		},
+	}
+}
 
-func DoStartFlashback(targetUserInfo string, targetSocket string, sshUser string, sshPass string) {
-	defer func() {
-		SlaveSqlMapper.DoClose()
-		MasterSqlMapper.DoClose()
-	}()
-	/**
-	主集群移除灾备集群、灾备集群端口主集群，可以幂等操作
-	*/
-	log.Println("准备主集群移除灾备集群")
-	RemoveSlaveCluster()
-	log.Println("主集群移除灾备集群完成")
-	log.Println("准备备集群关闭复制功能")
-	CloseReplication()
-	log.Println("备集群关闭复制功能完成")
-
-	/**
-	获取灾备集群的GTID，确保灾备集群的数据全部回放完成
-	*/
-	for {
-		GetSlaveGTIDSet()
-		if SlaveStatus.SecondsBehindMaster.Int64 == 0 {
-			log.Println(fmt.Sprintf("记录gtid [ %s ]", SlaveStatus.ExecutedGtidSet))
-			break
+func (s *Session) recordDataServersStep() Step {
+	return Step{
+		Name: "record_dataservers",
+		Desc: "记录灾备集群节点",
+		Actions: func(j *Journal) ([]Action, error) {
+			return []Action{s.recordDataServersAction(j)}, nil
+		},
+	}
+}
+
+// RunWorkflow 加载journal后按mode执行流程
+// ModeRollback 按逆序执行已完成步骤的补偿动作, ModePlan/ModePlanJson 只读取拓扑并输出执行计划
+// 流程从头执行前先做预检查, 必须项未通过时拒绝执行, ModeForce 忽略预检查结果
+func (s *Session) RunWorkflow(w *Workflow, mode string) error {
+	j, err := LoadJournal(JournalPath(s.TargetSocket), s.TargetSocket)
+	if err != nil {
+		return err
+	}
+	switch mode {
+	case ModeRun, ModeForce:
+		if w.Preflight != nil && !j.Started(w.Name) {
+			results := w.Preflight()
+			WriteCheckResults(os.Stdout, results)
+			if failed := FailedRequired(results); failed > 0 {
+				if mode != ModeForce {
+					return fmt.Errorf("预检查有 %d 项未通过, 确认后可以加 -a force 强制执行", failed)
+				}
+				log.Println(fmt.Sprintf("预检查有 %d 项未通过, 强制执行", failed))
+			}
+		}
+		return w.Run(j)
+	case ModePreflight:
+		if w.Preflight == nil {
+			return nil
+		}
+		results := w.Preflight()
+		WriteCheckResults(os.Stdout, results)
+		if failed := FailedRequired(results); failed > 0 {
+			return fmt.Errorf("预检查有 %d 项未通过", failed)
 		}
-		time.Sleep(3 * time.Second)
+		return nil
+	case ModeRollback:
+		return w.Rollback(j)
+	case ModePlan, ModePlanJson:
+		j.Planning = true
+		if j.Get(OutputSecondaryServer) == "" {
+			if err := s.RecordDataServers(j); err != nil {
+				return err
+			}
+		}
+		plans, err := w.Plan(j)
+		if err != nil {
+			return err
+		}
+		return WritePlan(os.Stdout, plans, mode)
 	}
-	/**
-	移除节点
-	*/
-	p, s, j := GetSshIp()
-	log.Println("准备备集群剔除孤岛节点")
-	DisableDataServer()
-	log.Println("备集群剔除孤岛节点完成")
-
-	log.Println("准备备集群关闭只读功能")
-	CloseReadOnly()
-	log.Println("备集群关闭只读功能完成")
-	log.Println("********************************************************************************************")
-	log.Println("*********************************备集群可以进行业务写入操作*********************************")
-	log.Println("********************************************************************************************")
-
-	initSshConnection(s, j, p, sshUser, sshPass)
-	primary, _ := primaryClient.Connect()
-	secondary, _ := secondaryClient.Connect()
-	joiner, _ := joinerClient.Connect()
-	defer func() {
-		primary.client.Close()
-		secondary.client.Close()
-		joiner.client.Close()
-	}()
-
-	/**
-	灾备集群孤岛节点安装clone插件，clone user 授权
-	*/
-	var scriptPath = getCurrentAbPath()
-	wg.Add(1)
-	go func(client *ssh.Client) {
-		log.Println(fmt.Sprintf("准备孤岛节点:%s上传clone脚本", s))
-		primaryClient.UploadFile(scriptPath+"/installClonePlugin.sh", "/home/mysql/installClonePlugin.sh", client)
-		result, _ := primaryClient.Run("chmod 755 *")
-		log.Println(result)
-		log.Println("孤岛节点上传clone脚本完成")
-		wg.Done()
-	}(primaryClient.client)
-
-	wg.Add(1)
-	go func(client *ssh.Client) {
-		log.Println(fmt.Sprintf("准备在%s节点上传initInstance/clone/check脚本", j))
-		secondaryClient.UploadFile(scriptPath+"/initInstance.sh", "/home/mysql/initInstance.sh", client)
-		secondaryClient.UploadFile(scriptPath+"/clone.sh", "/home/mysql/clone.sh", client)
-		secondaryClient.UploadFile(scriptPath+"/check.sh", "/home/mysql/check.sh", client)
-		result, _ := secondaryClient.Run("chmod 755 *")
-		log.Println(result)
-		log.Println(fmt.Sprintf("%s节点上传initInstance/clone/check脚本完成", j))
-		wg.Done()
-	}(secondaryClient.client)
-
-	wg.Add(1)
-	go func(client *ssh.Client) {
-		log.Println(fmt.Sprintf("准备在%s节点上传initInstance/clone/check脚本", p))
-		joinerClient.UploadFile(scriptPath+"/initInstance.sh", "/home/mysql/initInstance.sh", client)
-		joinerClient.UploadFile(scriptPath+"/clone.sh", "/home/mysql/clone.sh", client)
-		joinerClient.UploadFile(scriptPath+"/check.sh", "/home/mysql/check.sh", client)
-		result, _ := joinerClient.Run("chmod 755 *")
-		log.Println(result)
-		log.Println(fmt.Sprintf("%s节点上传initInstance/clone/check脚本完成", p))
-		wg.Done()
-	}(joinerClient.client)
-	wg.Wait()
-
-	/**
-	执行插件安装
-	*/
-	wg.Add(1)
-	go func(client *ssh.Client) {
-		log.Println("准备孤岛节点安装clone插件")
-		result, _ := primaryClient.Run("bash /home/mysql/installClonePlugin.sh")
-		log.Println(result)
-		log.Println("孤岛节点安装clone插件完成")
-		wg.Done()
-	}(primaryClient.client)
-	wg.Wait()
-
-	/**
-	执行clone动作
-	*/
-	wg.Add(1)
-	go func(client *ssh.Client) {
-		log.Println("准备初始化第一个clone实例")
-		secondaryClient.Run("bash /home/mysql/initInstance.sh")
-		log.Println("初始化第一个clone实例完成")
-
-		time.Sleep(5 * time.Second)
-
-		log.Println("准备执行第一个clone命令")
-		fields := strings.Split(targetUserInfo, ":")
-		scriptStr := fmt.Sprintf("bash /home/mysql/clone.sh %s %s %s %s", fields[0], fields[1], Host, Port)
-		result, _ := secondaryClient.Run(scriptStr)
-		log.Println(result)
-		log.Println("执行第一个clone命令完成")
-		wg.Done()
-	}(secondaryClient.client)
-	wg.Wait()
-
-	wg.Add(1)
-	go func(client *ssh.Client) {
-
-		log.Println("准备初始化第二个clone实例")
-		joinerClient.Run("bash /home/mysql/initInstance.sh")
-		log.Println("初始化第二个clone实例完成")
-
-		time.Sleep(5 * time.Second)
-
-		log.Println("准备执行第二个clone命令")
-		fields := strings.Split(targetUserInfo, ":")
-		scriptStr := fmt.Sprintf("bash /home/mysql/clone.sh %s %s %s %s", fields[0], fields[1], Host, Port)
-		result, _ := joinerClient.Run(scriptStr)
-		log.Println(result)
-		log.Println("执行第二个clone命令完成")
-		wg.Done()
-	}(joinerClient.client)
-	wg.Wait()
-
-}
-
-func DoStopFlashback(sourceUserInfo string, targetUserInfo string, targetSocket string, sshUser string, sshPass string) {
-
-	p, s, j := GetSshIp()
-
-	initSshConnection(s, j, p, sshUser, sshPass)
-	primary, _ := primaryClient.Connect()
-	secondary, _ := secondaryClient.Connect()
-	joiner, _ := joinerClient.Connect()
-	defer func() {
-		primary.client.Close()
-		secondary.client.Close()
-		joiner.client.Close()
-	}()
-
-	log.Println("准备备集群打开只读功能")
-	EnableReadOnly()
-	log.Println("备集群关闭只读功能完成")
-
-	wg.Add(1)
-	go func(client *ssh.Client) {
-		log.Println("准备还原第一个clone实例")
-		fields := strings.Split(targetUserInfo, ":")
-		scriptStr := fmt.Sprintf("bash /home/mysql/check.sh %s %s", fields[0], fields[1])
-		result, _ := secondaryClient.Run(scriptStr)
-		log.Println(result)
-		log.Println("还原第一个clone实例完成")
-		wg.Done()
-	}(secondaryClient.client)
-
-	wg.Add(1)
-	go func(client *ssh.Client) {
-		log.Println("准备还原第二个clone实例")
-		fields := strings.Split(targetUserInfo, ":")
-		scriptStr := fmt.Sprintf("bash /home/mysql/check.sh %s %s", fields[0], fields[1])
-		result, _ := joinerClient.Run(scriptStr)
-		log.Println(result)
-		log.Println("还原第二个clone实例完成")
-		wg.Done()
-	}(joinerClient.client)
-	wg.Wait()
-
-	wg.Add(1)
-	go func() {
-
-		EnableReadOnly()
-		time.Sleep(20 * time.Second)
-		EnableReadOnly()
-
-		time.Sleep(20 * time.Second)
-		EnableReadOnly()
-
-		time.Sleep(3 * time.Second)
-		EnableDataServer()
-
-		time.Sleep(3 * time.Second)
-		ForceOnline()
-
-		time.Sleep(3 * time.Second)
-		EnableReadOnly()
-
-		log.Println("准备修复flashback")
-		socket := strings.Split(targetSocket, ":")
-		fields := strings.Split(targetUserInfo, ":")
-		scriptStr := fmt.Sprintf("/data/app/mysql-8.0.26/bin/mysql -u%s -p%s -h%s -P%s -e \"stop slave;reset slave all;\"", fields[0], fields[1], MasterHost, MasterPort)
-		result, _ := primaryClient.Run(scriptStr)
-		log.Println(result)
-		log.Println("修复flashback完成")
-
-		AddData()
-		time.Sleep(5 * time.Second)
-		AddBackupCluster(sourceUserInfo, socket[0], socket[1], fields[0], fields[1])
-		time.Sleep(2 * time.Second)
-		StartSlave()
-		wg.Done()
-	}()
-	wg.Wait()
-
-	defer func() {
-		SlaveSqlMapper.DoClose()
-		MasterSqlMapper.DoClose()
-	}()
-
-}
-
-func getCurrentAbPath() string {
-	dir := getCurrentAbPathByExecutable()
-	tmpDir, _ := filepath.EvalSymlinks(os.TempDir())
-	if strings.Contains(dir, tmpDir) {
-		return getCurrentAbPathByCaller()
+	return fmt.Errorf("未知的执行方式: %s", mode)
+}
+
+func (s *Session) StartWorkflow() *Workflow {
+	return &Workflow{
+		Name: "start",
+		Preflight: func() []CheckResult {
+			return s.Preflight([]string{CheckSsh, CheckClone, CheckDisk, CheckReplica})
+		},
+		Steps: []Step{
+			s.waitHeartbeatStep(),
+			s.detachReplicationStep(),
+			s.waitReplayStep(),
+			s.recordDataServersStep(),
+			{
+				Name: "disable_island",
+				Desc: "备集群剔除孤岛节点",
+				Actions: func(j *Journal) ([]Action, error) {
+					serverName, err := j.MustGet(OutputSecondaryServer)
+					if err != nil {
+						return nil, err
+					}
+					return s.DisableDataServer(serverName), nil
+				},
+				Rollback: func(j *Journal) ([]Action, error) {
+					serverName, err := j.MustGet(OutputSecondaryServer)
+					if err != nil {
+						return nil, err
+					}
+					return s.EnableDataServer(serverName), nil
+				},
+			},
+			s.closeReadOnlyStep(),
+			s.installClonePluginStep(),
+			s.discoverCloneNodesStep(),
+			// 各节点并发初始化clone实例, 全部可以连接后再依次从孤岛节点clone
+			s.prepareCloneInstancesStep(),
+			s.cloneNodesStep(),
+		},
 	}
-	return dir
 }
 
-func getCurrentAbPathByCaller() string {
-	var abPath string
-	_, filename, _, ok := runtime.Caller(0)
-	if ok {
-		abPath = path.Dir(filename)
+func (s *Session) StopWorkflow() *Workflow {
+	return &Workflow{
+		Name: "stop",
+		Preflight: func() []CheckResult {
+			return s.Preflight([]string{CheckSsh})
+		},
+		Steps: []Step{
+			{
+				// start流程没有记录节点时重新获取
+				Name: "load_dataservers",
+				Desc: "读取灾备集群节点",
+				Actions: func(j *Journal) ([]Action, error) {
+					if j.Get(OutputSecondaryServer) != "" {
+						return nil, nil
+					}
+					return []Action{s.recordDataServersAction(j)}, nil
+				},
+			},
+			s.enableReadOnlyStep("enable_read_only"),
+			s.stopInstancesStep(),
+			s.swapDataDirStep(),
+			s.startInstancesStep(),
+			s.removeCloneDirsStep(),
+			{
+				Name: "enable_island",
+				Desc: "备集群加回孤岛节点",
+				Actions: func(j *Journal) ([]Action, error) {
+					serverName, err := j.MustGet(OutputSecondaryServer)
+					if err != nil {
+						return nil, err
+					}
+					return actions(s.EnableDataServer(serverName), s.ForceOnline(serverName), s.EnableReadOnly()), nil
+				},
+			},
+			{
+				Name: "repair_flashback",
+				Desc: "修复flashback",
+				Actions: func(j *Journal) ([]Action, error) {
+					return []Action{s.nodeSql(masterNode(j), []string{"stop slave", "reset slave all"}, "")}, nil
+				},
+			},
+			{
+				Name: "add_data",
+				Desc: "主集群写入数据",
+				Actions: func(j *Journal) ([]Action, error) {
+					return s.AddData(), nil
+				},
+			},
+			s.attachReplicationStep(),
+		},
+	}
+}
+
+// DoStartFlashback heartbeatTable 不为空时按心跳表判断灾备集群延迟
+func DoStartFlashback(sourceUserInfo string, sourceSocket string, targetUserInfo string, targetSocket string, exec Executor, heartbeatTable string, mode string) error {
+	settings, err := LoadCloneSettings(CloneSettingsPath(targetSocket))
+	if err != nil {
+		return err
 	}
-	return abPath
+	s := NewSession(sourceUserInfo, sourceSocket, targetUserInfo, targetSocket, exec)
+	s.Clone = settings
+	s.useHeartbeat(heartbeatTable)
+	defer s.Close()
+	return s.RunWorkflow(s.StartWorkflow(), mode)
 }
 
-func getCurrentAbPathByExecutable() string {
-	exePath, err := os.Executable()
+func DoStopFlashback(sourceUserInfo string, sourceSocket string, targetUserInfo string, targetSocket string, exec Executor, mode string) error {
+	settings, err := LoadCloneSettings(CloneSettingsPath(targetSocket))
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	res, _ := filepath.EvalSymlinks(filepath.Dir(exePath))
-	return res
+	s := NewSession(sourceUserInfo, sourceSocket, targetUserInfo, targetSocket, exec)
+	s.Clone = settings
+	defer s.Close()
+	return s.RunWorkflow(s.StopWorkflow(), mode)
 }
@@ -1,194 +1,270 @@
 package flashback
 
 import (
+	"context"
 	"fmt"
 	"giogii/src/entity"
 	"log"
 	"os"
 	"strconv"
 	"strings"
-	"time"
 )
 
-func GetPosAndSet() (masterStatus entity.MasterStatus) {
+func (s *Session) GetPosAndSet() (masterStatus entity.MasterStatus) {
 	var strSql string
 	strSql = fmt.Sprint("show master status")
-	masterStatus = SlaveSqlMapper.DoQueryParseMaster(strSql)
+	masterStatus = s.Slave.DoQueryParseMaster(strSql)
 	return
 }
 
-func SaveInfo(gtid string) int64 {
+func (s *Session) SaveInfo(gtid string) int64 {
 	var strSql string
 	strSql = fmt.Sprint("create table dbscale_tmp.gtid (id int primary key auto_increment, val varchar(1024))")
-	SlaveSqlMapper.DoQueryWithoutRes(strSql)
+	s.Slave.DoQueryWithoutRes(strSql)
 	strSql = fmt.Sprint("insert into dbscale_tmp.gtid (id,val) values (?,?) on duplicate key update val=?")
-	count := SlaveSqlMapper.DoInsertValues(strSql, 1, gtid, gtid)
+	count := s.Slave.DoInsertValues(strSql, 1, gtid, gtid)
 	return count
 }
 
-func DoBeginFlashback(sourceUserInfo string, sourceSocket string, targetUserInfo string, targetSocket string) {
-	InitMasterConnection(sourceUserInfo, sourceSocket)
-	InitSlaveConnection(targetUserInfo, targetSocket)
-
-	defer func() {
-		SlaveSqlMapper.DoClose()
-		MasterSqlMapper.DoClose()
-	}()
-
-	// 1.1 断开主备集群的复制，主集群踢出、备集群断开
-	RemoveSlaveCluster()
-	CloseReplication()
-
-	// 1.2 等待binlog回放完成
-	/**
-	获取灾备集群的GTID，确保灾备集群的数据全部回放完成
-	*/
-	for {
-		GetSlaveGTIDSet()
-		log.Println("等待灾备集群回放Binlog")
-		if SlaveStatus.SecondsBehindMaster.Int64 == 0 {
-			log.Println("灾备集群回放Binlog完成", SlaveStatus.ExecutedGtidSet)
-			break
-		}
-		time.Sleep(3 * time.Second)
+// recordPositionAction 记录备集群主节点binlog位点, gtidKey不为空时同时记录Executed_Gtid_Set
+func (s *Session) recordPositionAction(j *Journal, fileKey string, posKey string, gtidKey string) Action {
+	return Action{
+		Kind:    ActionQuery,
+		Target:  targetSlave,
+		Command: "show master status",
+		run: func(ctx context.Context) error {
+			masterStatus := s.GetPosAndSet()
+			if masterStatus.File == "" || masterStatus.Position == nil {
+				return fmt.Errorf("获取备集群位点失败")
+			}
+			log.Println(fmt.Sprintf("binlog位点: %s:%d, gtid: [ %s ]", masterStatus.File, *masterStatus.Position, masterStatus.ExecutedGtidSet))
+			j.Set(fileKey, masterStatus.File)
+			j.Set(posKey, strconv.Itoa(*masterStatus.Position))
+			if gtidKey != "" {
+				j.Set(gtidKey, strings.ReplaceAll(masterStatus.ExecutedGtidSet, "\n", ""))
+			}
+			return nil
+		},
 	}
+}
 
-	// 1.3 记录备集群GTID和POS位点信息，记录备集群拓扑关系、IP信息
-	masterStatus := GetPosAndSet()
-	log.Println(": ", masterStatus.File)
-	log.Println(": ", *masterStatus.Position)
-	log.Println(": ", masterStatus.ExecutedGtidSet)
-
-	// 1.4 关闭备集群只读参数，变为read write
-	CloseReadOnly()
-
-	// 1.5 保留gtid到数据库里
-	count := SaveInfo(masterStatus.ExecutedGtidSet)
-	// TODO
-	if !(count > 0) {
-		EnableReadOnly()
-		log.Println(": ", masterStatus.File)
+func (s *Session) BeginWorkflow() *Workflow {
+	return &Workflow{
+		Name: "begin",
+		Preflight: func() []CheckResult {
+			return s.Preflight([]string{CheckBinlog, CheckReplica})
+		},
+		Steps: []Step{
+			// 1.0 配置心跳表时等待心跳延迟追平
+			s.waitHeartbeatStep(),
+			// 1.1 断开主备集群的复制，主集群踢出、备集群断开
+			s.detachReplicationStep(),
+			// 1.2 等待binlog回放完成
+			s.waitReplayStep(),
+			{
+				// 1.3 记录备集群GTID和POS位点信息，记录备集群拓扑关系、IP信息
+				Name: "record_position",
+				Desc: "记录备集群GTID和位点",
+				Actions: func(j *Journal) ([]Action, error) {
+					return []Action{
+						s.recordPositionAction(j, OutputBinlogFile, OutputBinlogPos, OutputGtidSet),
+						s.recordDataServersAction(j),
+					}, nil
+				},
+			},
+			// 1.4 关闭备集群只读参数，变为read write
+			s.closeReadOnlyStep(),
+			{
+				// 1.5 保留gtid到数据库里, 保存失败时回滚会重新打开只读, journal丢失时end流程从数据库读取
+				Name: "save_gtid",
+				Desc: "保存GTID到dbscale_tmp.gtid",
+				Actions: func(j *Journal) ([]Action, error) {
+					gtidSet, err := j.MustGet(OutputGtidSet)
+					if err != nil {
+						return nil, err
+					}
+					return []Action{{
+						Kind:    ActionSql,
+						Target:  targetSlave,
+						Command: fmt.Sprintf("insert into dbscale_tmp.gtid (id,val) values (1,'%s') on duplicate key update val=values(val)", gtidSet),
+						run: func(ctx context.Context) error {
+							if count := s.SaveInfo(gtidSet); !(count > 0) {
+								return fmt.Errorf("保存gtid到dbscale_tmp.gtid失败")
+							}
+							return nil
+						},
+					}}, nil
+				},
+			},
+		},
 	}
-
 }
 
-func DoEndFlashback(sourceUserInfo string, sourceSocket string, targetUserInfo string, targetSocket string, sshUser string, sshPass string) {
-	InitMasterConnection(sourceUserInfo, sourceSocket)
-	InitSlaveConnection(targetUserInfo, targetSocket)
-
-	defer func() {
-		SlaveSqlMapper.DoClose()
-		MasterSqlMapper.DoClose()
-	}()
-	// 2.1 打开备集群只读参数，变为read only
-	EnableReadOnly()
-
-	// 2.2 记录备集群主节点GTID和POS位点信息，
-	masterStatus := GetPosAndSet()
-
-	// 2.3 根据binlog位点信息、GTID信息调用dbscale_binlog_tool执行闪回动作
-	var primaryPort string
-	var secondaryPort string
-	var joinerPort string
-	var primaryHost string
-	var secondaryHost string
-	var joinerHost string
-	strSql := fmt.Sprint("dbscale show dataservers")
-	m := SlaveSqlMapper.DoQueryParseToDataServers(strSql)
-	for i := 0; i < len(m); i++ {
-		if m[i].MasterOnlineStatus.String == "Master_Online" {
-			primaryPort = m[i].Port.String
-			primaryHost = m[i].Host.String
-		} else if secondaryPort == "" {
-			secondaryPort = m[i].Port.String
-			secondaryHost = m[i].Host.String
-		} else {
-			joinerPort = m[i].Port.String
-			joinerHost = m[i].Host.String
+func (s *Session) EndWorkflow(sqlFile string) *Workflow {
+	resetGtid := func(j *Journal, node string, startSlave bool) Action {
+		sqls := []string{"stop slave", "reset master", "reset slave", fmt.Sprintf("set global gtid_purged='%s'", j.Value(OutputGtidSet))}
+		if startSlave {
+			sqls = append(sqls, "start slave")
 		}
+		return s.nodeSql(node, sqls, "")
 	}
 
-	// 从dbscale_tmp.gtid获取gtid信息
-	var resSet string
-	strSql = fmt.Sprint("select val from dbscale_tmp.gtid where id = 1")
-	valueSet := SlaveSqlMapper.DoQueryParseSingleValue(strSql)
-	resSet = strings.ReplaceAll(valueSet, "\n", "")
-
-	// 初始化ssh连接
-	initSshConnection(primaryHost, secondaryHost, joinerHost, sshUser, sshPass)
-	primary, _ := primaryClient.Connect()
-	secondary, _ := secondaryClient.Connect()
-	joiner, _ := joinerClient.Connect()
-	defer func() {
-		primary.client.Close()
-		secondary.client.Close()
-		joiner.client.Close()
-	}()
-
-	// 获取mysql路径
-	var result string
-	wg.Add(1)
-	go func() {
-		scriptStr := fmt.Sprintf("string=`ls /data/mysqldata/` && array=(${string// /}) && echo ${array}")
-		result, _ = primaryClient.Run(scriptStr)
-		result = strings.TrimSpace(result)
-		wg.Done()
-	}()
-	wg.Wait()
+	return &Workflow{
+		Name: "end",
+		Preflight: func() []CheckResult {
+			return s.Preflight([]string{CheckBinlog, CheckSsh})
+		},
+		Steps: []Step{
+			// 2.1 打开备集群只读参数，变为read only
+			s.enableReadOnlyStep("enable_read_only"),
+			{
+				// 2.2 记录备集群主节点GTID和POS位点信息
+				Name: "record_end_position",
+				Desc: "记录备集群结束位点",
+				Actions: func(j *Journal) ([]Action, error) {
+					return []Action{
+						s.recordPositionAction(j, OutputEndFile, OutputEndPos, ""),
+						s.recordDataServersAction(j),
+					}, nil
+				},
+			},
+			{
+				// begin流程的journal不存在时从dbscale_tmp.gtid获取gtid信息
+				Name: "load_gtid",
+				Desc: "读取begin时记录的GTID",
+				Actions: func(j *Journal) ([]Action, error) {
+					if j.Completed("begin", "save_gtid") && j.Get(OutputGtidSet) != "" {
+						return nil, nil
+					}
+					strSql := fmt.Sprint("select val from dbscale_tmp.gtid where id = 1")
+					return []Action{{
+						Kind:    ActionQuery,
+						Target:  targetSlave,
+						Command: strSql,
+						run: func(ctx context.Context) error {
+							valueSet := s.Slave.DoQueryParseSingleValue(strSql)
+							j.Set(OutputGtidSet, strings.ReplaceAll(valueSet, "\n", ""))
+							_, err := j.MustGet(OutputGtidSet)
+							return err
+						},
+					}}, nil
+				},
+			},
+			{
+				// 2.3 根据binlog位点信息、GTID信息读取binlog生成反向事务执行闪回动作
+				// 反向事务执行后结束位点之前的binlog不变, 中断后重新执行会因为数据已经闪回而报错, 不会重复闪回
+				Name: "flashback_binlog",
+				Desc: "闪回binlog",
+				Actions: func(j *Journal) ([]Action, error) {
+					var gtidSet, endFile, endPos, host, port string
+					var err error
+					for _, v := range []struct {
+						key   string
+						value *string
+					}{
+						{OutputGtidSet, &gtidSet}, {OutputEndFile, &endFile}, {OutputEndPos, &endPos},
+						{OutputMasterHost, &host}, {OutputMasterPort, &port},
+					} {
+						if *v.value, err = j.MustGet(v.key); err != nil {
+							return nil, err
+						}
+					}
+					command := fmt.Sprintf("读取binlog, 跳过gtid [ %s ], 结束位点 %s:%s, 反向事务在主节点回放", gtidSet, endFile, endPos)
+					if sqlFile != "" {
+						command = fmt.Sprintf("读取binlog, 跳过gtid [ %s ], 结束位点 %s:%s, 反向SQL写入 %s 后暂停", gtidSet, endFile, endPos, sqlFile)
+					}
+					return []Action{{
+						Kind:    ActionBinlog,
+						Target:  fmt.Sprintf("%s:%s", host, port),
+						Command: command,
+						run: func(ctx context.Context) error {
+							return flashbackBinlog(s.TargetUserInfo, host, port, gtidSet, endFile, endPos, sqlFile)
+						},
+					}}, nil
+				},
+			},
+			{
+				Name: "reset_master_gtid",
+				Desc: "主节点重置gtid",
+				Actions: func(j *Journal) ([]Action, error) {
+					return []Action{resetGtid(j, fmt.Sprintf("%s:%s", j.Value(OutputMasterHost), j.Value(OutputMasterPort)), false)}, nil
+				},
+			},
+			{
+				Name: "reset_slave_gtid",
+				Desc: "从节点重置gtid",
+				Actions: func(j *Journal) ([]Action, error) {
+					reset := []Action{resetGtid(j, islandNode(j), true)}
+					for _, node := range j.SlaveNodes() {
+						reset = append(reset, resetGtid(j, node, true))
+					}
+					for i := range reset {
+						reset[i].Batch = "reset"
+					}
+					return reset, nil
+				},
+			},
+			// 2.6 重新构建主集群和备集群的复制关系
+			s.attachReplicationStep(),
+		},
+	}
+}
 
-	// 格式化灾备集群用户名和密码信息
+// flashbackBinlog 直接连接灾备集群主节点读取binlog, 反向事务也在主节点上回放
+// sqlFile不为空时只生成反向SQL供审核, 返回ErrPause, 审核后去掉-o重新执行从该步骤继续
+func flashbackBinlog(targetUserInfo string, host string, port string, gtidSet string, endFile string, endPos string, sqlFile string) error {
 	args := strings.Split(targetUserInfo, ":")
+	pos, err := strconv.Atoi(endPos)
+	if err != nil {
+		return err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
 
-	wg.Add(1)
-	go func() {
-		str := fmt.Sprintf("export LD_LIBRARY_PATH=/data/app/dbscale/libs && /data/app/dbscale/dbscale_binlog_tool "+
-			"-u%s -p'%s' -h127.0.0.1 -P%s "+
-			"--remote-user=%s --remote-password='%s' --remote-host=127.0.0.1 --remote-port=%s "+
-			"--gtid-set=\"%s\" "+
-			"-v  "+
-			"--end-position=%s --end-file=/data/mysqldata/%s/dbdata/%s", args[0], args[1], primaryPort, args[0], args[1], primaryPort, resSet, strconv.Itoa(*masterStatus.Position), result, masterStatus.File)
-		res, _ := primaryClient.Run(str)
-		if res == "" {
-			log.Println("闪回程序dbscale_binlog_tool出错")
-			os.Exit(-1)
-		}
-
-		strCmd := fmt.Sprintf("/data/app/mysql-8.0.26/bin/mysql -u%s -p'%s' -h127.0.0.1 -P%s -e \"stop slave;reset master;reset slave;set global gtid_purged='%s';\"", args[0], args[1], primaryPort, resSet)
-		res, _ = primaryClient.Run(strCmd)
-		log.Println(res)
-		wg.Done()
-	}()
-	wg.Wait()
-
-	wg.Add(1)
-	go func() {
-		strCmd := fmt.Sprintf("/data/app/mysql-8.0.26/bin/mysql -u%s -p'%s' -h127.0.0.1 -P%s -e \"stop slave;reset master;reset slave;set global gtid_purged='%s';start slave;\"", args[0], args[1], secondaryPort, resSet)
-		res, _ := secondaryClient.Run(strCmd)
-		log.Println(res)
-		wg.Done()
-	}()
+	primarySqlMapper := InitTmpConnection(targetUserInfo, fmt.Sprintf("%s:%s", host, port))
+	defer primarySqlMapper.DoClose()
+	reader := &RemoteBinlogReader{
+		Host:     host,
+		Port:     uint16(p),
+		User:     args[0],
+		Password: args[1],
+	}
+	fb := NewBinlogFlashback(gtidSet, endFile, uint32(pos))
+	fb.ColumnResolver = func(schema string, table string) []string {
+		strSql := "select column_name from information_schema.columns where table_schema = ? and table_name = ? order by ordinal_position"
+		return primarySqlMapper.DoQueryParseStrings(strSql, schema, table)
+	}
+	if err := fb.Run(reader); err != nil {
+		return fmt.Errorf("闪回读取binlog出错: %s", err)
+	}
 
-	wg.Add(1)
-	go func() {
-		strCmd := fmt.Sprintf("/data/app/mysql-8.0.26/bin/mysql -u%s -p'%s' -h127.0.0.1 -P%s -e \"stop slave;reset master;reset slave;set global gtid_purged='%s';start slave;\"", args[0], args[1], joinerPort, resSet)
-		res, _ := joinerClient.Run(strCmd)
-		log.Println(res)
-		wg.Done()
-	}()
-	wg.Wait()
+	if sqlFile != "" {
+		f, err := os.Create(sqlFile)
+		if err != nil {
+			return fmt.Errorf("创建闪回SQL文件失败: %s", err)
+		}
+		defer f.Close()
+		if err := fb.WriteSql(f); err != nil {
+			return fmt.Errorf("写入闪回SQL文件失败: %s", err)
+		}
+		log.Println(fmt.Sprintf("共 %d 个事务, 反向SQL已写入 %s", len(fb.Transactions), sqlFile))
+		return ErrPause
+	}
+	return fb.Apply(&primarySqlMapper)
+}
 
-	// 2.6 重新构建主集群和备集群的复制关系
-	socket := strings.Split(targetSocket, ":")
-	fields := strings.Split(targetUserInfo, ":")
-	AddBackupCluster(sourceUserInfo, socket[0], socket[1], fields[0], fields[1])
+// DoBeginFlashback heartbeatTable 不为空时按心跳表判断灾备集群延迟
+func DoBeginFlashback(sourceUserInfo string, sourceSocket string, targetUserInfo string, targetSocket string, heartbeatTable string, mode string) error {
+	s := NewSession(sourceUserInfo, sourceSocket, targetUserInfo, targetSocket, nil)
+	s.useHeartbeat(heartbeatTable)
+	defer s.Close()
+	return s.RunWorkflow(s.BeginWorkflow(), mode)
+}
 
-	//wg.Add(1)
-	//go func() {
-	//	strCmd := fmt.Sprintf("/data/app/mysql-8.0.26/bin/mysql -u%s -p'%s' -h127.0.0.1 -P%s -e \"start slave;\"", args[0], args[1], primaryPort)
-	//	res, _ := primaryClient.Run(strCmd)
-	//	log.Println(res)
-	//	wg.Done()
-	//}()
-	//wg.Wait()
-	StartSlave()
+func DoEndFlashback(sourceUserInfo string, sourceSocket string, targetUserInfo string, targetSocket string, exec Executor, sqlFile string, mode string) error {
+	s := NewSession(sourceUserInfo, sourceSocket, targetUserInfo, targetSocket, exec)
+	defer s.Close()
+	return s.RunWorkflow(s.EndWorkflow(sqlFile), mode)
 }
@@ -0,0 +1,174 @@
+package flashback
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journal中保存的步骤输出
+const (
+	OutputGtidSet         = "gtid_set"
+	OutputBinlogFile      = "binlog_file"
+	OutputBinlogPos       = "binlog_pos"
+	OutputEndFile         = "end_binlog_file"
+	OutputEndPos          = "end_binlog_pos"
+	OutputMasterHost      = "master_host"
+	OutputMasterPort      = "master_port"
+	OutputSecondaryServer = "secondary_server"
+	OutputSecondaryHost   = "secondary_host"
+	OutputSecondaryPort   = "secondary_port"
+	// OutputSlaveNodes 孤岛节点以外的从节点, 逗号分隔的ip:port
+	OutputSlaveNodes = "slave_nodes"
+)
+
+// StepRecord 已完成的步骤
+type StepRecord struct {
+	Name       string    `json:"name"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// WorkflowRecord 一个流程的执行记录
+type WorkflowRecord struct {
+	Steps    []StepRecord `json:"steps"`
+	Finished bool         `json:"finished"`
+}
+
+// Journal 闪回流程的本地日志, 每个步骤完成后立即落盘, 进程中断后可以从日志恢复
+type Journal struct {
+	Path      string                     `json:"-"`
+	Target    string                     `json:"target"`
+	Workflows map[string]*WorkflowRecord `json:"workflows"`
+	Outputs   map[string]string          `json:"outputs"`
+	// Planning plan模式下不落盘, 缺少的输出以占位符代替
+	Planning bool `json:"-"`
+	// lock 同一批并发执行的动作会同时记录输出
+	lock sync.Mutex
+}
+
+// JournalPath 每个灾备集群一个journal文件
+func JournalPath(targetSocket string) string {
+	name := strings.NewReplacer(":", "_", "/", "_").Replace(targetSocket)
+	return fmt.Sprintf("./flashback_%s.journal", name)
+}
+
+// LoadJournal 读取journal, 文件不存在时返回空journal
+func LoadJournal(path string, target string) (*Journal, error) {
+	j := &Journal{
+		Path:      path,
+		Target:    target,
+		Workflows: make(map[string]*WorkflowRecord),
+		Outputs:   make(map[string]string),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("解析journal文件 %s 失败: %s", path, err)
+	}
+	if j.Target != target {
+		return nil, fmt.Errorf("journal文件 %s 属于集群 %s, 不是 %s", path, j.Target, target)
+	}
+	if j.Workflows == nil {
+		j.Workflows = make(map[string]*WorkflowRecord)
+	}
+	if j.Outputs == nil {
+		j.Outputs = make(map[string]string)
+	}
+	return j, nil
+}
+
+// Save 先写临时文件再rename, 避免进程中断时journal损坏
+func (j *Journal) Save() error {
+	if j.Planning {
+		return nil
+	}
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := j.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.Path)
+}
+
+func (j *Journal) workflow(name string) *WorkflowRecord {
+	w, ok := j.Workflows[name]
+	if !ok {
+		w = &WorkflowRecord{}
+		j.Workflows[name] = w
+	}
+	return w
+}
+
+// Completed 步骤是否已经完成
+func (j *Journal) Completed(workflow string, step string) bool {
+	for _, s := range j.workflow(workflow).Steps {
+		if s.Name == step {
+			return true
+		}
+	}
+	return false
+}
+
+// Started 流程已经执行过部分步骤且没有完成
+func (j *Journal) Started(workflow string) bool {
+	w := j.workflow(workflow)
+	return len(w.Steps) > 0 && !w.Finished
+}
+
+// Get 读取步骤输出
+func (j *Journal) Get(key string) string {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.Outputs[key]
+}
+
+// Value 读取步骤输出, plan模式下不存在时返回占位符
+func (j *Journal) Value(key string) string {
+	if v := j.Get(key); v != "" || !j.Planning {
+		return v
+	}
+	return fmt.Sprintf("<%s>", key)
+}
+
+// SlaveNodes 孤岛节点以外的从节点
+func (j *Journal) SlaveNodes() []string {
+	var nodes []string
+	for _, n := range strings.Split(j.Get(OutputSlaveNodes), ",") {
+		if n != "" {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// Set 记录步骤输出, 随步骤完成一起落盘
+func (j *Journal) Set(key string, value string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.Outputs[key] = value
+}
+
+// MustGet 读取前置步骤的输出, 不存在时返回错误, plan模式下返回占位符
+func (j *Journal) MustGet(key string) (string, error) {
+	j.lock.Lock()
+	v, ok := j.Outputs[key]
+	j.lock.Unlock()
+	if (!ok || v == "") && j.Planning {
+		return fmt.Sprintf("<%s>", key), nil
+	}
+	if !ok || v == "" {
+		return "", fmt.Errorf("journal中没有 %s, 请确认前置流程已经执行", key)
+	}
+	return v, nil
+}
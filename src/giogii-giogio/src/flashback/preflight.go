@@ -0,0 +1,232 @@
+package flashback
+
+import (
+	"context"
+	"fmt"
+	"giogii/src/entity"
+	"giogii/src/mapper"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// 预检查项
+const (
+	CheckBinlog  = "binlog"
+	CheckClone   = "clone"
+	CheckDisk    = "disk"
+	CheckSsh     = "ssh"
+	CheckReplica = "replica"
+)
+
+// CheckResult 一个节点上一项检查的结果, Required 为false的检查项失败时只告警
+type CheckResult struct {
+	Name     string
+	Target   string
+	Required bool
+	Passed   bool
+	Detail   string
+}
+
+type preflightNode struct {
+	host string
+	port string
+	// reachable 可以通过执行器在节点上执行命令
+	reachable bool
+	sql       *mapper.SqlStruct
+}
+
+// Preflight 检查灾备集群的每个数据节点, checks 为需要执行的检查项
+func (s *Session) Preflight(checks []string) (results []CheckResult) {
+	enabled := make(map[string]bool)
+	for _, c := range checks {
+		enabled[c] = true
+	}
+
+	cluster, err := s.Topology()
+	if err != nil {
+		return []CheckResult{{Name: "灾备集群拓扑", Target: targetSlave, Required: true, Detail: err.Error()}}
+	}
+	shard, err := cluster.Shard()
+	if err != nil {
+		return []CheckResult{{Name: "灾备集群拓扑", Target: targetSlave, Required: true, Detail: err.Error()}}
+	}
+	var nodes []*preflightNode
+	for _, d := range shard.Servers {
+		nodes = append(nodes, &preflightNode{host: d.Host, port: d.Port})
+	}
+	defer func() {
+		for _, n := range nodes {
+			if n.sql != nil {
+				n.sql.DoClose()
+			}
+		}
+	}()
+
+	for _, n := range nodes {
+		target := fmt.Sprintf("%s:%s", n.host, n.port)
+		if enabled[CheckBinlog] || enabled[CheckClone] || enabled[CheckDisk] {
+			conn, err := mapper.OpenSourceConn(s.TargetUserInfo, target, "information_schema")
+			if err != nil {
+				results = append(results, CheckResult{Name: "MySQL连接", Target: target, Required: true, Detail: err.Error()})
+			} else {
+				n.sql = &conn
+			}
+		}
+		if enabled[CheckSsh] || enabled[CheckClone] || enabled[CheckDisk] {
+			if out, err := s.run(context.Background(), target, "true", ""); err != nil {
+				results = append(results, CheckResult{Name: "节点连接", Target: target, Required: true, Detail: strings.TrimSpace(fmt.Sprintf("%s %s", err, out))})
+			} else {
+				n.reachable = true
+				results = append(results, CheckResult{Name: "节点连接", Target: target, Required: true, Passed: true})
+			}
+		}
+	}
+
+	for _, n := range nodes {
+		target := fmt.Sprintf("%s:%s", n.host, n.port)
+		if enabled[CheckBinlog] && n.sql != nil {
+			results = append(results,
+				checkVariable(n.sql, target, "binlog_format", "ROW"),
+				checkVariable(n.sql, target, "binlog_row_image", "FULL"),
+				checkVariable(n.sql, target, "gtid_mode", "ON"),
+			)
+		}
+		if enabled[CheckClone] && n.sql != nil && n.reachable {
+			results = append(results, s.checkClonePlugin(n, target))
+		}
+		if enabled[CheckDisk] && n.sql != nil && n.reachable {
+			results = append(results, s.checkDisk(n, target))
+		}
+	}
+
+	if enabled[CheckReplica] {
+		replica := checkReplica(s.SlaveStatus())
+		if s.Heartbeat != nil {
+			// 配置心跳表时以心跳延迟为准, Seconds_Behind_Master只告警
+			replica[1].Required = false
+			replica = append(replica, s.checkHeartbeat())
+		}
+		results = append(results, replica...)
+	}
+	return results
+}
+
+func checkVariable(s mapper.SqlScaleOperator, target string, name string, expect string) CheckResult {
+	value := s.DoQueryParseValue(fmt.Sprintf("show global variables like '%s'", name))
+	r := CheckResult{Name: name, Target: target, Required: true, Passed: strings.EqualFold(value, expect)}
+	r.Detail = fmt.Sprintf("%s, 要求 %s", value, expect)
+	return r
+}
+
+// checkClonePlugin clone插件已经安装, 或者plugin_dir下存在mysql_clone.so可以加载
+func (s *Session) checkClonePlugin(n *preflightNode, target string) CheckResult {
+	r := CheckResult{Name: "clone插件", Target: target, Required: true}
+	status := n.sql.DoQueryParseSingleValue("select plugin_status from information_schema.plugins where plugin_name = 'clone'")
+	if status == "ACTIVE" {
+		r.Passed = true
+		r.Detail = "已安装"
+		return r
+	}
+	pluginDir := n.sql.DoQueryParseValue("show global variables like 'plugin_dir'")
+	if _, err := s.run(context.Background(), target, fmt.Sprintf("test -f %s/mysql_clone.so", strings.TrimSuffix(pluginDir, "/")), ""); err != nil {
+		r.Detail = fmt.Sprintf("%s 下没有mysql_clone.so", pluginDir)
+		return r
+	}
+	r.Passed = true
+	r.Detail = "未安装, 可以加载"
+	return r
+}
+
+// checkDisk clone实例需要与现有实例相当的空间, 要求clone目录所在磁盘的可用空间大于实例数据目录的已用空间
+func (s *Session) checkDisk(n *preflightNode, target string) CheckResult {
+	r := CheckResult{Name: "磁盘空间", Target: target, Required: true}
+	datadir := strings.TrimSuffix(n.sql.DoQueryParseSingleValue("select @@datadir"), "/")
+	if datadir == "" {
+		r.Detail = "读取datadir失败"
+		return r
+	}
+	settings := s.cloneSettings()
+	cloneDir := settings.path(settings.CloneDir, n.port)
+	if cloneDir == "" {
+		cloneDir = path.Join(path.Dir(path.Dir(datadir)), "clonebackup")
+	}
+	// clone目录在执行时才创建, 检查已经存在的上级目录
+	shell := fmt.Sprintf("du -sk %s | awk '{print $1}'; d=%s; while [ ! -d \"$d\" ]; do d=$(dirname \"$d\"); done; df -Pk \"$d\" | awk 'NR==2{print $4}'", datadir, cloneDir)
+	out, err := s.run(context.Background(), target, shell, "")
+	if err != nil {
+		r.Detail = fmt.Sprintf("读取磁盘空间失败: %s", err)
+		return r
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		r.Detail = fmt.Sprintf("无法解析磁盘空间: %s", out)
+		return r
+	}
+	used, err1 := strconv.ParseInt(fields[0], 10, 64)
+	avail, err2 := strconv.ParseInt(fields[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		r.Detail = fmt.Sprintf("无法解析磁盘空间: %s", out)
+		return r
+	}
+	r.Passed = avail > used
+	r.Detail = fmt.Sprintf("已用 %dMB, 可用 %dMB", used/1024, avail/1024)
+	return r
+}
+
+// checkReplica 复制线程必须在运行且没有延迟, 有延迟时需要等待回放完成或加 -a force
+func checkReplica(status entity.SlaveStatus) []CheckResult {
+	running := CheckResult{Name: "灾备复制线程", Target: targetSlave, Required: true,
+		Passed: status.SlaveIORunning == "Yes" && status.SlaveSQLRunning == "Yes"}
+	running.Detail = fmt.Sprintf("Slave_IO_Running: %s, Slave_SQL_Running: %s", status.SlaveIORunning, status.SlaveSQLRunning)
+	lag := CheckResult{Name: "灾备复制延迟", Target: targetSlave, Required: true,
+		Passed: status.SecondsBehindMaster.Valid && status.SecondsBehindMaster.Int64 == 0}
+	if status.SecondsBehindMaster.Valid {
+		lag.Detail = fmt.Sprintf("Seconds_Behind_Master: %d", status.SecondsBehindMaster.Int64)
+	} else {
+		lag.Detail = "Seconds_Behind_Master: NULL"
+	}
+	return []CheckResult{running, lag}
+}
+
+// checkHeartbeat 心跳延迟超过 heartbeatMaxLag 或读取心跳失败时不通过
+func (s *Session) checkHeartbeat() CheckResult {
+	r := CheckResult{Name: "灾备心跳延迟", Target: targetSlave, Required: true}
+	lag, err := s.Heartbeat.Lag(time.Now())
+	if err != nil {
+		r.Detail = err.Error()
+		return r
+	}
+	r.Passed = lag <= heartbeatMaxLag
+	r.Detail = fmt.Sprintf("%s: %s", s.Heartbeat.Table, lag)
+	return r
+}
+
+// FailedRequired 未通过的必须项数量
+func FailedRequired(results []CheckResult) (count int) {
+	for _, r := range results {
+		if r.Required && !r.Passed {
+			count++
+		}
+	}
+	return
+}
+
+// WriteCheckResults 以表格输出检查结果
+func WriteCheckResults(out io.Writer, results []CheckResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "检查项\t节点\t结果\t说明")
+	for _, r := range results {
+		state := "PASS"
+		if !r.Passed && r.Required {
+			state = "FAIL"
+		} else if !r.Passed {
+			state = "WARN"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Name, r.Target, state, r.Detail)
+	}
+	w.Flush()
+}
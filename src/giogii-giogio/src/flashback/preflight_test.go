@@ -0,0 +1,104 @@
+package flashback
+
+import (
+	"bytes"
+	"database/sql"
+	"giogii/src/entity"
+	"giogii/src/mapper"
+	"strings"
+	"testing"
+)
+
+// fakeVariables 按 show global variables like 'name' 返回预设的参数值
+type fakeVariables struct {
+	mapper.SqlScaleOperator
+	values map[string]string
+}
+
+func (f *fakeVariables) DoQueryParseValue(sqlStr string) string {
+	name := sqlStr[strings.Index(sqlStr, "'")+1 : strings.LastIndex(sqlStr, "'")]
+	return f.values[name]
+}
+
+func TestCheckVariable(t *testing.T) {
+	s := &fakeVariables{values: map[string]string{"binlog_format": "row", "binlog_row_image": "MINIMAL"}}
+	cases := []struct {
+		name   string
+		expect string
+		passed bool
+		detail string
+	}{
+		{"binlog_format", "ROW", true, "row, 要求 ROW"},
+		{"binlog_row_image", "FULL", false, "MINIMAL, 要求 FULL"},
+		{"gtid_mode", "ON", false, ", 要求 ON"},
+	}
+	for _, c := range cases {
+		r := checkVariable(s, "10.0.0.1:3306", c.name, c.expect)
+		if r.Name != c.name || r.Target != "10.0.0.1:3306" || !r.Required || r.Passed != c.passed || r.Detail != c.detail {
+			t.Fatalf("%s: unexpected result %+v", c.name, r)
+		}
+	}
+}
+
+func TestCheckReplica(t *testing.T) {
+	cases := []struct {
+		io, sqlThread string
+		lag           sql.NullInt64
+		running       bool
+		noLag         bool
+		lagDetail     string
+	}{
+		{"Yes", "Yes", sql.NullInt64{Int64: 0, Valid: true}, true, true, "Seconds_Behind_Master: 0"},
+		{"Yes", "Yes", sql.NullInt64{Int64: 12, Valid: true}, true, false, "Seconds_Behind_Master: 12"},
+		{"Yes", "No", sql.NullInt64{}, false, false, "Seconds_Behind_Master: NULL"},
+		{"Connecting", "Yes", sql.NullInt64{Int64: 0, Valid: true}, false, true, "Seconds_Behind_Master: 0"},
+	}
+	for _, c := range cases {
+		results := checkReplica(entity.SlaveStatus{SlaveIORunning: c.io, SlaveSQLRunning: c.sqlThread, SecondsBehindMaster: c.lag})
+		if len(results) != 2 {
+			t.Fatalf("expect 2 results, got %d", len(results))
+		}
+		running, lag := results[0], results[1]
+		if !running.Required || running.Passed != c.running {
+			t.Fatalf("%s/%s: unexpected running result %+v", c.io, c.sqlThread, running)
+		}
+		if !lag.Required || lag.Passed != c.noLag || lag.Detail != c.lagDetail {
+			t.Fatalf("%v: unexpected lag result %+v", c.lag, lag)
+		}
+	}
+}
+
+func TestCheckResults(t *testing.T) {
+	results := []CheckResult{
+		{Name: "binlog_format", Target: "10.0.0.1:3306", Required: true, Passed: true, Detail: "ROW, 要求 ROW"},
+		{Name: "灾备复制延迟", Target: targetSlave, Required: true, Detail: "Seconds_Behind_Master: 3"},
+		{Name: "灾备复制延迟", Target: targetSlave, Detail: "Seconds_Behind_Master: 1"},
+		{Name: "clone插件", Target: "10.0.0.2:3306", Required: true, Detail: "/usr/lib 下没有mysql_clone.so"},
+	}
+	cases := []struct {
+		results []CheckResult
+		failed  int
+	}{
+		{nil, 0},
+		{results[:1], 0},
+		{results[2:3], 0},
+		{results, 2},
+	}
+	for i, c := range cases {
+		if failed := FailedRequired(c.results); failed != c.failed {
+			t.Fatalf("case %d: expect %d failed, got %d", i, c.failed, failed)
+		}
+	}
+
+	var buf bytes.Buffer
+	WriteCheckResults(&buf, results)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[0], "检查项") {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+	for i, state := range []string{"PASS", "FAIL", "WARN", "FAIL"} {
+		if fields := strings.Fields(lines[i+1]); fields[2] != state {
+			t.Fatalf("line %d: expect %s, got %s", i+1, state, lines[i+1])
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package flashback
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"hash/crc32"
+)
+
+var dig2bytes = [10]int{0, 1, 1, 2, 2, 3, 3, 4, 4, 4}
+
+/**
+rows事件结构:
+header(19) | table_id(4/6) | flags(2) | [v2: extra_len(2) + extra] | column_count | bitmap1 | [bitmap2] | rows | [crc32(4)]
+每一行 = null bitmap + 列值, update事件每两个行镜像为一组(before, after)
+*/
+
+// reverseRowsEvent 按README描述反转rows事件: Write/Delete互换事件类型, Update交换前后镜像, 同时倒序事件内的行
+func reverseRowsEvent(raw []byte, ev *replication.RowsEvent, tableIDSize int, checksum bool, stmtEnd bool) ([]byte, error) {
+	end := len(raw)
+	if checksum {
+		end -= replication.BinlogChecksumLength
+	}
+
+	pos := replication.EventHeaderSize + tableIDSize
+	flagsPos := pos
+	pos += 2
+	if ev.Version == 2 {
+		extraLen := int(binary.LittleEndian.Uint16(raw[pos:]))
+		pos += extraLen
+	}
+	_, _, n := mysql.LengthEncodedInt(raw[pos:])
+	pos += n
+	pos += len(ev.ColumnBitmap1)
+
+	eventType := replication.EventType(raw[4])
+	isUpdate := eventType == replication.UPDATE_ROWS_EVENTv1 || eventType == replication.UPDATE_ROWS_EVENTv2
+	if isUpdate {
+		pos += len(ev.ColumnBitmap2)
+	}
+
+	// 切分行镜像
+	var images [][]byte
+	for p := pos; p < end; {
+		bitmap := ev.ColumnBitmap1
+		if isUpdate && len(images)%2 == 1 {
+			bitmap = ev.ColumnBitmap2
+		}
+		size, err := rowImageSize(ev.Table, bitmap, raw[p:end])
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, raw[p:p+size])
+		p += size
+	}
+	if isUpdate && len(images)%2 != 0 {
+		return nil, fmt.Errorf("update事件行镜像数量不是偶数: %d", len(images))
+	}
+
+	out := make([]byte, 0, len(raw))
+	out = append(out, raw[:pos]...)
+	if isUpdate {
+		// update的before/after使用各自的bitmap, 交换镜像时bitmap也要交换
+		b1 := pos - len(ev.ColumnBitmap1) - len(ev.ColumnBitmap2)
+		copy(out[b1:], ev.ColumnBitmap2)
+		copy(out[b1+len(ev.ColumnBitmap2):], ev.ColumnBitmap1)
+		for i := len(images) - 2; i >= 0; i -= 2 {
+			out = append(out, images[i+1]...)
+			out = append(out, images[i]...)
+		}
+	} else {
+		for i := len(images) - 1; i >= 0; i-- {
+			out = append(out, images[i]...)
+		}
+	}
+
+	switch eventType {
+	case replication.WRITE_ROWS_EVENTv1:
+		out[4] = byte(replication.DELETE_ROWS_EVENTv1)
+	case replication.DELETE_ROWS_EVENTv1:
+		out[4] = byte(replication.WRITE_ROWS_EVENTv1)
+	case replication.WRITE_ROWS_EVENTv2:
+		out[4] = byte(replication.DELETE_ROWS_EVENTv2)
+	case replication.DELETE_ROWS_EVENTv2:
+		out[4] = byte(replication.WRITE_ROWS_EVENTv2)
+	case replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+	default:
+		return nil, fmt.Errorf("不支持的rows事件类型: %s", eventType)
+	}
+
+	flags := binary.LittleEndian.Uint16(out[flagsPos:])
+	if stmtEnd {
+		flags |= replication.RowsEventStmtEndFlag
+	} else {
+		flags &^= replication.RowsEventStmtEndFlag
+	}
+	binary.LittleEndian.PutUint16(out[flagsPos:], flags)
+
+	if checksum {
+		out = append(out, 0, 0, 0, 0)
+	}
+	binary.LittleEndian.PutUint32(out[9:], uint32(len(out)))
+	if checksum {
+		binary.LittleEndian.PutUint32(out[len(out)-4:], crc32.ChecksumIEEE(out[:len(out)-4]))
+	}
+	return out, nil
+}
+
+// rowImageSize 计算一个行镜像(null bitmap + 列值)所占的字节数
+func rowImageSize(table *replication.TableMapEvent, bitmap []byte, data []byte) (int, error) {
+	present := 0
+	for i := 0; i < int(table.ColumnCount); i++ {
+		if isBitSet(bitmap, i) {
+			present++
+		}
+	}
+	nullBitmap := data[:(present+7)/8]
+	pos := len(nullBitmap)
+
+	nullIndex := 0
+	for i := 0; i < int(table.ColumnCount); i++ {
+		if !isBitSet(bitmap, i) {
+			continue
+		}
+		isNull := isBitSet(nullBitmap, nullIndex)
+		nullIndex++
+		if isNull {
+			continue
+		}
+		if pos >= len(data) {
+			return 0, fmt.Errorf("行镜像数据不完整, 表 %s.%s 第%d列", table.Schema, table.Table, i+1)
+		}
+		n, err := columnValueSize(data[pos:], table.ColumnType[i], table.ColumnMeta[i])
+		if err != nil {
+			return 0, err
+		}
+		pos += n
+	}
+	return pos, nil
+}
+
+// columnValueSize 与 go-mysql RowsEvent.decodeValue 的长度计算保持一致
+func columnValueSize(data []byte, tp byte, meta uint16) (int, error) {
+	length := 0
+	if tp == mysql.MYSQL_TYPE_STRING {
+		if meta >= 256 {
+			b0 := uint8(meta >> 8)
+			b1 := uint8(meta & 0xFF)
+			if b0&0x30 != 0x30 {
+				length = int(uint16(b1) | (uint16((b0&0x30)^0x30) << 4))
+				tp = b0 | 0x30
+			} else {
+				length = int(meta & 0xFF)
+				tp = b0
+			}
+		} else {
+			length = int(meta)
+		}
+	}
+
+	switch tp {
+	case mysql.MYSQL_TYPE_NULL:
+		return 0, nil
+	case mysql.MYSQL_TYPE_TINY, mysql.MYSQL_TYPE_YEAR:
+		return 1, nil
+	case mysql.MYSQL_TYPE_SHORT:
+		return 2, nil
+	case mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_DATE, mysql.MYSQL_TYPE_TIME:
+		return 3, nil
+	case mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_FLOAT, mysql.MYSQL_TYPE_TIMESTAMP:
+		return 4, nil
+	case mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_DOUBLE, mysql.MYSQL_TYPE_DATETIME:
+		return 8, nil
+	case mysql.MYSQL_TYPE_TIMESTAMP2:
+		return 4 + int(meta+1)/2, nil
+	case mysql.MYSQL_TYPE_DATETIME2:
+		return 5 + int(meta+1)/2, nil
+	case mysql.MYSQL_TYPE_TIME2:
+		return 3 + int(meta+1)/2, nil
+	case mysql.MYSQL_TYPE_NEWDECIMAL:
+		precision := int(meta >> 8)
+		decimals := int(meta & 0xFF)
+		integral := precision - decimals
+		return integral/9*4 + dig2bytes[integral%9] + decimals/9*4 + dig2bytes[decimals%9], nil
+	case mysql.MYSQL_TYPE_BIT:
+		nbits := ((meta >> 8) * 8) + (meta & 0xFF)
+		return int(nbits+7) / 8, nil
+	case mysql.MYSQL_TYPE_ENUM:
+		switch meta & 0xFF {
+		case 1:
+			return 1, nil
+		case 2:
+			return 2, nil
+		}
+		return 0, fmt.Errorf("未知的ENUM长度: %d", meta&0xFF)
+	case mysql.MYSQL_TYPE_SET:
+		return int(meta & 0xFF), nil
+	case mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_GEOMETRY, mysql.MYSQL_TYPE_JSON:
+		if int(meta) > len(data) || meta > 4 {
+			return 0, fmt.Errorf("无效的BLOB长度字节数: %d", meta)
+		}
+		return int(meta) + int(mysql.FixedLengthInt(data[:meta])), nil
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING:
+		return stringValueSize(data, int(meta)), nil
+	case mysql.MYSQL_TYPE_STRING:
+		return stringValueSize(data, length), nil
+	}
+	return 0, fmt.Errorf("不支持的列类型: %d", tp)
+}
+
+func stringValueSize(data []byte, length int) int {
+	if length < 256 {
+		return 1 + int(data[0])
+	}
+	return 2 + int(binary.LittleEndian.Uint16(data))
+}
+
+func isBitSet(bitmap []byte, i int) bool {
+	return bitmap[i>>3]&(1<<(uint(i)&7)) > 0
+}
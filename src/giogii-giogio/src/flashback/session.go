@@ -0,0 +1,166 @@
+package flashback
+
+import (
+	"context"
+	"fmt"
+	"giogii/src/entity"
+	"giogii/src/heartbeat"
+	"giogii/src/mapper"
+	"giogii/src/topology"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session 一次flashback操作的上下文, 持有主备集群连接、灾备集群拓扑和节点执行器
+// 连接都属于Session, 同一进程中可以同时对多个灾备集群执行flashback
+type Session struct {
+	SourceUserInfo string
+	SourceSocket   string
+	TargetUserInfo string
+	TargetSocket   string
+	// Exec 在数据节点上执行命令, begin流程不需要时为nil
+	Exec Executor
+
+	Master mapper.SqlScaleOperator
+	Slave  mapper.SqlScaleOperator
+	// Clone clone重建节点的路径和参数, 为nil时使用默认配置
+	Clone *CloneSettings
+	// Heartbeat 配置心跳表时用心跳延迟代替Seconds_Behind_Master判断灾备集群的延迟
+	Heartbeat *heartbeat.Monitor
+
+	cluster *topology.Cluster
+	// ports 每个主机上已经分配给clone临时实例的端口
+	ports map[string]map[int]bool
+	lock  sync.Mutex
+}
+
+// NewSession 连接主集群和灾备集群
+func NewSession(sourceUserInfo string, sourceSocket string, targetUserInfo string, targetSocket string, exec Executor) *Session {
+	master := mapper.InitSourceConn(sourceUserInfo, sourceSocket, "information_schema")
+	slave := mapper.InitSourceConn(targetUserInfo, targetSocket, "information_schema")
+	return &Session{
+		SourceUserInfo: sourceUserInfo,
+		SourceSocket:   sourceSocket,
+		TargetUserInfo: targetUserInfo,
+		TargetSocket:   targetSocket,
+		Exec:           exec,
+		Master:         &master,
+		Slave:          &slave,
+	}
+}
+
+// Close 关闭执行器和数据库连接
+func (s *Session) Close() {
+	if s.Exec != nil {
+		s.Exec.Close()
+	}
+	if s.Slave != nil {
+		s.Slave.DoClose()
+	}
+	if s.Master != nil {
+		s.Master.DoClose()
+	}
+}
+
+// useHeartbeat table为空时不使用心跳
+func (s *Session) useHeartbeat(table string) {
+	if table != "" {
+		s.Heartbeat = heartbeat.NewMonitor(s.Master, s.Slave, table)
+	}
+}
+
+// Topology 灾备集群拓扑, 第一次使用时读取
+func (s *Session) Topology() (*topology.Cluster, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cluster == nil {
+		cluster, err := topology.Load(s.Slave)
+		if err != nil {
+			return nil, err
+		}
+		s.cluster = cluster
+	}
+	return s.cluster, nil
+}
+
+// SlaveStatus 灾备集群的复制状态
+func (s *Session) SlaveStatus() entity.SlaveStatus {
+	return s.Slave.DoQueryParseSlave("show slave status")
+}
+
+// targetUser 灾备集群的用户名和密码
+func (s *Session) targetUser() (user string, password string) {
+	fields := strings.Split(s.TargetUserInfo, ":")
+	return fields[0], fields[1]
+}
+
+// run 在节点上执行命令, secret为需要脱敏的密码
+func (s *Session) run(ctx context.Context, node string, shell string, secret string) (string, error) {
+	if s.Exec == nil {
+		return "", fmt.Errorf("没有配置 %s 的执行器", node)
+	}
+	return s.Exec.Run(withSecret(ctx, secret), node, shell)
+}
+
+// scriptPath 节点上脚本的路径
+func (s *Session) scriptPath(node string, script string) string {
+	if s.Exec == nil {
+		return path.Join("/home/mysql", script)
+	}
+	return path.Join(s.Exec.Dir(node), script)
+}
+
+// shell 生成在节点上执行命令的动作, secret为需要脱敏的密码
+func (s *Session) shell(node string, shell string, secret string) Action {
+	display := maskSecret(shell, secret)
+	return Action{
+		Kind:    ActionShell,
+		Target:  node,
+		Command: display,
+		run: func(ctx context.Context) error {
+			result, err := s.run(ctx, node, shell, secret)
+			if result != "" {
+				log.Println(result)
+			}
+			if err != nil {
+				return fmt.Errorf("%s 执行 %s 失败: %s", node, display, maskSecret(err.Error(), secret))
+			}
+			return nil
+		},
+	}
+}
+
+// upload 上传本地脚本到节点的脚本目录
+func (s *Session) upload(node string, localFile string, script string) Action {
+	remoteFile := s.scriptPath(node, script)
+	return Action{
+		Kind:    ActionUpload,
+		Target:  node,
+		Command: fmt.Sprintf("%s -> %s", localFile, remoteFile),
+		Batch:   "upload",
+		run: func(ctx context.Context) error {
+			if s.Exec == nil {
+				return fmt.Errorf("没有配置 %s 的执行器", node)
+			}
+			return s.Exec.Upload(ctx, node, localFile, remoteFile)
+		},
+	}
+}
+
+// waitShell 在节点上轮询直到命令执行成功
+func (s *Session) waitShell(node string, desc string, timeout time.Duration, shell string, secret string) Action {
+	return Action{
+		Kind:    ActionWait,
+		Target:  node,
+		Command: fmt.Sprintf("%s, 轮询 %s", desc, maskSecret(shell, secret)),
+		run: func(ctx context.Context) error {
+			return waitFor(ctx, desc, timeout, 5*time.Second, func() (bool, error) {
+				_, err := s.run(ctx, node, shell, secret)
+				return err == nil, err
+			})
+		},
+	}
+}
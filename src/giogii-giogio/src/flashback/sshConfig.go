@@ -0,0 +1,164 @@
+package flashback
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ssh配置文件, 每行一个主机, 格式为 主机 key=value key=value...
+* 为所有主机的默认配置, 主机的配置在默认配置的基础上覆盖, # 开头为注释
+支持的配置: user password key passphrase agent known_hosts host_key(strict|tofu) timeout keepalive port sudo sudo_password
+例如:
+* user=mysql key=~/.ssh/id_rsa host_key=tofu keepalive=30s
+172.17.139.26 user=root password=xxx sudo=mysql
+*/
+
+// SshConfig 每个主机的ssh配置, 没有单独配置的主机使用默认配置
+type SshConfig struct {
+	Default Client
+	Port    string
+	Hosts   map[string]*sshHost
+}
+
+type sshHost struct {
+	client Client
+	port   string
+}
+
+// NewSshConfig 只有默认配置, 默认按known_hosts严格校验主机公钥
+func NewSshConfig(user string, password string) *SshConfig {
+	return &SshConfig{
+		Default: Client{
+			Username:  user,
+			Password:  password,
+			Timeout:   10 * time.Second,
+			Keepalive: 30 * time.Second,
+			HostKey:   HostKeyStrict,
+		},
+		Port:  "22",
+		Hosts: make(map[string]*sshHost),
+	}
+}
+
+// LoadSshConfig -u -p 作为默认用户和密码, path不为空时读取ssh配置文件
+func LoadSshConfig(path string, user string, password string) (*SshConfig, error) {
+	config := NewSshConfig(user, password)
+	if path == "" {
+		return config, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开ssh配置文件失败: %s", err)
+	}
+	defer f.Close()
+	if err := config.Parse(f); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return config, nil
+}
+
+// Parse 读取配置文件内容, 默认配置先于主机配置生效
+func (s *SshConfig) Parse(r io.Reader) error {
+	type line struct {
+		no     int
+		host   string
+		fields []string
+	}
+	var defaults, hosts []line
+	scanner := bufio.NewScanner(r)
+	for no := 1; scanner.Scan(); no++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		l := line{no: no, host: fields[0], fields: fields[1:]}
+		if l.host == "*" {
+			defaults = append(defaults, l)
+		} else {
+			hosts = append(hosts, l)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, l := range defaults {
+		if err := applySshOptions(&s.Default, &s.Port, l.fields); err != nil {
+			return fmt.Errorf("第%d行: %s", l.no, err)
+		}
+	}
+	for _, l := range hosts {
+		h, ok := s.Hosts[l.host]
+		if !ok {
+			h = &sshHost{client: s.Default, port: s.Port}
+			s.Hosts[l.host] = h
+		}
+		if err := applySshOptions(&h.client, &h.port, l.fields); err != nil {
+			return fmt.Errorf("第%d行: %s", l.no, err)
+		}
+	}
+	return nil
+}
+
+func applySshOptions(c *Client, port *string, options []string) error {
+	for _, option := range options {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("无法解析 %s, 需要key=value", option)
+		}
+		key, value := kv[0], kv[1]
+		var err error
+		switch key {
+		case "user":
+			c.Username = value
+		case "password":
+			c.Password = value
+		case "key":
+			c.KeyFile = value
+		case "passphrase":
+			c.KeyPassphrase = value
+		case "agent":
+			c.Agent, err = strconv.ParseBool(value)
+		case "known_hosts":
+			c.KnownHosts = value
+		case "host_key":
+			if value != HostKeyStrict && value != HostKeyTofu {
+				return fmt.Errorf("host_key只能是%s或%s", HostKeyStrict, HostKeyTofu)
+			}
+			c.HostKey = value
+		case "timeout":
+			c.Timeout, err = time.ParseDuration(value)
+		case "keepalive":
+			c.Keepalive, err = time.ParseDuration(value)
+		case "port":
+			_, err = strconv.Atoi(value)
+			*port = value
+		case "sudo":
+			c.SudoUser = value
+		case "sudo_password":
+			c.SudoPassword = value
+		default:
+			return fmt.Errorf("未知的配置 %s", key)
+		}
+		if err != nil {
+			return fmt.Errorf("%s=%s: %s", key, value, err)
+		}
+	}
+	return nil
+}
+
+// Client 按主机配置生成尚未连接的ssh客户端
+func (s *SshConfig) Client(host string) *Client {
+	c, port := s.Default, s.Port
+	if h, ok := s.Hosts[host]; ok {
+		c, port = h.client, h.port
+	}
+	c.Socket = fmt.Sprintf("%s:%s", host, port)
+	return &c
+}
@@ -0,0 +1,286 @@
+package flashback
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// ErrPause 步骤主动暂停流程, 该步骤不记为完成, 重新执行时从该步骤继续
+var ErrPause = errors.New("流程暂停")
+
+// 流程的执行方式
+const (
+	ModeRun      = ""
+	ModeRollback = "rollback"
+	ModePlan     = "plan"
+	ModePlanJson = "plan-json"
+	// ModePreflight 只执行预检查
+	ModePreflight = "preflight"
+	// ModeForce 预检查有必须项未通过时仍然执行
+	ModeForce = "force"
+)
+
+// 动作类型
+const (
+	ActionSql    = "sql"
+	ActionQuery  = "query"
+	ActionUpload = "upload"
+	ActionShell  = "shell"
+	ActionWait   = "wait"
+	ActionBinlog = "binlog"
+)
+
+// Action 步骤中的一个动作, plan模式只展示, 实际执行时调用run
+// Command 为展示内容, 其中的密码已经脱敏
+type Action struct {
+	Kind    string `json:"kind"`
+	Target  string `json:"target"`
+	Command string `json:"command"`
+	// Batch 相同且相邻的动作并发执行, 其中Target相同的动作按顺序执行
+	Batch string `json:"batch,omitempty"`
+	run   func(ctx context.Context) error
+}
+
+// Step 流程中的一个步骤, Rollback 为补偿动作, 为nil表示该步骤不需要回滚
+// 动作在步骤执行时才生成, 可以使用前置步骤记录到journal中的输出
+type Step struct {
+	Name     string
+	Desc     string
+	Actions  func(j *Journal) ([]Action, error)
+	Rollback func(j *Journal) ([]Action, error)
+}
+
+// Workflow 按顺序执行的步骤, Preflight 为流程开始前的预检查
+type Workflow struct {
+	Name      string
+	Steps     []Step
+	Preflight func() []CheckResult
+}
+
+// PlanStep plan模式输出的步骤
+type PlanStep struct {
+	Workflow  string   `json:"workflow"`
+	Name      string   `json:"name"`
+	Desc      string   `json:"desc"`
+	Completed bool     `json:"completed"`
+	Actions   []Action `json:"actions"`
+	Rollback  []Action `json:"rollback,omitempty"`
+}
+
+// runActions 按顺序执行动作, Batch相同的相邻动作并发执行
+func runActions(ctx context.Context, actions []Action) error {
+	for i := 0; i < len(actions); {
+		k := i + 1
+		for actions[i].Batch != "" && k < len(actions) && actions[k].Batch == actions[i].Batch {
+			k++
+		}
+		if err := runBatch(ctx, actions[i:k]); err != nil {
+			return err
+		}
+		i = k
+	}
+	return nil
+}
+
+// runBatch 按Target分组并发执行, 任一动作失败时取消其余动作, 返回第一个错误
+func runBatch(ctx context.Context, batch []Action) error {
+	if len(batch) == 1 {
+		return runAction(ctx, batch[0])
+	}
+	var targets []string
+	groups := make(map[string][]Action)
+	for _, a := range batch {
+		if _, ok := groups[a.Target]; !ok {
+			targets = append(targets, a.Target)
+		}
+		groups[a.Target] = append(groups[a.Target], a)
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	for _, target := range targets {
+		group := groups[target]
+		g.Go(func() error {
+			for _, a := range group {
+				if err := runAction(ctx, a); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+func runAction(ctx context.Context, a Action) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	log.Println(fmt.Sprintf("[%s] %s: %s", a.Kind, a.Target, a.Command))
+	if a.run == nil {
+		return nil
+	}
+	err := a.run(ctx)
+	if err != nil && err != ErrPause {
+		return fmt.Errorf("%s %s: %s", a.Target, a.Command, err)
+	}
+	return err
+}
+
+// Run 跳过journal中已完成的步骤, 从第一个未完成的步骤继续执行
+func (w *Workflow) Run(j *Journal) error {
+	record := j.workflow(w.Name)
+	if record.Finished {
+		// 上一次已经全部完成, 重新开始
+		record.Steps = nil
+		record.Finished = false
+	}
+
+	for i, step := range w.Steps {
+		if j.Completed(w.Name, step.Name) {
+			log.Println(fmt.Sprintf("[%s %d/%d] %s 已完成, 跳过", w.Name, i+1, len(w.Steps), step.Desc))
+			continue
+		}
+		log.Println(fmt.Sprintf("[%s %d/%d] 准备%s", w.Name, i+1, len(w.Steps), step.Desc))
+		actions, err := step.Actions(j)
+		if err == nil {
+			err = runActions(context.Background(), actions)
+		}
+		if err == ErrPause {
+			log.Println(fmt.Sprintf("[%s %d/%d] %s 暂停, 重新执行命令从该步骤继续", w.Name, i+1, len(w.Steps), step.Desc))
+			return j.Save()
+		}
+		if err != nil {
+			if saveErr := j.Save(); saveErr != nil {
+				log.Println("保存journal失败: ", saveErr)
+			}
+			return fmt.Errorf("[%s] 步骤 %s 失败: %s", w.Name, step.Name, err)
+		}
+		record.Steps = append(record.Steps, StepRecord{Name: step.Name, FinishedAt: time.Now()})
+		if err := j.Save(); err != nil {
+			return fmt.Errorf("保存journal失败: %s", err)
+		}
+		log.Println(fmt.Sprintf("[%s %d/%d] %s完成", w.Name, i+1, len(w.Steps), step.Desc))
+	}
+	record.Finished = true
+	return j.Save()
+}
+
+// Rollback 按完成的逆序执行补偿动作
+func (w *Workflow) Rollback(j *Journal) error {
+	record := j.workflow(w.Name)
+	for i := len(w.Steps) - 1; i >= 0; i-- {
+		step := w.Steps[i]
+		if !j.Completed(w.Name, step.Name) {
+			continue
+		}
+		if step.Rollback != nil {
+			log.Println(fmt.Sprintf("[%s] 回滚%s", w.Name, step.Desc))
+			actions, err := step.Rollback(j)
+			if err == nil {
+				err = runActions(context.Background(), actions)
+			}
+			if err != nil {
+				if saveErr := j.Save(); saveErr != nil {
+					log.Println("保存journal失败: ", saveErr)
+				}
+				return fmt.Errorf("[%s] 回滚步骤 %s 失败: %s", w.Name, step.Name, err)
+			}
+		} else {
+			log.Println(fmt.Sprintf("[%s] %s 没有补偿动作, 跳过", w.Name, step.Desc))
+		}
+		for k, s := range record.Steps {
+			if s.Name == step.Name {
+				record.Steps = append(record.Steps[:k], record.Steps[k+1:]...)
+				break
+			}
+		}
+		if err := j.Save(); err != nil {
+			return fmt.Errorf("保存journal失败: %s", err)
+		}
+	}
+	record.Finished = false
+	return j.Save()
+}
+
+// Plan 生成流程中每个步骤的动作, 不执行也不保存journal
+// j.Planning 为true时前置步骤尚未产生的输出以占位符展示
+func (w *Workflow) Plan(j *Journal) ([]PlanStep, error) {
+	j.Planning = true
+	finished := j.workflow(w.Name).Finished
+	var plans []PlanStep
+	for _, step := range w.Steps {
+		p := PlanStep{Workflow: w.Name, Name: step.Name, Desc: step.Desc, Completed: !finished && j.Completed(w.Name, step.Name)}
+		actions, err := step.Actions(j)
+		if err != nil {
+			return nil, fmt.Errorf("[%s] 步骤 %s 生成计划失败: %s", w.Name, step.Name, err)
+		}
+		p.Actions = actions
+		if step.Rollback != nil {
+			if p.Rollback, err = step.Rollback(j); err != nil {
+				return nil, fmt.Errorf("[%s] 步骤 %s 生成回滚计划失败: %s", w.Name, step.Name, err)
+			}
+		}
+		plans = append(plans, p)
+	}
+	return plans, nil
+}
+
+// WritePlan 按文本或json输出执行计划
+func WritePlan(out io.Writer, plans []PlanStep, mode string) error {
+	if mode == ModePlanJson {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plans)
+	}
+	for i, p := range plans {
+		state := ""
+		if p.Completed {
+			state = " (已完成, 跳过)"
+		}
+		fmt.Fprintf(out, "%d. [%s] %s%s\n", i+1, p.Name, p.Desc, state)
+		writePlanActions(out, p.Actions, "   ")
+		if len(p.Rollback) > 0 {
+			fmt.Fprintln(out, "   回滚:")
+			writePlanActions(out, p.Rollback, "     ")
+		}
+	}
+	return nil
+}
+
+func writePlanActions(out io.Writer, actions []Action, indent string) {
+	for _, a := range actions {
+		batch := ""
+		if a.Batch != "" {
+			batch = " (并发)"
+		}
+		fmt.Fprintf(out, "%s- %-6s %s%s: %s\n", indent, a.Kind, a.Target, batch, strings.ReplaceAll(a.Command, "\n", " "))
+	}
+}
+
+// waitFor 按间隔轮询直到条件满足或ctx取消, 代替固定时长的sleep
+func waitFor(ctx context.Context, desc string, timeout time.Duration, interval time.Duration, cond func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := cond()
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("等待%s超时: %s", desc, err)
+			}
+			return fmt.Errorf("等待%s超时", desc)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package flashback
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkflowResumeAndRollback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.journal")
+	var calls []string
+	fail := true
+	step := func(name string) Step {
+		return Step{
+			Name: name,
+			Desc: name,
+			Actions: func(j *Journal) ([]Action, error) {
+				return []Action{{Kind: ActionSql, Target: targetSlave, Command: "run " + name + " " + j.Value("a"), run: func(ctx context.Context) error {
+					if name == "b" && fail {
+						return errors.New("boom")
+					}
+					calls = append(calls, "run "+name)
+					j.Set(name, "done")
+					return nil
+				}}}, nil
+			},
+			Rollback: func(j *Journal) ([]Action, error) {
+				return []Action{{Kind: ActionSql, Target: targetSlave, Command: "rollback " + name, run: func(ctx context.Context) error {
+					calls = append(calls, "rollback "+name)
+					return nil
+				}}}, nil
+			},
+		}
+	}
+	w := &Workflow{Name: "test", Steps: []Step{step("a"), step("b"), step("c")}}
+
+	// plan模式只输出动作, 不执行也不落盘
+	j, _ := LoadJournal(path, "127.0.0.1:3306")
+	plans, err := w.Plan(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := WritePlan(&out, plans, ModePlan); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 0 || !strings.Contains(out.String(), "1. [a] a\n   - sql    灾备集群: run a <a>\n   回滚:\n     - sql    灾备集群: rollback a\n") {
+		t.Fatalf("unexpected plan %q, calls %v", out.String(), calls)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("plan should not save journal")
+	}
+
+	j, _ = LoadJournal(path, "127.0.0.1:3306")
+	if err := w.Run(j); err == nil {
+		t.Fatal("expect error")
+	}
+
+	// 重新加载journal后从失败的步骤继续
+	fail = false
+	j, err = LoadJournal(path, "127.0.0.1:3306")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !j.Completed("test", "a") || j.Completed("test", "b") || j.Get("a") != "done" {
+		t.Fatalf("unexpected journal %+v", j)
+	}
+	if err := w.Run(j); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Rollback(j); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"run a", "run b", "run c", "rollback c", "rollback b", "rollback a"}
+	if !reflect.DeepEqual(calls, expect) {
+		t.Fatalf("unexpected calls %v", calls)
+	}
+
+	if _, err := LoadJournal(path, "127.0.0.1:3307"); err == nil {
+		t.Fatal("expect target mismatch error")
+	}
+}
+
+func TestRunActionsCancelSiblings(t *testing.T) {
+	var canceled, skipped bool
+	started := make(chan struct{})
+	actions := []Action{
+		{Kind: ActionShell, Target: "10.0.0.1", Batch: "clone", run: func(ctx context.Context) error {
+			<-started
+			return errors.New("clone failed")
+		}},
+		{Kind: ActionShell, Target: "10.0.0.2", Batch: "clone", run: func(ctx context.Context) error {
+			close(started)
+			select {
+			case <-ctx.Done():
+				canceled = true
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+				return nil
+			}
+		}},
+		// 同一节点的后续动作不再执行
+		{Kind: ActionShell, Target: "10.0.0.2", Batch: "clone", run: func(ctx context.Context) error {
+			skipped = false
+			return nil
+		}},
+		{Kind: ActionShell, Target: "10.0.0.3", run: func(ctx context.Context) error {
+			skipped = false
+			return nil
+		}},
+	}
+	skipped = true
+	err := runActions(context.Background(), actions)
+	if err == nil || !strings.Contains(err.Error(), "clone failed") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !canceled || !skipped {
+		t.Fatalf("sibling not canceled: canceled %v, skipped %v", canceled, skipped)
+	}
+}
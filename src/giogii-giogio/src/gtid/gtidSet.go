@@ -0,0 +1,284 @@
+package gtid
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+MySQL GTID集合, 格式如下, 多个UUID之间用逗号分隔, 同一UUID下多个区间用冒号分隔
+3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5:11-18,
+2174b383-5441-11e8-b90a-c80aa9429562:1-3
+*/
+
+// Interval 闭区间 [Start, Stop]
+type Interval struct {
+	Start int64
+	Stop  int64
+}
+
+func (i Interval) String() string {
+	if i.Start == i.Stop {
+		return strconv.FormatInt(i.Start, 10)
+	}
+	return fmt.Sprintf("%d-%d", i.Start, i.Stop)
+}
+
+// Count 区间内的事务数
+func (i Interval) Count() int64 {
+	return i.Stop - i.Start + 1
+}
+
+// GtidSet 按UUID保存有序且不重叠的区间, 所有运算都返回新的集合
+type GtidSet struct {
+	sets map[string][]Interval
+}
+
+func NewGtidSet() *GtidSet {
+	return &GtidSet{sets: make(map[string][]Interval)}
+}
+
+// Parse 解析 Executed_Gtid_Set / gtid_purged 等变量的值
+func Parse(str string) (*GtidSet, error) {
+	s := NewGtidSet()
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return s, nil
+	}
+	for _, uuidSet := range strings.Split(str, ",") {
+		uuidSet = strings.TrimSpace(uuidSet)
+		if uuidSet == "" {
+			continue
+		}
+		fields := strings.Split(uuidSet, ":")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("无效的GTID: %s", uuidSet)
+		}
+		uuid := strings.ToLower(strings.TrimSpace(fields[0]))
+		if len(strings.ReplaceAll(uuid, "-", "")) != 32 {
+			return nil, fmt.Errorf("无效的UUID: %s", fields[0])
+		}
+		for _, field := range fields[1:] {
+			in, err := parseInterval(strings.TrimSpace(field))
+			if err != nil {
+				return nil, fmt.Errorf("无效的GTID区间 %s: %s", uuidSet, err)
+			}
+			s.sets[uuid] = append(s.sets[uuid], in)
+		}
+		s.sets[uuid] = normalize(s.sets[uuid])
+	}
+	return s, nil
+}
+
+// MustParse 用于常量GTID集合, 解析失败直接panic
+func MustParse(str string) *GtidSet {
+	s, err := Parse(str)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func parseInterval(str string) (Interval, error) {
+	var in Interval
+	var err error
+	parts := strings.Split(str, "-")
+	switch len(parts) {
+	case 1:
+		in.Start, err = strconv.ParseInt(parts[0], 10, 64)
+		in.Stop = in.Start
+	case 2:
+		if in.Start, err = strconv.ParseInt(parts[0], 10, 64); err == nil {
+			in.Stop, err = strconv.ParseInt(parts[1], 10, 64)
+		}
+	default:
+		return in, fmt.Errorf("%s", str)
+	}
+	if err != nil {
+		return in, err
+	}
+	if in.Start <= 0 || in.Stop < in.Start {
+		return in, fmt.Errorf("%s", str)
+	}
+	return in, nil
+}
+
+// normalize 排序并合并重叠或相邻的区间
+func normalize(in []Interval) []Interval {
+	if len(in) == 0 {
+		return nil
+	}
+	sorted := append([]Interval{}, in...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+	out := []Interval{sorted[0]}
+	for _, i := range sorted[1:] {
+		last := &out[len(out)-1]
+		if i.Start <= last.Stop+1 {
+			if i.Stop > last.Stop {
+				last.Stop = i.Stop
+			}
+			continue
+		}
+		out = append(out, i)
+	}
+	return out
+}
+
+// Clone 复制集合
+func (s *GtidSet) Clone() *GtidSet {
+	c := NewGtidSet()
+	for uuid, in := range s.sets {
+		c.sets[uuid] = append([]Interval{}, in...)
+	}
+	return c
+}
+
+// Union 并集
+func (s *GtidSet) Union(o *GtidSet) *GtidSet {
+	c := s.Clone()
+	for uuid, in := range o.sets {
+		c.sets[uuid] = normalize(append(c.sets[uuid], in...))
+	}
+	return c
+}
+
+// Subtract 差集, 返回在s中但不在o中的事务
+func (s *GtidSet) Subtract(o *GtidSet) *GtidSet {
+	c := NewGtidSet()
+	for uuid, in := range s.sets {
+		rest := subtractIntervals(in, o.sets[uuid])
+		if len(rest) > 0 {
+			c.sets[uuid] = rest
+		}
+	}
+	return c
+}
+
+func subtractIntervals(a []Interval, b []Interval) []Interval {
+	var out []Interval
+	for _, i := range a {
+		start := i.Start
+		for _, j := range b {
+			if j.Stop < start || j.Start > i.Stop {
+				continue
+			}
+			if j.Start > start {
+				out = append(out, Interval{Start: start, Stop: j.Start - 1})
+			}
+			start = j.Stop + 1
+			if start > i.Stop {
+				break
+			}
+		}
+		if start <= i.Stop {
+			out = append(out, Interval{Start: start, Stop: i.Stop})
+		}
+	}
+	return out
+}
+
+// Intersect 交集
+func (s *GtidSet) Intersect(o *GtidSet) *GtidSet {
+	return s.Subtract(s.Subtract(o))
+}
+
+// Contains o是否是s的子集
+func (s *GtidSet) Contains(o *GtidSet) bool {
+	return o.Subtract(s).IsEmpty()
+}
+
+// ContainsGtid 单个事务是否在集合中
+func (s *GtidSet) ContainsGtid(uuid string, gno int64) bool {
+	for _, in := range s.sets[strings.ToLower(uuid)] {
+		if gno >= in.Start && gno <= in.Stop {
+			return true
+		}
+	}
+	return false
+}
+
+// Add 添加单个事务
+func (s *GtidSet) Add(uuid string, gno int64) {
+	uuid = strings.ToLower(uuid)
+	s.sets[uuid] = normalize(append(s.sets[uuid], Interval{Start: gno, Stop: gno}))
+}
+
+func (s *GtidSet) Equal(o *GtidSet) bool {
+	return s.Contains(o) && o.Contains(s)
+}
+
+func (s *GtidSet) IsEmpty() bool {
+	return len(s.sets) == 0
+}
+
+// Count 集合中的事务总数
+func (s *GtidSet) Count() int64 {
+	var count int64
+	for _, in := range s.sets {
+		count += countIntervals(in)
+	}
+	return count
+}
+
+// CountOf 某个UUID下的事务数
+func (s *GtidSet) CountOf(uuid string) int64 {
+	return countIntervals(s.sets[strings.ToLower(uuid)])
+}
+
+func countIntervals(in []Interval) int64 {
+	var count int64
+	for _, i := range in {
+		count += i.Count()
+	}
+	return count
+}
+
+// UUIDs 按字典序返回集合中的UUID
+func (s *GtidSet) UUIDs() []string {
+	uuids := make([]string, 0, len(s.sets))
+	for uuid := range s.sets {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	return uuids
+}
+
+// Intervals 某个UUID下的区间
+func (s *GtidSet) Intervals(uuid string) []Interval {
+	return append([]Interval{}, s.sets[strings.ToLower(uuid)]...)
+}
+
+// Only 只保留指定UUID的部分
+func (s *GtidSet) Only(uuid string) *GtidSet {
+	c := NewGtidSet()
+	if in, ok := s.sets[strings.ToLower(uuid)]; ok {
+		c.sets[strings.ToLower(uuid)] = append([]Interval{}, in...)
+	}
+	return c
+}
+
+// UUIDString 单个UUID的GTID字符串, 例如 uuid:1-5:7
+func (s *GtidSet) UUIDString(uuid string) string {
+	in := s.sets[strings.ToLower(uuid)]
+	if len(in) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(in)+1)
+	parts = append(parts, strings.ToLower(uuid))
+	for _, i := range in {
+		parts = append(parts, i.String())
+	}
+	return strings.Join(parts, ":")
+}
+
+// String 与MySQL输出格式一致, UUID之间用逗号分隔
+func (s *GtidSet) String() string {
+	uuids := s.UUIDs()
+	parts := make([]string, 0, len(uuids))
+	for _, uuid := range uuids {
+		parts = append(parts, s.UUIDString(uuid))
+	}
+	return strings.Join(parts, ",")
+}
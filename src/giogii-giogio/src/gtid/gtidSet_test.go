@@ -0,0 +1,70 @@
+package gtid
+
+import (
+	"strings"
+	"testing"
+)
+
+const (
+	uuidA = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	uuidB = "2174b383-5441-11e8-b90a-c80aa9429562"
+)
+
+func TestParse(t *testing.T) {
+	s, err := Parse(uuidA + ":1-5:7:6:11-18,\n" + uuidB + ":1-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.String() != uuidB+":1-3,"+uuidA+":1-7:11-18" {
+		t.Fatalf("unexpected set %s", s)
+	}
+	if s.Count() != 18 || s.CountOf(uuidA) != 15 {
+		t.Fatalf("unexpected count %d %d", s.Count(), s.CountOf(uuidA))
+	}
+
+	empty, err := Parse("")
+	if err != nil || !empty.IsEmpty() {
+		t.Fatalf("expect empty set, got %s %v", empty, err)
+	}
+
+	for _, bad := range []string{"abc:1-5", uuidA, uuidA + ":5-1", uuidA + ":0", uuidA + ":x"} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("%s: expect error", bad)
+		}
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	master := MustParse(uuidA + ":1-100")
+	slave := MustParse(uuidA + ":1-40:45-90," + uuidB + ":1-2")
+
+	missing := master.Subtract(slave)
+	if missing.String() != uuidA+":41-44:91-100" || missing.Count() != 14 {
+		t.Fatalf("unexpected missing %s", missing)
+	}
+	extra := slave.Subtract(master)
+	if extra.String() != uuidB+":1-2" || extra.Count() != 2 {
+		t.Fatalf("unexpected extra %s", extra)
+	}
+
+	if master.Contains(slave) || !master.Union(slave).Contains(slave) {
+		t.Fatal("unexpected contains")
+	}
+	if !master.Union(slave).Equal(MustParse(uuidA + ":1-100," + uuidB + ":1-2")) {
+		t.Fatalf("unexpected union %s", master.Union(slave))
+	}
+	if master.Intersect(slave).String() != uuidA+":1-40:45-90" {
+		t.Fatalf("unexpected intersect %s", master.Intersect(slave))
+	}
+	if !master.ContainsGtid(strings.ToUpper(uuidA), 100) || master.ContainsGtid(uuidA, 101) {
+		t.Fatal("unexpected ContainsGtid")
+	}
+
+	s := NewGtidSet()
+	s.Add(uuidA, 2)
+	s.Add(uuidA, 1)
+	s.Add(uuidA, 3)
+	if s.String() != uuidA+":1-3" {
+		t.Fatalf("unexpected set %s", s)
+	}
+}
@@ -0,0 +1,138 @@
+package heartbeat
+
+import (
+	"fmt"
+	"giogii/src/mapper"
+	"log"
+	"strings"
+	"time"
+)
+
+/**
+心跳表, 类似pt-heartbeat: 主集群上每秒以源端server_id写入一行当前时间, 灾备集群通过复制收到这一行,
+两边同一server_id的时间差即为复制延迟. 延迟只比较表中的时间, 不受主备集群所在机器时钟差的影响,
+Seconds_Behind_Master在复制线程停止或dbscale转发时可能为0或NULL, 心跳延迟可以代替它判断灾备集群是否追上
+*/
+
+// DefaultTable 默认心跳表
+const DefaultTable = "dbscale_tmp.heartbeat"
+
+const timeLayout = "2006-01-02 15:04:05.000000"
+
+// Writer 在主集群上写入心跳
+type Writer struct {
+	Operator mapper.SqlScaleOperator
+	Table    string
+	ServerId string
+}
+
+// NewWriter 创建心跳表并读取主集群的server_id
+func NewWriter(operator mapper.SqlScaleOperator, table string) (*Writer, error) {
+	if i := strings.Index(table, "."); i > 0 {
+		if err := operator.DoExec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", table[:i])); err != nil {
+			return nil, err
+		}
+	}
+	if err := operator.DoExec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (server_id INT UNSIGNED NOT NULL PRIMARY KEY, ts DATETIME(6) NOT NULL)", table)); err != nil {
+		return nil, err
+	}
+	serverId := operator.DoQueryParseSingleValue("select @@server_id")
+	if serverId == "" {
+		return nil, fmt.Errorf("读取server_id失败")
+	}
+	return &Writer{Operator: operator, Table: table, ServerId: serverId}, nil
+}
+
+// Beat 写入一次心跳, 时间统一使用UTC
+func (w *Writer) Beat(now time.Time) error {
+	return w.Operator.DoExec(fmt.Sprintf("REPLACE INTO %s (server_id, ts) VALUES (%s, '%s')", w.Table, w.ServerId, now.UTC().Format(timeLayout)))
+}
+
+// Monitor 比较主集群和灾备集群的心跳
+type Monitor struct {
+	Master mapper.SqlScaleOperator
+	Slave  mapper.SqlScaleOperator
+	Table  string
+	// MaxAge 主集群最新的心跳超过该时间没有更新时认为心跳写入已经停止
+	MaxAge time.Duration
+}
+
+// NewMonitor 默认心跳30秒没有更新认为写入停止
+func NewMonitor(master mapper.SqlScaleOperator, slave mapper.SqlScaleOperator, table string) *Monitor {
+	return &Monitor{Master: master, Slave: slave, Table: table, MaxAge: 30 * time.Second}
+}
+
+func parseTs(value string) (time.Time, error) {
+	return time.ParseInLocation("2006-01-02 15:04:05.999999", value, time.UTC)
+}
+
+// Lag 灾备集群的心跳延迟: 主集群最新心跳的时间减去灾备集群上同一server_id的心跳时间
+func (m *Monitor) Lag(now time.Time) (time.Duration, error) {
+	_, rows, err := m.Master.DoQueryParseRows(fmt.Sprintf("select server_id, ts from %s order by ts desc limit 1", m.Table))
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, fmt.Errorf("主集群心跳表 %s 为空", m.Table)
+	}
+	serverId := rows[0][0]
+	slaveTs := m.Slave.DoQueryParseSingleValue(fmt.Sprintf("select ts from %s where server_id = %s", m.Table, serverId))
+	if slaveTs == "" {
+		return 0, fmt.Errorf("灾备集群心跳表 %s 中没有server_id %s 的心跳", m.Table, serverId)
+	}
+	return lagBetween(now, rows[0][1], slaveTs, m.MaxAge)
+}
+
+// lagBetween 两边心跳时间的差, 主集群心跳超过maxAge没有更新时返回错误
+func lagBetween(now time.Time, masterTs string, slaveTs string, maxAge time.Duration) (time.Duration, error) {
+	master, err := parseTs(masterTs)
+	if err != nil {
+		return 0, err
+	}
+	if age := now.Sub(master); maxAge > 0 && age > maxAge {
+		return 0, fmt.Errorf("主集群心跳已经 %s 没有更新, 请确认心跳写入正在运行", age.Round(time.Second))
+	}
+	slave, err := parseTs(slaveTs)
+	if err != nil {
+		return 0, err
+	}
+	if lag := master.Sub(slave); lag > 0 {
+		return lag, nil
+	}
+	return 0, nil
+}
+
+// DoHeartbeat 在主集群上按间隔写入心跳, 直到进程退出
+func DoHeartbeat(userInfo string, socket string, table string, interval time.Duration) {
+	s := mapper.InitSourceConn(userInfo, socket, "information_schema")
+	defer s.DoClose()
+	w, err := NewWriter(&s, table)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("初始化心跳表 %s 失败: %s", table, err))
+	}
+	log.Println(fmt.Sprintf("开始写入心跳 %s, server_id: %s, 间隔 %s", table, w.ServerId, interval))
+	for {
+		if err := w.Beat(time.Now()); err != nil {
+			log.Println(fmt.Sprintf("写入心跳失败: %s", err))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// DoMonitorHeartbeat 按间隔输出灾备集群的心跳延迟
+func DoMonitorHeartbeat(sourceUserInfo string, sourceSocket string, targetUserInfo string, targetSocket string, table string, interval time.Duration) {
+	s, t := mapper.InitAllConn(sourceUserInfo, sourceSocket, "information_schema", targetUserInfo, targetSocket, "information_schema")
+	defer func() {
+		s.DoClose()
+		t.DoClose()
+	}()
+	m := NewMonitor(&s, &t, table)
+	for {
+		if lag, err := m.Lag(time.Now()); err != nil {
+			log.Println(err)
+		} else {
+			fmt.Printf("%s 心跳延迟 %.3fs\n", time.Now().Format("2006-01-02 15:04:05"), lag.Seconds())
+		}
+		time.Sleep(interval)
+	}
+}
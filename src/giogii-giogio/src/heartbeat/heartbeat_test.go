@@ -0,0 +1,21 @@
+package heartbeat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLagBetween(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 10, 0, time.UTC)
+	lag, err := lagBetween(now, "2024-01-01 00:00:09.500000", "2024-01-01 00:00:07.250000", 30*time.Second)
+	if err != nil || lag != 2250*time.Millisecond {
+		t.Fatalf("unexpected lag %s %v", lag, err)
+	}
+	// 灾备集群的心跳不会比主集群新, 写入时间回退时按0处理
+	if lag, err := lagBetween(now, "2024-01-01 00:00:09", "2024-01-01 00:00:09.5", 30*time.Second); err != nil || lag != 0 {
+		t.Fatalf("unexpected lag %s %v", lag, err)
+	}
+	if _, err := lagBetween(now.Add(time.Minute), "2024-01-01 00:00:09", "2024-01-01 00:00:09", 30*time.Second); err == nil {
+		t.Fatal("expect error for stale heartbeat")
+	}
+}
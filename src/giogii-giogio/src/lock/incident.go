@@ -0,0 +1,132 @@
+package lock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Incident 连续多次检查中同一个阻塞者造成的问题, Start/End 为第一次和最后一次发现的时间, Severity 为最高级别
+type Incident struct {
+	Id       int       `json:"id"`
+	Key      string    `json:"key"`
+	Kind     string    `json:"kind"`
+	Blocker  int64     `json:"blocker"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Severity int       `json:"severity"`
+	Polls    int       `json:"polls"`
+	Events   int       `json:"events"`
+	MaxAge   int64     `json:"max_age,omitempty"`
+	MaxRows  int64     `json:"max_rows,omitempty"`
+	Sql      string    `json:"sql,omitempty"`
+	Open     bool      `json:"open"`
+}
+
+func (i *Incident) String() string {
+	return fmt.Sprintf("事故#%d %s PROCESS_ID: %d; 开始: %s; 结束: %s; 持续: %s; 最高级别: %s; 发现 %d 次",
+		i.Id, i.Kind, i.Blocker, i.Start.Format("2006-01-02 15:04:05"), i.End.Format("2006-01-02 15:04:05"),
+		i.End.Sub(i.Start).Round(time.Second), severityNames[i.Severity], i.Polls)
+}
+
+// IncidentTracker 按阻塞者归并各次检查的事件, 状态保存在 Path 中, 重启后继续归并未结束的事故
+type IncidentTracker struct {
+	Path      string      `json:"-"`
+	Incidents []*Incident `json:"incidents"`
+}
+
+// IncidentPath 实例的事故记录
+func IncidentPath(socket string) string {
+	return fmt.Sprintf("./lock_incidents_%s.json", strings.NewReplacer(":", "_", "/", "_").Replace(socket))
+}
+
+// LoadIncidents 读取事故记录, 文件不存在时返回空记录
+func LoadIncidents(path string) (*IncidentTracker, error) {
+	t := &IncidentTracker{Path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return t, nil
+}
+
+// Save 先写临时文件再改名
+func (t *IncidentTracker) Save() error {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.Path)
+}
+
+// incidentGrace 判断两次检查是否连续时在检查间隔之外允许的延迟
+const incidentGrace = 10 * time.Second
+
+// Observe 归并一次检查的事件: 相同Key的未结束事故延续, 否则开始新事故; 本次没有出现的未结束事故结束.
+// 未结束事故的最后发现时间早于 interval 加 incidentGrace 时(监控停止过), 先结束该事故, 不与本次的事件归并
+func (t *IncidentTracker) Observe(now time.Time, interval time.Duration, events []LockEvent) (opened []*Incident, closed []*Incident) {
+	open := make(map[string]*Incident)
+	nextId := 1
+	for _, i := range t.Incidents {
+		if i.Open && now.Sub(i.End) > interval+incidentGrace {
+			i.Open = false
+			closed = append(closed, i)
+		} else if i.Open {
+			open[i.Key] = i
+		}
+		if i.Id >= nextId {
+			nextId = i.Id + 1
+		}
+	}
+	seen := make(map[string]bool)
+	for _, e := range events {
+		key := e.Key()
+		i, ok := open[key]
+		if !ok {
+			i = &Incident{Id: nextId, Key: key, Kind: e.Kind, Blocker: e.Blocker, Start: now, Open: true}
+			nextId++
+			open[key] = i
+			t.Incidents = append(t.Incidents, i)
+			opened = append(opened, i)
+		}
+		if !seen[key] {
+			seen[key] = true
+			i.Polls++
+		}
+		i.End = now
+		i.Events++
+		if e.Severity > i.Severity {
+			i.Severity = e.Severity
+		}
+		if e.Age > i.MaxAge {
+			i.MaxAge = e.Age
+		}
+		if e.Rows > i.MaxRows {
+			i.MaxRows = e.Rows
+		}
+		if e.Sql != "" {
+			i.Sql = e.Sql
+		}
+	}
+	for key, i := range open {
+		if !seen[key] {
+			i.Open = false
+			closed = append(closed, i)
+		}
+	}
+	sort.Slice(closed, func(a, b int) bool { return closed[a].Id < closed[b].Id })
+	return opened, closed
+}
@@ -0,0 +1,101 @@
+package lock
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseThresholds(t *testing.T) {
+	th, err := ParseThresholds("trx=2m,rows=1000,wait=10,mdl=5s")
+	if err != nil || th.TrxAge != 2*time.Minute || th.RowsLocked != 1000 || th.LockWait != 10*time.Second || th.MdlWait != 5*time.Second {
+		t.Fatalf("unexpected thresholds %+v %v", th, err)
+	}
+	if th, _ := ParseThresholds(""); th != DefaultThresholds {
+		t.Fatalf("unexpected default %+v", th)
+	}
+	if _, err := ParseThresholds("age=1"); err == nil {
+		t.Fatal("expected error for unknown threshold")
+	}
+}
+
+func TestSeverity(t *testing.T) {
+	// 默认阈值为0或1时按基准计算, 锁等待可以达到CRITICAL, 锁定2行不是CRITICAL
+	for _, c := range []struct {
+		value, threshold, base int64
+		expect                 int
+	}{
+		{25, 0, 10, SeverityCritical},
+		{5, 0, 10, SeverityWarning},
+		{2, 1, 1000, SeverityWarning},
+		{2000, 1, 1000, SeverityCritical},
+		{150, 100, 60, SeverityWarning},
+		{200, 100, 60, SeverityCritical},
+	} {
+		if s := severity(c.value, c.threshold, c.base); s != c.expect {
+			t.Fatalf("severity(%d, %d, %d) = %d", c.value, c.threshold, c.base, s)
+		}
+	}
+}
+
+func TestIncidentTracker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), IncidentPath("127.0.0.1:3306"))
+	tracker, err := LoadIncidents(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	wait := func(pid int64, blocker int64, age int64, sev int) LockEvent {
+		return LockEvent{Kind: KindLockWait, Pid: pid, Blocker: blocker, Age: age, Severity: sev}
+	}
+
+	// 同一个阻塞者阻塞两个会话, 一次检查只计一次
+	opened, _ := tracker.Observe(start, time.Minute, []LockEvent{wait(11, 10, 5, SeverityWarning), wait(12, 10, 3, SeverityWarning)})
+	if len(opened) != 1 || tracker.Incidents[0].Polls != 1 || tracker.Incidents[0].Events != 2 {
+		t.Fatalf("unexpected incidents %+v", tracker.Incidents)
+	}
+	if err := tracker.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后继续归并未结束的事故
+	tracker, err = LoadIncidents(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, closed := tracker.Observe(start.Add(time.Minute), time.Minute, []LockEvent{wait(11, 10, 65, SeverityCritical), wait(21, 20, 1, SeverityWarning)})
+	if len(opened) != 1 || opened[0].Id != 2 || len(closed) != 0 {
+		t.Fatalf("unexpected opened %+v closed %+v", opened, closed)
+	}
+	_, closed = tracker.Observe(start.Add(2*time.Minute), time.Minute, nil)
+	if len(closed) != 2 {
+		t.Fatalf("unexpected closed %+v", closed)
+	}
+	i := closed[0]
+	if i.Id != 1 || i.Open || i.Polls != 2 || i.Severity != SeverityCritical || i.MaxAge != 65 || !i.Start.Equal(start) || !i.End.Equal(start.Add(time.Minute)) {
+		t.Fatalf("unexpected incident %+v", i)
+	}
+}
+
+func TestIncidentTrackerGap(t *testing.T) {
+	tracker := &IncidentTracker{}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	wait := LockEvent{Kind: KindLockWait, Pid: 11, Blocker: 10, Severity: SeverityWarning}
+	tracker.Observe(start, time.Minute, []LockEvent{wait})
+
+	// 间隔加宽限期以内的检查仍然延续
+	opened, closed := tracker.Observe(start.Add(time.Minute+incidentGrace), time.Minute, []LockEvent{wait})
+	if len(opened) != 0 || len(closed) != 0 || tracker.Incidents[0].Polls != 2 {
+		t.Fatalf("unexpected opened %+v closed %+v", opened, closed)
+	}
+
+	// 监控停止过一段时间, 同一个阻塞者开始新事故, 旧事故在最后发现的时间结束
+	last := tracker.Incidents[0].End
+	opened, closed = tracker.Observe(last.Add(time.Hour), time.Minute, []LockEvent{wait})
+	if len(closed) != 1 || closed[0].Id != 1 || closed[0].Open || !closed[0].End.Equal(last) {
+		t.Fatalf("unexpected closed %+v", closed)
+	}
+	if len(opened) != 1 || opened[0].Id != 2 || !opened[0].Start.Equal(last.Add(time.Hour)) || opened[0].Polls != 1 {
+		t.Fatalf("unexpected opened %+v", opened)
+	}
+}
@@ -0,0 +1,258 @@
+package lock
+
+import (
+	"encoding/json"
+	"fmt"
+	"giogii/src/mapper"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 锁事件类型
+const (
+	KindLongTrx  = "long_trx"
+	KindBigTrx   = "big_trx"
+	KindLockWait = "lock_wait"
+	KindMdlWait  = "mdl_wait"
+)
+
+// 事件级别, 超过阈值为WARNING, 超过阈值(不小于 severityBase)2倍为CRITICAL
+const (
+	SeverityWarning  = 1
+	SeverityCritical = 2
+)
+
+var severityNames = map[int]string{SeverityWarning: "WARNING", SeverityCritical: "CRITICAL"}
+
+// Thresholds 各项检查的阈值, 默认值与单次检查原来的行为相同
+type Thresholds struct {
+	TrxAge     time.Duration
+	RowsLocked int64
+	LockWait   time.Duration
+	MdlWait    time.Duration
+}
+
+var DefaultThresholds = Thresholds{TrxAge: 60 * time.Second, RowsLocked: 1}
+
+// ParseThresholds 解析 "trx=60s,rows=1000,wait=10s,mdl=10s", 时长不带单位时为秒
+func ParseThresholds(options string) (Thresholds, error) {
+	t := DefaultThresholds
+	for _, option := range strings.Split(options, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return t, fmt.Errorf("%s: 格式为 名称=值", option)
+		}
+		var err error
+		switch kv[0] {
+		case "trx":
+			t.TrxAge, err = parseSeconds(kv[1])
+		case "rows":
+			t.RowsLocked, err = strconv.ParseInt(kv[1], 10, 64)
+		case "wait":
+			t.LockWait, err = parseSeconds(kv[1])
+		case "mdl":
+			t.MdlWait, err = parseSeconds(kv[1])
+		default:
+			err = fmt.Errorf("未知的阈值, 可选 trx、rows、wait、mdl")
+		}
+		if err != nil {
+			return t, fmt.Errorf("%s: %s", option, err)
+		}
+	}
+	return t, nil
+}
+
+func parseSeconds(value string) (time.Duration, error) {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// severityBase 计算级别的最小基准: 默认阈值报告全部锁等待和锁定1行以上的事务, 按阈值的2倍计算时
+// 等待永远不会是CRITICAL, 锁定2行就是CRITICAL; 阈值小于基准时按基准计算
+var severityBase = Thresholds{TrxAge: 60 * time.Second, RowsLocked: 1000, LockWait: 10 * time.Second, MdlWait: 10 * time.Second}
+
+// severity 实际值达到阈值(不小于base)的2倍为CRITICAL, 否则为WARNING
+func severity(value int64, threshold int64, base int64) int {
+	if threshold < base {
+		threshold = base
+	}
+	if value >= 2*threshold {
+		return SeverityCritical
+	}
+	return SeverityWarning
+}
+
+// LockEvent 一次检查发现的一个问题, Blocker 为造成问题的会话, 相同Kind和Blocker的事件归为一个事故
+type LockEvent struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Severity int       `json:"severity"`
+	Pid      int64     `json:"pid"`
+	Blocker  int64     `json:"blocker"`
+	User     string    `json:"user,omitempty"`
+	Host     string    `json:"host,omitempty"`
+	Age      int64     `json:"age,omitempty"`
+	Rows     int64     `json:"rows,omitempty"`
+	Sql      string    `json:"sql,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// Key 事故的分组键
+func (e LockEvent) Key() string {
+	return fmt.Sprintf("%s/%d", e.Kind, e.Blocker)
+}
+
+func (e LockEvent) String() string {
+	level := severityNames[e.Severity]
+	switch e.Kind {
+	case KindLongTrx:
+		return fmt.Sprintf("[%s]长事务> PROCESS_ID: %d; 已运行: %d秒; 锁定行数: %d; 连接主机: %s; 连接用户: %s; 执行SQL: %s", level, e.Pid, e.Age, e.Rows, e.Host, e.User, e.Sql)
+	case KindBigTrx:
+		return fmt.Sprintf("[%s]大事务行锁检查> 锁定行数: %d; PROCESS_ID: %d; 连接主机: %s; 连接用户: %s; 执行SQL: %s", level, e.Rows, e.Pid, e.Host, e.User, e.Sql)
+	case KindLockWait:
+		return fmt.Sprintf("[%s]行锁锁等待检查> 语句: %s; 已等待: %d秒; 被PROCESS_ID: %d 阻塞; 可执行: %s 解除", level, e.Sql, e.Age, e.Blocker, e.Detail)
+	case KindMdlWait:
+		return fmt.Sprintf("[%s]MDL锁检查> %s; PROCESS_ID: %d; 执行时间: %d; 执行SQL: %s", level, e.Detail, e.Pid, e.Age, e.Sql)
+	}
+	return fmt.Sprintf("[%s]%s> PROCESS_ID: %d", level, e.Kind, e.Pid)
+}
+
+// Collect 执行四项检查, 返回超过阈值的事件
+func Collect(operator mapper.SqlScaleOperator, t Thresholds, now time.Time) ([]LockEvent, error) {
+	var events []LockEvent
+
+	// 1) 长时间运行的事务, 按事务开始时间计算
+	strSql = fmt.Sprintf("select i.trx_mysql_thread_id, p.USER, p.HOST, timestampdiff(second, i.trx_started, now()), i.trx_rows_locked, i.trx_query "+
+		"from information_schema.INNODB_TRX i inner join information_schema.PROCESSLIST p on i.trx_mysql_thread_id = p.ID "+
+		"where i.trx_started <= now() - interval %d second", int64(t.TrxAge.Seconds()))
+	_, rows, err := operator.DoQueryParseRows(strSql)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		e := LockEvent{Time: now, Kind: KindLongTrx, User: row[1], Host: row[2], Sql: row[5]}
+		e.Pid, _ = strconv.ParseInt(row[0], 10, 64)
+		e.Age, _ = strconv.ParseInt(row[3], 10, 64)
+		e.Rows, _ = strconv.ParseInt(row[4], 10, 64)
+		e.Blocker, e.Severity = e.Pid, severity(e.Age, int64(t.TrxAge.Seconds()), int64(severityBase.TrxAge.Seconds()))
+		events = append(events, e)
+	}
+
+	// 2) 锁定多行的大事务; 各项检查都使用返回错误的 DoQueryParseRows, 连接出错时本次检查失败, 持续监控在下一次继续
+	strSql = fmt.Sprint("select l.THREAD_ID,l.LOCK_COUNT ,t.PROCESSLIST_ID,t.PROCESSLIST_USER,t.PROCESSLIST_HOST ,p.SQL_TEXT from (select THREAD_ID,count(THREAD_ID) as LOCK_COUNT from performance_schema.data_locks where LOCK_MODE <> 'IX' and LOCK_TYPE <> 'TABLE' group by THREAD_ID) l left join performance_schema.threads t on l.THREAD_ID = t.THREAD_ID left join performance_schema.events_statements_current p  on l.THREAD_ID = p.THREAD_ID;")
+	if _, rows, err = operator.DoQueryParseRows(strSql); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		e := LockEvent{Time: now, Kind: KindBigTrx, User: row[3], Host: row[4], Sql: row[5]}
+		e.Rows, _ = strconv.ParseInt(row[1], 10, 64)
+		if e.Rows < t.RowsLocked {
+			continue
+		}
+		e.Pid, _ = strconv.ParseInt(row[2], 10, 64)
+		e.Blocker, e.Severity = e.Pid, severity(e.Rows, t.RowsLocked, severityBase.RowsLocked)
+		events = append(events, e)
+	}
+
+	// 行锁等待和MDL锁等待由锁等待图找到阻塞树的根阻塞者, 第一次需要时读取
+	var graph *LockGraph
+	loaded := false
+	rootBlocker := func(pid int64) int64 {
+		if !loaded {
+			loaded = true
+			var err error
+			if graph, err = LoadLockGraph(operator); err != nil {
+				log.Println(fmt.Sprintf("读取锁等待图失败: %s", err))
+			}
+		}
+		if graph == nil {
+			return 0
+		}
+		return graph.RootBlocker(pid)
+	}
+
+	// 3) 行锁等待, 按根阻塞者归并, 解除等待需要结束根阻塞者
+	strSql = fmt.Sprint("show status like 'Innodb_row_lock_current_waits'")
+	if _, rows, err = operator.DoQueryParseRows(strSql); err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 && len(rows[0]) > 1 && rows[0][1] != "0" {
+		strSql = fmt.Sprint("select wait_age_secs, waiting_pid, waiting_query, blocking_pid, sql_kill_blocking_query from sys.innodb_lock_waits")
+		if _, rows, err = operator.DoQueryParseRows(strSql); err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			e := LockEvent{Time: now, Kind: KindLockWait, Sql: row[2], Detail: row[4]}
+			e.Age, _ = strconv.ParseInt(row[0], 10, 64)
+			if e.Age < int64(t.LockWait.Seconds()) {
+				continue
+			}
+			e.Pid, _ = strconv.ParseInt(row[1], 10, 64)
+			e.Blocker, _ = strconv.ParseInt(row[3], 10, 64)
+			if root := rootBlocker(e.Pid); root != 0 && root != e.Blocker {
+				e.Detail = fmt.Sprintf("KILL %d(直接阻塞者PROCESS_ID: %d)", root, e.Blocker)
+				e.Blocker = root
+			}
+			e.Severity = severity(e.Age, int64(t.LockWait.Seconds()), int64(severityBase.LockWait.Seconds()))
+			events = append(events, e)
+		}
+	}
+
+	// 4) MDL锁等待
+	strSql = fmt.Sprint("select m.OBJECT_TYPE,m.LOCK_TYPE,m.LOCK_STATUS, t.PROCESSLIST_ID,t.PROCESSLIST_TIME,t.PROCESSLIST_INFO from performance_schema.metadata_locks m inner join performance_schema.threads t on m.OWNER_THREAD_ID = t.THREAD_ID where m.LOCK_STATUS = 'PENDING' order by t.PROCESSLIST_TIME DESC ")
+	if _, rows, err = operator.DoQueryParseRows(strSql); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		e := LockEvent{Time: now, Kind: KindMdlWait, Sql: row[5],
+			Detail: fmt.Sprintf("锁对象类型: %s; 锁类型: %s; 锁状态: %s", row[0], row[1], row[2])}
+		e.Age, _ = strconv.ParseInt(row[4], 10, 64)
+		if e.Age < int64(t.MdlWait.Seconds()) {
+			continue
+		}
+		e.Pid, _ = strconv.ParseInt(row[3], 10, 64)
+		e.Blocker, e.Severity = e.Pid, severity(e.Age, int64(t.MdlWait.Seconds()), int64(severityBase.MdlWait.Seconds()))
+		if root := rootBlocker(e.Pid); root != 0 {
+			e.Blocker = root
+			e.Detail += fmt.Sprintf("; 根阻塞者PROCESS_ID: %d", root)
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// EventLogPath 实例的锁事件日志
+func EventLogPath(socket string) string {
+	return fmt.Sprintf("./lock_events_%s.jsonl", strings.NewReplacer(":", "_", "/", "_").Replace(socket))
+}
+
+// AppendEvents 事件追加到事件日志, 一行一个事件
+func AppendEvents(path string, events []LockEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
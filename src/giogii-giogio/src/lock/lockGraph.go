@@ -0,0 +1,494 @@
+package lock
+
+import (
+	"encoding/json"
+	"fmt"
+	"giogii/src/mapper"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+锁等待图: 由 performance_schema.data_lock_waits/data_locks 得到行锁的等待关系,
+由 metadata_locks 中同一对象上 PENDING 与 GRANTED(以及更早的 PENDING)的锁按MDL兼容矩阵得到元数据锁的等待关系,
+threads 补充会话的用户、主机、语句和时长. 边从等待者指向持有者, 没有等待任何会话的持有者为根阻塞者
+*/
+
+// Session 图中的一个会话, Age 为当前语句或等待的时长, TrxAge 为事务时长
+type Session struct {
+	ThreadId  int64  `json:"thread_id"`
+	Pid       int64  `json:"pid"`
+	User      string `json:"user"`
+	Host      string `json:"host"`
+	Db        string `json:"db,omitempty"`
+	State     string `json:"state,omitempty"`
+	Statement string `json:"statement,omitempty"`
+	Age       int64  `json:"age"`
+	TrxAge    int64  `json:"trx_age,omitempty"`
+}
+
+// Label 用于输出的会话描述
+func (s *Session) Label() string {
+	label := fmt.Sprintf("[pid %d] %s@%s", s.Pid, s.User, s.Host)
+	if s.Db != "" {
+		label += " " + s.Db
+	}
+	label += fmt.Sprintf(" 时长 %ds", s.Age)
+	if s.TrxAge > 0 {
+		label += fmt.Sprintf(" 事务 %ds", s.TrxAge)
+	}
+	if s.Statement != "" {
+		label += ": " + shorten(s.Statement, 200)
+	}
+	return label
+}
+
+// 等待类型
+const (
+	WaitRow = "row"
+	WaitMdl = "mdl"
+)
+
+// WaitEdge Waiter 等待 Holder 持有或更早请求的锁
+type WaitEdge struct {
+	Waiter int64  `json:"waiter"`
+	Holder int64  `json:"holder"`
+	Kind   string `json:"kind"`
+	Object string `json:"object"`
+	Mode   string `json:"mode"`
+	Held   string `json:"held"`
+}
+
+func (e WaitEdge) String() string {
+	kind := "行锁"
+	if e.Kind == WaitMdl {
+		kind = "MDL"
+	}
+	return fmt.Sprintf("等待%s %s on %s (持有 %s)", kind, e.Mode, e.Object, e.Held)
+}
+
+// LockGraph 会话按thread_id索引
+type LockGraph struct {
+	Sessions map[int64]*Session `json:"-"`
+	Edges    []WaitEdge         `json:"edges"`
+}
+
+// MdlLock metadata_locks 中的一行
+type MdlLock struct {
+	Object   string
+	LockType string
+	Status   string
+	ThreadId int64
+}
+
+// MDL锁的简写, 与 mdl.h 中的兼容矩阵对应
+var mdlShort = map[string]string{
+	"INTENTION_EXCLUSIVE": "IX", "SHARED": "S", "SHARED_HIGH_PRIO": "SH", "SHARED_READ": "SR", "SHARED_WRITE": "SW",
+	"SHARED_WRITE_LOW_PRIO": "SWLP", "SHARED_UPGRADABLE": "SU", "SHARED_READ_ONLY": "SRO", "SHARED_NO_WRITE": "SNW",
+	"SHARED_NO_READ_WRITE": "SNRW", "EXCLUSIVE": "X",
+}
+
+// mdlGrantedConflicts 请求的锁与哪些已授予的锁不兼容
+var mdlGrantedConflicts = map[string][]string{
+	"IX":   {"S", "X"},
+	"S":    {"IX", "X"},
+	"SH":   {"X"},
+	"SR":   {"SNRW", "X"},
+	"SW":   {"SRO", "SNW", "SNRW", "X"},
+	"SWLP": {"SRO", "SNW", "SNRW", "X"},
+	"SU":   {"SU", "SNW", "SNRW", "X"},
+	"SRO":  {"SW", "SWLP", "SNRW", "X"},
+	"SNW":  {"SW", "SWLP", "SU", "SNW", "SNRW", "X"},
+	"SNRW": {"SR", "SW", "SWLP", "SU", "SRO", "SNW", "SNRW", "X"},
+	"X":    {"IX", "S", "SH", "SR", "SW", "SWLP", "SU", "SRO", "SNW", "SNRW", "X"},
+}
+
+// mdlPendingConflicts 请求的锁需要排在哪些更早的等待请求之后
+var mdlPendingConflicts = map[string][]string{
+	"IX":   {"X"},
+	"S":    {"X"},
+	"SR":   {"SNRW", "X"},
+	"SW":   {"SNW", "SNRW", "X"},
+	"SWLP": {"SRO", "SNW", "SNRW", "X"},
+	"SU":   {"X"},
+	"SRO":  {"SW", "SNRW", "X"},
+	"SNW":  {"X"},
+	"SNRW": {"X"},
+}
+
+func mdlConflict(conflicts map[string][]string, request string, other string) bool {
+	for _, t := range conflicts[mdlShort[request]] {
+		if t == mdlShort[other] {
+			return true
+		}
+	}
+	return false
+}
+
+// NewLockGraph 由会话、行锁等待和元数据锁构建等待图
+func NewLockGraph(sessions []*Session, rowWaits []WaitEdge, mdl []MdlLock) *LockGraph {
+	g := &LockGraph{Sessions: make(map[int64]*Session)}
+	for _, s := range sessions {
+		g.Sessions[s.ThreadId] = s
+	}
+	g.Edges = append(g.Edges, rowWaits...)
+	byObject := make(map[string][]MdlLock)
+	for _, l := range mdl {
+		byObject[l.Object] = append(byObject[l.Object], l)
+	}
+	for _, locks := range byObject {
+		for _, w := range locks {
+			if w.Status != "PENDING" {
+				continue
+			}
+			blocked := make(map[int64]bool)
+			for _, h := range locks {
+				if h.ThreadId == w.ThreadId || blocked[h.ThreadId] {
+					continue
+				}
+				if h.Status == "GRANTED" && mdlConflict(mdlGrantedConflicts, w.LockType, h.LockType) ||
+					h.Status == "PENDING" && g.waitedLonger(h.ThreadId, w.ThreadId) && mdlConflict(mdlPendingConflicts, w.LockType, h.LockType) {
+					blocked[h.ThreadId] = true
+					g.Edges = append(g.Edges, WaitEdge{Waiter: w.ThreadId, Holder: h.ThreadId, Kind: WaitMdl, Object: w.Object, Mode: w.LockType, Held: h.LockType})
+				}
+			}
+		}
+	}
+	sort.SliceStable(g.Edges, func(i, j int) bool {
+		if g.Edges[i].Holder != g.Edges[j].Holder {
+			return g.Edges[i].Holder < g.Edges[j].Holder
+		}
+		return g.Edges[i].Waiter < g.Edges[j].Waiter
+	})
+	return g
+}
+
+// waitedLonger a 是否比 b 更早开始等待
+func (g *LockGraph) waitedLonger(a int64, b int64) bool {
+	sa, sb := g.Sessions[a], g.Sessions[b]
+	return sa != nil && sb != nil && sa.Age > sb.Age
+}
+
+// session 图中没有的会话(已断开或不是前台线程)只记录thread_id
+func (g *LockGraph) session(threadId int64) *Session {
+	if s, ok := g.Sessions[threadId]; ok {
+		return s
+	}
+	s := &Session{ThreadId: threadId, User: "?", Host: "?"}
+	g.Sessions[threadId] = s
+	return s
+}
+
+func (g *LockGraph) waiting(threadId int64) bool {
+	for _, e := range g.Edges {
+		if e.Waiter == threadId {
+			return true
+		}
+	}
+	return false
+}
+
+// Roots 根阻塞者: 被等待但自身没有等待的会话; 只由环组成的等待链取环中时长最长的会话, 按时长从长到短排序
+func (g *LockGraph) Roots() []int64 {
+	var roots []int64
+	seen := make(map[int64]bool)
+	for _, e := range g.Edges {
+		if !seen[e.Holder] && !g.waiting(e.Holder) {
+			seen[e.Holder] = true
+			roots = append(roots, e.Holder)
+		}
+	}
+	reached := make(map[int64]bool)
+	for _, r := range roots {
+		g.reach(r, reached)
+	}
+	for _, e := range g.Edges {
+		if reached[e.Waiter] {
+			continue
+		}
+		// 环: 从该等待者沿等待关系走到重复的会话, 取环中时长最长的会话
+		var chain []int64
+		index := make(map[int64]int)
+		id := e.Waiter
+		for {
+			if _, ok := index[id]; ok {
+				break
+			}
+			index[id] = len(chain)
+			chain = append(chain, id)
+			for _, next := range g.Edges {
+				if next.Waiter == id {
+					id = next.Holder
+					break
+				}
+			}
+		}
+		oldest := id
+		for _, c := range chain[index[id]:] {
+			if g.session(c).Age > g.session(oldest).Age {
+				oldest = c
+			}
+		}
+		roots = append(roots, oldest)
+		g.reach(oldest, reached)
+	}
+	sort.SliceStable(roots, func(i, j int) bool { return g.session(roots[i]).Age > g.session(roots[j]).Age })
+	return roots
+}
+
+// reach 标记等待 threadId 的全部会话
+func (g *LockGraph) reach(threadId int64, reached map[int64]bool) {
+	if reached[threadId] {
+		return
+	}
+	reached[threadId] = true
+	for _, e := range g.Edges {
+		if e.Holder == threadId {
+			g.reach(e.Waiter, reached)
+		}
+	}
+}
+
+// BlockingNode 阻塞树中的一个会话, Wait 为该会话等待父节点的锁, 根节点为nil
+type BlockingNode struct {
+	Session *Session        `json:"session"`
+	Wait    *WaitEdge       `json:"wait,omitempty"`
+	Waiters []*BlockingNode `json:"waiters,omitempty"`
+	Cycle   bool            `json:"cycle,omitempty"`
+}
+
+// Trees 每个根阻塞者一棵阻塞树, 等待多个会话的会话在每个持有者下都出现
+func (g *LockGraph) Trees() []*BlockingNode {
+	var trees []*BlockingNode
+	for _, root := range g.Roots() {
+		trees = append(trees, g.tree(root, nil, map[int64]bool{}))
+	}
+	return trees
+}
+
+func (g *LockGraph) tree(threadId int64, wait *WaitEdge, path map[int64]bool) *BlockingNode {
+	node := &BlockingNode{Session: g.session(threadId), Wait: wait}
+	if path[threadId] {
+		node.Cycle = true
+		return node
+	}
+	path[threadId] = true
+	defer delete(path, threadId)
+	for i := range g.Edges {
+		if e := g.Edges[i]; e.Holder == threadId {
+			node.Waiters = append(node.Waiters, g.tree(e.Waiter, &g.Edges[i], path))
+		}
+	}
+	return node
+}
+
+// RootBlocker 会话所在阻塞树的根阻塞者的pid, 没有等待时返回0
+func (g *LockGraph) RootBlocker(pid int64) int64 {
+	for _, tree := range g.Trees() {
+		if tree.contains(pid) {
+			return tree.Session.Pid
+		}
+	}
+	return 0
+}
+
+func (n *BlockingNode) contains(pid int64) bool {
+	if n.Wait != nil && n.Session.Pid == pid {
+		return true
+	}
+	for _, w := range n.Waiters {
+		if !w.Cycle && w.contains(pid) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteTree 以缩进树输出
+func (g *LockGraph) WriteTree(w io.Writer) {
+	trees := g.Trees()
+	if len(trees) == 0 {
+		fmt.Fprintln(w, "没有锁等待")
+		return
+	}
+	for _, t := range trees {
+		fmt.Fprintln(w, t.Session.Label())
+		writeWaiters(w, t.Waiters, "")
+	}
+}
+
+func writeWaiters(w io.Writer, waiters []*BlockingNode, indent string) {
+	for i, n := range waiters {
+		branch, next := "├─ ", "│  "
+		if i == len(waiters)-1 {
+			branch, next = "└─ ", "   "
+		}
+		cycle := ""
+		if n.Cycle {
+			cycle = " (等待环)"
+		}
+		fmt.Fprintf(w, "%s%s%s%s\n%s%s   %s\n", indent, branch, n.Session.Label(), cycle, indent, next, n.Wait)
+		writeWaiters(w, n.Waiters, indent+next)
+	}
+}
+
+// WriteJson 以json输出阻塞树和全部等待关系
+func (g *LockGraph) WriteJson(w io.Writer) error {
+	sessions := make([]*Session, 0, len(g.Sessions))
+	for _, s := range g.Sessions {
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ThreadId < sessions[j].ThreadId })
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(struct {
+		Trees    []*BlockingNode `json:"trees"`
+		Sessions []*Session      `json:"sessions"`
+		Edges    []WaitEdge      `json:"edges"`
+	}{g.Trees(), sessions, g.Edges})
+}
+
+// shorten 截断过长的语句, 按字符截断
+func shorten(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "..."
+	}
+	return s
+}
+
+// WriteDot 以Graphviz DOT输出, 边从等待者指向持有者, 根阻塞者标红
+func (g *LockGraph) WriteDot(w io.Writer) {
+	fmt.Fprintln(w, "digraph locks {")
+	fmt.Fprintln(w, "  rankdir=RL;")
+	fmt.Fprintln(w, "  node [shape=box];")
+	roots := make(map[int64]bool)
+	for _, r := range g.Roots() {
+		roots[r] = true
+	}
+	var ids []int64
+	for _, e := range g.Edges {
+		for _, id := range []int64{e.Waiter, e.Holder} {
+			if !contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	for _, id := range ids {
+		s := g.session(id)
+		label := fmt.Sprintf("pid %d %s@%s\n时长 %ds\n%s", s.Pid, s.User, s.Host, s.Age, shorten(s.Statement, 60))
+		style := ""
+		if roots[id] {
+			style = ", style=filled, fillcolor=\"#f8d7da\""
+		}
+		fmt.Fprintf(w, "  t%d [label=%s%s];\n", id, strconv.Quote(label), style)
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(w, "  t%d -> t%d [label=%s];\n", e.Waiter, e.Holder, strconv.Quote(fmt.Sprintf("%s %s/%s %s", e.Kind, e.Mode, e.Held, e.Object)))
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func contains(ids []int64, id int64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func parseInt(value string) int64 {
+	n, _ := strconv.ParseInt(value, 10, 64)
+	return n
+}
+
+// LoadLockGraph 从performance_schema读取会话、行锁等待和元数据锁
+func LoadLockGraph(operator mapper.SqlScaleOperator) (*LockGraph, error) {
+	strSql = fmt.Sprint("select t.THREAD_ID, t.PROCESSLIST_ID, t.PROCESSLIST_USER, t.PROCESSLIST_HOST, t.PROCESSLIST_DB, t.PROCESSLIST_STATE, " +
+		"ifnull(t.PROCESSLIST_INFO, s.SQL_TEXT), t.PROCESSLIST_TIME, timestampdiff(second, i.trx_started, now()) " +
+		"from performance_schema.threads t left join performance_schema.events_statements_current s on t.THREAD_ID = s.THREAD_ID " +
+		"left join information_schema.INNODB_TRX i on t.PROCESSLIST_ID = i.trx_mysql_thread_id where t.PROCESSLIST_ID is not null")
+	_, rows, err := operator.DoQueryParseRows(strSql)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*Session
+	for _, row := range rows {
+		sessions = append(sessions, &Session{ThreadId: parseInt(row[0]), Pid: parseInt(row[1]), User: row[2], Host: row[3], Db: row[4],
+			State: row[5], Statement: row[6], Age: parseInt(row[7]), TrxAge: parseInt(row[8])})
+	}
+
+	strSql = fmt.Sprint("select w.REQUESTING_THREAD_ID, w.BLOCKING_THREAD_ID, concat_ws('.', r.OBJECT_SCHEMA, r.OBJECT_NAME, r.INDEX_NAME), " +
+		"r.LOCK_MODE, b.LOCK_MODE, r.LOCK_DATA from performance_schema.data_lock_waits w " +
+		"inner join performance_schema.data_locks r on w.REQUESTING_ENGINE_LOCK_ID = r.ENGINE_LOCK_ID " +
+		"left join performance_schema.data_locks b on w.BLOCKING_ENGINE_LOCK_ID = b.ENGINE_LOCK_ID")
+	_, rows, err = operator.DoQueryParseRows(strSql)
+	if err != nil {
+		return nil, err
+	}
+	var waits []WaitEdge
+	for _, row := range rows {
+		object := row[2]
+		if row[5] != "" {
+			object += " (" + row[5] + ")"
+		}
+		waits = append(waits, WaitEdge{Waiter: parseInt(row[0]), Holder: parseInt(row[1]), Kind: WaitRow, Object: object, Mode: row[3], Held: row[4]})
+	}
+
+	// 只读取有等待者的对象上的锁
+	strSql = fmt.Sprint("select concat_ws('.', m.OBJECT_TYPE, m.OBJECT_SCHEMA, m.OBJECT_NAME), m.LOCK_TYPE, m.LOCK_STATUS, m.OWNER_THREAD_ID " +
+		"from performance_schema.metadata_locks m inner join (select distinct OBJECT_TYPE, ifnull(OBJECT_SCHEMA, '') as OBJECT_SCHEMA, ifnull(OBJECT_NAME, '') as OBJECT_NAME " +
+		"from performance_schema.metadata_locks where LOCK_STATUS = 'PENDING') p on m.OBJECT_TYPE = p.OBJECT_TYPE " +
+		"and ifnull(m.OBJECT_SCHEMA, '') = p.OBJECT_SCHEMA and ifnull(m.OBJECT_NAME, '') = p.OBJECT_NAME " +
+		"where m.LOCK_STATUS in ('GRANTED', 'PENDING')")
+	_, rows, err = operator.DoQueryParseRows(strSql)
+	if err != nil {
+		return nil, err
+	}
+	var mdl []MdlLock
+	for _, row := range rows {
+		mdl = append(mdl, MdlLock{Object: row[0], LockType: row[1], Status: row[2], ThreadId: parseInt(row[3])})
+	}
+	return NewLockGraph(sessions, waits, mdl), nil
+}
+
+// DoShowBlockingTree 输出阻塞树, format 为 tree(默认)、json 或 dot, outFile 不为空时写入文件
+func DoShowBlockingTree(format string, outFile string) {
+	defer func() {
+		SourceSqlMapper.DoClose()
+	}()
+
+	g, err := LoadLockGraph(SourceSqlMapper)
+	if err != nil {
+		log.Println(fmt.Sprintf("读取锁信息失败: %s", err))
+		return
+	}
+	var out io.Writer = os.Stdout
+	if outFile != "" {
+		f, err := os.Create(outFile)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer f.Close()
+		out = f
+	}
+	switch format {
+	case "", "tree":
+		g.WriteTree(out)
+	case "json":
+		err = g.WriteJson(out)
+	case "dot":
+		g.WriteDot(out)
+	default:
+		err = fmt.Errorf("未知的格式 %s, 可选 tree、json、dot", format)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,125 @@
+package lock
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"giogii/src/mapper"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockGraph(t *testing.T) {
+	sessions := []*Session{
+		{ThreadId: 101, Pid: 1, User: "app", Host: "10.0.0.1", Statement: "select * from t", Age: 300, TrxAge: 300},
+		{ThreadId: 102, Pid: 2, User: "dba", Host: "10.0.0.2", Statement: "alter table t add c int", Age: 100},
+		{ThreadId: 103, Pid: 3, User: "app", Host: "10.0.0.3", Statement: "select * from t", Age: 50},
+		{ThreadId: 104, Pid: 4, User: "app", Host: "10.0.0.4", Statement: "update u set a = 1", Age: 20},
+		{ThreadId: 105, Pid: 5, User: "app", Host: "10.0.0.5", Statement: "update u set a = 2", Age: 10},
+		{ThreadId: 106, Pid: 6, User: "app", Host: "10.0.0.6", Age: 8},
+		{ThreadId: 107, Pid: 7, User: "app", Host: "10.0.0.7", Age: 9},
+	}
+	rows := []WaitEdge{
+		{Waiter: 105, Holder: 104, Kind: WaitRow, Object: "db.u.PRIMARY (1)", Mode: "X,REC_NOT_GAP", Held: "X,REC_NOT_GAP"},
+		{Waiter: 106, Holder: 107, Kind: WaitRow, Object: "db.v.PRIMARY (1)", Mode: "X", Held: "X"},
+		{Waiter: 107, Holder: 106, Kind: WaitRow, Object: "db.v.PRIMARY (2)", Mode: "X", Held: "X"},
+	}
+	mdl := []MdlLock{
+		{Object: "TABLE.db.t", LockType: "SHARED_READ", Status: "GRANTED", ThreadId: 101},
+		{Object: "TABLE.db.t", LockType: "EXCLUSIVE", Status: "PENDING", ThreadId: 102},
+		{Object: "TABLE.db.t", LockType: "SHARED_READ", Status: "PENDING", ThreadId: 103},
+	}
+	g := NewLockGraph(sessions, rows, mdl)
+
+	roots := g.Roots()
+	if len(roots) != 3 || roots[0] != 101 || roots[1] != 104 || roots[2] != 107 {
+		t.Fatalf("unexpected roots %v", roots)
+	}
+	trees := g.Trees()
+	// 新的SELECT排在等待中的ALTER之后
+	mdlTree := trees[0]
+	if len(mdlTree.Waiters) != 1 || mdlTree.Waiters[0].Session.Pid != 2 || len(mdlTree.Waiters[0].Waiters) != 1 ||
+		mdlTree.Waiters[0].Waiters[0].Session.Pid != 3 || mdlTree.Waiters[0].Waiters[0].Wait.Held != "EXCLUSIVE" {
+		t.Fatalf("unexpected mdl tree %+v", mdlTree)
+	}
+	if !trees[2].Waiters[0].Waiters[0].Cycle {
+		t.Fatalf("expected cycle in %+v", trees[2])
+	}
+	if g.RootBlocker(3) != 1 || g.RootBlocker(5) != 4 || g.RootBlocker(1) != 0 {
+		t.Fatal("unexpected root blocker")
+	}
+
+	var buf bytes.Buffer
+	g.WriteTree(&buf)
+	if !strings.HasPrefix(buf.String(), "[pid 1] app@10.0.0.1 时长 300s 事务 300s: select * from t\n└─ [pid 2]") {
+		t.Fatalf("unexpected tree:\n%s", buf.String())
+	}
+	buf.Reset()
+	g.WriteDot(&buf)
+	if !strings.Contains(buf.String(), "t102 -> t101") || !strings.Contains(buf.String(), "fillcolor") {
+		t.Fatalf("unexpected dot:\n%s", buf.String())
+	}
+	buf.Reset()
+	if err := g.WriteJson(&buf); err != nil || !json.Valid(buf.Bytes()) {
+		t.Fatalf("unexpected json %v", err)
+	}
+}
+
+// fakeLockOperator 只有行锁等待: pid 3 等待 pid 2, pid 2 等待 pid 1; fail 中的语句返回错误
+type fakeLockOperator struct {
+	mapper.SqlScaleOperator
+	fail string
+}
+
+func (f *fakeLockOperator) DoQueryParseRows(sqlStr string) ([]string, [][]string, error) {
+	if f.fail != "" && strings.Contains(sqlStr, f.fail) {
+		return nil, nil, fmt.Errorf("invalid connection")
+	}
+	switch {
+	case strings.Contains(sqlStr, "from performance_schema.threads t left join"):
+		return nil, [][]string{
+			{"101", "1", "app", "10.0.0.1", "db", "", "", "100", "100"},
+			{"102", "2", "app", "10.0.0.2", "db", "updating", "update t set a = 2", "30", "40"},
+			{"103", "3", "app", "10.0.0.3", "db", "updating", "update t set a = 3", "20", "20"},
+		}, nil
+	case strings.Contains(sqlStr, "data_lock_waits"):
+		return nil, [][]string{
+			{"103", "102", "db.t.PRIMARY", "X,REC_NOT_GAP", "X,REC_NOT_GAP", "1"},
+			{"102", "101", "db.t.PRIMARY", "X,REC_NOT_GAP", "X,REC_NOT_GAP", "1"},
+		}, nil
+	case strings.Contains(sqlStr, "Innodb_row_lock_current_waits"):
+		return nil, [][]string{{"Innodb_row_lock_current_waits", "2"}}, nil
+	case strings.Contains(sqlStr, "sys.innodb_lock_waits"):
+		return nil, [][]string{
+			{"20", "3", "update t set a = 3", "2", "KILL QUERY 2"},
+			{"30", "2", "update t set a = 2", "1", "KILL QUERY 1"},
+		}, nil
+	}
+	return nil, nil, nil
+}
+
+func TestCollectRootBlocker(t *testing.T) {
+	// 没有MDL等待时行锁等待也按根阻塞者归并, 两个等待是同一个事故
+	events, err := Collect(&fakeLockOperator{}, DefaultThresholds, time.Now())
+	if err != nil || len(events) != 2 {
+		t.Fatalf("unexpected events %+v %v", events, err)
+	}
+	for _, e := range events {
+		if e.Kind != KindLockWait || e.Blocker != 1 || e.Key() != events[0].Key() {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	}
+	if events[0].Detail != "KILL 1(直接阻塞者PROCESS_ID: 2)" || events[1].Detail != "KILL QUERY 1" {
+		t.Fatalf("unexpected detail %q %q", events[0].Detail, events[1].Detail)
+	}
+}
+
+func TestCollectQueryError(t *testing.T) {
+	// 任何一项检查的查询失败都返回错误, 不会panic
+	for _, fail := range []string{"INNODB_TRX", "data_locks where", "Innodb_row_lock_current_waits", "sys.innodb_lock_waits", "metadata_locks m"} {
+		if _, err := Collect(&fakeLockOperator{fail: fail}, DefaultThresholds, time.Now()); err == nil {
+			t.Fatalf("expect error when %s fails", fail)
+		}
+	}
+}
@@ -4,13 +4,14 @@ import (
 	"fmt"
 	"giogii/src/mapper"
 	"log"
-	"strconv"
+	"time"
 )
 
 var SourceSqlMapper mapper.SqlScaleOperator
 var TargetSocket string
 
 func InitConf(sourceUserInfo string, sourceSocket string, sourceDatabase string) {
+	TargetSocket = sourceSocket
 	s := mapper.InitSourceConn(sourceUserInfo, sourceSocket, sourceDatabase)
 	SourceSqlMapper = &s
 }
@@ -75,70 +76,61 @@ unlock tables;
 var strSql string
 var BaseSqlScaleOperator mapper.SqlScaleOperator
 
-func DoMonitorLock() {
+// monitorOnce 执行一次检查并输出事件, tracker 不为nil(持续监控)时写入事件日志并归并为事故
+func monitorOnce(tracker *IncidentTracker, t Thresholds, interval time.Duration) {
+	now := time.Now()
+	events, err := Collect(SourceSqlMapper, t, now)
+	if err != nil {
+		log.Println(fmt.Sprintf("锁检查失败: %s", err))
+		return
+	}
+	counts := make(map[string]int)
+	for _, e := range events {
+		counts[e.Kind]++
+		log.Println(e.String())
+	}
+	if counts[KindLongTrx] > 0 {
+		log.Printf("超过%s的事务>  共计: %d 个", t.TrxAge, counts[KindLongTrx])
+	}
+	if tracker == nil {
+		return
+	}
+	if err := AppendEvents(EventLogPath(TargetSocket), events); err != nil {
+		log.Println(fmt.Sprintf("写入锁事件日志失败: %s", err))
+	}
+	opened, closed := tracker.Observe(now, interval, events)
+	for _, i := range opened {
+		log.Println(fmt.Sprintf("开始 %s", i))
+	}
+	for _, i := range closed {
+		log.Println(fmt.Sprintf("结束 %s", i))
+	}
+	if err := tracker.Save(); err != nil {
+		log.Println(fmt.Sprintf("保存锁事故记录失败: %s", err))
+	}
+}
+
+// DoMonitorLock 检查长事务、大事务行锁、行锁等待和MDL锁等待, interval 大于0时按间隔持续检查
+func DoMonitorLock(t Thresholds, interval time.Duration) {
 
 	defer func() {
 		SourceSqlMapper.DoClose()
 	}()
 
-	/**
-	1） 判断是否有长时间运行的事务  -L l
-	*/
-	// 1.1 超过60秒的事务有几个
-	strSql = fmt.Sprint("select count(*) from information_schema.INNODB_TRX i inner join information_schema.PROCESSLIST p on i.trx_mysql_thread_id = p.ID where p.TIME > 60")
-	trxLongerThanSixtySecondCount := SourceSqlMapper.DoQueryParseSingleValue(strSql)
-	count, _ := strconv.Atoi(trxLongerThanSixtySecondCount)
-	if count > 0 {
-		log.Printf("超过60秒的事务>  共计: %s 个", trxLongerThanSixtySecondCount)
-		//strSql = fmt.Sprint("select p.ID, p.USER, p.HOST, p.DB, p.TIME, s.SQL_TEXT from information_schema.INNODB_TRX i inner join information_schema.PROCESSLIST p on i.trx_mysql_thread_id = p.ID inner join performance_schema.threads t on i.trx_mysql_thread_id = t.PROCESSLIST_ID inner join performance_schema.events_statements_current s on t.THREAD_ID = s.THREAD_ID")
+	if interval <= 0 {
+		// 单次检查只输出, 不写事件日志和事故记录
+		monitorOnce(nil, t, interval)
+		return
 	}
-
-	/**
-	2) 判断当前环境是否有大事务锁了多行  -L t
-	select count(*) from data_locks where LOCK_MODE <> 'IX';
-	select THREAD_ID,count(THREAD_ID) from performance_schema.data_locks where LOCK_MODE <> 'IX' group by THREAD_ID;
-	*/
-	strSql = fmt.Sprint("select l.THREAD_ID,l.LOCK_COUNT ,t.PROCESSLIST_ID,t.PROCESSLIST_USER,t.PROCESSLIST_HOST ,p.SQL_TEXT from (select THREAD_ID,count(THREAD_ID) as LOCK_COUNT from performance_schema.data_locks where LOCK_MODE <> 'IX' and LOCK_TYPE <> 'TABLE' group by THREAD_ID) l left join performance_schema.threads t on l.THREAD_ID = t.THREAD_ID left join performance_schema.events_statements_current p  on l.THREAD_ID = p.THREAD_ID;")
-	bt := SourceSqlMapper.DoQueryParseToBigTransaction(strSql)
-	if len(bt) > 0 {
-		for i := 0; i < len(bt); i++ {
-			b := bt[i]
-			if *b.LockCount > 0 {
-				log.Print("大事务行锁检查> ", " 锁定行数: ", *b.LockCount, "; PROCESS_ID: ", *b.ProcesslistId, "; 连接主机: ", b.ProcesslistHost, "; 连接用户: ", b.ProcesslistUser, "; 执行SQL: ", b.SqlText)
-			}
-		}
+	tracker, err := LoadIncidents(IncidentPath(TargetSocket))
+	if err != nil {
+		log.Println(err)
+		return
 	}
-
-	/**
-	3）判断当前环境是否存在锁等待   -L w
-	等待时长要记录
-	*/
-	strSql = fmt.Sprint("show status like 'Innodb_row_lock_current_waits'")
-	innodbRowLockCurrentWaits := SourceSqlMapper.DoQueryParseString(strSql)
-	value, _ := strconv.Atoi(innodbRowLockCurrentWaits) //strconv.ParseInt(innodbRowLockCurrentWaits, 10, 64)
-	if value > 0 {                                      // 如果正在等待锁的值大于0，
-		log.Print("行锁锁等待检查> ", " 当前环境至少存在", value, "个锁等待")
-		strSql = fmt.Sprint("select * from sys.innodb_lock_waits")
-		lw := SourceSqlMapper.DoQueryParseToSysInnodbLockWaits(strSql)
-		if len(lw) > 0 {
-			for i := 0; i < len(lw); i++ {
-				l := lw[i]
-				log.Print("(", i+1, ") 语句> ", " ", l.WaitingQuery.String, " ; 被PROCESS_ID : ", *l.BlockingPid, " 阻塞;", " 可执行: ", l.SqlKillBlockingQuery.String, " 解除; ")
-			}
-		}
+	log.Println(fmt.Sprintf("开始监控 %s 的锁, 间隔 %s, 事务 %s, 锁定行数 %d, 行锁等待 %s, MDL等待 %s",
+		TargetSocket, interval, t.TrxAge, t.RowsLocked, t.LockWait, t.MdlWait))
+	for {
+		monitorOnce(tracker, t, interval)
+		time.Sleep(interval)
 	}
-
-	/**
-	4) 判断当前环境是否存在MDL锁等待且阻塞现象
-	*/
-
-	strSql = fmt.Sprint("select m.OBJECT_TYPE,m.LOCK_TYPE,m.LOCK_STATUS, t.PROCESSLIST_ID,t.PROCESSLIST_TIME,t.PROCESSLIST_INFO from performance_schema.metadata_locks m inner join performance_schema.threads t on m.OWNER_THREAD_ID = t.THREAD_ID where m.LOCK_STATUS = 'PENDING' order by t.PROCESSLIST_TIME DESC ")
-	ml := SourceSqlMapper.DoQueryParseToMetadataLocks(strSql)
-	if len(ml) > 0 {
-		for i := 0; i < len(ml); i++ {
-			m := ml[i]
-			log.Print("MDL锁检查> ", " 锁对象类型: ", m.ObjectType, "; 锁状态: ", m.LockStatus, "; PROCESS_ID: ", *m.ProcesslistId, "; 执行时间: ", m.ProcesslistTime, "; 执行SQL: ", m.ProcesslistInfo)
-		}
-	}
-
 }
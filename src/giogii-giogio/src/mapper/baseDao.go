@@ -31,6 +31,22 @@ func (sqlScaleStruct *SqlStruct) InitConnection() {
 	sqlScaleStruct.Connection = db
 }
 
+// OpenConnection 与InitConnection相同, 连接失败时返回错误而不是退出进程
+func (sqlScaleStruct *SqlStruct) OpenConnection() error {
+	db, err := sql.Open(sqlScaleStruct.DriverName, sqlScaleStruct.ConnInfo)
+	if err != nil {
+		return err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return err
+	}
+	db.SetConnMaxIdleTime(sqlScaleStruct.ConnIdleTime)
+	db.SetMaxIdleConns(sqlScaleStruct.MaxIdleConn)
+	sqlScaleStruct.Connection = db
+	return nil
+}
+
 func (sqlScaleStruct *SqlStruct) doQuery(sqlStr string) *sql.Rows {
 	con := sqlScaleStruct.Connection
 	rows, err := con.Query(sqlStr)
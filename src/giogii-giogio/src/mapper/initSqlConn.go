@@ -38,3 +38,17 @@ func InitSourceConn(sourceUserInfo string, sourceSocket string, sourceDatabase s
 	s.InitConnection()
 	return
 }
+
+// OpenSourceConn 用于检查类的连接, 连接失败时返回错误, 连接超时5秒
+func OpenSourceConn(sourceUserInfo string, sourceSocket string, sourceDatabase string) (s SqlStruct, err error) {
+
+	s = SqlStruct{
+		MaxIdleConn:  1,
+		DriverName:   "mysql",
+		ConnIdleTime: time.Minute * 1,
+		ConnInfo:     fmt.Sprintf("%s@tcp(%s)/%s?timeout=5s", sourceUserInfo, sourceSocket, sourceDatabase),
+	}
+
+	err = s.OpenConnection()
+	return
+}
@@ -1,6 +1,9 @@
 package mapper
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"giogii/src/entity"
 	_ "github.com/go-sql-driver/mysql"
 	"log"
@@ -23,6 +26,12 @@ type SqlScaleOperator interface {
 	DoQueryWithoutRes(sqlStr string)
 	DoQueryParseToClusterInfo(sqlStr string) (c []entity.ClusterInfo)
 	DoInsertValues(sqlStr string, id int64, args string, args2 string) (count int64)
+	DoQueryParseStrings(sqlStr string, args ...interface{}) (s []string)
+	DoExecInSession(sqls []string) error
+	DoQueryInSession(sqls []string) (results [][][]sql.NullString, err error)
+	DoExec(sqlStr string) error
+	DoQueryParseRows(sqlStr string) (columns []string, values [][]string, err error)
+	DoQueryParseNullRows(sqlStr string) (columns []string, values [][]sql.NullString, err error)
 }
 
 func (sqlScaleStruct *SqlStruct) DoClose() {
@@ -200,3 +209,135 @@ func (sqlScaleStruct *SqlStruct) DoInsertValues(sqlStr string, id int64, args st
 	}
 	return count
 }
+
+func (sqlScaleStruct *SqlStruct) DoQueryParseStrings(sqlStr string, args ...interface{}) (s []string) {
+	rows, err := sqlScaleStruct.Connection.Query(sqlStr, args...)
+	if err != nil {
+		log.Println(fmt.Sprintf("This is a bad connection. SQL info: %s;%s", sqlStr, err))
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			log.Println(err)
+		}
+		s = append(s, value)
+	}
+	return s
+}
+
+// DoExecInSession 在同一个会话中顺序执行, 遇到错误立即返回
+func (sqlScaleStruct *SqlStruct) DoExecInSession(sqls []string) error {
+	ctx := context.Background()
+	conn, err := sqlScaleStruct.Connection.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for _, sqlStr := range sqls {
+		if _, err := conn.ExecContext(ctx, sqlStr); err != nil {
+			return fmt.Errorf("SQL info: %s ;%s", sqlStr, err)
+		}
+	}
+	return nil
+}
+
+// DoQueryInSession 在同一个会话中顺序执行并读取每条语句的结果, 没有结果集的语句对应空结果, 用于一致性快照事务中的多次读取
+func (sqlScaleStruct *SqlStruct) DoQueryInSession(sqls []string) (results [][][]sql.NullString, err error) {
+	ctx := context.Background()
+	conn, err := sqlScaleStruct.Connection.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer func() {
+		if err != nil {
+			// 连接会放回连接池, 出错时释放会话中的全局读锁和事务
+			conn.ExecContext(ctx, "unlock tables")
+			conn.ExecContext(ctx, "rollback")
+		}
+	}()
+	for _, sqlStr := range sqls {
+		rows, err := conn.QueryContext(ctx, sqlStr)
+		if err != nil {
+			return nil, fmt.Errorf("SQL info: %s ;%s", sqlStr, err)
+		}
+		values, err := scanNullRows(rows)
+		if err != nil {
+			return nil, fmt.Errorf("SQL info: %s ;%s", sqlStr, err)
+		}
+		results = append(results, values)
+	}
+	return results, nil
+}
+
+func (sqlScaleStruct *SqlStruct) DoExec(sqlStr string) error {
+	if _, err := sqlScaleStruct.Connection.Exec(sqlStr); err != nil {
+		return fmt.Errorf("SQL info: %s ;%s", sqlStr, err)
+	}
+	return nil
+}
+
+// DoQueryParseRows 按字符串读取任意结果集, 用于列不固定的dbscale命令
+func (sqlScaleStruct *SqlStruct) DoQueryParseRows(sqlStr string) (columns []string, values [][]string, err error) {
+	rows, err := sqlScaleStruct.Connection.Query(sqlStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("SQL info: %s ;%s", sqlStr, err)
+	}
+	defer rows.Close()
+	if columns, err = rows.Columns(); err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		raw := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range raw {
+			dest[i] = &raw[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, nil, err
+		}
+		row := make([]string, len(columns))
+		for i, v := range raw {
+			row[i] = v.String
+		}
+		values = append(values, row)
+	}
+	return columns, values, rows.Err()
+}
+
+// DoQueryParseNullRows 与DoQueryParseRows相同, 保留NULL, 用于比较和修复行数据
+func (sqlScaleStruct *SqlStruct) DoQueryParseNullRows(sqlStr string) (columns []string, values [][]sql.NullString, err error) {
+	rows, err := sqlScaleStruct.Connection.Query(sqlStr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("SQL info: %s ;%s", sqlStr, err)
+	}
+	if columns, err = rows.Columns(); err != nil {
+		rows.Close()
+		return nil, nil, err
+	}
+	values, err = scanNullRows(rows)
+	return columns, values, err
+}
+
+// scanNullRows 读取全部行后关闭rows
+func scanNullRows(rows *sql.Rows) (values [][]sql.NullString, err error) {
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		row := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		values = append(values, row)
+	}
+	return values, rows.Err()
+}
@@ -0,0 +1,299 @@
+package topology
+
+import (
+	"encoding/json"
+	"fmt"
+	"giogii/src/entity"
+	"giogii/src/mapper"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/**
+DBScale集群拓扑
+dbscale request cluster info  集群中的dbscale节点
+dbscale show datasources      datasource(分片)及其包含的dataserver
+dbscale show dataservers      dataserver的地址、状态及是否为主节点
+业务分片的datasource命名为normal_0、normal_1..., 其中的dataserver命名为normal_0_1、normal_0_2...
+灾备集群在主集群中以slave_dbscale_source/slave_dbscale_server的形式出现
+*/
+
+// Role dataserver在datasource中的角色
+type Role string
+
+const (
+	RoleMaster Role = "master"
+	RoleSlave  Role = "slave"
+	// RoleDbscale 作为dataserver加入的灾备集群dbscale
+	RoleDbscale Role = "dbscale"
+)
+
+const slaveDbscalePrefix = "slave_dbscale"
+
+type DataServer struct {
+	Name               string `json:"name"`
+	Host               string `json:"host"`
+	Port               string `json:"port"`
+	Status             string `json:"status"`
+	MasterOnlineStatus string `json:"master_online_status"`
+	Role               Role   `json:"role"`
+}
+
+// Socket ip:port
+func (d *DataServer) Socket() string {
+	return fmt.Sprintf("%s:%s", d.Host, d.Port)
+}
+
+type DataSource struct {
+	Name    string        `json:"name"`
+	Type    string        `json:"type,omitempty"`
+	Status  string        `json:"status,omitempty"`
+	Servers []*DataServer `json:"servers"`
+}
+
+// Master datasource的主节点, 没有Master_Online的节点时返回nil
+func (d *DataSource) Master() *DataServer {
+	for _, s := range d.Servers {
+		if s.Role == RoleMaster {
+			return s
+		}
+	}
+	return nil
+}
+
+// Slaves datasource中除主节点以外的节点, 按dbscale返回的顺序
+func (d *DataSource) Slaves() (slaves []*DataServer) {
+	for _, s := range d.Servers {
+		if s.Role == RoleSlave {
+			slaves = append(slaves, s)
+		}
+	}
+	return
+}
+
+type Dbscale struct {
+	Host    string `json:"host"`
+	Master  bool   `json:"master"`
+	Version string `json:"version,omitempty"`
+}
+
+type Cluster struct {
+	Dbscales    []*Dbscale    `json:"dbscales"`
+	DataSources []*DataSource `json:"datasources"`
+}
+
+// Load 通过dbscale命令读取集群拓扑, datasources读取失败时按dataserver命名推断分片
+func Load(operator mapper.SqlScaleOperator) (*Cluster, error) {
+	servers := operator.DoQueryParseToDataServers("dbscale show dataservers")
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("dbscale show dataservers 没有返回数据节点")
+	}
+	columns, datasources, err := operator.DoQueryParseRows("dbscale show datasources")
+	if err != nil {
+		log.Println("读取datasource失败, 按dataserver命名推断分片: ", err)
+	}
+	info := operator.DoQueryParseToClusterInfo("dbscale request cluster info")
+	return Parse(servers, columns, datasources, info), nil
+}
+
+var nameToken = regexp.MustCompile(`[A-Za-z0-9_]+`)
+var serverSuffix = regexp.MustCompile(`_[0-9]+$`)
+
+// Parse 由dbscale命令的结果构建拓扑
+// datasource行中出现的dataserver名称即为该datasource的成员, 未出现在任何datasource中的dataserver按名称去掉末尾序号归组
+func Parse(servers []entity.DataServers, columns []string, datasources [][]string, info []entity.ClusterInfo) *Cluster {
+	c := &Cluster{}
+	for _, i := range info {
+		c.Dbscales = append(c.Dbscales, &Dbscale{Host: i.Host, Master: i.MasterDbscale == "master", Version: i.DbscaleVersion})
+	}
+
+	byName := make(map[string]*DataServer)
+	var ordered []*DataServer
+	for _, s := range servers {
+		d := &DataServer{
+			Name:               s.Servername.String,
+			Host:               s.Host.String,
+			Port:               s.Port.String,
+			Status:             s.Status.String,
+			MasterOnlineStatus: s.MasterOnlineStatus.String,
+			Role:               RoleSlave,
+		}
+		if d.MasterOnlineStatus == "Master_Online" {
+			d.Role = RoleMaster
+		}
+		if strings.HasPrefix(d.Name, slaveDbscalePrefix) {
+			d.Role = RoleDbscale
+		}
+		byName[d.Name] = d
+		ordered = append(ordered, d)
+	}
+
+	assigned := make(map[string]bool)
+	for _, row := range datasources {
+		ds := &DataSource{Name: column(columns, row, "name", "datasource_name", "datasource")}
+		if ds.Name == "" && len(row) > 0 {
+			ds.Name = row[0]
+		}
+		ds.Type = column(columns, row, "type", "datasource_type")
+		ds.Status = column(columns, row, "status", "datasource_status")
+		for _, value := range row {
+			for _, token := range nameToken.FindAllString(value, -1) {
+				if s, ok := byName[token]; ok && !assigned[token] && token != ds.Name {
+					assigned[token] = true
+					ds.Servers = append(ds.Servers, s)
+				}
+			}
+		}
+		if len(ds.Servers) > 0 {
+			c.DataSources = append(c.DataSources, ds)
+		}
+	}
+
+	for _, s := range ordered {
+		if assigned[s.Name] {
+			continue
+		}
+		name := serverSuffix.ReplaceAllString(s.Name, "")
+		if strings.HasPrefix(s.Name, slaveDbscalePrefix) {
+			name = slaveDbscalePrefix + "_source"
+		}
+		ds := c.DataSource(name)
+		if ds == nil {
+			ds = &DataSource{Name: name}
+			c.DataSources = append(c.DataSources, ds)
+		}
+		ds.Servers = append(ds.Servers, s)
+	}
+	sort.SliceStable(c.DataSources, func(i, j int) bool { return c.DataSources[i].Name < c.DataSources[j].Name })
+	return c
+}
+
+func column(columns []string, row []string, names ...string) string {
+	for i, col := range columns {
+		for _, name := range names {
+			if strings.EqualFold(strings.ReplaceAll(strings.TrimSpace(col), " ", "_"), name) && i < len(row) {
+				return row[i]
+			}
+		}
+	}
+	return ""
+}
+
+// DataSource 按名称查找datasource
+func (c *Cluster) DataSource(name string) *DataSource {
+	for _, ds := range c.DataSources {
+		if ds.Name == name {
+			return ds
+		}
+	}
+	return nil
+}
+
+// Shards 业务分片, 不包含灾备集群的slave_dbscale_source
+func (c *Cluster) Shards() (shards []*DataSource) {
+	for _, ds := range c.DataSources {
+		if !strings.HasPrefix(ds.Name, slaveDbscalePrefix) {
+			shards = append(shards, ds)
+		}
+	}
+	return
+}
+
+// Shard 单分片集群的唯一分片
+func (c *Cluster) Shard() (*DataSource, error) {
+	shards := c.Shards()
+	if len(shards) != 1 {
+		names := make([]string, 0, len(shards))
+		for _, ds := range shards {
+			names = append(names, ds.Name)
+		}
+		return nil, fmt.Errorf("需要单分片集群, 实际分片: [%s]", strings.Join(names, ", "))
+	}
+	return shards[0], nil
+}
+
+// DataServers 所有dataserver
+func (c *Cluster) DataServers(role ...Role) (servers []*DataServer) {
+	for _, ds := range c.DataSources {
+		for _, s := range ds.Servers {
+			if len(role) == 0 || hasRole(role, s.Role) {
+				servers = append(servers, s)
+			}
+		}
+	}
+	return
+}
+
+func hasRole(roles []Role, role Role) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// MasterDbscale 集群中的master dbscale
+func (c *Cluster) MasterDbscale() *Dbscale {
+	for _, d := range c.Dbscales {
+		if d.Master {
+			return d
+		}
+	}
+	return nil
+}
+
+// WriteJson 以json格式输出拓扑
+func (c *Cluster) WriteJson(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c)
+}
+
+// WriteTree 以树形输出拓扑
+func (c *Cluster) WriteTree(w io.Writer) {
+	fmt.Fprintln(w, "cluster")
+	for _, d := range c.Dbscales {
+		role := "dbscale"
+		if d.Master {
+			role = "dbscale master"
+		}
+		fmt.Fprintf(w, "├── %s %s %s\n", role, d.Host, d.Version)
+	}
+	for i, ds := range c.DataSources {
+		branch, indent := "├── ", "│   "
+		if i == len(c.DataSources)-1 {
+			branch, indent = "└── ", "    "
+		}
+		fmt.Fprintf(w, "%sdatasource %s %s\n", branch, ds.Name, strings.TrimSpace(ds.Type+" "+ds.Status))
+		for k, s := range ds.Servers {
+			leaf := "├── "
+			if k == len(ds.Servers)-1 {
+				leaf = "└── "
+			}
+			fmt.Fprintf(w, "%s%s%s %s [%s] %s\n", indent, leaf, s.Name, s.Socket(), s.Role, s.Status)
+		}
+	}
+}
+
+// DoShowTopology 输出集群拓扑, format为json时输出json, 否则输出树形
+func DoShowTopology(userInfo string, socket string, format string) {
+	s := mapper.InitSourceConn(userInfo, socket, "information_schema")
+	defer s.DoClose()
+	cluster, err := Load(&s)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if format == "json" {
+		if err := cluster.WriteJson(os.Stdout); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	cluster.WriteTree(os.Stdout)
+}
@@ -0,0 +1,67 @@
+package topology
+
+import (
+	"bytes"
+	"database/sql"
+	"giogii/src/entity"
+	"strings"
+	"testing"
+)
+
+func server(name string, host string, status string) entity.DataServers {
+	return entity.DataServers{
+		Servername:         sql.NullString{String: name, Valid: true},
+		Host:               sql.NullString{String: host, Valid: true},
+		Port:               sql.NullString{String: "16310", Valid: true},
+		Status:             sql.NullString{String: "Online", Valid: true},
+		MasterOnlineStatus: sql.NullString{String: status, Valid: true},
+	}
+}
+
+func TestParse(t *testing.T) {
+	servers := []entity.DataServers{
+		server("normal_0_1", "10.0.0.1", "Slave_Online"),
+		server("normal_0_2", "10.0.0.2", "Master_Online"),
+		server("normal_0_3", "10.0.0.3", "Slave_Online"),
+		server("normal_0_4", "10.0.0.4", "Slave_Online"),
+		server("normal_1_1", "10.0.1.1", "Master_Online"),
+		server("normal_1_2", "10.0.1.2", "Slave_Online"),
+		server("slave_dbscale_server", "10.0.9.1", ""),
+	}
+	columns := []string{"Datasource name", "Type", "Servers", "Status"}
+	rows := [][]string{
+		{"normal_0", "replication", "normal_0_1-1-1000-400-800;normal_0_2-1-1000-400-800;normal_0_3-1-1000-400-800;normal_0_4-1-1000-400-800", "Working"},
+	}
+	info := []entity.ClusterInfo{{MasterDbscale: "master", Host: "10.0.0.100:16310"}}
+
+	c := Parse(servers, columns, rows, info)
+	if len(c.DataSources) != 3 {
+		t.Fatalf("unexpected datasources %+v", c.DataSources)
+	}
+	shard0 := c.DataSource("normal_0")
+	if shard0.Type != "replication" || shard0.Status != "Working" || len(shard0.Servers) != 4 {
+		t.Fatalf("unexpected normal_0 %+v", shard0)
+	}
+	if shard0.Master().Name != "normal_0_2" || len(shard0.Slaves()) != 3 || shard0.Slaves()[0].Name != "normal_0_1" {
+		t.Fatalf("unexpected roles %+v", shard0.Servers)
+	}
+	// datasources中没有的分片按名称推断
+	if shard1 := c.DataSource("normal_1"); shard1 == nil || shard1.Master().Host != "10.0.1.1" {
+		t.Fatalf("unexpected normal_1 %+v", shard1)
+	}
+	if ds := c.DataSource("slave_dbscale_source"); ds == nil || ds.Servers[0].Role != RoleDbscale {
+		t.Fatalf("unexpected slave dbscale %+v", ds)
+	}
+	if len(c.Shards()) != 2 || len(c.DataServers(RoleMaster)) != 2 || c.MasterDbscale().Host != "10.0.0.100:16310" {
+		t.Fatal("unexpected cluster")
+	}
+	if _, err := c.Shard(); err == nil {
+		t.Fatal("expect error for multi-shard cluster")
+	}
+
+	var out bytes.Buffer
+	c.WriteTree(&out)
+	if !strings.Contains(out.String(), "│   ├── normal_0_2 10.0.0.2:16310 [master] Online") {
+		t.Fatalf("unexpected tree\n%s", out.String())
+	}
+}